@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// セッションはCookieに入っていてサーバーには残らないので、ログイン中のユーザー数を数えるために
+// セッションIDを有効期限つきで Redis の sorted set に記録する (スコアは有効期限の unix 秒)
+
+var activeSessions = expvar.NewInt("active_sessions")
+
+var activeSessionsKey = activeSessionsKeyspace.Key()
+
+// trackSession はログインしたセッションを記録し、ゲージを更新します
+func trackSession(ctx context.Context, sessionID string, expiresAt time.Time) error {
+	if err := redisConn.ZAdd(ctx, activeSessionsKey, redis.Z{Score: float64(expiresAt.Unix()), Member: sessionID}).Err(); err != nil {
+		return err
+	}
+	return refreshActiveSessions(ctx)
+}
+
+// untrackSession は破棄したセッションを記録から消し、ゲージを更新します
+func untrackSession(ctx context.Context, sessionID string) error {
+	if err := redisConn.ZRem(ctx, activeSessionsKey, sessionID).Err(); err != nil {
+		return err
+	}
+	return refreshActiveSessions(ctx)
+}
+
+// refreshActiveSessions は期限切れのセッションを消してから残りを数えます
+func refreshActiveSessions(ctx context.Context) error {
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	pipe := redisConn.TxPipeline()
+	pipe.ZRemRangeByScore(ctx, activeSessionsKey, "-inf", "("+now)
+	count := pipe.ZCard(ctx, activeSessionsKey)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	activeSessions.Set(count.Val())
+	return nil
+}
+
+// startActiveSessionsSampler はログイン・退会がなくても期限切れがゲージに反映されるよう、定期的に数え直します
+func startActiveSessionsSampler(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			if err := refreshActiveSessions(ctx); err != nil {
+				log.Printf("failed to count active sessions: %+v", err)
+			}
+			cancel()
+		}
+	}()
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ログインしたセッションを数え、期限切れと破棄したセッションは数えない
+func TestActiveSessionsGauge(t *testing.T) {
+	setupIntegration(t)
+	ctx := context.Background()
+	live := []string{uuid.NewString(), uuid.NewString()}
+	expired := uuid.NewString()
+	t.Cleanup(func() {
+		redisConn.ZRem(ctx, activeSessionsKey, live[0], live[1], expired)
+		refreshActiveSessions(ctx)
+	})
+	if err := refreshActiveSessions(ctx); err != nil {
+		t.Fatalf("refreshActiveSessions: %+v", err)
+	}
+	base := activeSessions.Value()
+	gauge := func() int64 {
+		t.Helper()
+		v, ok := expvar.Get("active_sessions").(*expvar.Int)
+		if !ok {
+			t.Fatal("active_sessions is not published")
+		}
+		return v.Value() - base
+	}
+
+	for _, sessionID := range live {
+		if err := trackSession(ctx, sessionID, time.Now().Add(time.Hour)); err != nil {
+			t.Fatalf("trackSession: %+v", err)
+		}
+	}
+	if err := trackSession(ctx, expired, time.Now().Add(-time.Minute)); err != nil {
+		t.Fatalf("trackSession: %+v", err)
+	}
+	if got := gauge(); got != 2 {
+		t.Errorf("active sessions after login = %d, want 2", got)
+	}
+
+	if err := untrackSession(ctx, live[0]); err != nil {
+		t.Fatalf("untrackSession: %+v", err)
+	}
+	if got := gauge(); got != 1 {
+		t.Errorf("active sessions after logout = %d, want 1", got)
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const adminTokenHeader = "X-Admin-Token"
+
+// adminToken が空の場合は管理者用APIを使えない
+var adminToken string
+
+func verifyAdminToken(c echo.Context) error {
+	if adminToken == "" {
+		return echo.NewHTTPError(http.StatusForbidden, "admin api is disabled")
+	}
+	token := c.Request().Header.Get(adminTokenHeader)
+	if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		return echo.NewHTTPError(http.StatusUnauthorized, "invalid admin token")
+	}
+	return nil
+}
+
+type IconModel struct {
+	ID       int64  `db:"id"`
+	UserID   int64  `db:"user_id"`
+	Image    []byte `db:"image"`
+	IconHash string `db:"icon_hash"`
+}
+
+type RehashIconsResponse struct {
+	Scanned int64 `json:"scanned"`
+	Changed int64 `json:"changed"`
+}
+
+// アイコン画像から icon_hash を再計算するバッチ1回あたりの件数
+const rehashIconsBatchSize = 100
+
+// アイコンのハッシュ再計算API
+// POST /api/admin/icons/rehash
+func rehashIconsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyAdminToken(c); err != nil {
+		return err
+	}
+
+	var res RehashIconsResponse
+	var lastID int64
+	for {
+		// トランザクションが長くならないよう、バッチごとにコミットする
+		tx, err := dbConn.BeginTxx(ctx, nil)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+		}
+
+		var icons []IconModel
+		if err := tx.SelectContext(ctx, &icons, "SELECT * FROM icons WHERE id > ? ORDER BY id LIMIT ?", lastID, rehashIconsBatchSize); err != nil {
+			tx.Rollback()
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get icons: "+err.Error())
+		}
+		if len(icons) == 0 {
+			tx.Rollback()
+			break
+		}
+
+		// 履歴のアイコンも含むため、どのハッシュが現在のものかはここでは決めずにキャッシュを消す
+		changed := make(map[int64]struct{})
+		for _, icon := range icons {
+			iconHash := sha256.Sum256(icon.Image)
+			hashString := hex.EncodeToString(iconHash[:])
+			if hashString == icon.IconHash {
+				continue
+			}
+			if _, err := tx.ExecContext(ctx, "UPDATE icons SET icon_hash = ? WHERE id = ?", hashString, icon.ID); err != nil {
+				tx.Rollback()
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to update icon hash: "+err.Error())
+			}
+			changed[icon.UserID] = struct{}{}
+			res.Changed++
+		}
+
+		if err := tx.Commit(); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+		}
+
+		for userID := range changed {
+			if err := invalidateIconHashCache(ctx, userID); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to invalidate icon hash cache: "+err.Error())
+			}
+		}
+
+		res.Scanned += int64(len(icons))
+		lastID = icons[len(icons)-1].ID
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+type DNSRecordResponse struct {
+	Name string `json:"name"`
+	// Record は登録時に書き込む行
+	Record string `json:"record"`
+	// Exists は Record と同じ行がゾーンファイルにあるかどうか
+	Exists bool `json:"exists"`
+	// ZoneRecords はゾーンファイルにあるこのユーザー名の行 (アドレスが違うものも含む)
+	ZoneRecords []string `json:"zone_records"`
+}
+
+// DNSレコードの確認API
+// GET /api/admin/dns/:username
+// 登録時に書き込む行と、ゾーンファイルに今ある行を返す
+func getDNSRecordHandler(c echo.Context) error {
+	if err := verifyAdminToken(c); err != nil {
+		return err
+	}
+
+	name := c.Param("username")
+	res := DNSRecordResponse{
+		Name:        name,
+		Record:      dnsRecordLine(name),
+		ZoneRecords: []string{},
+	}
+
+	zoneFileMu.Lock()
+	b, err := os.ReadFile(config.ZoneFilePath)
+	zoneFileMu.Unlock()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to read zone file: "+err.Error())
+	}
+
+	prefix := name + "\t"
+	for _, line := range strings.Split(string(b), "\n") {
+		if !strings.HasPrefix(line, prefix) {
+			continue
+		}
+		res.ZoneRecords = append(res.ZoneRecords, line)
+		if line == res.Record {
+			res.Exists = true
+		}
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+// 通報者ごとの通報一覧で一度に返せる件数
+const (
+	defaultReporterReportsLimit = 20
+	maxReporterReportsLimit     = 100
+)
+
+// 通報者ごとの通報一覧API
+// GET /api/admin/reports?reporter=&limit=&cursor=
+// reporter (ユーザー名) が全配信で行った通報を新しい順に返す
+// カーソルは "<created_at>,<id>" で、次のページがある場合は X-Next-Cursor ヘッダで返す
+func getReportsByReporterHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyAdminToken(c); err != nil {
+		return err
+	}
+
+	reporterName := c.QueryParam("reporter")
+	if reporterName == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "reporter query parameter is required")
+	}
+
+	limit := defaultReporterReportsLimit
+	if v := c.QueryParam("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be a positive integer")
+		}
+		limit = n
+	}
+	if limit > maxReporterReportsLimit {
+		limit = maxReporterReportsLimit
+	}
+
+	var reports []LivecommentReport
+	var nextCursor string
+	if err := withReadTx(ctx, func(tx *sqlx.Tx) error {
+		reporterID, err := getUserIDByName(ctx, tx, reporterName)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+		}
+
+		// NGワードで消されたコメントの通報は返さない
+		// 取得後に捨てるとページが limit 件に満たなくなるので、消されていないコメントとの JOIN で絞ってから LIMIT をかける
+		query := "SELECT r.* FROM livecomment_reports r INNER JOIN livecomments l ON l.id = r.livecomment_id WHERE r.user_id = ?"
+		args := []interface{}{reporterID}
+		if cursor := c.QueryParam("cursor"); cursor != "" {
+			cursorCreatedAt, cursorID, err := parseTimeIDCursor(cursor)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "cursor query parameter must be formatted as <created_at>,<id>")
+			}
+			query += " AND (r.created_at < ? OR (r.created_at = ? AND r.id < ?))"
+			args = append(args, cursorCreatedAt, cursorCreatedAt, cursorID)
+		}
+		query += " ORDER BY r.created_at DESC, r.id DESC LIMIT ?"
+		args = append(args, limit)
+
+		var reportModels []LivecommentReportModel
+		if err := tx.SelectContext(ctx, &reportModels, query, args...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment reports: "+err.Error())
+		}
+		if len(reportModels) == limit {
+			last := reportModels[len(reportModels)-1]
+			nextCursor = fmt.Sprintf("%d,%d", last.CreatedAt, last.ID)
+		}
+		if len(reportModels) == 0 {
+			reports = []LivecommentReport{}
+			return nil
+		}
+
+		reporterModel, err := getUser(ctx, tx, reporterID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+		}
+		reporter, err := fillUserResponse(ctx, tx, reporterModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
+		}
+
+		// 通報されたコメントと配信はページ内の分をまとめて引いて埋める
+		livecommentIDs := make([]int64, len(reportModels))
+		for i := range reportModels {
+			livecommentIDs[i] = reportModels[i].LivecommentID
+		}
+		query, params, err := sqlx.In("SELECT * FROM livecomments WHERE id IN (?)", livecommentIDs)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+		}
+		var livecommentModels []LivecommentModel
+		if err := tx.SelectContext(ctx, &livecommentModels, query, params...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
+		}
+		livecomments, err := fillLivecommentsResponse(ctx, tx, livecommentModels, fillUserResponse)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomments: "+err.Error())
+		}
+		livecommentByID := make(map[int64]Livecomment, len(livecomments))
+		for _, livecomment := range livecomments {
+			livecommentByID[livecomment.ID] = livecomment
+		}
+
+		reports = make([]LivecommentReport, 0, len(reportModels))
+		for _, reportModel := range reportModels {
+			// JOIN で絞っているので、同じトランザクション内では必ず見つかる
+			livecomment, ok := livecommentByID[reportModel.LivecommentID]
+			if !ok {
+				continue
+			}
+			reports = append(reports, LivecommentReport{
+				ID:          reportModel.ID,
+				Reporter:    reporter,
+				Livecomment: livecomment,
+				CreatedAt:   reportModel.CreatedAt,
+			})
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if nextCursor != "" {
+		c.Response().Header().Set("X-Next-Cursor", nextCursor)
+	}
+	return c.JSON(http.StatusOK, reports)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func getTestReportsByReporter(t *testing.T, reporter string, limit, cursor string) ([]LivecommentReport, string) {
+	t.Helper()
+	query := url.Values{"reporter": {reporter}, "limit": {limit}}
+	if cursor != "" {
+		query.Set("cursor", cursor)
+	}
+	c, rec := newTestContext(http.MethodGet, "/api/admin/reports?"+query.Encode(), nil)
+	c.Request().Header.Set(adminTokenHeader, adminToken)
+	if err := getReportsByReporterHandler(c); err != nil {
+		t.Fatalf("getReportsByReporterHandler: %+v", err)
+	}
+	var reports []LivecommentReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &reports); err != nil {
+		t.Fatalf("failed to decode response: %+v", err)
+	}
+	return reports, rec.Header().Get("X-Next-Cursor")
+}
+
+// 複数の配信にまたがる通報のうち、指定した通報者の分だけを新しい順に返す
+// NGワードで消されたコメントの通報は、ページの件数を減らさずに除かれる
+func TestGetReportsByReporter(t *testing.T) {
+	setupIntegration(t)
+	prevToken := adminToken
+	adminToken = "test-admin-token"
+	t.Cleanup(func() { adminToken = prevToken })
+
+	owner := createTestUser(t)
+	reporter := createTestUser(t)
+	other := createTestUser(t)
+	livestreams := []LivestreamModel{createTestLivestream(t, owner.ID), createTestLivestream(t, owner.ID)}
+
+	base := time.Now().Unix()
+	var want []int64
+	var deleted LivecommentModel
+	for i := 0; i < 5; i++ {
+		livecomment := createTestLivecomment(t, owner.ID, livestreams[i%2].ID, base+int64(i))
+		report := createTestReport(t, reporter.ID, livecomment, base+int64(i))
+		createTestReport(t, other.ID, livecomment, base+int64(i))
+		if i == 2 {
+			deleted = livecomment
+			continue
+		}
+		want = append([]int64{report.ID}, want...)
+	}
+	if _, err := dbConn.ExecContext(context.Background(), "DELETE FROM livecomments WHERE id = ?", deleted.ID); err != nil {
+		t.Fatalf("failed to delete livecomment: %+v", err)
+	}
+
+	var got []int64
+	pages := 0
+	cursor := ""
+	for {
+		reports, next := getTestReportsByReporter(t, reporter.Name, "2", cursor)
+		pages++
+		if next != "" && len(reports) != 2 {
+			t.Errorf("page %d has %d reports, want 2", pages, len(reports))
+		}
+		for _, report := range reports {
+			if report.Reporter.ID != reporter.ID {
+				t.Errorf("report %d has reporter %d, want %d", report.ID, report.Reporter.ID, reporter.ID)
+			}
+			if report.Livecomment.ID == deleted.ID {
+				t.Errorf("report %d is for the deleted livecomment", report.ID)
+			}
+			got = append(got, report.ID)
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("got reports %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got reports %v, want %v", got, want)
+		}
+	}
+}
+
+func TestVerifyAdminToken(t *testing.T) {
+	prevToken := adminToken
+	t.Cleanup(func() { adminToken = prevToken })
+
+	for _, tt := range []struct {
+		name     string
+		token    string
+		header   string
+		wantCode int
+	}{
+		{"disabled", "", "anything", http.StatusForbidden},
+		{"wrong token", "test-admin-token", "wrong", http.StatusUnauthorized},
+		{"missing token", "test-admin-token", "", http.StatusUnauthorized},
+		{"valid", "test-admin-token", "test-admin-token", 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			adminToken = tt.token
+			c, _ := newTestContext(http.MethodPost, "/api/admin/icons/rehash", nil)
+			if tt.header != "" {
+				c.Request().Header.Set(adminTokenHeader, tt.header)
+			}
+			err := verifyAdminToken(c)
+			if tt.wantCode == 0 {
+				if err != nil {
+					t.Errorf("verifyAdminToken: %+v", err)
+				}
+				return
+			}
+			var httpErr *echo.HTTPError
+			if !errors.As(err, &httpErr) || httpErr.Code != tt.wantCode {
+				t.Errorf("verifyAdminToken = %v, want %d", err, tt.wantCode)
+			}
+		})
+	}
+}
+
+// 保存されている icon_hash が壊れていても、再計算で画像から求め直して直す
+func TestRehashIconsFixesCorruptedHash(t *testing.T) {
+	setupIntegration(t)
+	ctx := context.Background()
+	prevToken := adminToken
+	adminToken = "test-admin-token"
+	t.Cleanup(func() { adminToken = prevToken })
+	user := createTestUser(t)
+	want := uploadTestIcon(t, user.ID, []byte("rehash icon"))
+
+	if _, err := dbConn.ExecContext(ctx, "UPDATE icons SET icon_hash = ? WHERE user_id = ?", "corrupted", user.ID); err != nil {
+		t.Fatalf("failed to corrupt icon hash: %+v", err)
+	}
+	if err := redisConn.Set(ctx, getIconHashKey(user.ID), "corrupted", 0).Err(); err != nil {
+		t.Fatalf("failed to corrupt cached icon hash: %+v", err)
+	}
+
+	c, rec := newTestContext(http.MethodPost, "/api/admin/icons/rehash", nil)
+	c.Request().Header.Set(adminTokenHeader, adminToken)
+	if err := rehashIconsHandler(c); err != nil {
+		t.Fatalf("rehashIconsHandler: %+v", err)
+	}
+	var res RehashIconsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("failed to decode response: %+v", err)
+	}
+	if res.Changed < 1 || res.Scanned < res.Changed {
+		t.Errorf("response = %+v, want at least one changed icon", res)
+	}
+
+	var stored string
+	if err := dbConn.GetContext(ctx, &stored, "SELECT icon_hash FROM icons WHERE user_id = ?", user.ID); err != nil {
+		t.Fatalf("failed to get icon hash: %+v", err)
+	}
+	if stored != want {
+		t.Errorf("stored icon hash = %s, want %s", stored, want)
+	}
+	got, err := getIconHash(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("failed to get icon hash: %+v", err)
+	}
+	if got != want {
+		t.Errorf("getIconHash = %s, want %s", got, want)
+	}
+}
+
+func getTestDNSRecord(t *testing.T, username string) DNSRecordResponse {
+	t.Helper()
+	c, rec := newTestContext(http.MethodGet, "/api/admin/dns/"+username, nil)
+	c.SetParamNames("username")
+	c.SetParamValues(username)
+	c.Request().Header.Set(adminTokenHeader, adminToken)
+	if err := getDNSRecordHandler(c); err != nil {
+		t.Fatalf("getDNSRecordHandler: %+v", err)
+	}
+	var res DNSRecordResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("failed to decode response: %+v", err)
+	}
+	return res
+}
+
+// 登録時に書き込む行を返し、ゾーンファイルにある同じ名前の行と突き合わせる
+func TestGetDNSRecord(t *testing.T) {
+	prevToken := adminToken
+	adminToken = "test-admin-token"
+	t.Cleanup(func() { adminToken = prevToken })
+	setTestZoneFile(t, "$ORIGIN u.isucon.local.\n"+
+		"alice\tIN\tA\t192.0.2.1\n"+
+		"alice2\tIN\tA\t192.0.2.1\n"+
+		"bob\tIN\tA\t198.51.100.1\n")
+
+	for _, tt := range []struct {
+		name        string
+		wantExists  bool
+		wantRecords []string
+	}{
+		{name: "alice", wantExists: true, wantRecords: []string{"alice\tIN\tA\t192.0.2.1"}},
+		{name: "bob", wantExists: false, wantRecords: []string{"bob\tIN\tA\t198.51.100.1"}},
+		{name: "carol", wantExists: false, wantRecords: []string{}},
+	} {
+		res := getTestDNSRecord(t, tt.name)
+		if want := tt.name + "\tIN\tA\t192.0.2.1"; res.Record != want {
+			t.Errorf("%s: record = %q, want %q", tt.name, res.Record, want)
+		}
+		if res.Exists != tt.wantExists {
+			t.Errorf("%s: exists = %v, want %v", tt.name, res.Exists, tt.wantExists)
+		}
+		if !reflect.DeepEqual(res.ZoneRecords, tt.wantRecords) {
+			t.Errorf("%s: zone_records = %q, want %q", tt.name, res.ZoneRecords, tt.wantRecords)
+		}
+	}
+}
+
+func TestGetDNSRecordRequiresAdmin(t *testing.T) {
+	prevToken := adminToken
+	adminToken = "test-admin-token"
+	t.Cleanup(func() { adminToken = prevToken })
+
+	c, _ := newTestContext(http.MethodGet, "/api/admin/dns/alice", nil)
+	c.SetParamNames("username")
+	c.SetParamValues("alice")
+	if err := getDNSRecordHandler(c); !isHTTPErrorCode(err, http.StatusUnauthorized) {
+		t.Errorf("getDNSRecordHandler = %v, want 401", err)
+	}
+}
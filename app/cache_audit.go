@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"expvar"
+	"log"
+	"time"
+)
+
+// userCache がDBとずれていないかを定期的に確かめます
+// 書き込み経路でキャッシュの破棄漏れがあった場合に気づけるよう、キャッシュ済みのユーザーを一部取り出してDBと比べる
+
+var (
+	cacheAuditChecked    = expvar.NewInt("user_cache_audit_checked")
+	cacheAuditMismatches = expvar.NewInt("user_cache_audit_mismatches")
+)
+
+type userCacheAuditor struct {
+	interval time.Duration
+	sample   int
+	// heal が true なら、ずれていたエントリをキャッシュから消す
+	heal bool
+}
+
+func startUserCacheAuditor(interval time.Duration, sample int, heal bool) {
+	a := &userCacheAuditor{
+		interval: interval,
+		sample:   sample,
+		heal:     heal,
+	}
+	go a.run()
+}
+
+func (a *userCacheAuditor) run() {
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), a.interval)
+		if err := a.audit(ctx); err != nil {
+			log.Printf("failed to audit user cache: %+v", err)
+		}
+		cancel()
+	}
+}
+
+func (a *userCacheAuditor) audit(ctx context.Context) error {
+	sampled := userCache.Sample(a.sample)
+
+	for _, cached := range sampled {
+		var user UserModel
+		err := dbConn.GetContext(ctx, &user, "SELECT * FROM users WHERE id = ?", cached.ID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		cacheAuditChecked.Add(1)
+		if err == nil && sameUserModel(cached, user) {
+			continue
+		}
+
+		cacheAuditMismatches.Add(1)
+		log.Printf("user cache is stale for user_id=%d (healing=%t)", cached.ID, a.heal)
+		if !a.heal {
+			continue
+		}
+		// 比較している間に更新された場合は新しい値なので消さない
+		userCache.DeleteIf(cached.ID, func(current UserModel) bool {
+			return sameUserModel(current, cached)
+		})
+	}
+	return nil
+}
+
+func sameUserModel(a, b UserModel) bool {
+	if a.ID != b.ID || a.Name != b.Name || a.DisplayName != b.DisplayName || a.Description != b.Description || a.HashedPassword != b.HashedPassword {
+		return false
+	}
+	return sameInt64Ptr(a.DeletedAt, b.DeletedAt) && sameInt64Ptr(a.CreatedAt, b.CreatedAt)
+}
+
+func sameInt64Ptr(a, b *int64) bool {
+	if (a == nil) != (b == nil) {
+		return false
+	}
+	return a == nil || *a == *b
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+// 古い値をキャッシュに入れておくと、監査で見つかり、heal なら消される
+func TestUserCacheAuditorHealsStaleEntry(t *testing.T) {
+	setupIntegration(t)
+	user := createTestUser(t)
+	var fresh UserModel
+	if err := dbConn.GetContext(context.Background(), &fresh, "SELECT * FROM users WHERE id = ?", user.ID); err != nil {
+		t.Fatalf("failed to get user: %+v", err)
+	}
+	stale := fresh
+	stale.DisplayName = "stale display name"
+
+	prevCache := userCache
+	t.Cleanup(func() { userCache = prevCache })
+
+	for _, tt := range []struct {
+		name     string
+		heal     bool
+		wantKept bool
+	}{
+		{"detect only", false, true},
+		{"heal", true, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			userCache = newTestUserLRU(10)
+			userCache.Store(stale.ID, stale)
+			other := createTestUser(t)
+			var otherFresh UserModel
+			if err := dbConn.GetContext(context.Background(), &otherFresh, "SELECT * FROM users WHERE id = ?", other.ID); err != nil {
+				t.Fatalf("failed to get user: %+v", err)
+			}
+			userCache.Store(otherFresh.ID, otherFresh)
+			mismatches := cacheAuditMismatches.Value()
+
+			a := &userCacheAuditor{sample: 10, heal: tt.heal}
+			if err := a.audit(context.Background()); err != nil {
+				t.Fatalf("audit: %+v", err)
+			}
+			if got := cacheAuditMismatches.Value() - mismatches; got != 1 {
+				t.Errorf("mismatches = %d, want 1", got)
+			}
+			if _, ok := userCache.Load(stale.ID); ok != tt.wantKept {
+				t.Errorf("stale entry kept = %v, want %v", ok, tt.wantKept)
+			}
+			if _, ok := userCache.Load(otherFresh.ID); !ok {
+				t.Error("an up-to-date entry was removed")
+			}
+		})
+	}
+}
+
+func TestSameUserModel(t *testing.T) {
+	createdAt, deletedAt := int64(1), int64(2)
+	base := UserModel{ID: 1, Name: "a", DisplayName: "A", Description: "d", HashedPassword: "x", CreatedAt: &createdAt}
+	if !sameUserModel(base, base) {
+		t.Error("a user differs from itself")
+	}
+	copied := base
+	copiedAt := createdAt
+	copied.CreatedAt = &copiedAt
+	if !sameUserModel(base, copied) {
+		t.Error("users with equal created_at pointers' values differ")
+	}
+	for name, modify := range map[string]func(*UserModel){
+		"display name": func(u *UserModel) { u.DisplayName = "B" },
+		"deleted":      func(u *UserModel) { u.DeletedAt = &deletedAt },
+		"created_at":   func(u *UserModel) { u.CreatedAt = nil },
+	} {
+		changed := base
+		modify(&changed)
+		if sameUserModel(base, changed) {
+			t.Errorf("a change of %s was not detected", name)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Config は起動時に環境変数から一度だけ読む接続先などの設定です
+// チューニング用の値は main.go の init で読む
+type Config struct {
+	MySQL                    *mysql.Config
+	RedisAddr                string
+	SessionTTL               time.Duration
+	BcryptCost               int
+	ZoneFilePath             string
+	PowerDNSSubdomainAddress string
+}
+
+var config = defaultConfig()
+
+func defaultConfig() Config {
+	// 環境変数がセットされていなかった場合でも一旦動かせるように、デフォルト値を入れておく
+	mysqlConfig := mysql.NewConfig()
+	mysqlConfig.Net = "tcp"
+	mysqlConfig.Addr = net.JoinHostPort("127.0.0.1", "3306")
+	mysqlConfig.User = "isucon"
+	mysqlConfig.Passwd = "isucon"
+	mysqlConfig.DBName = "isupipe"
+	mysqlConfig.ParseTime = true
+
+	return Config{
+		MySQL:        mysqlConfig,
+		RedisAddr:    "127.0.0.1:6379",
+		SessionTTL:   1 * time.Hour,
+		BcryptCost:   bcrypt.MinCost,
+		ZoneFilePath: "/etc/powerdns/u.isucon.local.zone",
+	}
+}
+
+// loadConfig は環境変数から設定を読み、不正な値や足りない値をすべてまとめたエラーを返します
+func loadConfig() (Config, error) {
+	const (
+		networkTypeEnvKey = "ISUCON13_MYSQL_DIALCONFIG_NET"
+		addrEnvKey        = "ISUCON13_MYSQL_DIALCONFIG_ADDRESS"
+		portEnvKey        = "ISUCON13_MYSQL_DIALCONFIG_PORT"
+		userEnvKey        = "ISUCON13_MYSQL_DIALCONFIG_USER"
+		passwordEnvKey    = "ISUCON13_MYSQL_DIALCONFIG_PASSWORD"
+		dbNameEnvKey      = "ISUCON13_MYSQL_DIALCONFIG_DATABASE"
+		parseTimeEnvKey   = "ISUCON13_MYSQL_DIALCONFIG_PARSETIME"
+		// ISUCON13_REDIS_DIALCONFIG_ADDRESS は別ホストを指していることがあるので読まない
+		redisAddrEnvKey    = "ISUCON13_REDIS_ADDR"
+		sessionTTLEnvKey   = "ISUCON13_SESSION_TTL_SECONDS"
+		bcryptCostEnvKey   = "ISUCON13_BCRYPT_COST"
+		zoneFilePathEnvKey = "ISUCON13_ZONE_FILE_PATH"
+	)
+
+	cfg := defaultConfig()
+	var errs []error
+
+	if v, ok := os.LookupEnv(networkTypeEnvKey); ok {
+		cfg.MySQL.Net = v
+	}
+	if addr, ok := os.LookupEnv(addrEnvKey); ok {
+		if port, ok2 := os.LookupEnv(portEnvKey); ok2 {
+			cfg.MySQL.Addr = net.JoinHostPort(addr, port)
+		} else {
+			cfg.MySQL.Addr = net.JoinHostPort(addr, "3306")
+		}
+	}
+	if v, ok := os.LookupEnv(userEnvKey); ok {
+		cfg.MySQL.User = v
+	}
+	if v, ok := os.LookupEnv(passwordEnvKey); ok {
+		cfg.MySQL.Passwd = v
+	}
+	if v, ok := os.LookupEnv(dbNameEnvKey); ok {
+		cfg.MySQL.DBName = v
+	}
+	if v, ok := os.LookupEnv(parseTimeEnvKey); ok {
+		parseTime, err := strconv.ParseBool(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s must be a bool: %q", parseTimeEnvKey, v))
+		}
+		cfg.MySQL.ParseTime = parseTime
+	}
+
+	if v, ok := os.LookupEnv(redisAddrEnvKey); ok {
+		if _, _, err := net.SplitHostPort(v); err != nil {
+			errs = append(errs, fmt.Errorf("%s must be host:port: %q", redisAddrEnvKey, v))
+		}
+		cfg.RedisAddr = v
+	}
+
+	if v, ok := os.LookupEnv(sessionTTLEnvKey); ok {
+		sec, err := strconv.Atoi(v)
+		if err != nil || sec < 1 {
+			errs = append(errs, fmt.Errorf("%s must be a positive integer: %q", sessionTTLEnvKey, v))
+		}
+		cfg.SessionTTL = time.Duration(sec) * time.Second
+	}
+
+	if v, ok := os.LookupEnv(bcryptCostEnvKey); ok {
+		cost, err := strconv.Atoi(v)
+		if err != nil || cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+			errs = append(errs, fmt.Errorf("%s must be an integer between %d and %d: %q", bcryptCostEnvKey, bcrypt.MinCost, bcrypt.MaxCost, v))
+		}
+		cfg.BcryptCost = cost
+	}
+
+	if v, ok := os.LookupEnv(zoneFilePathEnvKey); ok {
+		if v == "" {
+			errs = append(errs, fmt.Errorf("%s must not be empty", zoneFilePathEnvKey))
+		}
+		cfg.ZoneFilePath = v
+	}
+
+	if v, ok := os.LookupEnv(powerDNSSubdomainAddressEnvKey); !ok {
+		errs = append(errs, fmt.Errorf("%s must be provided", powerDNSSubdomainAddressEnvKey))
+	} else if ip := net.ParseIP(v); ip == nil || ip.To4() == nil {
+		// A レコードに書き込むので IPv4 に限る。不正な行を書くと pdns のリロードが全員分失敗する
+		errs = append(errs, fmt.Errorf("%s must be an IPv4 address: %q", powerDNSSubdomainAddressEnvKey, v))
+	} else {
+		cfg.PowerDNSSubdomainAddress = v
+	}
+
+	return cfg, errors.Join(errs...)
+}
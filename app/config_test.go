@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+// unsetTestEnv は key をテストの間だけ未設定にします
+func unsetTestEnv(t *testing.T, key string) {
+	t.Helper()
+	t.Setenv(key, "")
+	os.Unsetenv(key)
+}
+
+// 足りない値と不正な値は最初の1つで止めず、すべてまとめて返す
+func TestLoadConfigCombinedError(t *testing.T) {
+	unsetTestEnv(t, powerDNSSubdomainAddressEnvKey)
+	t.Setenv("ISUCON13_REDIS_ADDR", "no-port")
+	t.Setenv("ISUCON13_BCRYPT_COST", "100")
+	t.Setenv("ISUCON13_SESSION_TTL_SECONDS", "0")
+	t.Setenv("ISUCON13_ZONE_FILE_PATH", "")
+
+	_, err := loadConfig()
+	if err == nil {
+		t.Fatal("loadConfig succeeded with invalid values")
+	}
+	for _, key := range []string{
+		powerDNSSubdomainAddressEnvKey,
+		"ISUCON13_REDIS_ADDR",
+		"ISUCON13_BCRYPT_COST",
+		"ISUCON13_SESSION_TTL_SECONDS",
+		"ISUCON13_ZONE_FILE_PATH",
+	} {
+		if !strings.Contains(err.Error(), key) {
+			t.Errorf("error does not mention %s:\n%v", key, err)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	t.Setenv(powerDNSSubdomainAddressEnvKey, "192.0.2.1")
+	t.Setenv("ISUCON13_MYSQL_DIALCONFIG_ADDRESS", "db.example")
+	unsetTestEnv(t, "ISUCON13_MYSQL_DIALCONFIG_PORT")
+	t.Setenv("ISUCON13_REDIS_ADDR", "redis.example:6380")
+	t.Setenv("ISUCON13_SESSION_TTL_SECONDS", "120")
+	t.Setenv("ISUCON13_BCRYPT_COST", "5")
+	t.Setenv("ISUCON13_ZONE_FILE_PATH", "/tmp/test.zone")
+
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatalf("loadConfig: %+v", err)
+	}
+	if cfg.MySQL.Addr != "db.example:3306" {
+		t.Errorf("MySQL.Addr = %q, want %q", cfg.MySQL.Addr, "db.example:3306")
+	}
+	if cfg.RedisAddr != "redis.example:6380" {
+		t.Errorf("RedisAddr = %q, want %q", cfg.RedisAddr, "redis.example:6380")
+	}
+	if cfg.SessionTTL != 2*time.Minute {
+		t.Errorf("SessionTTL = %v, want %v", cfg.SessionTTL, 2*time.Minute)
+	}
+	if cfg.BcryptCost != 5 {
+		t.Errorf("BcryptCost = %d, want 5", cfg.BcryptCost)
+	}
+	if cfg.ZoneFilePath != "/tmp/test.zone" {
+		t.Errorf("ZoneFilePath = %q, want %q", cfg.ZoneFilePath, "/tmp/test.zone")
+	}
+	if cfg.PowerDNSSubdomainAddress != "192.0.2.1" {
+		t.Errorf("PowerDNSSubdomainAddress = %q, want %q", cfg.PowerDNSSubdomainAddress, "192.0.2.1")
+	}
+}
+
+// A レコードに書くので IPv6 や不正なアドレスは受け付けない
+func TestLoadConfigPowerDNSAddress(t *testing.T) {
+	for _, v := range []string{"2001:db8::1", "not-an-ip", ""} {
+		t.Setenv(powerDNSSubdomainAddressEnvKey, v)
+		if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), powerDNSSubdomainAddressEnvKey) {
+			t.Errorf("%q: loadConfig = %v, want an error for %s", v, err, powerDNSSubdomainAddressEnvKey)
+		}
+	}
+}
+
+// 不正なアドレスが渡されたら、サーバーを起動せずに終了する
+func TestMainExitsOnInvalidPowerDNSAddress(t *testing.T) {
+	if os.Getenv("ISUCON13_TEST_RUN_MAIN") == "1" {
+		main()
+		return
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestMainExitsOnInvalidPowerDNSAddress$")
+	cmd.Env = append(os.Environ(), "ISUCON13_TEST_RUN_MAIN=1", powerDNSSubdomainAddressEnvKey+"=not-an-ip")
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+		t.Fatalf("main = %v, want exit status 1\n%s", err, out)
+	}
+	if !strings.Contains(string(out), powerDNSSubdomainAddressEnvKey) {
+		t.Errorf("output does not mention %s:\n%s", powerDNSSubdomainAddressEnvKey, out)
+	}
+}
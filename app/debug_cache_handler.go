@@ -0,0 +1,145 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 既定で返すエントリの件数
+const defaultDebugCacheSample = 10
+
+type DebugCacheResponse struct {
+	UserCache   DebugUserCache   `json:"user_cache"`
+	ThemeCache  DebugThemeCache  `json:"theme_cache"`
+	UserRanking DebugUserRanking `json:"user_ranking"`
+	RankingBlob DebugRankingBlob `json:"ranking_blob"`
+	UserTotals  DebugUserTotals  `json:"user_totals"`
+}
+
+// DebugUserCacheEntry は userCache のエントリです。パスワードのハッシュは返さない
+type DebugUserCacheEntry struct {
+	ID          int64  `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+	Description string `json:"description"`
+	DeletedAt   *int64 `json:"deleted_at,omitempty"`
+	CreatedAt   *int64 `json:"created_at,omitempty"`
+}
+
+type DebugUserCache struct {
+	Size    int                   `json:"size"`
+	Limit   int                   `json:"limit"`
+	Entries []DebugUserCacheEntry `json:"entries"`
+}
+
+type DebugThemeCacheEntry struct {
+	ID       int64 `json:"id"`
+	UserID   int64 `json:"user_id"`
+	DarkMode bool  `json:"dark_mode"`
+}
+
+type DebugThemeCache struct {
+	Size    int                    `json:"size"`
+	Entries []DebugThemeCacheEntry `json:"entries"`
+}
+
+type DebugUserRanking struct {
+	HasGood bool `json:"has_good"`
+	// LastError は直近の集計が失敗していればそのエラー
+	LastError string `json:"last_error,omitempty"`
+	FailedAt  int64  `json:"failed_at,omitempty"`
+}
+
+type DebugRankingBlob struct {
+	Cached bool `json:"cached"`
+	// AgeMs は作ってからの経過時間。キャッシュが無ければ省略する
+	AgeMs     *int64 `json:"age_ms,omitempty"`
+	ExpiresAt int64  `json:"expires_at,omitempty"`
+}
+
+type DebugUserTotals struct {
+	Size       int    `json:"size"`
+	Generation uint64 `json:"generation"`
+}
+
+// キャッシュの中身を確かめるAPI
+// GET /api/debug/cache?sample=
+// 各キャッシュの件数と、最大 sample 件のエントリを返す。ロックは1つずつ短く取る
+func getDebugCacheHandler(c echo.Context) error {
+	if err := verifyAdminToken(c); err != nil {
+		return err
+	}
+
+	sample := defaultDebugCacheSample
+	if v := c.QueryParam("sample"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "sample query parameter must be non-negative integer")
+		}
+		sample = n
+	}
+
+	var res DebugCacheResponse
+
+	users := userCache.Sample(sample)
+	res.UserCache.Entries = make([]DebugUserCacheEntry, len(users))
+	for i, user := range users {
+		res.UserCache.Entries[i] = DebugUserCacheEntry{
+			ID:          user.ID,
+			Name:        user.Name,
+			DisplayName: user.DisplayName,
+			Description: user.Description,
+			DeletedAt:   user.DeletedAt,
+			CreatedAt:   user.CreatedAt,
+		}
+	}
+	res.UserCache.Size = userCache.Len()
+	res.UserCache.Limit = userCache.Limit()
+
+	res.ThemeCache.Entries = make([]DebugThemeCacheEntry, 0, sample)
+	themeCache.RLock()
+	res.ThemeCache.Size = len(themeCache.m)
+	for _, theme := range themeCache.m {
+		if len(res.ThemeCache.Entries) >= sample {
+			break
+		}
+		res.ThemeCache.Entries = append(res.ThemeCache.Entries, DebugThemeCacheEntry{
+			ID:       theme.ID,
+			UserID:   theme.UserID,
+			DarkMode: theme.DarkMode,
+		})
+	}
+	themeCache.RUnlock()
+
+	userRankingState.Lock()
+	res.UserRanking.HasGood = userRankingState.hasGood
+	if userRankingState.lastErr != nil {
+		res.UserRanking.LastError = userRankingState.lastErr.Error()
+		res.UserRanking.FailedAt = userRankingState.failedAt.Unix()
+	}
+	userRankingState.Unlock()
+
+	userRankingBlobCache.RLock()
+	blob, expiresAt := userRankingBlobCache.blob, userRankingBlobCache.expiresAt
+	userRankingBlobCache.RUnlock()
+	if blob != nil {
+		age := time.Since(expiresAt.Add(-userRankingBlobTTL)).Milliseconds()
+		res.RankingBlob = DebugRankingBlob{
+			Cached:    time.Now().Before(expiresAt),
+			AgeMs:     &age,
+			ExpiresAt: expiresAt.Unix(),
+		}
+	}
+
+	userTotalsCache.Lock()
+	res.UserTotals = DebugUserTotals{
+		Size:       len(userTotalsCache.m),
+		Generation: userTotalsCache.gen,
+	}
+	userTotalsCache.Unlock()
+
+	return c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func getTestDebugCache(t *testing.T, sample int) (DebugCacheResponse, string) {
+	t.Helper()
+	c, rec := newTestContext(http.MethodGet, "/api/debug/cache?sample="+strconv.Itoa(sample), nil)
+	c.Request().Header.Set(adminTokenHeader, adminToken)
+	if err := getDebugCacheHandler(c); err != nil {
+		t.Fatalf("getDebugCacheHandler: %+v", err)
+	}
+	var res DebugCacheResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("failed to decode response: %+v", err)
+	}
+	return res, rec.Body.String()
+}
+
+// キャッシュに載せたユーザーとテーマが返り、パスワードのハッシュは返さない
+func TestGetDebugCacheReportsEntry(t *testing.T) {
+	prevToken := adminToken
+	adminToken = "test-admin-token"
+	t.Cleanup(func() { adminToken = prevToken })
+	user := UserModel{ID: 1<<40 + 13, Name: "test013", DisplayName: "debug cache", HashedPassword: "secret-hash"}
+	cacheTestUser(t, user)
+	themeCache.Lock()
+	themeCache.m[user.ID] = ThemeModel{ID: 42, UserID: user.ID, DarkMode: true}
+	themeCache.Unlock()
+	t.Cleanup(func() {
+		themeCache.Lock()
+		delete(themeCache.m, user.ID)
+		themeCache.Unlock()
+	})
+
+	// 他のテストが載せたエントリがあっても、全件を返させれば必ず含まれる
+	res, body := getTestDebugCache(t, 1<<20)
+	if strings.Contains(body, user.HashedPassword) {
+		t.Error("the response contains the hashed password")
+	}
+	found := false
+	for _, entry := range res.UserCache.Entries {
+		if entry.ID == user.ID {
+			found = true
+			if entry.Name != user.Name || entry.DisplayName != user.DisplayName {
+				t.Errorf("user entry = %+v, want %+v", entry, user)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("user %d is not in the user cache entries", user.ID)
+	}
+	if res.UserCache.Size < 1 || res.UserCache.Limit != userCache.Limit() {
+		t.Errorf("user cache size = %d, limit = %d, want size >= 1 and limit %d", res.UserCache.Size, res.UserCache.Limit, userCache.Limit())
+	}
+	found = false
+	for _, entry := range res.ThemeCache.Entries {
+		if entry.UserID == user.ID {
+			found = entry == DebugThemeCacheEntry{ID: 42, UserID: user.ID, DarkMode: true}
+		}
+	}
+	if !found {
+		t.Errorf("theme of user %d is not reported correctly: %+v", user.ID, res.ThemeCache.Entries)
+	}
+}
+
+// sample を超えてエントリを返さず、管理者トークンが無ければ拒否する
+func TestGetDebugCacheSampleAndAuth(t *testing.T) {
+	prevToken := adminToken
+	adminToken = "test-admin-token"
+	t.Cleanup(func() { adminToken = prevToken })
+	cacheTestUser(t, UserModel{ID: 1<<40 + 14, Name: "test014"})
+
+	res, _ := getTestDebugCache(t, 0)
+	if len(res.UserCache.Entries) != 0 || len(res.ThemeCache.Entries) != 0 {
+		t.Errorf("sample=0 returned %d users and %d themes", len(res.UserCache.Entries), len(res.ThemeCache.Entries))
+	}
+
+	c, _ := newTestContext(http.MethodGet, "/api/debug/cache", nil)
+	if err := getDebugCacheHandler(c); !isHTTPErrorCode(err, http.StatusUnauthorized) {
+		t.Errorf("getDebugCacheHandler without a token = %v, want 401", err)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"expvar"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// 登録がDBにはコミットされたがDNSレコードの追加だけ失敗した、あるいは退会後もレコードが残った、
+// といったゾーンファイルとDBのずれを見つけるため、ユーザーのレコード数と退会していないユーザー数を定期的に比べる
+
+var (
+	// dnsZoneUserRecords はゾーンファイルにあるユーザーのAレコードの行数です
+	dnsZoneUserRecords = expvar.NewInt("dns_zone_user_records")
+	// dnsZoneUserDelta はユーザーのAレコード数から退会していないユーザー数を引いた値です
+	// 負ならレコードの無いユーザーが、正なら消し忘れのレコードがある
+	dnsZoneUserDelta = expvar.NewInt("dns_zone_user_delta")
+)
+
+// startDNSDriftChecker は起動直後に一度確かめてから、interval ごとに確かめ直します
+// 最初の interval が過ぎるまでゲージが 0 のままだと、ずれが無いように見えてしまう
+func startDNSDriftChecker(interval time.Duration) {
+	check := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		defer cancel()
+		if err := checkDNSDrift(ctx); err != nil {
+			log.Printf("failed to check dns drift: %+v", err)
+		}
+	}
+	go func() {
+		check()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			check()
+		}
+	}()
+}
+
+// checkDNSDrift はゾーンファイルのレコード数とユーザー数を数えてゲージを更新します
+func checkDNSDrift(ctx context.Context) error {
+	records, err := countZoneUserRecords()
+	if err != nil {
+		return err
+	}
+
+	var users int64
+	if err := dbConn.GetContext(ctx, &users, "SELECT COUNT(*) FROM users WHERE deleted_at IS NULL"); err != nil {
+		return err
+	}
+
+	setDNSDrift(records, users)
+	return nil
+}
+
+// setDNSDrift は数えたレコード数とユーザー数でゲージを更新します
+func setDNSDrift(records, users int64) {
+	dnsZoneUserRecords.Set(records)
+	dnsZoneUserDelta.Set(records - users)
+	if records != users {
+		log.Printf("dns zone has %d user records for %d users", records, users)
+	}
+}
+
+// countZoneUserRecords はゾーンファイルのうちユーザーのアドレスを向いたAレコードを数えます
+// 手で入れたレコードも拾えるよう、区切りはタブに限らない
+// ネームサーバーなどのレコードはユーザーのアドレスを向いていないので数えない
+func countZoneUserRecords() (int64, error) {
+	zoneFileMu.Lock()
+	b, err := os.ReadFile(config.ZoneFilePath)
+	zoneFileMu.Unlock()
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	var n int64
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 4 && fields[0] != "@" && fields[1] == "IN" && fields[2] == "A" && fields[3] == config.PowerDNSSubdomainAddress {
+			n++
+		}
+	}
+	return n, scanner.Err()
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// setTestZoneFile は config をテスト用のゾーンファイルに向けます
+func setTestZoneFile(t *testing.T, zone string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "u.isucon.local.zone")
+	if err := os.WriteFile(path, []byte(zone), 0o644); err != nil {
+		t.Fatalf("failed to write zone file: %+v", err)
+	}
+	prev := config
+	config.ZoneFilePath = path
+	config.PowerDNSSubdomainAddress = "192.0.2.1"
+	t.Cleanup(func() { config = prev })
+}
+
+func TestCountZoneUserRecords(t *testing.T) {
+	setTestZoneFile(t, `$ORIGIN u.isucon.local.
+$TTL 0
+@	IN	SOA	ns1.u.isucon.local. hostmaster.u.isucon.local. 1 3600 900 604800 0
+@	IN	NS	ns1.u.isucon.local.
+@	IN	A	192.0.2.1
+ns1	IN	A	192.0.2.53
+alice	IN	A	192.0.2.1
+bob IN A 192.0.2.1
+carol	IN	A	192.0.2.1
+dave	IN	A	198.51.100.1
+`)
+
+	got, err := countZoneUserRecords()
+	if err != nil {
+		t.Fatalf("countZoneUserRecords: %+v", err)
+	}
+	if got != 3 {
+		t.Errorf("countZoneUserRecords = %d, want 3", got)
+	}
+}
+
+func TestCountZoneUserRecordsMissingFile(t *testing.T) {
+	prev := config
+	config.ZoneFilePath = filepath.Join(t.TempDir(), "missing.zone")
+	t.Cleanup(func() { config = prev })
+
+	got, err := countZoneUserRecords()
+	if err != nil {
+		t.Fatalf("countZoneUserRecords: %+v", err)
+	}
+	if got != 0 {
+		t.Errorf("countZoneUserRecords = %d, want 0", got)
+	}
+}
+
+// ゾーンファイルのレコードがユーザーより少なければ、差が負の値で出る
+func TestSetDNSDriftReportsDelta(t *testing.T) {
+	setTestZoneFile(t, "alice\tIN\tA\t192.0.2.1\nbob\tIN\tA\t192.0.2.1\n")
+
+	records, err := countZoneUserRecords()
+	if err != nil {
+		t.Fatalf("countZoneUserRecords: %+v", err)
+	}
+	setDNSDrift(records, 5)
+
+	if got := dnsZoneUserRecords.Value(); got != 2 {
+		t.Errorf("dns_zone_user_records = %d, want 2", got)
+	}
+	if got := dnsZoneUserDelta.Value(); got != -3 {
+		t.Errorf("dns_zone_user_delta = %d, want -3", got)
+	}
+}
+
+// DBのユーザー数と比べた差が、ゾーンファイルに足りないレコードの数になる
+func TestCheckDNSDrift(t *testing.T) {
+	setupIntegration(t)
+	createTestUser(t)
+	setTestZoneFile(t, "")
+
+	var users int64
+	if err := dbConn.Get(&users, "SELECT COUNT(*) FROM users WHERE deleted_at IS NULL"); err != nil {
+		t.Fatalf("failed to count users: %+v", err)
+	}
+	if err := checkDNSDrift(context.Background()); err != nil {
+		t.Fatalf("checkDNSDrift: %+v", err)
+	}
+	if got := dnsZoneUserDelta.Value(); got != -users {
+		t.Errorf("dns_zone_user_delta = %d, want %d", got, -users)
+	}
+}
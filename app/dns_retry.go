@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// DNSレコードの追加やゾーンのリロードに失敗したユーザー名を Redis の集合に積んでおき、
+// 成功するまで定期的にレコードを入れ直してリロードする
+// 登録はDBにコミット済みなので、ここで拾わないと名前解決できないユーザーが残る
+
+var dnsRetryKey = dnsRetryKeyspace.Key()
+
+// dnsRetryBacklog は再試行待ちのユーザー数です
+var dnsRetryBacklog = expvar.NewInt("dns_retry_backlog")
+
+// enqueueDNSRetry はレコードを入れ直すユーザー名を積みます
+func enqueueDNSRetry(ctx context.Context, names ...string) {
+	if len(names) == 0 {
+		return
+	}
+	members := make([]interface{}, len(names))
+	for i, name := range names {
+		members[i] = name
+	}
+	if err := redisConn.SAdd(ctx, dnsRetryKey, members...).Err(); err != nil {
+		log.Printf("failed to enqueue dns retry for %v: %+v", names, err)
+		return
+	}
+	if n, err := redisConn.SCard(ctx, dnsRetryKey).Result(); err == nil {
+		dnsRetryBacklog.Set(n)
+	}
+}
+
+func startDNSRetrier(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			if err := retryDNSRecords(ctx); err != nil {
+				log.Printf("failed to retry dns records: %+v", err)
+			}
+			cancel()
+		}
+	}()
+}
+
+// retryDNSRecords は積まれたユーザーのレコードをゾーンファイルに入れ直してリロードします
+// 退会・改名などで今はいないユーザー名はレコードを入れずに捨てる
+func retryDNSRecords(ctx context.Context) error {
+	names, err := redisConn.SMembers(ctx, dnsRetryKey).Result()
+	if err != nil {
+		return err
+	}
+	dnsRetryBacklog.Set(int64(len(names)))
+	if len(names) == 0 {
+		return nil
+	}
+
+	query, params, err := sqlx.In("SELECT name FROM users WHERE name IN (?) AND deleted_at IS NULL", names)
+	if err != nil {
+		return err
+	}
+	var alive []string
+	if err := dbConn.SelectContext(ctx, &alive, query, params...); err != nil {
+		return err
+	}
+
+	if err := ensureDNSRecords(alive); err != nil {
+		return err
+	}
+
+	members := make([]interface{}, len(names))
+	for i, name := range names {
+		members[i] = name
+	}
+	if err := redisConn.SRem(ctx, dnsRetryKey, members...).Err(); err != nil {
+		return err
+	}
+	n, err := redisConn.SCard(ctx, dnsRetryKey).Result()
+	if err != nil {
+		return err
+	}
+	dnsRetryBacklog.Set(n)
+	return nil
+}
+
+// ensureDNSRecords はゾーンファイルに無いユーザーのレコードだけを追記し、リロードします
+// 追記済みでリロードだけ失敗していた場合もあるので、追記するものが無くてもリロードする
+func ensureDNSRecords(names []string) error {
+	zoneFileMu.Lock()
+	defer zoneFileMu.Unlock()
+
+	b, err := os.ReadFile(config.ZoneFilePath)
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]struct{})
+	for _, line := range strings.Split(string(b), "\n") {
+		existing[line] = struct{}{}
+	}
+	var records strings.Builder
+	if len(b) > 0 && b[len(b)-1] != '\n' {
+		records.WriteByte('\n')
+	}
+	missing := 0
+	for _, name := range names {
+		line := dnsRecordLine(name)
+		if _, ok := existing[line]; ok {
+			continue
+		}
+		records.WriteString(line)
+		records.WriteByte('\n')
+		missing++
+	}
+	if missing > 0 {
+		if err := os.WriteFile(config.ZoneFilePath, append(b, records.String()...), 0666); err != nil {
+			return err
+		}
+	}
+
+	if out, err := exec.Command("pdns_control", "bind-reload-now", "u.isucon.local").CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %w", string(out), err)
+	}
+	return nil
+}
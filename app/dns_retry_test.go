@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// flakyPDNSControl は recoverPDNS を呼ぶまで失敗する pdns_control を PATH の先頭に置きます
+func flakyPDNSControl(t *testing.T) (recoverPDNS func()) {
+	t.Helper()
+	dir := t.TempDir()
+	ok := filepath.Join(dir, "ok")
+	script := "#!/bin/sh\n[ -e " + ok + " ] && exit 0\necho 'reload failed'\nexit 1\n"
+	if err := os.WriteFile(filepath.Join(dir, "pdns_control"), []byte(script), 0o755); err != nil {
+		t.Fatalf("failed to write fake pdns_control: %+v", err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return func() {
+		if err := os.WriteFile(ok, nil, 0o644); err != nil {
+			t.Fatalf("failed to recover fake pdns_control: %+v", err)
+		}
+	}
+}
+
+// 追記済みのレコードは重複させず、追記するものが無くてもリロードはやり直す
+func TestEnsureDNSRecords(t *testing.T) {
+	// ゾーンファイルの最後に改行が無くても行を繋げない
+	setTestZoneFile(t, "$ORIGIN u.isucon.local.\nalice\tIN\tA\t192.0.2.1")
+	recoverPDNS := flakyPDNSControl(t)
+
+	if err := ensureDNSRecords([]string{"alice", "bob"}); err == nil {
+		t.Fatal("ensureDNSRecords succeeded while pdns_control fails")
+	}
+	recoverPDNS()
+	if err := ensureDNSRecords([]string{"alice", "bob"}); err != nil {
+		t.Fatalf("ensureDNSRecords: %+v", err)
+	}
+
+	b, err := os.ReadFile(config.ZoneFilePath)
+	if err != nil {
+		t.Fatalf("failed to read zone file: %+v", err)
+	}
+	want := "$ORIGIN u.isucon.local.\n" + dnsRecordLine("alice") + "\n" + dnsRecordLine("bob") + "\n"
+	if string(b) != want {
+		t.Errorf("zone file = %q, want %q", b, want)
+	}
+}
+
+// 登録時のリロードに失敗したユーザーは積まれ、pdns が直った後の再試行で名前解決できるようになる
+func TestDNSRetryAfterFailedReload(t *testing.T) {
+	setupIntegration(t)
+	ctx := context.Background()
+	setTestZoneFile(t, "")
+	recoverPDNS := flakyPDNSControl(t)
+	name := fmt.Sprintf("test%dretry", time.Now().UnixNano())
+	t.Cleanup(func() { redisConn.SRem(context.Background(), dnsRetryKey, name) })
+
+	code, _ := postTestRegister(t, PostUserRequest{Name: name, DisplayName: name, Password: "s3cr3t"})
+	if code != http.StatusCreated {
+		t.Fatalf("status = %d, want %d", code, http.StatusCreated)
+	}
+	if queued, err := redisConn.SIsMember(ctx, dnsRetryKey, name).Result(); err != nil || !queued {
+		t.Fatalf("%s is not queued for retry (err=%v)", name, err)
+	}
+	if dnsRetryBacklog.Value() < 1 {
+		t.Errorf("dns_retry_backlog = %d, want at least 1", dnsRetryBacklog.Value())
+	}
+
+	recoverPDNS()
+	if err := retryDNSRecords(ctx); err != nil {
+		t.Fatalf("retryDNSRecords: %+v", err)
+	}
+	if queued, err := redisConn.SIsMember(ctx, dnsRetryKey, name).Result(); err != nil || queued {
+		t.Errorf("%s is still queued after a successful retry (err=%v)", name, err)
+	}
+	b, err := os.ReadFile(config.ZoneFilePath)
+	if err != nil {
+		t.Fatalf("failed to read zone file: %+v", err)
+	}
+	if n := strings.Count(string(b), dnsRecordLine(name)+"\n"); n != 1 {
+		t.Errorf("zone file has %d records for %s, want 1:\n%s", n, name, b)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"os"
+	"strconv"
+)
+
+// featureFlags は再デプロイせずに環境変数で切り替える機能の有効・無効です
+// 起動時に一度だけ読み、現在の値は /api/metrics の features で確認できる
+type featureFlags struct {
+	// true の場合はユーザー・配信ランキングを Redis の sorted set で管理する
+	// false にすると従来どおり毎回 SQL で集計する
+	RedisRanking bool `json:"redis_ranking"`
+	// true の場合は同じユーザー・配信・絵文字のリアクションを1件にまとめる
+	ReactionDedup bool `json:"reaction_dedup"`
+	// true の場合、DBからユーザーを読めないときは最後に読めた値を返す
+	// プロフィールが古くても困らない環境でのみ有効にする
+	UserStaleFallback bool `json:"user_stale_fallback"`
+	// true の場合、ユーザー登録・ログインのリクエストに知らないフィールドがあれば400を返す
+	// 余分なフィールドを送ってくるクライアントがいるので、既定では無視する
+	StrictRequestJSON bool `json:"strict_request_json"`
+}
+
+var features = featureFlags{
+	RedisRanking:      true,
+	ReactionDedup:     false,
+	UserStaleFallback: false,
+	StrictRequestJSON: false,
+}
+
+// loadFeatureFlags は ISUCON13_FEATURE_<名前> からフラグを読みます
+// フラグにする前の環境変数名も互換のため読むが、両方ある場合は新しい名前を優先する
+func loadFeatureFlags() {
+	for _, flag := range []struct {
+		envKeys []string
+		value   *bool
+	}{
+		{[]string{"ISUCON13_FEATURE_REDIS_RANKING", "ISUCON13_USER_RANKING_ZSET"}, &features.RedisRanking},
+		{[]string{"ISUCON13_FEATURE_REACTION_DEDUP", "ISUCON13_REACTION_DEDUP"}, &features.ReactionDedup},
+		{[]string{"ISUCON13_FEATURE_USER_STALE_FALLBACK"}, &features.UserStaleFallback},
+		{[]string{"ISUCON13_FEATURE_STRICT_REQUEST_JSON"}, &features.StrictRequestJSON},
+	} {
+		for _, key := range flag.envKeys {
+			v, ok := os.LookupEnv(key)
+			if !ok {
+				continue
+			}
+			enabled, err := strconv.ParseBool(v)
+			if err != nil {
+				log.Fatalf("failed to parse environment variable '%s' as bool: %+v", key, err)
+			}
+			*flag.value = enabled
+			break
+		}
+	}
+}
+
+func init() {
+	expvar.Publish("features", expvar.Func(func() interface{} { return features }))
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"strings"
+	"testing"
+)
+
+func saveFeatures(t *testing.T) {
+	t.Helper()
+	prevFeatures := features
+	t.Cleanup(func() { features = prevFeatures })
+}
+
+// 新しい名前の環境変数を優先し、無ければフラグにする前の名前を読む
+func TestLoadFeatureFlags(t *testing.T) {
+	saveFeatures(t)
+	features = featureFlags{RedisRanking: true}
+	t.Setenv("ISUCON13_FEATURE_REDIS_RANKING", "false")
+	t.Setenv("ISUCON13_USER_RANKING_ZSET", "true")
+	t.Setenv("ISUCON13_REACTION_DEDUP", "1")
+	t.Setenv("ISUCON13_FEATURE_STRICT_REQUEST_JSON", "true")
+
+	loadFeatureFlags()
+
+	want := featureFlags{
+		RedisRanking:      false,
+		ReactionDedup:     true,
+		UserStaleFallback: false,
+		StrictRequestJSON: true,
+	}
+	if features != want {
+		t.Errorf("features = %+v, want %+v", features, want)
+	}
+
+	var published featureFlags
+	if err := json.Unmarshal([]byte(expvar.Get("features").String()), &published); err != nil {
+		t.Fatalf("failed to decode published features: %+v", err)
+	}
+	if published != want {
+		t.Errorf("published features = %+v, want %+v", published, want)
+	}
+}
+
+// フラグを切り替えると、知らないフィールドの扱いが変わる
+func TestStrictRequestJSONFlag(t *testing.T) {
+	saveFeatures(t)
+	body := `{"username":"test","password":"p","unknown":1}`
+
+	features.StrictRequestJSON = false
+	var req LoginRequest
+	if err := decodeRequestJSON(strings.NewReader(body), &req); err != nil {
+		t.Errorf("decodeRequestJSON with the flag off: %+v", err)
+	}
+
+	features.StrictRequestJSON = true
+	var unknownErr *unknownFieldsError
+	if err := decodeRequestJSON(strings.NewReader(body), &req); !errors.As(err, &unknownErr) {
+		t.Fatalf("decodeRequestJSON with the flag on = %v, want *unknownFieldsError", err)
+	}
+	if len(unknownErr.fields) != 1 || unknownErr.fields[0] != "unknown" {
+		t.Errorf("unknown fields = %v, want [unknown]", unknownErr.fields)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ヘルスチェックで依存先の応答を待つ上限
+const healthCheckTimeout = 1 * time.Second
+
+type HealthResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// ヘルスチェックAPI
+// GET /api/healthz
+// DBかRedisに繋がらない場合は503を返し、ロードバランサがすぐに再試行しないよう Retry-After を付ける
+func healthzHandler(c echo.Context) error {
+	ctx, cancel := context.WithTimeout(c.Request().Context(), healthCheckTimeout)
+	defer cancel()
+
+	res := HealthResponse{
+		Status: "ok",
+		Checks: map[string]string{
+			"mysql": "ok",
+			"redis": "ok",
+		},
+	}
+	if err := dbConn.PingContext(ctx); err != nil {
+		res.Status = "unavailable"
+		res.Checks["mysql"] = err.Error()
+	}
+	if err := redisConn.Ping(ctx).Err(); err != nil {
+		res.Status = "unavailable"
+		res.Checks["redis"] = err.Error()
+	}
+
+	if res.Status != "ok" {
+		c.Response().Header().Set("Retry-After", strconv.Itoa(int(healthRetryAfter/time.Second)))
+		return c.JSON(http.StatusServiceUnavailable, res)
+	}
+	return c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// 依存先に繋がらなければ 503 を返し、Retry-After で再試行までの秒数を伝える
+func TestHealthzRetryAfter(t *testing.T) {
+	prevDB, prevRedis, prevRetryAfter := dbConn, redisConn, healthRetryAfter
+	dbConn = newBrokenDB(t)
+	// 誰も待ち受けていないポートに繋ぎ、再試行せずにすぐ失敗させる
+	redisConn = redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	healthRetryAfter = 7 * time.Second
+	t.Cleanup(func() {
+		redisConn.Close()
+		dbConn, redisConn, healthRetryAfter = prevDB, prevRedis, prevRetryAfter
+	})
+
+	c, rec := newTestContext(http.MethodGet, "/api/healthz", nil)
+	if err := healthzHandler(c); err != nil {
+		t.Fatalf("healthzHandler: %+v", err)
+	}
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	if got, want := rec.Header().Get("Retry-After"), "7"; got != want {
+		t.Errorf("Retry-After = %q, want %q", got, want)
+	}
+	var res HealthResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("failed to decode response: %+v", err)
+	}
+	if res.Status != "unavailable" || res.Checks["mysql"] == "ok" || res.Checks["redis"] == "ok" {
+		t.Errorf("response = %+v, want both checks to fail", res)
+	}
+}
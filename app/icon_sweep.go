@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 退会済み・存在しないユーザーのアイコンを定期的に消します
+// 退会時にも消しているが、退会APIより前に退会したユーザーや、途中で失敗した場合の取りこぼしを拾う
+
+var iconsSwept = expvar.NewInt("icons_swept")
+
+// 1回の削除で扱うアイコンの件数
+const iconSweepBatchSize = 100
+
+func startIconSweeper(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			if err := sweepOrphanIcons(ctx); err != nil {
+				log.Printf("failed to sweep orphan icons: %+v", err)
+			}
+			cancel()
+		}
+	}()
+}
+
+func sweepOrphanIcons(ctx context.Context) error {
+	for {
+		var icons []struct {
+			ID       int64  `db:"id"`
+			UserID   int64  `db:"user_id"`
+			IconHash string `db:"icon_hash"`
+		}
+		query := `
+			SELECT i.id, i.user_id, i.icon_hash
+			FROM icons i
+			LEFT JOIN users u ON u.id = i.user_id
+			WHERE u.id IS NULL OR u.deleted_at IS NOT NULL
+			LIMIT ?
+		`
+		if err := dbConn.SelectContext(ctx, &icons, query, iconSweepBatchSize); err != nil {
+			return err
+		}
+		if len(icons) == 0 {
+			return nil
+		}
+
+		ids := make([]int64, len(icons))
+		iconHashes := make([]string, len(icons))
+		userIDs := make(map[int64]struct{})
+		for i, icon := range icons {
+			ids[i] = icon.ID
+			iconHashes[i] = icon.IconHash
+			userIDs[icon.UserID] = struct{}{}
+		}
+		query, params, err := sqlx.In("DELETE FROM icons WHERE id IN (?)", ids)
+		if err != nil {
+			return err
+		}
+		if _, err := dbConn.ExecContext(ctx, query, params...); err != nil {
+			return err
+		}
+
+		evictIconImages(iconHashes)
+		for userID := range userIDs {
+			if err := invalidateIconHashCache(ctx, userID); err != nil {
+				return err
+			}
+		}
+		iconsSwept.Add(int64(len(icons)))
+
+		if len(icons) < iconSweepBatchSize {
+			return nil
+		}
+	}
+}
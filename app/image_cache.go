@@ -0,0 +1,120 @@
+package main
+
+import (
+	"container/list"
+	"expvar"
+	"sync"
+)
+
+// iconImageCacheEvictions は iconImageCache が上限を超えて追い出した件数です
+var iconImageCacheEvictions = expvar.NewInt("icon_image_cache_evictions")
+
+// imageLRU は画像のハッシュをキーとし、画像を値とするLRUキャッシュです
+// 件数ではなく画像の合計バイト数で上限を決める。maxBytes が 0 の場合は追い出さない
+type imageLRU struct {
+	mu       sync.Mutex
+	maxBytes int
+	bytes    int
+	ll       *list.List
+	m        map[string]*list.Element
+}
+
+type imageLRUEntry struct {
+	hash  string
+	image []byte
+}
+
+func newImageLRU(maxBytes int) *imageLRU {
+	return &imageLRU{
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		m:        make(map[string]*list.Element),
+	}
+}
+
+// SetMaxBytes は上限を変えます。既に超えている分はその場で追い出す
+func (c *imageLRU) SetMaxBytes(maxBytes int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxBytes = maxBytes
+	c.evict()
+}
+
+func (c *imageLRU) Load(hash string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.m[hash]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(e)
+	return e.Value.(*imageLRUEntry).image, true
+}
+
+// Store は画像を保存します。1枚で上限を超える画像は保存しない
+func (c *imageLRU) Store(hash string, image []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.maxBytes > 0 && len(image) > c.maxBytes {
+		return
+	}
+	if e, ok := c.m[hash]; ok {
+		entry := e.Value.(*imageLRUEntry)
+		c.bytes += len(image) - len(entry.image)
+		entry.image = image
+		c.ll.MoveToFront(e)
+	} else {
+		c.m[hash] = c.ll.PushFront(&imageLRUEntry{hash: hash, image: image})
+		c.bytes += len(image)
+	}
+	c.evict()
+}
+
+func (c *imageLRU) Delete(hash string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.m[hash]; ok {
+		c.remove(e)
+	}
+}
+
+// Bytes は保存している画像の合計バイト数を返します
+func (c *imageLRU) Bytes() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bytes
+}
+
+func (c *imageLRU) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+// Reset は全件を消します。上限はそのまま
+func (c *imageLRU) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ll.Init()
+	c.m = make(map[string]*list.Element)
+	c.bytes = 0
+}
+
+// remove は c.mu を持った状態で呼ぶ
+func (c *imageLRU) remove(e *list.Element) {
+	entry := e.Value.(*imageLRUEntry)
+	c.ll.Remove(e)
+	delete(c.m, entry.hash)
+	c.bytes -= len(entry.image)
+}
+
+// evict は上限を超えた分を、最も長く使われていないものから消します。c.mu を持った状態で呼ぶ
+func (c *imageLRU) evict() {
+	if c.maxBytes <= 0 {
+		return
+	}
+	for c.bytes > c.maxBytes {
+		c.remove(c.ll.Back())
+		iconImageCacheEvictions.Add(1)
+	}
+}
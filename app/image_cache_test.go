@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// 合計バイト数が上限を超えると、最も長く使われていないものから追い出す
+func TestImageLRUEvictsByBytes(t *testing.T) {
+	c := newImageLRU(10)
+	c.Store("a", bytes.Repeat([]byte("a"), 4))
+	c.Store("b", bytes.Repeat([]byte("b"), 4))
+	if _, ok := c.Load("a"); !ok {
+		t.Fatal("a is missing")
+	}
+	c.Store("c", bytes.Repeat([]byte("c"), 4))
+
+	if _, ok := c.Load("b"); ok {
+		t.Error("b was not evicted")
+	}
+	for _, hash := range []string{"a", "c"} {
+		if _, ok := c.Load(hash); !ok {
+			t.Errorf("%s was evicted", hash)
+		}
+	}
+	if got := c.Bytes(); got != 8 {
+		t.Errorf("bytes = %d, want 8", got)
+	}
+}
+
+func TestImageLRUSkipsOversizedImage(t *testing.T) {
+	c := newImageLRU(10)
+	c.Store("a", []byte("a"))
+	c.Store("big", bytes.Repeat([]byte("x"), 11))
+	if _, ok := c.Load("big"); ok {
+		t.Error("an image larger than the limit was stored")
+	}
+	if _, ok := c.Load("a"); !ok {
+		t.Error("storing an oversized image evicted a")
+	}
+}
+
+func TestImageLRUDeleteAndReset(t *testing.T) {
+	c := newImageLRU(0)
+	c.Store("a", []byte("aaa"))
+	c.Store("b", []byte("bb"))
+	c.Delete("a")
+	if got := c.Bytes(); got != 2 {
+		t.Errorf("bytes after delete = %d, want 2", got)
+	}
+	c.Reset()
+	if c.Len() != 0 || c.Bytes() != 0 {
+		t.Errorf("after reset: len = %d, bytes = %d, want 0, 0", c.Len(), c.Bytes())
+	}
+}
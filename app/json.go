@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// JSONライブラリはビルドタグで切り替える
+//   - デフォルト: encoding/json (json_std.go)
+//   - -tags goccyjson: github.com/goccy/go-json (json_goccy.go)
+// 各実装は jsonMarshal, newJSONEncoder, newJSONDecoder を提供する
+
+type jsonEncoder interface {
+	Encode(v interface{}) error
+	SetIndent(prefix, indent string)
+}
+
+type jsonDecoder interface {
+	Decode(v interface{}) error
+	DisallowUnknownFields()
+}
+
+func decodeJSON(r io.Reader, v interface{}) error {
+	return newJSONDecoder(r).Decode(v)
+}
+
+// unknownFieldsError は v に無いフィールドがリクエストに含まれていたことを表します
+type unknownFieldsError struct {
+	fields []string
+}
+
+func (e *unknownFieldsError) Error() string {
+	return "unknown fields in the request body: " + strings.Join(e.fields, ", ")
+}
+
+// decodeRequestJSON はユーザー登録・ログインのリクエストを読みます
+// features.StrictRequestJSON が有効な場合、知らないフィールドがあれば *unknownFieldsError を返す
+// トップレベルのものはまとめて列挙し、入れ子のものはデコーダーのエラーで返す
+func decodeRequestJSON(r io.Reader, v interface{}) error {
+	if !features.StrictRequestJSON {
+		return decodeJSON(r, v)
+	}
+
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	var fields map[string]interface{}
+	if err := decodeJSON(bytes.NewReader(body), &fields); err != nil {
+		return err
+	}
+	if unknown := unknownJSONFields(fields, v); len(unknown) > 0 {
+		return &unknownFieldsError{fields: unknown}
+	}
+
+	dec := newJSONDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// unknownJSONFields は fields のうち、構造体 v の json タグに無いキーを返します
+// encoding/json と同じく大文字小文字は区別しない
+func unknownJSONFields(fields map[string]interface{}, v interface{}) []string {
+	t := reflect.TypeOf(v)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	known := make(map[string]struct{}, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = t.Field(i).Name
+		}
+		known[strings.ToLower(name)] = struct{}{}
+	}
+
+	var unknown []string
+	for key := range fields {
+		if _, ok := known[strings.ToLower(key)]; !ok {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// jsonSerializer は c.JSON などのレスポンスにも切り替えたJSONライブラリを使うための echo.JSONSerializer です
+type jsonSerializer struct{}
+
+func (jsonSerializer) Serialize(c echo.Context, i interface{}, indent string) error {
+	enc := newJSONEncoder(c.Response())
+	if indent != "" {
+		enc.SetIndent("", indent)
+	}
+	return enc.Encode(i)
+}
+
+func (jsonSerializer) Deserialize(c echo.Context, i interface{}) error {
+	if err := decodeJSON(c.Request().Body, i); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json").SetInternal(err)
+	}
+	return nil
+}
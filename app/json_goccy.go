@@ -0,0 +1,21 @@
+//go:build goccyjson
+
+package main
+
+import (
+	"io"
+
+	"github.com/goccy/go-json"
+)
+
+const jsonLibrary = "github.com/goccy/go-json"
+
+var jsonMarshal = json.Marshal
+
+func newJSONEncoder(w io.Writer) jsonEncoder {
+	return json.NewEncoder(w)
+}
+
+func newJSONDecoder(r io.Reader) jsonDecoder {
+	return json.NewDecoder(r)
+}
@@ -0,0 +1,20 @@
+//go:build !goccyjson
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+)
+
+const jsonLibrary = "encoding/json"
+
+var jsonMarshal = json.Marshal
+
+func newJSONEncoder(w io.Writer) jsonEncoder {
+	return json.NewEncoder(w)
+}
+
+func newJSONDecoder(r io.Reader) jsonDecoder {
+	return json.NewDecoder(r)
+}
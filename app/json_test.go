@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	stdjson "encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// ライブラリごとの比較は、タグを変えて同じベンチマークを流して比べる
+//   go test -run '^$' -bench JSON -benchmem . > std.txt
+//   go test -run '^$' -bench JSON -benchmem -tags goccyjson . > goccy.txt
+//   benchstat std.txt goccy.txt
+
+var testPostUserRequest = PostUserRequest{
+	Name:        "test001",
+	DisplayName: "テストユーザー",
+	Description: "普段配信者をしています。\n\"よろしく\" <お願いします> & ありがとう",
+	Password:    "s3cr3t",
+	Theme:       &PostUserRequestTheme{DarkMode: true},
+	Nonce:       "0123456789abcdef",
+}
+
+var testUserStatistics = UserStatistics{
+	Rank:              3,
+	ViewersCount:      120,
+	TotalReactions:    4567,
+	TotalLivecomments: 890,
+	TotalActivity:     5457,
+	TotalTip:          123456,
+	FavoriteEmoji:     "heart_eyes",
+	FavoriteEmojis:    &[]EmojiCount{{EmojiName: "heart_eyes", Count: 40}, {EmojiName: "+1", Count: 12}, {EmojiName: "smile", Count: 3}},
+}
+
+var testLivestreamStatistics = LivestreamStatistics{
+	Rank:                 1,
+	ViewersCount:         15,
+	TotalViewers:         300,
+	MaxConcurrentViewers: 42,
+	TotalReactions:       1000,
+	TotalReports:         2,
+	MaxTip:               10000,
+}
+
+// roundTripJSON は v を選ばれているライブラリで書いて読み直し、書いた内容を返します
+func roundTripJSON(t *testing.T, v interface{}, out interface{}) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := newJSONEncoder(&buf).Encode(v); err != nil {
+		t.Fatalf("failed to encode with %s: %+v", jsonLibrary, err)
+	}
+	encoded := append([]byte(nil), buf.Bytes()...)
+	if err := decodeJSON(&buf, out); err != nil {
+		t.Fatalf("failed to decode with %s: %+v", jsonLibrary, err)
+	}
+	return encoded
+}
+
+// どのライブラリでも、書いて読み直した値が元と同じで、書いた内容は encoding/json と同じ意味になる
+func TestJSONRoundTrip(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		v    interface{}
+		out  func() interface{}
+	}{
+		{"PostUserRequest", testPostUserRequest, func() interface{} { return &PostUserRequest{} }},
+		{"PostUserRequest without theme", PostUserRequest{Name: "test002", Password: "p"}, func() interface{} { return &PostUserRequest{} }},
+		{"UserStatistics", testUserStatistics, func() interface{} { return &UserStatistics{} }},
+		{"UserStatistics without favorites", UserStatistics{Rank: 1}, func() interface{} { return &UserStatistics{} }},
+		{"LivestreamStatistics", testLivestreamStatistics, func() interface{} { return &LivestreamStatistics{} }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			out := tt.out()
+			encoded := roundTripJSON(t, tt.v, out)
+			if got := reflect.ValueOf(out).Elem().Interface(); !reflect.DeepEqual(got, tt.v) {
+				t.Errorf("%s round trip = %+v, want %+v", jsonLibrary, got, tt.v)
+			}
+
+			want, err := stdjson.Marshal(tt.v)
+			if err != nil {
+				t.Fatalf("failed to marshal with encoding/json: %+v", err)
+			}
+			var gotFields, wantFields interface{}
+			if err := stdjson.Unmarshal(encoded, &gotFields); err != nil {
+				t.Fatalf("%s wrote invalid json %s: %+v", jsonLibrary, encoded, err)
+			}
+			if err := stdjson.Unmarshal(want, &wantFields); err != nil {
+				t.Fatalf("failed to unmarshal with encoding/json: %+v", err)
+			}
+			if !reflect.DeepEqual(gotFields, wantFields) {
+				t.Errorf("%s wrote %s, encoding/json writes %s", jsonLibrary, strings.TrimSpace(string(encoded)), want)
+			}
+		})
+	}
+}
+
+// 厳格モードで知らないフィールドを拒むのは、どのライブラリのデコーダーでも同じ
+func TestJSONDecoderDisallowUnknownFields(t *testing.T) {
+	dec := newJSONDecoder(strings.NewReader(`{"name":"test001","unknown":1}`))
+	dec.DisallowUnknownFields()
+	var req PostUserRequest
+	if err := dec.Decode(&req); err == nil {
+		t.Errorf("%s accepted an unknown field", jsonLibrary)
+	}
+}
+
+func TestUnknownJSONFields(t *testing.T) {
+	fields := map[string]interface{}{"name": "a", "Display_Name": "b", "extra": 1, "another": true}
+	got := unknownJSONFields(fields, &PostUserRequest{})
+	want := []string{"another", "extra"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unknownJSONFields = %v, want %v", got, want)
+	}
+}
+
+func BenchmarkJSONMarshalPostUserRequest(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := jsonMarshal(testPostUserRequest); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkJSONDecodePostUserRequest(b *testing.B) {
+	body, err := stdjson.Marshal(testPostUserRequest)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var req PostUserRequest
+		if err := decodeJSON(bytes.NewReader(body), &req); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkJSONEncodeUserStatistics(b *testing.B) {
+	var buf bytes.Buffer
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		if err := newJSONEncoder(&buf).Encode(testUserStatistics); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkJSONEncodeLivestreamStatistics(b *testing.B) {
+	var buf bytes.Buffer
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		if err := newJSONEncoder(&buf).Encode(testLivestreamStatistics); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultLeaderboardLimit = 10
+	maxLeaderboardLimit     = 100
+)
+
+type TopReactor struct {
+	Rank          int64 `json:"rank"`
+	User          User  `json:"user"`
+	ReactionCount int64 `json:"reaction_count"`
+}
+
+type TopTipper struct {
+	Rank     int64 `json:"rank"`
+	User     User  `json:"user"`
+	TotalTip int64 `json:"total_tip"`
+}
+
+// userCountModel は集計値つきのユーザーです
+type userCountModel struct {
+	UserModel
+	Count int64 `db:"cnt"`
+}
+
+// 配信ごとのリアクションした人ランキングAPI (配信者のみ)
+// GET /api/livestream/:livestream_id/top-reactors?limit=
+// 同じリアクション数の場合はユーザーIDが小さいものを上位とする
+func getTopReactorsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID, err := verifyUserSession(c)
+	if err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := parseInt64Param(c, "livestream_id")
+	if err != nil {
+		return err
+	}
+
+	limit, err := parseLeaderboardLimit(c)
+	if err != nil {
+		return err
+	}
+
+	fillUser, err := userFillerFromQuery(c)
+	if err != nil {
+		return err
+	}
+
+	var reactors []TopReactor
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		if err := verifyLivestreamOwner(ctx, tx, livestreamID, userID); err != nil {
+			return err
+		}
+
+		var counts []userCountModel
+		query := `
+			SELECT u.*, COUNT(*) AS cnt
+			FROM reactions r
+			INNER JOIN users u ON u.id = r.user_id
+			WHERE r.livestream_id = ? AND u.deleted_at IS NULL
+			GROUP BY u.id
+			ORDER BY cnt DESC, u.id ASC
+			LIMIT ?
+		`
+		if err := tx.SelectContext(ctx, &counts, query, livestreamID, limit); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to count reactions by user: "+err.Error())
+		}
+
+		reactors = make([]TopReactor, len(counts))
+		for i := range counts {
+			user, err := fillUser(ctx, tx, counts[i].UserModel)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
+			}
+			reactors[i] = TopReactor{
+				Rank:          int64(i + 1),
+				User:          user,
+				ReactionCount: counts[i].Count,
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, reactors)
+}
+
+// 配信ごとのチップを送った人ランキングAPI (配信者のみ)
+// GET /api/livestream/:livestream_id/top-tippers?limit=
+// チップを送っていないユーザーは含めない。同じ合計額の場合はユーザーIDが小さいものを上位とする
+func getTopTippersHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID, err := verifyUserSession(c)
+	if err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := parseInt64Param(c, "livestream_id")
+	if err != nil {
+		return err
+	}
+
+	limit, err := parseLeaderboardLimit(c)
+	if err != nil {
+		return err
+	}
+
+	fillUser, err := userFillerFromQuery(c)
+	if err != nil {
+		return err
+	}
+
+	var tippers []TopTipper
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		if err := verifyLivestreamOwner(ctx, tx, livestreamID, userID); err != nil {
+			return err
+		}
+
+		var sums []userCountModel
+		query := `
+			SELECT u.*, SUM(lc.tip) AS cnt
+			FROM livecomments lc
+			INNER JOIN users u ON u.id = lc.user_id
+			WHERE lc.livestream_id = ? AND lc.tip > 0 AND u.deleted_at IS NULL
+			GROUP BY u.id
+			ORDER BY cnt DESC, u.id ASC
+			LIMIT ?
+		`
+		if err := tx.SelectContext(ctx, &sums, query, livestreamID, limit); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to sum tips by user: "+err.Error())
+		}
+
+		tippers = make([]TopTipper, len(sums))
+		for i := range sums {
+			user, err := fillUser(ctx, tx, sums[i].UserModel)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
+			}
+			tippers[i] = TopTipper{
+				Rank:     int64(i + 1),
+				User:     user,
+				TotalTip: sums[i].Count,
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, tippers)
+}
+
+func parseLeaderboardLimit(c echo.Context) (int, error) {
+	limit := defaultLeaderboardLimit
+	if v := c.QueryParam("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxLeaderboardLimit {
+			return 0, echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be an integer between 1 and "+strconv.Itoa(maxLeaderboardLimit))
+		}
+		limit = n
+	}
+	return limit, nil
+}
+
+// verifyLivestreamOwner は配信が存在し、userID の配信者のものであることを確かめます
+func verifyLivestreamOwner(ctx context.Context, tx *sqlx.Tx, livestreamID, userID int64) error {
+	var ownerID int64
+	if err := tx.GetContext(ctx, &ownerID, "SELECT user_id FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if ownerID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "only the streamer can see the leaderboard of the livestream")
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// getTestLeaderboard は配信のランキングを取得し、v に読み込みます
+func getTestLeaderboard(t *testing.T, h echo.HandlerFunc, viewer UserModel, livestreamID int64, query url.Values, v interface{}) error {
+	t.Helper()
+	id := strconv.FormatInt(livestreamID, 10)
+	c, rec := newTestContext(http.MethodGet, "/api/livestream/"+id+"/leaderboard?"+query.Encode(), nil)
+	c.SetParamNames("livestream_id")
+	c.SetParamValues(id)
+	if err := serveWithSession(c, viewer, h); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("failed to decode response: %+v", err)
+	}
+	return nil
+}
+
+// リアクションの多い順、同数ならユーザーIDの小さい順に並び、limit 件で切る
+func TestGetTopReactors(t *testing.T) {
+	setupIntegration(t)
+	owner := createTestUser(t)
+	livestream := createTestLivestream(t, owner.ID)
+	now := time.Now().Unix()
+	var users []UserModel
+	for _, n := range []int{1, 3, 2, 3} {
+		user := createTestUser(t)
+		users = append(users, user)
+		for i := 0; i < n; i++ {
+			createTestReaction(t, user.ID, livestream.ID, "heart", now)
+		}
+	}
+
+	var reactors []TopReactor
+	if err := getTestLeaderboard(t, getTopReactorsHandler, owner, livestream.ID, url.Values{"limit": {"3"}}, &reactors); err != nil {
+		t.Fatalf("getTopReactorsHandler: %+v", err)
+	}
+	want := []struct {
+		userID int64
+		count  int64
+	}{{users[1].ID, 3}, {users[3].ID, 3}, {users[2].ID, 2}}
+	if len(reactors) != len(want) {
+		t.Fatalf("got %d reactors, want %d", len(reactors), len(want))
+	}
+	for i, w := range want {
+		got := reactors[i]
+		if got.Rank != int64(i+1) || got.User.ID != w.userID || got.ReactionCount != w.count {
+			t.Errorf("reactors[%d] = rank %d user %d count %d, want rank %d user %d count %d", i, got.Rank, got.User.ID, got.ReactionCount, i+1, w.userID, w.count)
+		}
+	}
+}
+
+// 配信者以外はランキングを見られない
+func TestGetTopReactorsByOtherUser(t *testing.T) {
+	setupIntegration(t)
+	owner := createTestUser(t)
+	other := createTestUser(t)
+	livestream := createTestLivestream(t, owner.ID)
+
+	var reactors []TopReactor
+	err := getTestLeaderboard(t, getTopReactorsHandler, other, livestream.ID, nil, &reactors)
+	if !isHTTPErrorCode(err, http.StatusForbidden) {
+		t.Errorf("getTopReactorsHandler by other user = %v, want %d", err, http.StatusForbidden)
+	}
+}
+
+func TestGetTopReactorsInvalidLimit(t *testing.T) {
+	viewer := UserModel{ID: -1, Name: "leaderboard-viewer"}
+	cacheTestUser(t, viewer)
+	for _, limit := range []string{"0", "-1", "abc", strconv.Itoa(maxLeaderboardLimit + 1)} {
+		var reactors []TopReactor
+		err := getTestLeaderboard(t, getTopReactorsHandler, viewer, 1, url.Values{"limit": {limit}}, &reactors)
+		if !isHTTPErrorCode(err, http.StatusBadRequest) {
+			t.Errorf("limit=%s: getTopReactorsHandler = %v, want %d", limit, err, http.StatusBadRequest)
+		}
+	}
+}
+
+// チップの合計が多い順に並び、チップを送っていないユーザーは含めない
+func TestGetTopTippers(t *testing.T) {
+	setupIntegration(t)
+	ctx := context.Background()
+	owner := createTestUser(t)
+	livestream := createTestLivestream(t, owner.ID)
+	now := time.Now().Unix()
+	var users []UserModel
+	for _, tips := range [][]int64{{100}, {0, 0}, {500, 500}, {1000}, {}} {
+		user := createTestUser(t)
+		users = append(users, user)
+		for _, tip := range tips {
+			if _, err := dbConn.ExecContext(ctx, "INSERT INTO livecomments (user_id, livestream_id, comment, tip, created_at) VALUES (?, ?, ?, ?, ?)", user.ID, livestream.ID, "tip", tip, now); err != nil {
+				t.Fatalf("failed to insert livecomment: %+v", err)
+			}
+		}
+	}
+	// チップを送らずにリアクションだけしたユーザーも含めない
+	createTestReaction(t, users[4].ID, livestream.ID, "heart", now)
+
+	var tippers []TopTipper
+	if err := getTestLeaderboard(t, getTopTippersHandler, owner, livestream.ID, nil, &tippers); err != nil {
+		t.Fatalf("getTopTippersHandler: %+v", err)
+	}
+	want := []struct {
+		userID int64
+		total  int64
+	}{{users[2].ID, 1000}, {users[3].ID, 1000}, {users[0].ID, 100}}
+	if len(tippers) != len(want) {
+		t.Fatalf("got %d tippers, want %d: %+v", len(tippers), len(want), tippers)
+	}
+	for i, w := range want {
+		got := tippers[i]
+		if got.Rank != int64(i+1) || got.User.ID != w.userID || got.TotalTip != w.total {
+			t.Errorf("tippers[%d] = rank %d user %d total %d, want rank %d user %d total %d", i, got.Rank, got.User.ID, got.TotalTip, i+1, w.userID, w.total)
+		}
+	}
+}
+
+func TestGetTopTippersByOtherUser(t *testing.T) {
+	setupIntegration(t)
+	owner := createTestUser(t)
+	other := createTestUser(t)
+	livestream := createTestLivestream(t, owner.ID)
+
+	var tippers []TopTipper
+	err := getTestLeaderboard(t, getTopTippersHandler, other, livestream.ID, nil, &tippers)
+	if !isHTTPErrorCode(err, http.StatusForbidden) {
+		t.Errorf("getTopTippersHandler by other user = %v, want %d", err, http.StatusForbidden)
+	}
+}
@@ -3,15 +3,15 @@ package main
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/jmoiron/sqlx"
-	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
 )
 
@@ -68,14 +68,19 @@ type NGWord struct {
 func getLivecommentsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
-	if err := verifyUserSession(c); err != nil {
+	if _, err := verifyUserSession(c); err != nil {
 		// echo.NewHTTPErrorが返っているのでそのまま出力
 		return err
 	}
 
-	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	livestreamID, err := parseInt64Param(c, "livestream_id")
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+		return err
+	}
+
+	fillUser, err := userFillerFromQuery(c)
+	if err != nil {
+		return err
 	}
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
@@ -84,9 +89,22 @@ func getLivecommentsHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	query := "SELECT * FROM livecomments WHERE livestream_id = ? ORDER BY created_at DESC"
+	// created_at が同じコメントがあってもページ境界がぶれないよう、(created_at, id) の降順で並べる
+	// カーソルも同じキーで "<created_at>,<id>" の形式とし、そのコメントより古いものを返す
+	query := "SELECT * FROM livecomments WHERE livestream_id = ?"
+	args := []interface{}{livestreamID}
+	if cursor := c.QueryParam("cursor"); cursor != "" {
+		cursorCreatedAt, cursorID, err := parseTimeIDCursor(cursor)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "cursor query parameter must be formatted as <created_at>,<id>")
+		}
+		query += " AND (created_at < ? OR (created_at = ? AND id < ?))"
+		args = append(args, cursorCreatedAt, cursorCreatedAt, cursorID)
+	}
+	query += " ORDER BY created_at DESC, id DESC"
+	limit := 0
 	if c.QueryParam("limit") != "" {
-		limit, err := strconv.Atoi(c.QueryParam("limit"))
+		limit, err = strconv.Atoi(c.QueryParam("limit"))
 		if err != nil {
 			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
 		}
@@ -94,7 +112,7 @@ func getLivecommentsHandler(c echo.Context) error {
 	}
 
 	livecommentModels := []LivecommentModel{}
-	err = tx.SelectContext(ctx, &livecommentModels, query, livestreamID)
+	err = tx.SelectContext(ctx, &livecommentModels, query, args...)
 	if errors.Is(err, sql.ErrNoRows) {
 		return c.JSON(http.StatusOK, []*Livecomment{})
 	}
@@ -102,14 +120,70 @@ func getLivecommentsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
 	}
 
-	livecomments := make([]Livecomment, len(livecommentModels))
-	for i := range livecommentModels {
-		livecomment, err := fillLivecommentResponse(ctx, tx, livecommentModels[i])
-		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fil livecomments: "+err.Error())
+	livecomments, err := fillLivecommentsResponse(ctx, tx, livecommentModels, fillUser)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fil livecomments: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	if limit > 0 && len(livecommentModels) == limit {
+		last := livecommentModels[len(livecommentModels)-1]
+		c.Response().Header().Set("X-Next-Cursor", fmt.Sprintf("%d,%d", last.CreatedAt, last.ID))
+	}
+
+	return c.JSON(http.StatusOK, livecomments)
+}
+
+// 全配信の最新ライブコメントで一度に返せる件数
+const (
+	defaultRecentLivecommentsLimit = 20
+	maxRecentLivecommentsLimit     = 100
+)
+
+// 全配信の最新ライブコメント取得API
+// GET /api/livecomments/recent
+func getRecentLivecommentsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if _, err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	limit := defaultRecentLivecommentsLimit
+	if v := c.QueryParam("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be a positive integer")
 		}
+		limit = n
+	}
+	if limit > maxRecentLivecommentsLimit {
+		limit = maxRecentLivecommentsLimit
+	}
 
-		livecomments[i] = livecomment
+	fillUser, err := userFillerFromQuery(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	livecommentModels := []LivecommentModel{}
+	if err := tx.SelectContext(ctx, &livecommentModels, "SELECT * FROM livecomments ORDER BY created_at DESC, id DESC LIMIT ?", limit); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
+	}
+
+	livecomments, err := fillLivecommentsResponse(ctx, tx, livecommentModels, fillUser)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomments: "+err.Error())
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -119,21 +193,89 @@ func getLivecommentsHandler(c echo.Context) error {
 	return c.JSON(http.StatusOK, livecomments)
 }
 
-func getNgwords(c echo.Context) error {
+// parseTimeIDCursor は "<日時>,<id>" 形式のカーソルを解釈します
+func parseTimeIDCursor(cursor string) (int64, int64, error) {
+	createdAtStr, idStr, ok := strings.Cut(cursor, ",")
+	if !ok {
+		return 0, 0, errors.New("invalid cursor")
+	}
+	createdAt, err := strconv.ParseInt(createdAtStr, 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return createdAt, id, nil
+}
+
+type NotificationsResponse struct {
+	ReportCount int64 `json:"report_count"`
+}
+
+type reportCountCacheEntry struct {
+	count     int64
+	expiresAt time.Time
+}
+
+// reportCountCache は配信者のユーザーIDをキーとし、自分の配信に付いたスパム報告数を短時間キャッシュします
+var reportCountCache = struct {
+	sync.RWMutex
+	m map[int64]reportCountCacheEntry
+}{m: make(map[int64]reportCountCacheEntry)}
+
+const reportCountCacheTTL = 3 * time.Second
+
+// 配信者向けの通知(スパム報告数)取得API
+// GET /api/user/me/notifications
+func getMyNotificationsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
-	if err := verifyUserSession(c); err != nil {
+	userID, err := verifyUserSession(c)
+	if err != nil {
 		return err
 	}
 
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	reportCountCache.RLock()
+	entry, ok := reportCountCache.m[userID]
+	reportCountCache.RUnlock()
+	if ok && time.Now().Before(entry.expiresAt) {
+		return c.JSON(http.StatusOK, NotificationsResponse{ReportCount: entry.count})
+	}
+
+	var reportCount int64
+	query := `
+	SELECT COUNT(*)
+	FROM livestreams l
+	INNER JOIN livecomment_reports r ON r.livestream_id = l.id
+	WHERE l.user_id = ?
+	`
+	if err := dbConn.GetContext(ctx, &reportCount, query, userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count livecomment reports: "+err.Error())
+	}
+
+	reportCountCache.Lock()
+	reportCountCache.m[userID] = reportCountCacheEntry{
+		count:     reportCount,
+		expiresAt: time.Now().Add(reportCountCacheTTL),
+	}
+	reportCountCache.Unlock()
+
+	return c.JSON(http.StatusOK, NotificationsResponse{ReportCount: reportCount})
+}
 
-	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+func getNgwords(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID, err := verifyUserSession(c)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+		return err
+	}
+
+	livestreamID, err := parseInt64Param(c, "livestream_id")
+	if err != nil {
+		return err
 	}
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
@@ -162,22 +304,18 @@ func postLivecommentHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	defer c.Request().Body.Close()
 
-	if err := verifyUserSession(c); err != nil {
+	userID, err := verifyUserSession(c)
+	if err != nil {
 		return err
 	}
 
-	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	livestreamID, err := parseInt64Param(c, "livestream_id")
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+		return err
 	}
 
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
-
 	var req *PostLivecommentRequest
-	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+	if err := decodeJSON(c.Request().Body, &req); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
 
@@ -224,7 +362,7 @@ func postLivecommentHandler(c echo.Context) error {
 	now := time.Now().Unix()
 	livecommentModel := LivecommentModel{
 		UserID:       userID,
-		LivestreamID: int64(livestreamID),
+		LivestreamID: livestreamID,
 		Comment:      req.Comment,
 		Tip:          req.Tip,
 		CreatedAt:    now,
@@ -250,31 +388,38 @@ func postLivecommentHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	invalidateUserStats(livecomment.Livestream.Owner.ID)
+	if err := incrUserScore(ctx, livecomment.Livestream.Owner.Name, livecomment.Tip); err != nil {
+		c.Logger().Warnf("failed to increment user score: %+v", err)
+	}
+	if err := incrLivestreamScore(ctx, livecomment.Livestream.ID, livecomment.Tip); err != nil {
+		c.Logger().Warnf("failed to increment livestream score: %+v", err)
+	}
+	if err := publishLivecomment(ctx, livecomment); err != nil {
+		c.Logger().Warnf("failed to publish livecomment: %+v", err)
+	}
+
 	return c.JSON(http.StatusCreated, livecomment)
 }
 
 func reportLivecommentHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
-	if err := verifyUserSession(c); err != nil {
+	userID, err := verifyUserSession(c)
+	if err != nil {
 		return err
 	}
 
-	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	livestreamID, err := parseInt64Param(c, "livestream_id")
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+		return err
 	}
 
-	livecommentID, err := strconv.Atoi(c.Param("livecomment_id"))
+	livecommentID, err := parseInt64Param(c, "livecomment_id")
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livecomment_id in path must be integer")
+		return err
 	}
 
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
-
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
@@ -301,9 +446,9 @@ func reportLivecommentHandler(c echo.Context) error {
 
 	now := time.Now().Unix()
 	reportModel := LivecommentReportModel{
-		UserID:        int64(userID),
-		LivestreamID:  int64(livestreamID),
-		LivecommentID: int64(livecommentID),
+		UserID:        userID,
+		LivestreamID:  livestreamID,
+		LivecommentID: livecommentID,
 		CreatedAt:     now,
 	}
 	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livecomment_reports(user_id, livestream_id, livecomment_id, created_at) VALUES (:user_id, :livestream_id, :livecomment_id, :created_at)", &reportModel)
@@ -332,22 +477,18 @@ func moderateHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	defer c.Request().Body.Close()
 
-	if err := verifyUserSession(c); err != nil {
+	userID, err := verifyUserSession(c)
+	if err != nil {
 		return err
 	}
 
-	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	livestreamID, err := parseInt64Param(c, "livestream_id")
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+		return err
 	}
 
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
-
 	var req *ModerateRequest
-	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+	if err := decodeJSON(c.Request().Body, &req); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
 
@@ -367,8 +508,8 @@ func moderateHandler(c echo.Context) error {
 	}
 
 	rs, err := tx.NamedExecContext(ctx, "INSERT INTO ng_words(user_id, livestream_id, word, created_at) VALUES (:user_id, :livestream_id, :word, :created_at)", &NGWord{
-		UserID:       int64(userID),
-		LivestreamID: int64(livestreamID),
+		UserID:       userID,
+		LivestreamID: livestreamID,
 		Word:         req.NGWord,
 		CreatedAt:    time.Now().Unix(),
 	})
@@ -387,6 +528,8 @@ func moderateHandler(c echo.Context) error {
 	}
 
 	// NGワードにヒットする過去の投稿も全削除する
+	// 消えたチップの分はランキングのスコアからも減らす
+	var deletedTips int64
 	for _, ngword := range ngwords {
 		// ライブコメント一覧取得
 		// var livecomments []*LivecommentModel
@@ -394,6 +537,12 @@ func moderateHandler(c echo.Context) error {
 		// 	return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
 		// }
 
+		var tips int64
+		if err := tx.GetContext(ctx, &tips, "SELECT IFNULL(SUM(tip), 0) FROM livecomments WHERE livestream_id = ? AND comment LIKE CONCAT('%', ?, '%')", livestreamID, ngword.Word); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to sum tips of livecomments that hit spams: "+err.Error())
+		}
+		deletedTips += tips
+
 		query := `
 		DELETE
 		FROM livecomments
@@ -404,10 +553,23 @@ func moderateHandler(c echo.Context) error {
 		}
 	}
 
+	owner, err := getUser(ctx, tx, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	invalidateUserStats(owner.ID)
+	if err := incrUserScore(ctx, owner.Name, -deletedTips); err != nil {
+		c.Logger().Warnf("failed to decrement user score: %+v", err)
+	}
+	if err := incrLivestreamScore(ctx, livestreamID, -deletedTips); err != nil {
+		c.Logger().Warnf("failed to decrement livestream score: %+v", err)
+	}
+
 	return c.JSON(http.StatusCreated, map[string]interface{}{
 		"word_id": wordID,
 	})
@@ -444,6 +606,64 @@ func fillLivecommentResponse(ctx context.Context, tx *sqlx.Tx, livecommentModel
 	return livecomment, nil
 }
 
+// fillLivecommentsResponse は複数の配信にまたがるライブコメントをまとめて埋めます
+// 配信は1クエリでまとめて取得し、配信・ユーザーともに同じものは一度だけ埋めます
+// コメントしたユーザーは fillUser で埋めます
+func fillLivecommentsResponse(ctx context.Context, tx *sqlx.Tx, livecommentModels []LivecommentModel, fillUser userFiller) ([]Livecomment, error) {
+	livecomments := make([]Livecomment, len(livecommentModels))
+	if len(livecommentModels) == 0 {
+		return livecomments, nil
+	}
+
+	livestreamIDs := make([]int64, len(livecommentModels))
+	for i := range livecommentModels {
+		livestreamIDs[i] = livecommentModels[i].LivestreamID
+	}
+	query, params, err := sqlx.In("SELECT * FROM livestreams WHERE id IN (?)", livestreamIDs)
+	if err != nil {
+		return nil, err
+	}
+	var livestreamModels []*LivestreamModel
+	if err := tx.SelectContext(ctx, &livestreamModels, query, params...); err != nil {
+		return nil, err
+	}
+	livestreams := make(map[int64]Livestream, len(livestreamModels))
+	for _, livestreamModel := range livestreamModels {
+		livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModel)
+		if err != nil {
+			return nil, err
+		}
+		livestreams[livestreamModel.ID] = livestream
+	}
+
+	users := make(map[int64]User)
+	for i := range livecommentModels {
+		user, ok := users[livecommentModels[i].UserID]
+		if !ok {
+			userModel, err := getUser(ctx, tx, livecommentModels[i].UserID)
+			if err != nil {
+				return nil, err
+			}
+			user, err = fillUser(ctx, tx, userModel)
+			if err != nil {
+				return nil, err
+			}
+			users[livecommentModels[i].UserID] = user
+		}
+
+		livecomments[i] = Livecomment{
+			ID:         livecommentModels[i].ID,
+			User:       user,
+			Livestream: livestreams[livecommentModels[i].LivestreamID],
+			Comment:    livecommentModels[i].Comment,
+			Tip:        livecommentModels[i].Tip,
+			CreatedAt:  livecommentModels[i].CreatedAt,
+		}
+	}
+
+	return livecomments, nil
+}
+
 func fillLivecommentReportResponse(ctx context.Context, tx *sqlx.Tx, reportModel LivecommentReportModel) (LivecommentReport, error) {
 	reporterModel, err := getUser(ctx, tx, reportModel.UserID)
 	if err != nil {
@@ -471,3 +691,29 @@ func fillLivecommentReportResponse(ctx context.Context, tx *sqlx.Tx, reportModel
 	}
 	return report, nil
 }
+
+// getTipSums は配信ごとのチップ合計をまとめて集計します
+// ライブコメントが無い配信はマップに含まれないので、参照側では0として扱う
+// since (unix 秒) より前のライブコメントは数えない。全期間の場合は 0 を渡す
+func getTipSums(ctx context.Context, tx *sqlx.Tx, livestreamIDs []int64, since int64) (map[int64]int64, error) {
+	tipSums := make(map[int64]int64, len(livestreamIDs))
+	if len(livestreamIDs) == 0 {
+		return tipSums, nil
+	}
+
+	var sums []struct {
+		LivestreamID int64 `db:"livestream_id"`
+		Sum          int64 `db:"total"`
+	}
+	query, params, err := sqlx.In("SELECT livestream_id, IFNULL(SUM(tip), 0) AS total FROM livecomments WHERE livestream_id IN (?) AND created_at >= ? GROUP BY livestream_id", livestreamIDs, since)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.SelectContext(ctx, &sums, query, params...); err != nil {
+		return nil, err
+	}
+	for _, sum := range sums {
+		tipSums[sum.LivestreamID] = sum.Sum
+	}
+	return tipSums, nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// getTestLivecommentsPage はライブコメントを1ページ取得し、次のページのカーソルと一緒に返します
+func getTestLivecommentsPage(t *testing.T, viewer UserModel, livestreamID int64, query url.Values) ([]Livecomment, string) {
+	t.Helper()
+	id := strconv.FormatInt(livestreamID, 10)
+	c, rec := newTestContext(http.MethodGet, "/api/livestream/"+id+"/livecomment?"+query.Encode(), nil)
+	c.SetParamNames("livestream_id")
+	c.SetParamValues(id)
+	if err := serveWithSession(c, viewer, getLivecommentsHandler); err != nil {
+		t.Fatalf("getLivecommentsHandler: %+v", err)
+	}
+	var livecomments []Livecomment
+	if err := json.Unmarshal(rec.Body.Bytes(), &livecomments); err != nil {
+		t.Fatalf("failed to decode response: %+v", err)
+	}
+	return livecomments, rec.Header().Get("X-Next-Cursor")
+}
+
+// created_at が同じコメントがあっても、カーソルで辿ると漏れも重複も無く (created_at, id) の降順に並ぶ
+func TestGetLivecommentsStablePages(t *testing.T) {
+	setupIntegration(t)
+	owner := createTestUser(t)
+	viewer := createTestUser(t)
+	livestream := createTestLivestream(t, owner.ID)
+	now := time.Now().Unix()
+	var want []int64
+	for i := 0; i < 7; i++ {
+		// 3件ずつ同じ時刻にする
+		livecomment := createTestLivecomment(t, viewer.ID, livestream.ID, now+int64(i/3))
+		want = append([]int64{livecomment.ID}, want...)
+	}
+
+	var got []int64
+	query := url.Values{"limit": {"2"}}
+	for page := 0; ; page++ {
+		if page > len(want) {
+			t.Fatalf("pagination did not finish after %d pages", page)
+		}
+		livecomments, cursor := getTestLivecommentsPage(t, viewer, livestream.ID, query)
+		for _, livecomment := range livecomments {
+			got = append(got, livecomment.ID)
+		}
+		if cursor == "" {
+			break
+		}
+		query.Set("cursor", cursor)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ids = %v, want %v", got, want)
+	}
+}
+
+func TestParseTimeIDCursor(t *testing.T) {
+	createdAt, id, err := parseTimeIDCursor("1700000000,42")
+	if err != nil {
+		t.Fatalf("parseTimeIDCursor: %+v", err)
+	}
+	if createdAt != 1700000000 || id != 42 {
+		t.Errorf("parseTimeIDCursor = (%d, %d), want (1700000000, 42)", createdAt, id)
+	}
+	for _, cursor := range []string{"", "1700000000", "x,42", "1700000000,x"} {
+		if _, _, err := parseTimeIDCursor(cursor); err == nil {
+			t.Errorf("parseTimeIDCursor(%q) accepted an invalid cursor", cursor)
+		}
+	}
+}
+
+func getTestNotifications(t *testing.T, user UserModel) NotificationsResponse {
+	t.Helper()
+	c, rec := newTestContext(http.MethodGet, "/api/user/me/notifications", nil)
+	if err := serveWithSession(c, user, getMyNotificationsHandler); err != nil {
+		t.Fatalf("getMyNotificationsHandler: %+v", err)
+	}
+	var res NotificationsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("failed to decode response: %+v", err)
+	}
+	return res
+}
+
+// 自分の配信すべてに付いたスパム報告を数え、他人の配信への報告は数えない
+func TestGetMyNotificationsReportCount(t *testing.T) {
+	setupIntegration(t)
+	owner := createTestUser(t)
+	other := createTestUser(t)
+	reporter := createTestUser(t)
+	now := time.Now().Unix()
+	for i := 0; i < 2; i++ {
+		livestream := createTestLivestream(t, owner.ID)
+		for j := 0; j <= i; j++ {
+			createTestReport(t, reporter.ID, createTestLivecomment(t, reporter.ID, livestream.ID, now), now)
+		}
+	}
+	otherLivestream := createTestLivestream(t, other.ID)
+	createTestReport(t, reporter.ID, createTestLivecomment(t, reporter.ID, otherLivestream.ID, now), now)
+	t.Cleanup(func() {
+		reportCountCache.Lock()
+		delete(reportCountCache.m, owner.ID)
+		reportCountCache.Unlock()
+	})
+
+	if got := getTestNotifications(t, owner).ReportCount; got != 3 {
+		t.Errorf("report_count = %d, want 3", got)
+	}
+}
+
+// 全配信の最新コメントを新しい順に、投稿者と配信を埋めて返す
+func TestGetRecentLivecomments(t *testing.T) {
+	setupIntegration(t)
+	owner := createTestUser(t)
+	viewer := createTestUser(t)
+	livestreams := []LivestreamModel{createTestLivestream(t, owner.ID), createTestLivestream(t, owner.ID)}
+	// 既存のどのコメントよりも新しくなるよう、未来の時刻で入れる
+	future := time.Now().Add(24 * time.Hour).Unix()
+	var want []LivecommentModel
+	for i := 0; i < 4; i++ {
+		livecomment := createTestLivecomment(t, viewer.ID, livestreams[i%2].ID, future+int64(i))
+		want = append([]LivecommentModel{livecomment}, want...)
+	}
+
+	c, rec := newTestContext(http.MethodGet, "/api/livecomments/recent?limit=4", nil)
+	if err := serveWithSession(c, viewer, getRecentLivecommentsHandler); err != nil {
+		t.Fatalf("getRecentLivecommentsHandler: %+v", err)
+	}
+	var livecomments []Livecomment
+	if err := json.Unmarshal(rec.Body.Bytes(), &livecomments); err != nil {
+		t.Fatalf("failed to decode response: %+v", err)
+	}
+	if len(livecomments) != len(want) {
+		t.Fatalf("got %d livecomments, want %d", len(livecomments), len(want))
+	}
+	for i, livecomment := range livecomments {
+		if livecomment.ID != want[i].ID {
+			t.Errorf("livecomments[%d].id = %d, want %d", i, livecomment.ID, want[i].ID)
+		}
+		if livecomment.User.Name != viewer.Name {
+			t.Errorf("livecomments[%d].user.name = %q, want %q", i, livecomment.User.Name, viewer.Name)
+		}
+		if livecomment.Livestream.ID != want[i].LivestreamID || livecomment.Livestream.Owner.Name != owner.Name {
+			t.Errorf("livecomments[%d].livestream = %+v, want livestream %d owned by %s", i, livecomment.Livestream, want[i].LivestreamID, owner.Name)
+		}
+	}
+}
+
+func TestGetRecentLivecommentsInvalidLimit(t *testing.T) {
+	user := UserModel{ID: 1<<40 + 6, Name: "test006"}
+	cacheTestUser(t, user)
+	for _, limit := range []string{"0", "-1", "x"} {
+		c, _ := newTestContext(http.MethodGet, "/api/livecomments/recent?limit="+limit, nil)
+		wantBadRequest(t, serveWithSession(c, user, getRecentLivecommentsHandler))
+	}
+}
+
+// まとめて求めたチップ合計は、配信ごとに SUM したものと一致する
+func TestGetTipSumsMatchesPerLivestream(t *testing.T) {
+	setupIntegration(t)
+	ctx := context.Background()
+	owner := createTestUser(t)
+	viewer := createTestUser(t)
+	now := time.Now().Unix()
+	var livestreamIDs []int64
+	for _, tips := range [][]int64{{100, 500}, {0}, {}, {1000, 10, 20000}} {
+		livestream := createTestLivestream(t, owner.ID)
+		livestreamIDs = append(livestreamIDs, livestream.ID)
+		for _, tip := range tips {
+			if _, err := dbConn.ExecContext(ctx, "INSERT INTO livecomments (user_id, livestream_id, comment, tip, created_at) VALUES (?, ?, ?, ?, ?)", viewer.ID, livestream.ID, "tip", tip, now); err != nil {
+				t.Fatalf("failed to insert livecomment: %+v", err)
+			}
+		}
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		t.Fatalf("failed to begin transaction: %+v", err)
+	}
+	defer tx.Rollback()
+
+	// 最後の配信は渡さず、結果に含まれないことも確かめる
+	subset := livestreamIDs[:3]
+	got, err := getTipSums(ctx, tx, subset, 0)
+	if err != nil {
+		t.Fatalf("getTipSums: %+v", err)
+	}
+	if _, ok := got[livestreamIDs[3]]; ok {
+		t.Errorf("getTipSums includes livestream %d that was not requested", livestreamIDs[3])
+	}
+	for _, id := range subset {
+		var want int64
+		if err := tx.GetContext(ctx, &want, "SELECT IFNULL(SUM(tip), 0) FROM livecomments WHERE livestream_id = ?", id); err != nil {
+			t.Fatalf("failed to sum tips: %+v", err)
+		}
+		if got[id] != want {
+			t.Errorf("getTipSums[%d] = %d, want %d", id, got[id], want)
+		}
+	}
+
+	got, err = getTipSums(ctx, tx, livestreamIDs[3:], now+1)
+	if err != nil {
+		t.Fatalf("getTipSums with since: %+v", err)
+	}
+	if got[livestreamIDs[3]] != 0 {
+		t.Errorf("getTipSums with since = %v, want no tips", got)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 新しいライブコメントは投稿時に配信ごとの Redis のチャンネルへ publish し、
+// 購読中のクライアントへ Server-Sent Events で流す
+// NGワードに引っかかったコメントは保存されないので publish もされない
+
+// SSE の接続を中継するプロキシに切られないよう、この間隔でコメント行を送る
+const livecommentStreamHeartbeat = 15 * time.Second
+
+func getLivecommentChannel(livestreamID int64) string {
+	return livecommentChannelKeyspace.Key(livestreamID)
+}
+
+// publishLivecomment は投稿されたライブコメントを購読者に流します
+func publishLivecomment(ctx context.Context, livecomment Livecomment) error {
+	payload, err := jsonMarshal(livecomment)
+	if err != nil {
+		return err
+	}
+	return redisConn.Publish(ctx, getLivecommentChannel(livecomment.Livestream.ID), payload).Err()
+}
+
+// ライブコメントのストリーミングAPI
+// GET /api/livestream/:livestream_id/livecomments/stream
+// 接続後に投稿されたライブコメントを1件ずつ livecomment イベントとして送る
+func getLivecommentStreamHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if _, err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := parseInt64Param(c, "livestream_id")
+	if err != nil {
+		return err
+	}
+
+	var exists int64
+	if err := dbConn.GetContext(ctx, &exists, "SELECT id FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
+	// レスポンスを返し始める前に購読を確定させ、エラーならまだステータスを返せるうちに返す
+	pubsub := redisConn.Subscribe(ctx, getLivecommentChannel(livestreamID))
+	defer pubsub.Close()
+	if _, err := pubsub.Receive(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to subscribe livecomments: "+err.Error())
+	}
+	messages := pubsub.Channel()
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set(echo.HeaderCacheControl, "no-cache")
+	res.Header().Set(echo.HeaderConnection, "keep-alive")
+	res.WriteHeader(http.StatusOK)
+	res.Flush()
+
+	heartbeat := time.NewTicker(livecommentStreamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			// クライアントが切断した。defer で購読を解除する
+			return nil
+		case msg, ok := <-messages:
+			if !ok {
+				return nil
+			}
+			if _, err := fmt.Fprintf(res, "event: livecomment\ndata: %s\n\n", msg.Payload); err != nil {
+				return nil
+			}
+			res.Flush()
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(res, ": ping\n\n"); err != nil {
+				return nil
+			}
+			res.Flush()
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func postTestLivecomment(t *testing.T, user UserModel, livestreamID int64, comment string) error {
+	t.Helper()
+	body, err := json.Marshal(PostLivecommentRequest{Comment: comment})
+	if err != nil {
+		t.Fatalf("failed to marshal request: %+v", err)
+	}
+	id := strconv.FormatInt(livestreamID, 10)
+	c, _ := newTestContext(http.MethodPost, "/api/livestream/"+id+"/livecomment", bytes.NewReader(body))
+	c.SetParamNames("livestream_id")
+	c.SetParamValues(id)
+	return serveWithSession(c, user, postLivecommentHandler)
+}
+
+// 購読後に投稿されたコメントが投稿者つきで届き、NGワードで弾かれたコメントは届かない
+// 切断すると購読が解除される
+func TestLivecommentStream(t *testing.T) {
+	setupIntegration(t)
+	ctx := context.Background()
+	owner := createTestUser(t)
+	viewer := createTestUser(t)
+	livestream := createTestLivestream(t, owner.ID)
+	if _, err := dbConn.ExecContext(ctx, "INSERT INTO ng_words (user_id, livestream_id, word, created_at) VALUES (?, ?, ?, ?)", owner.ID, livestream.ID, "forbidden", time.Now().Unix()); err != nil {
+		t.Fatalf("failed to insert ng word: %+v", err)
+	}
+
+	e := echo.New()
+	e.GET("/api/livestream/:livestream_id/livecomments/stream", getLivecommentStreamHandler, func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error { return serveWithSession(c, viewer, next) }
+	})
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	streamCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(streamCtx, http.MethodGet, srv.URL+"/api/livestream/"+strconv.FormatInt(livestream.ID, 10)+"/livecomments/stream", nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %+v", err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to connect stream: %+v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusOK)
+	}
+
+	// ヘッダが返った時点で購読は済んでいる
+	if err := postTestLivecomment(t, viewer, livestream.ID, "this is forbidden"); !isHTTPErrorCode(err, http.StatusBadRequest) {
+		t.Fatalf("posting an ng comment = %v, want %d", err, http.StatusBadRequest)
+	}
+	if err := postTestLivecomment(t, viewer, livestream.ID, "hello stream"); err != nil {
+		t.Fatalf("postLivecommentHandler: %+v", err)
+	}
+
+	events := make(chan string, 1)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+				events <- data
+				return
+			}
+		}
+	}()
+	var data string
+	select {
+	case data = <-events:
+	case <-streamCtx.Done():
+		t.Fatal("no livecomment was delivered")
+	}
+	var got Livecomment
+	if err := json.Unmarshal([]byte(data), &got); err != nil {
+		t.Fatalf("failed to decode event %q: %+v", data, err)
+	}
+	if got.Comment != "hello stream" {
+		t.Errorf("comment = %q, want %q", got.Comment, "hello stream")
+	}
+	if got.User.ID != viewer.ID || got.User.Name != viewer.Name {
+		t.Errorf("author = %d %q, want %d %q", got.User.ID, got.User.Name, viewer.ID, viewer.Name)
+	}
+	if got.Livestream.ID != livestream.ID {
+		t.Errorf("livestream = %d, want %d", got.Livestream.ID, livestream.ID)
+	}
+
+	cancel()
+	channel := getLivecommentChannel(livestream.ID)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		subs, err := redisConn.PubSubNumSub(ctx, channel).Result()
+		if err != nil {
+			t.Fatalf("failed to count subscribers: %+v", err)
+		}
+		if subs[channel] == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d subscribers remain after disconnecting", subs[channel])
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
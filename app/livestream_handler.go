@@ -3,7 +3,6 @@ package main
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
@@ -13,7 +12,6 @@ import (
 	"time"
 
 	"github.com/jmoiron/sqlx"
-	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
 )
 
@@ -28,9 +26,11 @@ type ReserveLivestreamRequest struct {
 }
 
 type LivestreamViewerModel struct {
-	UserID       int64 `db:"user_id" json:"user_id"`
-	LivestreamID int64 `db:"livestream_id" json:"livestream_id"`
-	CreatedAt    int64 `db:"created_at" json:"created_at"`
+	ID           int64  `db:"id" json:"id"`
+	UserID       int64  `db:"user_id" json:"user_id"`
+	LivestreamID int64  `db:"livestream_id" json:"livestream_id"`
+	CreatedAt    int64  `db:"created_at" json:"created_at"`
+	LeftAt       *int64 `db:"left_at" json:"left_at"`
 }
 
 type LivestreamModel struct {
@@ -54,6 +54,9 @@ type Livestream struct {
 	Tags         []Tag  `json:"tags"`
 	StartAt      int64  `json:"start_at"`
 	EndAt        int64  `json:"end_at"`
+
+	// include_stats=1 のときのみ埋める
+	Statistics *LivestreamStatistics `json:"statistics,omitempty"`
 }
 
 type LivestreamTagModel struct {
@@ -78,18 +81,14 @@ func reserveLivestreamHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	defer c.Request().Body.Close()
 
-	if err := verifyUserSession(c); err != nil {
+	userID, err := verifyUserSession(c)
+	if err != nil {
 		// echo.NewHTTPErrorが返っているのでそのまま出力
 		return err
 	}
 
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
-
 	var req *ReserveLivestreamRequest
-	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+	if err := decodeJSON(c.Request().Body, &req); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
 
@@ -117,20 +116,16 @@ func reserveLivestreamHandler(c echo.Context) error {
 		c.Logger().Warnf("予約枠一覧取得でエラー発生: %+v", err)
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
 	}
+	// 行はロック済みなので、読んだ残数をそのまま使える
 	for _, slot := range slots {
-		var count int
-		if err := tx.GetContext(ctx, &count, "SELECT slot FROM reservation_slots WHERE start_at = ? AND end_at = ?", slot.StartAt, slot.EndAt); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
-		}
-		c.Logger().Infof("%d ~ %d予約枠の残数 = %d\n", slot.StartAt, slot.EndAt, slot.Slot)
-		if count < 1 {
+		if slot.Slot < 1 {
 			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("予約期間 %d ~ %dに対して、予約区間 %d ~ %dが予約できません", termStartAt.Unix(), termEndAt.Unix(), req.StartAt, req.EndAt))
 		}
 	}
 
 	var (
 		livestreamModel = &LivestreamModel{
-			UserID:       int64(userID),
+			UserID:       userID,
 			Title:        req.Title,
 			Description:  req.Description,
 			PlaylistUrl:  req.PlaylistUrl,
@@ -140,9 +135,19 @@ func reserveLivestreamHandler(c echo.Context) error {
 		}
 	)
 
-	if _, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot - 1 WHERE start_at >= ? AND end_at <= ?", req.StartAt, req.EndAt); err != nil {
+	// 残数が0の枠は減らさず、減らせた行数がロックした枠の数に足りなければ満席として扱う
+	// FOR UPDATE を外しても売り越さないための保険
+	result, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot - 1 WHERE start_at >= ? AND end_at <= ? AND slot > 0", req.StartAt, req.EndAt)
+	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation_slot: "+err.Error())
 	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error())
+	}
+	if updated < int64(len(slots)) {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("予約期間 %d ~ %dに対して、予約区間 %d ~ %dが予約できません", termStartAt.Unix(), termEndAt.Unix(), req.StartAt, req.EndAt))
+	}
 
 	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livestreams (user_id, title, description, playlist_url, thumbnail_url, start_at, end_at) VALUES(:user_id, :title, :description, :playlist_url, :thumbnail_url, :start_at, :end_at)", livestreamModel)
 	if err != nil {
@@ -174,9 +179,60 @@ func reserveLivestreamHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	if err := addLivestreamScoreMember(ctx, livestreamModel.ID); err != nil {
+		c.Logger().Warnf("failed to add livestream score: %+v", err)
+	}
+
 	return c.JSON(http.StatusCreated, livestream)
 }
 
+type ReservationSlotAvailability struct {
+	StartAt   int64 `json:"start_at"`
+	EndAt     int64 `json:"end_at"`
+	Remaining int64 `json:"remaining"`
+}
+
+// 予約枠の空き状況API
+// GET /api/livestream/reservation/slots?start=&end=
+// [start, end) に収まる1時間ごとの枠について、あと何件予約できるかを返す
+// reservation_slots.slot は予約時に減らしているので、そのまま残数になる
+func getReservationSlotsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if _, err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	startAt, err := strconv.ParseInt(c.QueryParam("start"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "start query parameter must be integer")
+	}
+	endAt, err := strconv.ParseInt(c.QueryParam("end"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "end query parameter must be integer")
+	}
+	if endAt <= startAt {
+		return echo.NewHTTPError(http.StatusBadRequest, "end must be after start")
+	}
+
+	var slots []ReservationSlotModel
+	if err := dbConn.SelectContext(ctx, &slots, "SELECT * FROM reservation_slots WHERE start_at >= ? AND end_at <= ? ORDER BY start_at", startAt, endAt); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
+	}
+
+	availability := make([]ReservationSlotAvailability, len(slots))
+	for i, slot := range slots {
+		availability[i] = ReservationSlotAvailability{
+			StartAt:   slot.StartAt,
+			EndAt:     slot.EndAt,
+			Remaining: max(slot.Slot, 0),
+		}
+	}
+
+	return c.JSON(http.StatusOK, availability)
+}
+
 func searchLivestreamsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	keyTagName := c.QueryParam("tag")
@@ -246,7 +302,8 @@ func searchLivestreamsHandler(c echo.Context) error {
 
 func getMyLivestreamsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
-	if err := verifyUserSession(c); err != nil {
+	userID, err := verifyUserSession(c)
+	if err != nil {
 		return err
 	}
 
@@ -256,11 +313,6 @@ func getMyLivestreamsHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
-
 	var livestreamModels []*LivestreamModel
 	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE user_id = ?", userID); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
@@ -283,7 +335,7 @@ func getMyLivestreamsHandler(c echo.Context) error {
 
 func getUserLivestreamsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
-	if err := verifyUserSession(c); err != nil {
+	if _, err := verifyUserSession(c); err != nil {
 		return err
 	}
 
@@ -296,7 +348,7 @@ func getUserLivestreamsHandler(c echo.Context) error {
 	defer tx.Rollback()
 
 	var user UserModel
-	if err := tx.GetContext(ctx, &user, "SELECT * FROM users WHERE name = ?", username); err != nil {
+	if err := tx.GetContext(ctx, &user, "SELECT * FROM users WHERE name = ? AND deleted_at IS NULL", username); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return echo.NewHTTPError(http.StatusNotFound, "user not found")
 		} else {
@@ -324,23 +376,50 @@ func getUserLivestreamsHandler(c echo.Context) error {
 	return c.JSON(http.StatusOK, livestreams)
 }
 
-// viewerテーブルの廃止
-func enterLivestreamHandler(c echo.Context) error {
+type LivestreamListEntry struct {
+	Livestream
+	TotalReactions int64 `json:"total_reactions"`
+	TotalTip       int64 `json:"total_tip"`
+}
+
+// 配信一覧で一度に返せる件数
+const (
+	defaultLivestreamListLimit = 20
+	maxLivestreamListLimit     = 100
+)
+
+// 配信一覧API
+// GET /api/livestreams?sort=recent|popular&limit=&cursor=
+// recent は開始日時の新しい順で、カーソルは "<start_at>,<id>"
+// popular はランキングの上位順で、カーソルは先頭からの件数
+// 次のページがある場合は X-Next-Cursor ヘッダでカーソルを返す
+func getLivestreamsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
-	if err := verifyUserSession(c); err != nil {
-		// echo.NewHTTPErrorが返っているのでそのまま出力
+
+	if _, err := verifyUserSession(c); err != nil {
 		return err
 	}
 
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	sortBy := c.QueryParam("sort")
+	if sortBy == "" {
+		sortBy = "recent"
+	}
+	if sortBy != "recent" && sortBy != "popular" {
+		return echo.NewHTTPError(http.StatusBadRequest, "sort query parameter must be 'recent' or 'popular'")
+	}
 
-	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
-	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id must be integer")
+	limit := defaultLivestreamListLimit
+	if v := c.QueryParam("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be a positive integer")
+		}
+		limit = n
+	}
+	if limit > maxLivestreamListLimit {
+		limit = maxLivestreamListLimit
 	}
+	cursor := c.QueryParam("cursor")
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
@@ -348,52 +427,161 @@ func enterLivestreamHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	viewer := LivestreamViewerModel{
-		UserID:       int64(userID),
-		LivestreamID: int64(livestreamID),
-		CreatedAt:    time.Now().Unix(),
+	var livestreamModels []*LivestreamModel
+	var nextCursor string
+	switch sortBy {
+	case "recent":
+		query := "SELECT * FROM livestreams"
+		var args []interface{}
+		if cursor != "" {
+			cursorStartAt, cursorID, err := parseTimeIDCursor(cursor)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "cursor query parameter must be formatted as <start_at>,<id>")
+			}
+			query += " WHERE (start_at < ? OR (start_at = ? AND id < ?))"
+			args = append(args, cursorStartAt, cursorStartAt, cursorID)
+		}
+		query += " ORDER BY start_at DESC, id DESC LIMIT ?"
+		args = append(args, limit)
+		if err := tx.SelectContext(ctx, &livestreamModels, query, args...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+		}
+		if len(livestreamModels) == limit {
+			last := livestreamModels[len(livestreamModels)-1]
+			nextCursor = fmt.Sprintf("%d,%d", last.StartAt, last.ID)
+		}
+	case "popular":
+		var offset int64
+		if cursor != "" {
+			offset, err = strconv.ParseInt(cursor, 10, 64)
+			if err != nil || offset < 0 {
+				return echo.NewHTTPError(http.StatusBadRequest, "cursor query parameter must be a non-negative integer")
+			}
+		}
+		ids, err := getPopularLivestreamIDs(ctx, tx, offset, int64(limit))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream ranking: "+err.Error())
+		}
+		if len(ids) > 0 {
+			query, params, err := sqlx.In("SELECT * FROM livestreams WHERE id IN (?)", ids)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+			}
+			var models []*LivestreamModel
+			if err := tx.SelectContext(ctx, &models, query, params...); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+			}
+			// ランキングの順に並べ直す
+			byID := make(map[int64]*LivestreamModel, len(models))
+			for _, model := range models {
+				byID[model.ID] = model
+			}
+			for _, id := range ids {
+				if model, ok := byID[id]; ok {
+					livestreamModels = append(livestreamModels, model)
+				}
+			}
+		}
+		if len(ids) == limit {
+			nextCursor = strconv.FormatInt(offset+int64(limit), 10)
+		}
 	}
 
-	if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_viewers_history (user_id, livestream_id, created_at) VALUES(:user_id, :livestream_id, :created_at)", viewer); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream_view_history: "+err.Error())
+	livestreams, err := fillLivestreamsResponse(ctx, tx, livestreamModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestreams: "+err.Error())
+	}
+
+	// リアクション数とチップ合計はページ内の配信分だけまとめて集計する
+	ids := make([]int64, len(livestreamModels))
+	for i := range livestreamModels {
+		ids[i] = livestreamModels[i].ID
+	}
+	reactionCounts, err := getReactionCounts(ctx, tx, ids, 0)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count reactions: "+err.Error())
+	}
+	tipSums, err := getTipSums(ctx, tx, ids, 0)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to sum tips: "+err.Error())
 	}
 
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	return c.NoContent(http.StatusOK)
+	entries := make([]LivestreamListEntry, len(livestreams))
+	for i := range livestreams {
+		entries[i] = LivestreamListEntry{
+			Livestream:     livestreams[i],
+			TotalReactions: reactionCounts[livestreams[i].ID],
+			TotalTip:       tipSums[livestreams[i].ID],
+		}
+	}
+
+	if nextCursor != "" {
+		c.Response().Header().Set("X-Next-Cursor", nextCursor)
+	}
+	return c.JSON(http.StatusOK, entries)
 }
 
-func exitLivestreamHandler(c echo.Context) error {
+// viewerテーブルの廃止
+func enterLivestreamHandler(c echo.Context) error {
 	ctx := c.Request().Context()
-	if err := verifyUserSession(c); err != nil {
+	userID, err := verifyUserSession(c)
+	if err != nil {
 		// echo.NewHTTPErrorが返っているのでそのまま出力
 		return err
 	}
 
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
-
-	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	livestreamID, err := parseInt64Param(c, "livestream_id")
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+		return err
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	viewer := LivestreamViewerModel{
+		UserID:       userID,
+		LivestreamID: livestreamID,
+		CreatedAt:    time.Now().Unix(),
+	}
+
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_viewers_history (user_id, livestream_id, created_at) VALUES(:user_id, :livestream_id, :created_at)", viewer); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream_view_history: "+err.Error())
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if err := invalidateUserStatsByLivestream(ctx, livestreamID); err != nil {
+		c.Logger().Warnf("failed to invalidate user statistics cache: %+v", err)
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+func exitLivestreamHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	userID, err := verifyUserSession(c)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
 	}
-	defer tx.Rollback()
 
-	if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_viewers_history WHERE user_id = ? AND livestream_id = ?", userID, livestreamID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream_view_history: "+err.Error())
+	livestreamID, err := parseInt64Param(c, "livestream_id")
+	if err != nil {
+		return err
 	}
 
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		// 累計視聴者数を数えられるよう、行は消さずに退出時刻を記録する
+		if _, err := tx.ExecContext(ctx, "UPDATE livestream_viewers_history SET left_at = ? WHERE user_id = ? AND livestream_id = ? AND left_at IS NULL", time.Now().Unix(), userID, livestreamID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream_view_history: "+err.Error())
+		}
+		return nil
+	}); err != nil {
+		return err
 	}
 
 	return c.NoContent(http.StatusOK)
@@ -402,13 +590,13 @@ func exitLivestreamHandler(c echo.Context) error {
 func getLivestreamHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
-	if err := verifyUserSession(c); err != nil {
+	if _, err := verifyUserSession(c); err != nil {
 		return err
 	}
 
-	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	livestreamID, err := parseInt64Param(c, "livestream_id")
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+		return err
 	}
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
@@ -431,6 +619,15 @@ func getLivestreamHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
 	}
 
+	// 詳細画面で統計情報も一度に取得できるようにする
+	if c.QueryParam("include_stats") == "1" {
+		stats, err := getLivestreamStatistics(ctx, tx, livestreamModel.ID, 0, true)
+		if err != nil {
+			return err
+		}
+		livestream.Statistics = &stats
+	}
+
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
@@ -441,13 +638,14 @@ func getLivestreamHandler(c echo.Context) error {
 func getLivecommentReportsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
-	if err := verifyUserSession(c); err != nil {
+	userID, err := verifyUserSession(c)
+	if err != nil {
 		return err
 	}
 
-	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	livestreamID, err := parseInt64Param(c, "livestream_id")
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+		return err
 	}
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
@@ -461,11 +659,6 @@ func getLivecommentReportsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
 	}
 
-	// error already check
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already check
-	userID := sess.Values[defaultUserIDKey].(int64)
-
 	if livestreamModel.UserID != userID {
 		return echo.NewHTTPError(http.StatusForbidden, "can't get other streamer's livecomment reports")
 	}
@@ -556,3 +749,49 @@ func fillLivestreamResponse(ctx context.Context, tx *sqlx.Tx, livestreamModel Li
 	}
 	return livestream, nil
 }
+
+// fillLivestreamsResponse は複数の配信をまとめて埋めます
+// 配信者は同じユーザーにつき一度だけ埋めます
+func fillLivestreamsResponse(ctx context.Context, tx *sqlx.Tx, livestreamModels []*LivestreamModel) ([]Livestream, error) {
+	// 配信者はまとめて埋める
+	var ownerModels []UserModel
+	seen := make(map[int64]struct{})
+	for _, livestreamModel := range livestreamModels {
+		if _, ok := seen[livestreamModel.UserID]; ok {
+			continue
+		}
+		seen[livestreamModel.UserID] = struct{}{}
+		ownerModel, err := getUser(ctx, tx, livestreamModel.UserID)
+		if err != nil {
+			return nil, err
+		}
+		ownerModels = append(ownerModels, ownerModel)
+	}
+	owners, err := fillUsersResponse(ctx, tx, ownerModels)
+	if err != nil {
+		return nil, err
+	}
+
+	livestreams := make([]Livestream, len(livestreamModels))
+	for i, livestreamModel := range livestreamModels {
+		owner := owners[livestreamModel.UserID]
+
+		livestreamTags, err := getLivestreamTags(ctx, tx, livestreamModel.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		livestreams[i] = Livestream{
+			ID:           livestreamModel.ID,
+			Owner:        owner,
+			Title:        livestreamModel.Title,
+			Tags:         livestreamTags,
+			Description:  livestreamModel.Description,
+			PlaylistUrl:  livestreamModel.PlaylistUrl,
+			ThumbnailUrl: livestreamModel.ThumbnailUrl,
+			StartAt:      livestreamModel.StartAt,
+			EndAt:        livestreamModel.EndAt,
+		}
+	}
+	return livestreams, nil
+}
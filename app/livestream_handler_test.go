@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+func callTestViewerHandler(t *testing.T, h echo.HandlerFunc, user UserModel, livestreamID int64) {
+	t.Helper()
+	id := strconv.FormatInt(livestreamID, 10)
+	c, rec := newTestContext(http.MethodPost, "/api/livestream/"+id, nil)
+	c.SetParamNames("livestream_id")
+	c.SetParamValues(id)
+	if err := serveWithSession(c, user, h); err != nil {
+		t.Fatalf("handler: %+v", err)
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func getTestViewers(t *testing.T, livestreamID int64) (current, total int64) {
+	t.Helper()
+	var stats LivestreamStatistics
+	if err := withReadTx(context.Background(), func(tx *sqlx.Tx) error {
+		var err error
+		stats, err = getLivestreamStatistics(context.Background(), tx, livestreamID, 0, false)
+		return err
+	}); err != nil {
+		t.Fatalf("getLivestreamStatistics: %+v", err)
+	}
+	return stats.ViewersCount, stats.TotalViewers
+}
+
+// 入室で現在と累計の視聴者数が増え、退出では現在の視聴者数だけが減る
+func TestEnterAndLeaveLivestream(t *testing.T) {
+	setupIntegration(t)
+	owner := createTestUser(t)
+	alice := createTestUser(t)
+	bob := createTestUser(t)
+	livestream := createTestLivestream(t, owner.ID)
+
+	for _, step := range []struct {
+		name        string
+		handler     echo.HandlerFunc
+		user        UserModel
+		wantCurrent int64
+		wantTotal   int64
+	}{
+		{"alice enters", enterLivestreamHandler, alice, 1, 1},
+		{"bob enters", enterLivestreamHandler, bob, 2, 2},
+		{"alice leaves", exitLivestreamHandler, alice, 1, 2},
+		{"alice leaves again", exitLivestreamHandler, alice, 1, 2},
+		{"alice comes back", enterLivestreamHandler, alice, 2, 3},
+		{"bob leaves", exitLivestreamHandler, bob, 1, 3},
+	} {
+		callTestViewerHandler(t, step.handler, step.user, livestream.ID)
+		current, total := getTestViewers(t, livestream.ID)
+		if current != step.wantCurrent || total != step.wantTotal {
+			t.Fatalf("%s: viewers = (current %d, total %d), want (current %d, total %d)", step.name, current, total, step.wantCurrent, step.wantTotal)
+		}
+	}
+}
+
+func getTestLivestream(t *testing.T, viewer UserModel, livestreamID int64, query string) (Livestream, error) {
+	t.Helper()
+	id := strconv.FormatInt(livestreamID, 10)
+	c, rec := newTestContext(http.MethodGet, "/api/livestream/"+id+"?"+query, nil)
+	c.SetParamNames("livestream_id")
+	c.SetParamValues(id)
+	if err := serveWithSession(c, viewer, getLivestreamHandler); err != nil {
+		return Livestream{}, err
+	}
+	var livestream Livestream
+	if err := json.Unmarshal(rec.Body.Bytes(), &livestream); err != nil {
+		t.Fatalf("failed to decode response: %+v", err)
+	}
+	return livestream, nil
+}
+
+// 1件の配信を、タグ・配信者・統計まで埋めて返す
+func TestGetLivestreamDetails(t *testing.T) {
+	setupIntegration(t)
+	ctx := context.Background()
+	owner := createTestUser(t)
+	viewer := createTestUser(t)
+	seeded := createTestLivestream(t, owner.ID)
+	var tag Tag
+	if err := dbConn.GetContext(ctx, &tag, "SELECT * FROM tags ORDER BY id LIMIT 1"); err != nil {
+		t.Fatalf("failed to get tag: %+v", err)
+	}
+	if _, err := dbConn.ExecContext(ctx, "INSERT INTO livestream_tags (livestream_id, tag_id) VALUES (?, ?)", seeded.ID, tag.ID); err != nil {
+		t.Fatalf("failed to insert livestream tag: %+v", err)
+	}
+	createTestReaction(t, viewer.ID, seeded.ID, "heart", time.Now().Unix())
+
+	livestream, err := getTestLivestream(t, viewer, seeded.ID, "include_stats=1")
+	if err != nil {
+		t.Fatalf("getLivestreamHandler: %+v", err)
+	}
+	if livestream.ID != seeded.ID || livestream.Title != seeded.Title || livestream.Description != seeded.Description ||
+		livestream.StartAt != seeded.StartAt || livestream.EndAt != seeded.EndAt {
+		t.Errorf("livestream = %+v, want the fields of %+v", livestream, seeded)
+	}
+	if livestream.Owner.ID != owner.ID || livestream.Owner.Name != owner.Name {
+		t.Errorf("owner = %+v, want %s", livestream.Owner, owner.Name)
+	}
+	if len(livestream.Tags) != 1 || livestream.Tags[0] != tag {
+		t.Errorf("tags = %+v, want [%+v]", livestream.Tags, tag)
+	}
+	if livestream.Statistics == nil {
+		t.Fatal("statistics is missing")
+	}
+	if livestream.Statistics.TotalReactions != 1 || livestream.Statistics.Rank < 1 {
+		t.Errorf("statistics = %+v, want 1 reaction and a rank", *livestream.Statistics)
+	}
+}
+
+func TestGetLivestreamNotFound(t *testing.T) {
+	setupIntegration(t)
+	viewer := createTestUser(t)
+	_, err := getTestLivestream(t, viewer, 1<<50, "")
+	var httpErr *echo.HTTPError
+	if !errors.As(err, &httpErr) || httpErr.Code != http.StatusNotFound {
+		t.Errorf("getLivestreamHandler = %v, want a 404 echo.HTTPError", err)
+	}
+}
+
+func getTestLivestreamsPage(t *testing.T, viewer UserModel, query url.Values) ([]LivestreamListEntry, string) {
+	t.Helper()
+	c, rec := newTestContext(http.MethodGet, "/api/livestreams?"+query.Encode(), nil)
+	if err := serveWithSession(c, viewer, getLivestreamsHandler); err != nil {
+		t.Fatalf("getLivestreamsHandler: %+v", err)
+	}
+	var entries []LivestreamListEntry
+	if err := json.Unmarshal(rec.Body.Bytes(), &entries); err != nil {
+		t.Fatalf("failed to decode response: %+v", err)
+	}
+	return entries, rec.Header().Get("X-Next-Cursor")
+}
+
+// collectTestLivestreams はカーソルを辿って n 件の配信を集めます
+func collectTestLivestreams(t *testing.T, viewer UserModel, sortBy string, n int) []LivestreamListEntry {
+	t.Helper()
+	var entries []LivestreamListEntry
+	query := url.Values{"sort": {sortBy}, "limit": {"2"}}
+	for len(entries) < n {
+		page, cursor := getTestLivestreamsPage(t, viewer, query)
+		entries = append(entries, page...)
+		if cursor == "" {
+			break
+		}
+		query.Set("cursor", cursor)
+	}
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries
+}
+
+// recent は開始時刻の新しい順に、ページをまたいでも漏れなく並ぶ
+func TestGetLivestreamsRecent(t *testing.T) {
+	setupIntegration(t)
+	ctx := context.Background()
+	owner := createTestUser(t)
+	// 既存のどの配信よりも新しくなるよう未来に開始させ、2件は同じ時刻にする
+	future := time.Now().Add(24 * time.Hour).Unix()
+	var want []int64
+	for i, offset := range []int64{0, 1, 1, 2, 3} {
+		livestream := createTestLivestream(t, owner.ID)
+		if _, err := dbConn.ExecContext(ctx, "UPDATE livestreams SET start_at = ?, end_at = ? WHERE id = ?", future+offset, future+offset+3600, livestream.ID); err != nil {
+			t.Fatalf("failed to update livestream %d: %+v", i, err)
+		}
+		want = append([]int64{livestream.ID}, want...)
+	}
+
+	entries := collectTestLivestreams(t, owner, "recent", len(want))
+	got := make([]int64, len(entries))
+	for i, entry := range entries {
+		got[i] = entry.ID
+		if entry.Owner.Name != owner.Name {
+			t.Errorf("entries[%d].owner.name = %q, want %q", i, entry.Owner.Name, owner.Name)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ids = %v, want %v", got, want)
+	}
+}
+
+// popular はスコアの高い順に、ページをまたいでも重複なく並ぶ
+func TestGetLivestreamsPopular(t *testing.T) {
+	setupIntegration(t)
+	owner := createTestUser(t)
+	viewer := createTestUser(t)
+	now := time.Now().Unix()
+	for i := 0; i < 3; i++ {
+		livestream := createTestLivestream(t, owner.ID)
+		for j := 0; j <= i; j++ {
+			createTestReaction(t, viewer.ID, livestream.ID, "heart", now)
+		}
+	}
+
+	entries := collectTestLivestreams(t, viewer, "popular", 6)
+	if len(entries) != 6 {
+		t.Fatalf("got %d livestreams, want 6", len(entries))
+	}
+	seen := make(map[int64]bool)
+	for i, entry := range entries {
+		if seen[entry.ID] {
+			t.Errorf("livestream %d appears twice", entry.ID)
+		}
+		seen[entry.ID] = true
+		if i == 0 {
+			continue
+		}
+		prev, cur := entries[i-1].TotalReactions+entries[i-1].TotalTip, entry.TotalReactions+entry.TotalTip
+		if cur > prev {
+			t.Errorf("entries[%d] score %d is above entries[%d] score %d", i, cur, i-1, prev)
+		}
+	}
+}
+
+// setTestReservationSlots は startAt から1時間ごとの枠の残りを counts にし、テスト後に元に戻します
+// 予約できるのは期間内の枠だけなので、初期データの枠を書き換えて使う
+func setTestReservationSlots(t *testing.T, startAt int64, counts ...int64) {
+	t.Helper()
+	ctx := context.Background()
+	endAt := startAt + int64(len(counts))*3600
+	var prev []ReservationSlotModel
+	if err := dbConn.SelectContext(ctx, &prev, "SELECT * FROM reservation_slots WHERE start_at >= ? AND end_at <= ?", startAt, endAt); err != nil {
+		t.Fatalf("failed to get reservation_slots: %+v", err)
+	}
+	if len(prev) != len(counts) {
+		t.Fatalf("found %d reservation slots from %d, want %d", len(prev), startAt, len(counts))
+	}
+	t.Cleanup(func() {
+		for _, slot := range prev {
+			dbConn.ExecContext(context.Background(), "UPDATE reservation_slots SET slot = ? WHERE id = ?", slot.Slot, slot.ID)
+		}
+	})
+	for i, count := range counts {
+		at := startAt + int64(i)*3600
+		if _, err := dbConn.ExecContext(ctx, "UPDATE reservation_slots SET slot = ? WHERE start_at = ?", count, at); err != nil {
+			t.Fatalf("failed to set reservation slot: %+v", err)
+		}
+	}
+}
+
+func reserveTestLivestream(t *testing.T, user UserModel, startAt, endAt int64) error {
+	t.Helper()
+	body, err := json.Marshal(ReserveLivestreamRequest{
+		Tags:         []int64{},
+		Title:        "test reservation",
+		PlaylistUrl:  "https://media.xiii.isucon.dev/api/4/playlist.m3u8",
+		ThumbnailUrl: "https://media.xiii.isucon.dev/isucon12_final.webp",
+		StartAt:      startAt,
+		EndAt:        endAt,
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal request: %+v", err)
+	}
+	c, _ := newTestContext(http.MethodPost, "/api/livestream/reservation", bytes.NewReader(body))
+	return serveWithSession(c, user, reserveLivestreamHandler)
+}
+
+// 予約の入った枠だけ残りが減り、範囲外の枠は返さない
+func TestGetReservationSlots(t *testing.T) {
+	setupIntegration(t)
+	user := createTestUser(t)
+	startAt := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC).Unix()
+	setTestReservationSlots(t, startAt, 3, 3, 1)
+	if err := reserveTestLivestream(t, user, startAt, startAt+3600); err != nil {
+		t.Fatalf("reserveLivestreamHandler: %+v", err)
+	}
+	if err := reserveTestLivestream(t, user, startAt+7200, startAt+10800); err != nil {
+		t.Fatalf("reserveLivestreamHandler: %+v", err)
+	}
+
+	query := url.Values{"start": {strconv.FormatInt(startAt, 10)}, "end": {strconv.FormatInt(startAt+10800, 10)}}
+	c, rec := newTestContext(http.MethodGet, "/api/livestream/reservation/slots?"+query.Encode(), nil)
+	if err := serveWithSession(c, user, getReservationSlotsHandler); err != nil {
+		t.Fatalf("getReservationSlotsHandler: %+v", err)
+	}
+	var got []ReservationSlotAvailability
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("failed to decode response: %+v", err)
+	}
+	want := []ReservationSlotAvailability{
+		{StartAt: startAt, EndAt: startAt + 3600, Remaining: 2},
+		{StartAt: startAt + 3600, EndAt: startAt + 7200, Remaining: 3},
+		{StartAt: startAt + 7200, EndAt: startAt + 10800, Remaining: 0},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("slots = %+v, want %+v", got, want)
+	}
+}
+
+func TestGetReservationSlotsInvalidRange(t *testing.T) {
+	user := UserModel{ID: 1<<40 + 12, Name: "test012"}
+	cacheTestUser(t, user)
+	for _, query := range []string{"start=x&end=3600", "start=0&end=x", "start=3600&end=3600", "start=7200&end=3600"} {
+		c, _ := newTestContext(http.MethodGet, "/api/livestream/reservation/slots?"+query, nil)
+		wantBadRequest(t, serveWithSession(c, user, getReservationSlotsHandler))
+	}
+}
+
+// 最後の1枠に同時に予約しても、成功するのは1件だけで枠は負にならない
+func TestReserveLivestreamLastSlotRace(t *testing.T) {
+	setupIntegration(t)
+	ctx := context.Background()
+	users := []UserModel{createTestUser(t), createTestUser(t)}
+	startAt := time.Date(2024, 6, 2, 0, 0, 0, 0, time.UTC).Unix()
+	setTestReservationSlots(t, startAt, 1)
+
+	errs := make([]error, len(users))
+	var wg sync.WaitGroup
+	for i, user := range users {
+		wg.Add(1)
+		go func(i int, user UserModel) {
+			defer wg.Done()
+			errs[i] = reserveTestLivestream(t, user, startAt, startAt+3600)
+		}(i, user)
+	}
+	wg.Wait()
+
+	succeeded := 0
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			succeeded++
+		case !isHTTPErrorCode(err, http.StatusBadRequest):
+			t.Errorf("reserveLivestreamHandler = %v, want nil or 400", err)
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("%d reservations succeeded for the last slot, want 1", succeeded)
+	}
+	var slot int64
+	if err := dbConn.GetContext(ctx, &slot, "SELECT slot FROM reservation_slots WHERE start_at = ?", startAt); err != nil {
+		t.Fatalf("failed to get reservation slot: %+v", err)
+	}
+	if slot != 0 {
+		t.Errorf("slot = %d, want 0", slot)
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+var dbLoadShed = expvar.NewInt("db_load_shed")
+
+// shedWhenDBBusy はDBの使用中のコネクションが dbShedInUse を超えている間、
+// 重い集計系のAPIを待たせずに503で返すミドルウェアです
+// 軽いAPIには付けないので、コネクションはそちらに回る
+func shedWhenDBBusy() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if dbShedInUse > 0 && dbConn.Stats().InUse > dbShedInUse {
+				dbLoadShed.Add(1)
+				c.Response().Header().Set("Retry-After", strconv.Itoa(int(dbShedRetryAfter/time.Second)))
+				return echo.NewHTTPError(http.StatusServiceUnavailable, "database is busy")
+			}
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// コネクションを掴んでプールを埋めると重いAPIは503で断り、空けば通す
+func TestShedWhenDBBusy(t *testing.T) {
+	prevDB, prevInUse, prevRetryAfter := dbConn, dbShedInUse, dbShedRetryAfter
+	t.Cleanup(func() { dbConn, dbShedInUse, dbShedRetryAfter = prevDB, prevInUse, prevRetryAfter })
+	dbConn = sqlx.NewDb(sql.OpenDB(fakeSlowConnector{}), "mysql")
+	t.Cleanup(func() { dbConn.Close() })
+	dbShedInUse = 1
+	dbShedRetryAfter = 3 * time.Second
+
+	called := 0
+	h := shedWhenDBBusy()(func(c echo.Context) error {
+		called++
+		return c.NoContent(http.StatusOK)
+	})
+
+	ctx := context.Background()
+	var conns []*sql.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := dbConn.Conn(ctx)
+		if err != nil {
+			t.Fatalf("failed to get conn: %+v", err)
+		}
+		conns = append(conns, conn)
+	}
+
+	before := dbLoadShed.Value()
+	c, rec := newTestContext(http.MethodGet, "/api/ranking/users", nil)
+	err := h(c)
+	if !isHTTPErrorCode(err, http.StatusServiceUnavailable) {
+		t.Fatalf("saturated pool: handler = %v, want %d", err, http.StatusServiceUnavailable)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "3" {
+		t.Errorf("Retry-After = %q, want %q", got, "3")
+	}
+	if called != 0 {
+		t.Error("the heavy handler ran while the pool was saturated")
+	}
+	if got := dbLoadShed.Value() - before; got != 1 {
+		t.Errorf("db_load_shed increased by %d, want 1", got)
+	}
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+	c, _ = newTestContext(http.MethodGet, "/api/ranking/users", nil)
+	if err := h(c); err != nil {
+		t.Fatalf("idle pool: handler = %+v", err)
+	}
+	if called != 1 {
+		t.Errorf("the heavy handler ran %d times, want 1", called)
+	}
+}
+
+// しきい値が0なら、どれだけ混んでいても断らない
+func TestShedWhenDBBusyDisabled(t *testing.T) {
+	prevInUse := dbShedInUse
+	dbShedInUse = 0
+	t.Cleanup(func() { dbShedInUse = prevInUse })
+
+	// 無効な場合は dbConn を見ない。見れば nil の dbConn で panic する
+	prevDB := dbConn
+	dbConn = nil
+	t.Cleanup(func() { dbConn = prevDB })
+
+	h := shedWhenDBBusy()(func(c echo.Context) error { return c.NoContent(http.StatusOK) })
+	c, _ := newTestContext(http.MethodGet, "/api/ranking/users", nil)
+	if err := h(c); err != nil {
+		t.Errorf("handler = %+v", err)
+	}
+}
@@ -4,13 +4,19 @@ package main
 // sqlx的な参考: https://jmoiron.github.io/sqlx/
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"runtime"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
@@ -20,6 +26,7 @@ import (
 	"github.com/gorilla/sessions"
 	echoInt "github.com/kaz/pprotein/integration/echov4"
 	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/gommon/bytes"
 	echolog "github.com/labstack/gommon/log"
 
 	"github.com/redis/go-redis/v9"
@@ -31,10 +38,55 @@ const (
 )
 
 var (
-	powerDNSSubdomainAddress string
-	dbConn                   *sqlx.DB
-	redisConn                *redis.Client
-	secret                   = []byte("isucon13_session_cookiestore_defaultsecret")
+	dbConn                *sqlx.DB
+	redisConn             *redis.Client
+	secret                = []byte("isucon13_session_cookiestore_defaultsecret")
+	sessionCookieDomain   = "u.isucon.local"
+	sessionCookieSecure   = true
+	sessionCookieSameSite = http.SameSiteLaxMode
+	// 0 より大きい場合はリアクションのINSERTをこの間隔でまとめる
+	reactionBatchInterval = time.Duration(0)
+	reactionBatchMaxSize  = 100
+	// 0 より大きい場合、同じユーザーが同じ配信に同じ絵文字を reactionRateWindow の間に投稿できる回数
+	reactionRateLimit  = 0
+	reactionRateWindow = 10 * time.Second
+	// アイコン変更時に残す過去のアイコンの件数 (0 なら残さない)
+	iconHistorySize = 0
+	// Redisに置いたアイコンのハッシュの有効期限
+	// DBだけ初期化された場合などに古いハッシュを返し続けないよう、無期限にはしない
+	iconHashTTL = 24 * time.Hour
+	// 0 より大きい場合はこの間隔で userCache とDBの差分を確かめる
+	userCacheAuditInterval = time.Duration(0)
+	// 1回の確認で比べるユーザー数
+	userCacheAuditSample = 10
+	// true の場合は差分のあったエントリをキャッシュから消す
+	userCacheAuditHeal = false
+	// 0 より大きい場合はこの間隔で退会済みユーザーのアイコンを消す
+	iconSweepInterval = time.Duration(0)
+	// リクエストボディの上限 (画像のアップロード以外)
+	maxBodySize = "1M"
+	// アップロードできる画像(アイコン・サムネイル)の上限バイト数
+	maxImageSize = 10 << 20
+	// 0 より大きい場合はこれより時間のかかったクエリをログに出す
+	slowQueryThreshold = time.Duration(0)
+	// 0 より大きい場合はユーザー統計をこの期間キャッシュする
+	userStatsCacheTTL = time.Duration(0)
+	// ヘルスチェックが503のときに返す Retry-After
+	healthRetryAfter = 5 * time.Second
+	// 0 より大きい場合、DBの使用中のコネクションがこれを超えている間は集計系のAPIが503を返す
+	dbShedInUse = 0
+	// 集計系のAPIが503のときに返す Retry-After
+	dbShedRetryAfter = 1 * time.Second
+	// 0 より大きい場合はこの間隔でログイン中のセッション数を数え直す
+	activeSessionsInterval = time.Duration(0)
+	// 登録時にテーマが省略された場合のダークモード
+	defaultDarkMode = false
+	// DNSレコードの追加に失敗したユーザーを入れ直す間隔 (0 なら再試行しない)
+	dnsRetryInterval = 5 * time.Second
+	// 0 より大きい場合はこの間隔でゾーンファイルのレコード数とユーザー数のずれを確かめる
+	dnsDriftInterval = time.Duration(0)
+	// 同時に実行する bcrypt の数の上限
+	bcryptConcurrency = runtime.GOMAXPROCS(0)
 )
 
 func init() {
@@ -42,6 +94,244 @@ func init() {
 	if secretKey, ok := os.LookupEnv("ISUCON13_SESSION_SECRETKEY"); ok {
 		secret = []byte(secretKey)
 	}
+	if token, ok := os.LookupEnv("ISUCON13_ADMIN_TOKEN"); ok {
+		adminToken = token
+	}
+	if v, ok := os.LookupEnv("ISUCON13_REGISTRATION_CLOSED"); ok {
+		closed, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("failed to parse environment variable 'ISUCON13_REGISTRATION_CLOSED' as bool: %+v", err)
+		}
+		registrationClosed.Store(closed)
+	}
+	if domain, ok := os.LookupEnv("ISUCON13_SESSION_COOKIE_DOMAIN"); ok {
+		sessionCookieDomain = domain
+	}
+	// ローカルでHTTPのまま動作確認する場合は false にする
+	if v, ok := os.LookupEnv("ISUCON13_SESSION_COOKIE_SECURE"); ok {
+		secure, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("failed to parse environment variable 'ISUCON13_SESSION_COOKIE_SECURE' as bool: %+v", err)
+		}
+		sessionCookieSecure = secure
+	}
+	if v, ok := os.LookupEnv("ISUCON13_REACTION_BATCH_INTERVAL_MS"); ok {
+		ms, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("failed to parse environment variable 'ISUCON13_REACTION_BATCH_INTERVAL_MS' as int: %+v", err)
+		}
+		reactionBatchInterval = time.Duration(ms) * time.Millisecond
+	}
+	if v, ok := os.LookupEnv("ISUCON13_REACTION_BATCH_MAX_SIZE"); ok {
+		size, err := strconv.Atoi(v)
+		if err != nil || size < 1 {
+			log.Fatalf("environment variable 'ISUCON13_REACTION_BATCH_MAX_SIZE' must be a positive integer: %q", v)
+		}
+		reactionBatchMaxSize = size
+	}
+	loadFeatureFlags()
+	if v, ok := os.LookupEnv("ISUCON13_REACTION_RATE_LIMIT"); ok {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			log.Fatalf("environment variable 'ISUCON13_REACTION_RATE_LIMIT' must be a non-negative integer: %q", v)
+		}
+		reactionRateLimit = limit
+	}
+	if v, ok := os.LookupEnv("ISUCON13_REACTION_RATE_WINDOW_MS"); ok {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms < 1 {
+			log.Fatalf("environment variable 'ISUCON13_REACTION_RATE_WINDOW_MS' must be a positive integer: %q", v)
+		}
+		reactionRateWindow = time.Duration(ms) * time.Millisecond
+	}
+	if v, ok := os.LookupEnv("ISUCON13_ICON_HISTORY_SIZE"); ok {
+		size, err := strconv.Atoi(v)
+		if err != nil || size < 0 {
+			log.Fatalf("environment variable 'ISUCON13_ICON_HISTORY_SIZE' must be a non-negative integer: %q", v)
+		}
+		iconHistorySize = size
+	}
+	if v, ok := os.LookupEnv("ISUCON13_ICON_HASH_TTL_SECONDS"); ok {
+		sec, err := strconv.Atoi(v)
+		if err != nil || sec < 1 {
+			log.Fatalf("environment variable 'ISUCON13_ICON_HASH_TTL_SECONDS' must be a positive integer: %q", v)
+		}
+		iconHashTTL = time.Duration(sec) * time.Second
+	}
+	if v, ok := os.LookupEnv("ISUCON13_USER_CACHE_AUDIT_INTERVAL_MS"); ok {
+		ms, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("failed to parse environment variable 'ISUCON13_USER_CACHE_AUDIT_INTERVAL_MS' as int: %+v", err)
+		}
+		userCacheAuditInterval = time.Duration(ms) * time.Millisecond
+	}
+	if v, ok := os.LookupEnv("ISUCON13_USER_CACHE_AUDIT_SAMPLE"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatalf("environment variable 'ISUCON13_USER_CACHE_AUDIT_SAMPLE' must be a positive integer: %q", v)
+		}
+		userCacheAuditSample = n
+	}
+	if v, ok := os.LookupEnv("ISUCON13_USER_CACHE_AUDIT_HEAL"); ok {
+		heal, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("failed to parse environment variable 'ISUCON13_USER_CACHE_AUDIT_HEAL' as bool: %+v", err)
+		}
+		userCacheAuditHeal = heal
+	}
+	if v, ok := os.LookupEnv("ISUCON13_ICON_SWEEP_INTERVAL_MS"); ok {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms < 0 {
+			log.Fatalf("environment variable 'ISUCON13_ICON_SWEEP_INTERVAL_MS' must be a non-negative integer: %q", v)
+		}
+		iconSweepInterval = time.Duration(ms) * time.Millisecond
+	}
+	if v, ok := os.LookupEnv("ISUCON13_MAX_BODY_SIZE"); ok {
+		if _, err := bytes.Parse(v); err != nil {
+			log.Fatalf("failed to parse environment variable 'ISUCON13_MAX_BODY_SIZE' as size: %+v", err)
+		}
+		maxBodySize = v
+	}
+	if v, ok := os.LookupEnv("ISUCON13_MAX_IMAGE_SIZE_BYTES"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatalf("environment variable 'ISUCON13_MAX_IMAGE_SIZE_BYTES' must be a positive integer: %q", v)
+		}
+		maxImageSize = n
+	}
+	if v, ok := os.LookupEnv("ISUCON13_SLOW_QUERY_THRESHOLD_MS"); ok {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms < 0 {
+			log.Fatalf("environment variable 'ISUCON13_SLOW_QUERY_THRESHOLD_MS' must be a non-negative integer: %q", v)
+		}
+		slowQueryThreshold = time.Duration(ms) * time.Millisecond
+	}
+	if v, ok := os.LookupEnv("ISUCON13_USER_STATS_CACHE_TTL_MS"); ok {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms < 0 {
+			log.Fatalf("environment variable 'ISUCON13_USER_STATS_CACHE_TTL_MS' must be a non-negative integer: %q", v)
+		}
+		userStatsCacheTTL = time.Duration(ms) * time.Millisecond
+	}
+	if v, ok := os.LookupEnv("ISUCON13_HEALTHZ_RETRY_AFTER_SECONDS"); ok {
+		sec, err := strconv.Atoi(v)
+		if err != nil || sec < 1 {
+			log.Fatalf("environment variable 'ISUCON13_HEALTHZ_RETRY_AFTER_SECONDS' must be a positive integer: %q", v)
+		}
+		healthRetryAfter = time.Duration(sec) * time.Second
+	}
+	if v, ok := os.LookupEnv("ISUCON13_DB_SHED_IN_USE"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("environment variable 'ISUCON13_DB_SHED_IN_USE' must be a non-negative integer: %q", v)
+		}
+		dbShedInUse = n
+	}
+	if v, ok := os.LookupEnv("ISUCON13_DB_SHED_RETRY_AFTER_SECONDS"); ok {
+		sec, err := strconv.Atoi(v)
+		if err != nil || sec < 1 {
+			log.Fatalf("environment variable 'ISUCON13_DB_SHED_RETRY_AFTER_SECONDS' must be a positive integer: %q", v)
+		}
+		dbShedRetryAfter = time.Duration(sec) * time.Second
+	}
+	if v, ok := os.LookupEnv("ISUCON13_ACTIVE_SESSIONS_INTERVAL_MS"); ok {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms < 0 {
+			log.Fatalf("environment variable 'ISUCON13_ACTIVE_SESSIONS_INTERVAL_MS' must be a non-negative integer: %q", v)
+		}
+		activeSessionsInterval = time.Duration(ms) * time.Millisecond
+	}
+	if v, ok := os.LookupEnv("ISUCON13_DEFAULT_DARK_MODE"); ok {
+		darkMode, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("failed to parse environment variable 'ISUCON13_DEFAULT_DARK_MODE' as bool: %+v", err)
+		}
+		defaultDarkMode = darkMode
+	}
+	if v, ok := os.LookupEnv("ISUCON13_DNS_RETRY_INTERVAL_MS"); ok {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms < 0 {
+			log.Fatalf("environment variable 'ISUCON13_DNS_RETRY_INTERVAL_MS' must be a non-negative integer: %q", v)
+		}
+		dnsRetryInterval = time.Duration(ms) * time.Millisecond
+	}
+	if v, ok := os.LookupEnv("ISUCON13_DNS_DRIFT_INTERVAL_MS"); ok {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms < 0 {
+			log.Fatalf("environment variable 'ISUCON13_DNS_DRIFT_INTERVAL_MS' must be a non-negative integer: %q", v)
+		}
+		dnsDriftInterval = time.Duration(ms) * time.Millisecond
+	}
+	if v, ok := os.LookupEnv("ISUCON13_BCRYPT_CONCURRENCY"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatalf("environment variable 'ISUCON13_BCRYPT_CONCURRENCY' must be a positive integer: %q", v)
+		}
+		bcryptConcurrency = n
+	}
+	bcryptSem = make(chan struct{}, bcryptConcurrency)
+	if v, ok := os.LookupEnv("ISUCON13_USER_CACHE_SIZE"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("environment variable 'ISUCON13_USER_CACHE_SIZE' must be a non-negative integer: %q", v)
+		}
+		userCache.SetLimit(n)
+	}
+	if v, ok := os.LookupEnv("ISUCON13_USER_STALE_CACHE_SIZE"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("environment variable 'ISUCON13_USER_STALE_CACHE_SIZE' must be a non-negative integer: %q", v)
+		}
+		userStaleCache.SetLimit(n)
+	}
+	if v, ok := os.LookupEnv("ISUCON13_ICON_IMAGE_CACHE_BYTES"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("environment variable 'ISUCON13_ICON_IMAGE_CACHE_BYTES' must be a non-negative integer: %q", v)
+		}
+		iconImageCache.SetMaxBytes(n)
+	}
+	if v, ok := os.LookupEnv("ISUCON13_SESSION_COOKIE_SAMESITE"); ok {
+		sameSite, err := parseSameSite(v)
+		if err != nil {
+			log.Fatalf("failed to parse environment variable 'ISUCON13_SESSION_COOKIE_SAMESITE': %+v", err)
+		}
+		sessionCookieSameSite = sameSite
+	}
+}
+
+// imageBodyLimit は画像アップロードのリクエストボディの上限です
+// 画像はJSONの中で base64 になり 4/3 倍に膨らむので、その分とJSONの他の部分の余裕を足す
+func imageBodyLimit() string {
+	return strconv.Itoa((maxImageSize+2)/3*4 + 4096)
+}
+
+// imageUploadPaths は imageBodyLimit を適用するルートです
+var imageUploadPaths = map[string]bool{
+	"/api/icon": true,
+	"/api/livestream/:livestream_id/thumbnail": true,
+}
+
+// bodyLimitMiddleware は巨大なボディでメモリを使い切らないよう、読み込む前に上限を超えたら 413 を返します
+// 画像のアップロードはルートごとに imageBodyLimit を設定する
+func bodyLimitMiddleware() echo.MiddlewareFunc {
+	return middleware.BodyLimitWithConfig(middleware.BodyLimitConfig{
+		Skipper: func(c echo.Context) bool { return imageUploadPaths[c.Path()] },
+		Limit:   maxBodySize,
+	})
+}
+
+func parseSameSite(v string) (http.SameSite, error) {
+	switch strings.ToLower(v) {
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	default:
+		return http.SameSiteDefaultMode, fmt.Errorf("unknown SameSite value %q", v)
+	}
 }
 
 type InitializeResponse struct {
@@ -49,57 +339,21 @@ type InitializeResponse struct {
 }
 
 func connectDB(logger echo.Logger) (*sqlx.DB, error) {
-	const (
-		networkTypeEnvKey = "ISUCON13_MYSQL_DIALCONFIG_NET"
-		addrEnvKey        = "ISUCON13_MYSQL_DIALCONFIG_ADDRESS"
-		portEnvKey        = "ISUCON13_MYSQL_DIALCONFIG_PORT"
-		userEnvKey        = "ISUCON13_MYSQL_DIALCONFIG_USER"
-		passwordEnvKey    = "ISUCON13_MYSQL_DIALCONFIG_PASSWORD"
-		dbNameEnvKey      = "ISUCON13_MYSQL_DIALCONFIG_DATABASE"
-		parseTimeEnvKey   = "ISUCON13_MYSQL_DIALCONFIG_PARSETIME"
-	)
-
-	conf := mysql.NewConfig()
-
-	// 環境変数がセットされていなかった場合でも一旦動かせるように、デフォルト値を入れておく
-	// この挙動を変更して、エラーを出すようにしてもいいかもしれない
-	conf.Net = "tcp"
-	conf.Addr = net.JoinHostPort("127.0.0.1", "3306")
-	conf.User = "isucon"
-	conf.Passwd = "isucon"
-	conf.DBName = "isupipe"
-	conf.ParseTime = true
-
-	if v, ok := os.LookupEnv(networkTypeEnvKey); ok {
-		conf.Net = v
-	}
-	if addr, ok := os.LookupEnv(addrEnvKey); ok {
-		if port, ok2 := os.LookupEnv(portEnvKey); ok2 {
-			conf.Addr = net.JoinHostPort(addr, port)
-		} else {
-			conf.Addr = net.JoinHostPort(addr, "3306")
-		}
-	}
-	if v, ok := os.LookupEnv(userEnvKey); ok {
-		conf.User = v
-	}
-	if v, ok := os.LookupEnv(passwordEnvKey); ok {
-		conf.Passwd = v
-	}
-	if v, ok := os.LookupEnv(dbNameEnvKey); ok {
-		conf.DBName = v
-	}
-	if v, ok := os.LookupEnv(parseTimeEnvKey); ok {
-		parseTime, err := strconv.ParseBool(v)
+	conf := config.MySQL.Clone()
+
+	var db *sqlx.DB
+	if slowQueryThreshold > 0 {
+		connector, err := mysql.NewConnector(conf)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse environment variable '%s' as bool: %+v", parseTimeEnvKey, err)
+			return nil, err
+		}
+		db = sqlx.NewDb(sql.OpenDB(slowQueryConnector{connector: connector}), "mysql")
+	} else {
+		var err error
+		db, err = sqlx.Open("mysql", conf.FormatDSN())
+		if err != nil {
+			return nil, err
 		}
-		conf.ParseTime = parseTime
-	}
-
-	db, err := sqlx.Open("mysql", conf.FormatDSN())
-	if err != nil {
-		return nil, err
 	}
 	db.SetMaxOpenConns(10)
 
@@ -111,18 +365,8 @@ func connectDB(logger echo.Logger) (*sqlx.DB, error) {
 }
 
 func connectRedis(logger echo.Logger) (*redis.Client, error) {
-	const (
-		redisAddrEnvKey = "ISUCON13_REDIS_DIALCONFIG_ADDRESS"
-	)
-
-	redisAddr := "127.0.0.1:6379"
-
-	// if v, ok := os.LookupEnv(redisAddrEnvKey); ok {
-	// 	redisAddr = v
-	// }
-
 	rdb := redis.NewClient(&redis.Options{
-		Addr:     redisAddr,
+		Addr:     config.RedisAddr,
 		Password: "", // no password set
 		DB:       0,  // use default DB
 	})
@@ -136,6 +380,17 @@ func initializeHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to initialize: "+err.Error())
 	}
 
+	if err := migrateSchema(c.Request().Context()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to migrate schema: "+err.Error())
+	}
+	// init.sh が作り直さないアプリ側のテーブルは、配信IDが振り直されるので中身を消す
+	if _, err := dbConn.ExecContext(c.Request().Context(), "TRUNCATE TABLE livestream_thumbnails"); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to truncate livestream_thumbnails: "+err.Error())
+	}
+	if _, err := dbConn.ExecContext(c.Request().Context(), "TRUNCATE TABLE reaction_dedup_keys"); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to truncate reaction_dedup_keys: "+err.Error())
+	}
+
 	// pprotein
 	go func() {
 		if _, err := http.Get("http://localhost:9000/api/group/collect"); err != nil {
@@ -145,14 +400,47 @@ func initializeHandler(c echo.Context) error {
 
 	themeCache.m = make(map[int64]ThemeModel)
 	livestreamTagsCache.m = make(map[int64][]Tag)
-	userCache.m = make(map[int64]UserModel)
+	userCache.Reset()
+	userStaleCache.Reset()
+	iconImageCache.Reset()
+	reportCountCache.m = make(map[int64]reportCountCacheEntry)
+	userStatsCache.Lock()
+	userStatsCache.m = make(map[int64]userStatsCacheEntry)
+	userStatsCache.Unlock()
+	userTotalsCache.Lock()
+	userTotalsCache.m = make(map[int64]userTotals)
+	userTotalsCache.invalidatedAt = make(map[int64]uint64)
+	userTotalsCache.Unlock()
+	userRankingState.Lock()
+	userRankingState.lastGood, userRankingState.hasGood, userRankingState.lastErr = nil, false, nil
+	userRankingState.Unlock()
+	userRankingBlobCache.Lock()
+	userRankingBlobCache.blob = nil
+	userRankingBlobCache.Unlock()
+	favoriteEmojiCache.Lock()
+	favoriteEmojiCache.m = make(map[int64]string)
+	favoriteEmojiCache.invalidatedAt = make(map[int64]uint64)
+	favoriteEmojiCache.Unlock()
+	userIDByNameCache.Range(func(key, _ interface{}) bool {
+		userIDByNameCache.Delete(key)
+		return true
+	})
 
 	ctx := c.Request().Context()
-	err := redisConn.FlushAll(ctx).Err()
+	err := flushRedisKeys(ctx, redisKeyPrefix)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to initialize redis: "+err.Error())
 	}
 
+	if features.RedisRanking {
+		if err := rebuildUserScores(ctx); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to rebuild user scores: "+err.Error())
+		}
+		if err := rebuildLivestreamScores(ctx); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to rebuild livestream scores: "+err.Error())
+		}
+	}
+
 	c.Request().Header.Add("Content-Type", "application/json;charset=utf-8")
 	return c.JSON(http.StatusOK, InitializeResponse{
 		Language: "golang",
@@ -163,11 +451,27 @@ func main() {
 	e := echo.New()
 	e.Debug = true
 	e.Logger.SetLevel(echolog.DEBUG)
+
+	// 接続先などの設定は、足りないものや不正なものをまとめて出してから終了する
+	cfg, err := loadConfig()
+	if err != nil {
+		e.Logger.Errorf("invalid configuration:\n%v", err)
+		os.Exit(1)
+	}
+	config = cfg
+
+	if err := loadFallbackImage(); err != nil {
+		e.Logger.Warnf("failed to load fallback image; serving it from the file: %v", err)
+	}
+
 	e.Use(middleware.Logger())
+	e.JSONSerializer = jsonSerializer{}
+	e.Logger.Infof("json library: %s", jsonLibrary)
 	cookieStore := sessions.NewCookieStore(secret)
-	cookieStore.Options.Domain = "*.u.isucon.local"
+	cookieStore.Options.Domain = "*." + sessionCookieDomain
 	e.Use(session.Middleware(cookieStore))
 	// e.Use(middleware.Recover())
+	e.Use(bodyLimitMiddleware())
 
 	echoInt.Integrate(e)
 
@@ -181,18 +485,31 @@ func main() {
 	// livestream
 	// reserve livestream
 	e.POST("/api/livestream/reservation", reserveLivestreamHandler)
+	// 1時間ごとの予約枠の残数
+	e.GET("/api/livestream/reservation/slots", getReservationSlotsHandler)
 	// list livestream
 	e.GET("/api/livestream/search", searchLivestreamsHandler)
+	// 全配信の一覧 (新着順・人気順)
+	e.GET("/api/livestreams", getLivestreamsHandler)
 	e.GET("/api/livestream", getMyLivestreamsHandler)
 	e.GET("/api/user/:username/livestream", getUserLivestreamsHandler)
 	// get livestream
 	e.GET("/api/livestream/:livestream_id", getLivestreamHandler)
+	// 配信サムネイル
+	e.GET("/api/livestream/:livestream_id/thumbnail", getThumbnailHandler)
+	e.POST("/api/livestream/:livestream_id/thumbnail", postThumbnailHandler, middleware.BodyLimit(imageBodyLimit()))
 	// get polling livecomment timeline
 	e.GET("/api/livestream/:livestream_id/livecomment", getLivecommentsHandler)
+	e.GET("/api/livestream/:livestream_id/livecomments/stream", getLivecommentStreamHandler)
+	// 全配信の最新ライブコメント
+	e.GET("/api/livecomments/recent", getRecentLivecommentsHandler)
 	// ライブコメント投稿
 	e.POST("/api/livestream/:livestream_id/livecomment", postLivecommentHandler)
 	e.POST("/api/livestream/:livestream_id/reaction", postReactionHandler)
 	e.GET("/api/livestream/:livestream_id/reaction", getReactionsHandler)
+	e.GET("/api/livestream/:livestream_id/reactions", getReactionsByEmojiHandler)
+	e.GET("/api/livestream/:livestream_id/top-reactors", getTopReactorsHandler)
+	e.GET("/api/livestream/:livestream_id/top-tippers", getTopTippersHandler)
 
 	// (配信者向け)ライブコメントの報告一覧取得API
 	e.GET("/api/livestream/:livestream_id/report", getLivecommentReportsHandler)
@@ -207,24 +524,53 @@ func main() {
 	e.POST("/api/livestream/:livestream_id/enter", enterLivestreamHandler)
 	// ユーザ視聴終了 (viewer)
 	e.DELETE("/api/livestream/:livestream_id/exit", exitLivestreamHandler)
+	e.POST("/api/livestream/:livestream_id/leave", exitLivestreamHandler)
 
 	// user
 	e.POST("/api/register", registerHandler)
+	e.POST("/api/register/batch", registerBatchHandler)
 	e.POST("/api/login", loginHandler)
+	e.GET("/api/session", getSessionHandler)
 	e.GET("/api/user/me", getMeHandler)
+	e.DELETE("/api/user/me", deleteMeHandler)
+	e.PATCH("/api/user", patchUserHandler)
+	e.PATCH("/api/user/name", patchUserNameHandler)
+	e.GET("/api/user/me/reactions", getMyReactionsHandler)
+	e.GET("/api/user/me/reactions/count", getMyReactionCountHandler)
+	e.GET("/api/user/me/notifications", getMyNotificationsHandler)
 	// フロントエンドで、配信予約のコラボレーターを指定する際に必要
 	e.GET("/api/user/:username", getUserHandler)
-	e.GET("/api/user/:username/statistics", getUserStatisticsHandler)
+	e.GET("/api/user/:username/statistics", getUserStatisticsHandler, shedWhenDBBusy(), observeLatency(userStatisticsLatency))
 	e.GET("/api/user/:username/icon", getIconHandler)
-	e.POST("/api/icon", postIconHandler)
+	e.GET("/api/user/:username/icons", getIconHistoryHandler)
+	e.POST("/api/icon", postIconHandler, middleware.BodyLimit(imageBodyLimit()))
+	// 複数ユーザーの統計情報をまとめて取得
+	e.POST("/api/users/stats", postUsersStatisticsHandler, shedWhenDBBusy())
 
 	// stats
 	// ライブ配信統計情報
-	e.GET("/api/livestream/:livestream_id/statistics", getLivestreamStatisticsHandler)
+	e.GET("/api/livestream/:livestream_id/statistics", getLivestreamStatisticsHandler, shedWhenDBBusy())
+	// 全体で人気の絵文字
+	e.GET("/api/stats/emoji/top", getTopEmojiHandler, shedWhenDBBusy())
+	// ユーザーランキング
+	e.GET("/api/ranking/users", getUserRankingHandler, shedWhenDBBusy())
 
 	// 課金情報
 	e.GET("/api/payment", GetPaymentResult)
 
+	// メトリクス
+	e.GET("/api/metrics", metricsHandler)
+	// ヘルスチェック
+	e.GET("/api/healthz", healthzHandler)
+
+	// 管理者用
+	e.POST("/api/admin/icons/rehash", rehashIconsHandler)
+	e.GET("/api/admin/dns/:username", getDNSRecordHandler)
+	e.GET("/api/debug/cache", getDebugCacheHandler)
+	e.GET("/api/admin/registration", getRegistrationHandler)
+	e.PUT("/api/admin/registration", putRegistrationHandler)
+	e.GET("/api/admin/reports", getReportsByReporterHandler)
+
 	e.HTTPErrorHandler = errorResponseHandler
 
 	// DB接続
@@ -236,6 +582,11 @@ func main() {
 	defer conn.Close()
 	dbConn = conn
 
+	if err := migrateSchema(context.Background()); err != nil {
+		e.Logger.Errorf("failed to migrate schema: %v", err)
+		os.Exit(1)
+	}
+
 	// Redis接続
 	rdbConn, err := connectRedis(e.Logger)
 	if err != nil {
@@ -245,12 +596,41 @@ func main() {
 	defer rdbConn.Close()
 	redisConn = rdbConn
 
-	subdomainAddr, ok := os.LookupEnv(powerDNSSubdomainAddressEnvKey)
-	if !ok {
-		e.Logger.Errorf("environ %s must be provided", powerDNSSubdomainAddressEnvKey)
-		os.Exit(1)
+	// Redis だけ再起動した場合などに sorted set が無ければ作り直す
+	if features.RedisRanking {
+		if err := ensureUserScores(context.Background()); err != nil {
+			e.Logger.Errorf("failed to rebuild user scores: %v", err)
+			os.Exit(1)
+		}
+		if err := ensureLivestreamScores(context.Background()); err != nil {
+			e.Logger.Errorf("failed to rebuild livestream scores: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	if reactionBatchInterval > 0 {
+		reactionBatchWriter = newReactionBatcher(reactionBatchMaxSize, reactionBatchInterval)
+	}
+
+	if userCacheAuditInterval > 0 {
+		startUserCacheAuditor(userCacheAuditInterval, userCacheAuditSample, userCacheAuditHeal)
+	}
+
+	if iconSweepInterval > 0 {
+		startIconSweeper(iconSweepInterval)
+	}
+
+	if activeSessionsInterval > 0 {
+		startActiveSessionsSampler(activeSessionsInterval)
+	}
+
+	if dnsRetryInterval > 0 {
+		startDNSRetrier(dnsRetryInterval)
+	}
+
+	if dnsDriftInterval > 0 {
+		startDNSDriftChecker(dnsDriftInterval)
 	}
-	powerDNSSubdomainAddress = subdomainAddr
 
 	// HTTPサーバ起動
 	listenAddr := net.JoinHostPort("", strconv.Itoa(listenPort))
@@ -262,12 +642,24 @@ func main() {
 
 type ErrorResponse struct {
 	Error string `json:"error"`
+	// Code はクライアントが失敗理由で分岐するための識別子 (セッション関連のみ)
+	Code string `json:"code,omitempty"`
+}
+
+func errorCode(err error) string {
+	switch {
+	case errors.Is(err, errSessionExpired):
+		return errSessionExpired.Error()
+	case errors.Is(err, errSessionMissing):
+		return errSessionMissing.Error()
+	}
+	return ""
 }
 
 func errorResponseHandler(err error, c echo.Context) {
 	c.Logger().Errorf("error at %s: %+v", c.Path(), err)
 	if he, ok := err.(*echo.HTTPError); ok {
-		if e := c.JSON(he.Code, &ErrorResponse{Error: err.Error()}); e != nil {
+		if e := c.JSON(he.Code, &ErrorResponse{Error: err.Error(), Code: errorCode(err)}); e != nil {
 			c.Logger().Errorf("%+v", e)
 		}
 		return
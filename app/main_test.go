@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+func TestParseSameSite(t *testing.T) {
+	for _, tt := range []struct {
+		value string
+		want  http.SameSite
+	}{
+		{"lax", http.SameSiteLaxMode},
+		{"strict", http.SameSiteStrictMode},
+		{"none", http.SameSiteNoneMode},
+	} {
+		got, err := parseSameSite(tt.value)
+		if err != nil {
+			t.Errorf("parseSameSite(%q): %+v", tt.value, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseSameSite(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+	if _, err := parseSameSite("bogus"); err == nil {
+		t.Error("parseSameSite accepted an unknown value")
+	}
+}
+
+func newTestBodyLimitServer() *echo.Echo {
+	e := echo.New()
+	e.Use(bodyLimitMiddleware())
+	readAll := func(c echo.Context) error {
+		if _, err := io.ReadAll(c.Request().Body); err != nil {
+			return err
+		}
+		return c.NoContent(http.StatusOK)
+	}
+	e.POST("/api/register", readAll)
+	e.POST("/api/icon", readAll, middleware.BodyLimit(imageBodyLimit()))
+	return e
+}
+
+// 上限を超えるボディは 413 で弾き、画像のアップロードは base64 で膨らんだ分まで受け付ける
+func TestBodyLimit(t *testing.T) {
+	prevBodySize, prevImageSize := maxBodySize, maxImageSize
+	maxBodySize, maxImageSize = "1K", 4096
+	t.Cleanup(func() { maxBodySize, maxImageSize = prevBodySize, prevImageSize })
+	e := newTestBodyLimitServer()
+
+	iconBody := func(size int) []byte {
+		b, err := json.Marshal(PostIconRequest{Image: bytes.Repeat([]byte{0xff}, size)})
+		if err != nil {
+			t.Fatalf("failed to marshal icon request: %+v", err)
+		}
+		return b
+	}
+
+	for _, tt := range []struct {
+		name     string
+		path     string
+		body     []byte
+		wantCode int
+	}{
+		{"small body", "/api/register", bytes.Repeat([]byte("a"), 512), http.StatusOK},
+		{"oversized body", "/api/register", bytes.Repeat([]byte("a"), 2048), http.StatusRequestEntityTooLarge},
+		{"largest icon", "/api/icon", iconBody(maxImageSize), http.StatusOK},
+		{"oversized icon", "/api/icon", iconBody(2 * maxImageSize), http.StatusRequestEntityTooLarge},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tt.path, bytes.NewReader(tt.body))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+			if rec.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantCode)
+			}
+		})
+	}
+}
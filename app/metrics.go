@@ -0,0 +1,119 @@
+package main
+
+import (
+	"expvar"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// メトリクスは expvar で公開し、GET /api/metrics で確認できる
+// (/debug/* は pprotein が使っているので避ける)
+
+var defaultLatencyBuckets = []time.Duration{
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+}
+
+// latencyHistogram はバケット単位でレイテンシを数えるヒストグラムです
+// パーセンタイルはサンプルが入ったバケットの上限値で近似します
+type latencyHistogram struct {
+	mu     sync.Mutex
+	bounds []time.Duration
+	counts []int64 // 最後の要素は最大のバケットを超えたもの
+	count  int64
+	sum    time.Duration
+}
+
+func newLatencyHistogram(name string, bounds []time.Duration) *latencyHistogram {
+	h := &latencyHistogram{
+		bounds: bounds,
+		counts: make([]int64, len(bounds)+1),
+	}
+	expvar.Publish(name, expvar.Func(h.snapshot))
+	return h
+}
+
+func (h *latencyHistogram) Observe(d time.Duration) {
+	i := sort.Search(len(h.bounds), func(i int) bool { return d <= h.bounds[i] })
+
+	h.mu.Lock()
+	h.counts[i]++
+	h.count++
+	h.sum += d
+	h.mu.Unlock()
+}
+
+// quantile は呼び出し側でロックを取っている前提
+func (h *latencyHistogram) quantile(q float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	rank := int64(q * float64(h.count))
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int64
+	for i, cnt := range h.counts {
+		seen += cnt
+		if seen >= rank {
+			if i == len(h.bounds) {
+				// 最大のバケットを超えた分は上限がわからないので最大のバケットの値を返す
+				return h.bounds[len(h.bounds)-1]
+			}
+			return h.bounds[i]
+		}
+	}
+	return h.bounds[len(h.bounds)-1]
+}
+
+func (h *latencyHistogram) snapshot() interface{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	buckets := make(map[string]int64, len(h.counts))
+	for i, cnt := range h.counts {
+		if i == len(h.bounds) {
+			buckets["+Inf"] = cnt
+		} else {
+			buckets[h.bounds[i].String()] = cnt
+		}
+	}
+
+	return map[string]interface{}{
+		"count":   h.count,
+		"sum_ms":  float64(h.sum) / float64(time.Millisecond),
+		"p50_ms":  float64(h.quantile(0.50)) / float64(time.Millisecond),
+		"p95_ms":  float64(h.quantile(0.95)) / float64(time.Millisecond),
+		"p99_ms":  float64(h.quantile(0.99)) / float64(time.Millisecond),
+		"buckets": buckets,
+	}
+}
+
+// observeLatency はハンドラの処理時間をヒストグラムに記録するミドルウェアです
+func observeLatency(h *latencyHistogram) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			err := next(c)
+			h.Observe(time.Since(start))
+			return err
+		}
+	}
+}
+
+var userStatisticsLatency = newLatencyHistogram("user_statistics_latency", defaultLatencyBuckets)
+
+// メトリクス取得API
+// GET /api/metrics
+var metricsHandler = echo.WrapHandler(expvar.Handler())
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// newTestLatencyHistogram は expvar に公開せずにヒストグラムを作ります
+// 同じ名前で何度も公開すると expvar が panic するため
+func newTestLatencyHistogram(bounds []time.Duration) *latencyHistogram {
+	return &latencyHistogram{
+		bounds: bounds,
+		counts: make([]int64, len(bounds)+1),
+	}
+}
+
+func TestLatencyHistogramQuantile(t *testing.T) {
+	h := newTestLatencyHistogram([]time.Duration{10 * time.Millisecond, 100 * time.Millisecond, time.Second})
+	for i := 0; i < 90; i++ {
+		h.Observe(5 * time.Millisecond)
+	}
+	for i := 0; i < 9; i++ {
+		h.Observe(50 * time.Millisecond)
+	}
+	h.Observe(2 * time.Second)
+
+	for _, tt := range []struct {
+		q    float64
+		want time.Duration
+	}{
+		{0.50, 10 * time.Millisecond},
+		{0.95, 100 * time.Millisecond},
+		{1, time.Second},
+	} {
+		if got := h.quantile(tt.q); got != tt.want {
+			t.Errorf("quantile(%v) = %s, want %s", tt.q, got, tt.want)
+		}
+	}
+
+	snapshot := h.snapshot().(map[string]interface{})
+	if got := snapshot["count"]; got != int64(100) {
+		t.Errorf("count = %v, want 100", got)
+	}
+	if got := snapshot["buckets"].(map[string]int64)["+Inf"]; got != 1 {
+		t.Errorf("+Inf bucket = %d, want 1", got)
+	}
+}
+
+// 統計APIを呼ぶと、失敗した場合でもヒストグラムにサンプルが1つ入る
+func TestUserStatisticsLatencyObserved(t *testing.T) {
+	prevDB := dbConn
+	dbConn = newBrokenDB(t)
+	t.Cleanup(func() { dbConn = prevDB })
+	user := UserModel{ID: 1 << 40, Name: "test001"}
+	cacheTestUser(t, user)
+
+	userStatisticsLatency.mu.Lock()
+	before := userStatisticsLatency.count
+	userStatisticsLatency.mu.Unlock()
+
+	c, _ := newTestContext(http.MethodGet, "/api/user/test001/statistics", nil)
+	c.SetParamNames("username")
+	c.SetParamValues(user.Name)
+	_ = serveWithSession(c, user, observeLatency(userStatisticsLatency)(getUserStatisticsHandler))
+
+	userStatisticsLatency.mu.Lock()
+	after := userStatisticsLatency.count
+	userStatisticsLatency.mu.Unlock()
+	if after != before+1 {
+		t.Errorf("count = %d, want %d", after, before+1)
+	}
+}
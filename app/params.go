@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// parseInt64Param はパスパラメータ name を整数として読みます
+// 整数でなければそのまま返せる400のエラーを返す
+func parseInt64Param(c echo.Context, name string) (int64, error) {
+	v, err := strconv.ParseInt(c.Param(name), 10, 64)
+	if err != nil {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, name+" in path must be integer")
+	}
+	return v, nil
+}
+
+// limitOffsetClause は ?limit=&offset= から " LIMIT n OFFSET m" を組み立てます
+// 両方とも省略できるが、MySQL は LIMIT 無しの OFFSET を書けないので offset だけの指定は400にする
+func limitOffsetClause(c echo.Context) (string, error) {
+	var clause string
+	if v := c.QueryParam("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			return "", echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be non-negative integer")
+		}
+		clause = fmt.Sprintf(" LIMIT %d", limit)
+	}
+	if v := c.QueryParam("offset"); v != "" {
+		if clause == "" {
+			return "", echo.NewHTTPError(http.StatusBadRequest, "offset query parameter requires limit")
+		}
+		offset, err := strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return "", echo.NewHTTPError(http.StatusBadRequest, "offset query parameter must be non-negative integer")
+		}
+		clause += fmt.Sprintf(" OFFSET %d", offset)
+	}
+	return clause, nil
+}
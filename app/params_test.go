@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func wantBadRequest(t *testing.T, err error) {
+	t.Helper()
+	var httpErr *echo.HTTPError
+	if !errors.As(err, &httpErr) || httpErr.Code != http.StatusBadRequest {
+		t.Errorf("err = %v, want a 400 echo.HTTPError", err)
+	}
+}
+
+func TestParseInt64Param(t *testing.T) {
+	for _, tt := range []struct {
+		value   string
+		want    int64
+		wantErr bool
+	}{
+		{value: "1", want: 1},
+		{value: "0", want: 0},
+		{value: "-5", want: -5},
+		{value: "9223372036854775807", want: 9223372036854775807},
+		{value: "9223372036854775808", wantErr: true},
+		{value: "", wantErr: true},
+		{value: "abc", wantErr: true},
+		{value: "1.5", wantErr: true},
+		{value: " 1", wantErr: true},
+	} {
+		c, _ := newTestContext(http.MethodGet, "/", nil)
+		c.SetParamNames("livestream_id")
+		c.SetParamValues(tt.value)
+
+		got, err := parseInt64Param(c, "livestream_id")
+		if tt.wantErr {
+			wantBadRequest(t, err)
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseInt64Param(%q): %+v", tt.value, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseInt64Param(%q) = %d, want %d", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestParseInt64ParamMessage(t *testing.T) {
+	c, _ := newTestContext(http.MethodGet, "/", nil)
+	c.SetParamNames("livestream_id")
+	c.SetParamValues("abc")
+
+	_, err := parseInt64Param(c, "livestream_id")
+	var httpErr *echo.HTTPError
+	if !errors.As(err, &httpErr) {
+		t.Fatalf("err = %v, want an echo.HTTPError", err)
+	}
+	if want := "livestream_id in path must be integer"; httpErr.Message != want {
+		t.Errorf("message = %v, want %q", httpErr.Message, want)
+	}
+}
+
+func TestLimitOffsetClause(t *testing.T) {
+	for _, tt := range []struct {
+		query   string
+		want    string
+		wantErr bool
+	}{
+		{query: "", want: ""},
+		{query: "limit=10", want: " LIMIT 10"},
+		{query: "limit=10&offset=20", want: " LIMIT 10 OFFSET 20"},
+		{query: "limit=0", want: " LIMIT 0"},
+		{query: "offset=20", wantErr: true},
+		{query: "limit=-1", wantErr: true},
+		{query: "limit=x", wantErr: true},
+		{query: "limit=10&offset=-1", wantErr: true},
+		{query: "limit=10&offset=x", wantErr: true},
+	} {
+		c, _ := newTestContext(http.MethodGet, "/?"+tt.query, nil)
+		got, err := limitOffsetClause(c)
+		if tt.wantErr {
+			wantBadRequest(t, err)
+			continue
+		}
+		if err != nil {
+			t.Errorf("limitOffsetClause(%q): %+v", tt.query, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("limitOffsetClause(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// bcryptSem は同時に実行する bcrypt の数を bcryptConcurrency までに制限します
+// ログインが集中したときに bcrypt が全コアを使い切り、他のハンドラが処理されなくなるのを防ぐ
+var bcryptSem chan struct{}
+
+func acquireBcrypt(ctx context.Context) error {
+	select {
+	case bcryptSem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func releaseBcrypt() {
+	<-bcryptSem
+}
+
+func generatePasswordHash(ctx context.Context, password string) ([]byte, error) {
+	if err := acquireBcrypt(ctx); err != nil {
+		return nil, err
+	}
+	defer releaseBcrypt()
+	return bcrypt.GenerateFromPassword([]byte(password), config.BcryptCost)
+}
+
+func comparePasswordHash(ctx context.Context, hashedPassword, password string) error {
+	if err := acquireBcrypt(ctx); err != nil {
+		return err
+	}
+	defer releaseBcrypt()
+	return bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func setTestBcryptConcurrency(t *testing.T, n int) {
+	t.Helper()
+	prevSem, prevCost := bcryptSem, config.BcryptCost
+	bcryptSem = make(chan struct{}, n)
+	config.BcryptCost = bcrypt.MinCost
+	t.Cleanup(func() { bcryptSem, config.BcryptCost = prevSem, prevCost })
+}
+
+// 同時に bcrypt を実行できるのは bcryptSem の大きさまで
+func TestBcryptConcurrencyLimit(t *testing.T) {
+	const limit = 2
+	setTestBcryptConcurrency(t, limit)
+
+	var running, peak atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := acquireBcrypt(context.Background()); err != nil {
+				t.Errorf("acquireBcrypt: %+v", err)
+				return
+			}
+			n := running.Add(1)
+			for {
+				p := peak.Load()
+				if n <= p || peak.CompareAndSwap(p, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			running.Add(-1)
+			releaseBcrypt()
+		}()
+	}
+	wg.Wait()
+
+	if got := peak.Load(); got > limit {
+		t.Errorf("peak concurrency = %d, want at most %d", got, limit)
+	}
+}
+
+// 空きを待っている間にリクエストが終わったら、待つのをやめる
+func TestAcquireBcryptCanceled(t *testing.T) {
+	setTestBcryptConcurrency(t, 1)
+	if err := acquireBcrypt(context.Background()); err != nil {
+		t.Fatalf("acquireBcrypt: %+v", err)
+	}
+	defer releaseBcrypt()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := generatePasswordHash(ctx, "s3cr3t"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("generatePasswordHash = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestPasswordHashRoundTrip(t *testing.T) {
+	setTestBcryptConcurrency(t, 1)
+	ctx := context.Background()
+	hashed, err := generatePasswordHash(ctx, "s3cr3t")
+	if err != nil {
+		t.Fatalf("generatePasswordHash: %+v", err)
+	}
+	if err := comparePasswordHash(ctx, string(hashed), "s3cr3t"); err != nil {
+		t.Errorf("comparePasswordHash with the right password: %+v", err)
+	}
+	if err := comparePasswordHash(ctx, string(hashed), "wrong"); !errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		t.Errorf("comparePasswordHash with a wrong password = %v, want a mismatch", err)
+	}
+	if n := len(bcryptSem); n != 0 {
+		t.Errorf("%d bcrypt slots are still held", n)
+	}
+}
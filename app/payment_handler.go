@@ -3,6 +3,7 @@ package main
 import (
 	"net/http"
 
+	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo/v4"
 )
 
@@ -13,19 +14,14 @@ type PaymentResult struct {
 func GetPaymentResult(c echo.Context) error {
 	ctx := c.Request().Context()
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
-	}
-	defer tx.Rollback()
-
 	var totalTip int64
-	if err := tx.GetContext(ctx, &totalTip, "SELECT IFNULL(SUM(tip), 0) FROM livecomments"); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count total tip: "+err.Error())
-	}
-
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		if err := tx.GetContext(ctx, &totalTip, "SELECT IFNULL(SUM(tip), 0) FROM livecomments"); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to count total tip: "+err.Error())
+		}
+		return nil
+	}); err != nil {
+		return err
 	}
 
 	return c.JSON(http.StatusOK, &PaymentResult{
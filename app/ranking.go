@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/redis/go-redis/v9"
+)
+
+// ユーザーランキングのスコア (配信に付いたリアクション数 + チップ合計) を Redis の sorted set で持つ
+// features.RedisRanking が有効な場合、リアクション・チップの投稿ごとにスコアを加算し、
+// 順位は ZREVRANK、上位は ZREVRANGE で引く。SQL の集計は再構築と Redis が使えない場合のフォールバックに使う
+
+var userScoresKey = userScoresKeyspace.Key()
+
+// userScoresQuery はユーザーごとのリアクション数とチップ合計を集計します
+// リアクションとライブコメントを同時に JOIN すると行数が掛け算になるので、それぞれ先に集計してから結合する
+const userScoresQuery = `
+	SELECT
+		u.id,
+		u.name AS username,
+		IFNULL(r.reaction_count, 0) AS reaction_count,
+		IFNULL(t.total_tips, 0) AS total_tips
+	FROM
+		users u
+	LEFT JOIN (
+		SELECT l.user_id, COUNT(*) AS reaction_count
+		FROM livestreams l
+		INNER JOIN reactions r ON r.livestream_id = l.id
+		GROUP BY l.user_id
+	) r ON r.user_id = u.id
+	LEFT JOIN (
+		SELECT l.user_id, SUM(lc.tip) AS total_tips
+		FROM livestreams l
+		INNER JOIN livecomments lc ON lc.livestream_id = l.id
+		GROUP BY l.user_id
+	) t ON t.user_id = u.id
+	WHERE u.deleted_at IS NULL
+`
+
+// rebuildUserScores は SQL の集計結果で sorted set を作り直します
+func rebuildUserScores(ctx context.Context) error {
+	var userScores []UserScore
+	if err := dbConn.SelectContext(ctx, &userScores, userScoresQuery); err != nil {
+		return err
+	}
+
+	members := make([]redis.Z, len(userScores))
+	for i, userScore := range userScores {
+		members[i] = redis.Z{
+			Score:  float64(userScore.ReactionCount + userScore.TotalTips),
+			Member: userScore.Username,
+		}
+	}
+
+	// 作り直している途中の空の sorted set が読まれないよう、MULTI でまとめて入れ替える
+	_, err := redisConn.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, userScoresKey)
+		if len(members) > 0 {
+			pipe.ZAdd(ctx, userScoresKey, members...)
+		}
+		return nil
+	})
+	return err
+}
+
+// ensureUserScores は sorted set が無い場合だけ作り直します
+func ensureUserScores(ctx context.Context) error {
+	n, err := redisConn.Exists(ctx, userScoresKey).Result()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+	return rebuildUserScores(ctx)
+}
+
+// addUserScoreMember は登録直後のユーザーをスコア0で追加します
+// メンバーが無いと ZREVRANK で順位が引けず、毎回 SQL にフォールバックしてしまう
+func addUserScoreMember(ctx context.Context, username string) error {
+	if !features.RedisRanking {
+		return nil
+	}
+	return redisConn.ZAddNX(ctx, userScoresKey, redis.Z{Score: 0, Member: username}).Err()
+}
+
+// removeUserScoreMember は退会したユーザーをランキングから外します
+func removeUserScoreMember(ctx context.Context, username string) error {
+	if !features.RedisRanking {
+		return nil
+	}
+	return redisConn.ZRem(ctx, userScoresKey, username).Err()
+}
+
+// renameUserScoreScript はスコアを保ったままメンバー名を付け替えます
+// 読んでから書くまでの間の加算を取りこぼさないよう、スクリプトで一度に行う
+var renameUserScoreScript = redis.NewScript(`
+local score = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if score then
+	redis.call('ZREM', KEYS[1], ARGV[1])
+	redis.call('ZINCRBY', KEYS[1], score, ARGV[2])
+end
+return score
+`)
+
+// renameUserScoreMember はユーザー名の変更に合わせてランキングのメンバーを付け替えます
+func renameUserScoreMember(ctx context.Context, oldName, newName string) error {
+	if !features.RedisRanking {
+		return nil
+	}
+	err := renameUserScoreScript.Run(ctx, redisConn, []string{userScoresKey}, oldName, newName).Err()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return err
+	}
+	return nil
+}
+
+// incrUserScore は配信者のスコアを加算します
+// NGワードでライブコメントが消された場合は負の値でチップ分を減らす
+func incrUserScore(ctx context.Context, username string, delta int64) error {
+	if !features.RedisRanking || delta == 0 {
+		return nil
+	}
+	return redisConn.ZIncrBy(ctx, userScoresKey, float64(delta), username).Err()
+}
+
+// getUserRanks はユーザー名ごとの順位(1始まり)を返します
+// 同じスコアの場合はユーザー名の辞書順で後ろのものを上位とする
+// sorted set も同点のメンバーは辞書順に並ぶため、ZREVRANK の結果は SQL の集計と一致する
+func getUserRanks(ctx context.Context, usernames []string) (map[string]int64, error) {
+	if features.RedisRanking {
+		ranks, err := getUserRanksFromZSet(ctx, usernames)
+		if err == nil {
+			return ranks, nil
+		}
+		log.Printf("failed to get user ranks from redis; falling back to sql: %+v", err)
+	}
+
+	ranking, err := getUserRanking()
+	if err != nil {
+		return nil, err
+	}
+	positions := make(map[string]int64, len(ranking))
+	for i := range ranking {
+		positions[ranking[i].Username] = int64(len(ranking) - i)
+	}
+	ranks := make(map[string]int64, len(usernames))
+	for _, username := range usernames {
+		if rank, ok := positions[username]; ok {
+			ranks[username] = rank
+		} else {
+			ranks[username] = int64(len(ranking) + 1)
+		}
+	}
+	return ranks, nil
+}
+
+func getUserRanksFromZSet(ctx context.Context, usernames []string) (map[string]int64, error) {
+	cmds := make([]*redis.IntCmd, len(usernames))
+	_, err := redisConn.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, username := range usernames {
+			cmds[i] = pipe.ZRevRank(ctx, userScoresKey, username)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+
+	ranks := make(map[string]int64, len(usernames))
+	for i, username := range usernames {
+		rank, err := cmds[i].Result()
+		if err != nil {
+			// メンバーが無い場合も集計し直さないと順位が決まらないので、呼び出し側で SQL に切り替える
+			return nil, err
+		}
+		ranks[username] = rank + 1
+	}
+	return ranks, nil
+}
+
+// getTopUsers はスコアの上位 n 人を上位から順に返します
+// n が0以下の場合は全員を返す
+func getTopUsers(ctx context.Context, n int64) (UserRanking, error) {
+	if features.RedisRanking {
+		// n が0以下なら stop が -1 になり、末尾まで取得する
+		stop := n - 1
+		if n <= 0 {
+			stop = -1
+		}
+		zs, err := redisConn.ZRevRangeWithScores(ctx, userScoresKey, 0, stop).Result()
+		if err == nil {
+			top := make(UserRanking, len(zs))
+			for i, z := range zs {
+				top[i] = UserRankingEntry{
+					Username: z.Member.(string),
+					Score:    int64(z.Score),
+				}
+			}
+			return top, nil
+		}
+		log.Printf("failed to get top users from redis; falling back to sql: %+v", err)
+	}
+
+	ranking, err := getUserRanking()
+	if err != nil {
+		return nil, err
+	}
+	if n <= 0 || n > int64(len(ranking)) {
+		n = int64(len(ranking))
+	}
+	top := make(UserRanking, 0, n)
+	for i := len(ranking) - 1; i >= 0 && int64(len(top)) < n; i-- {
+		top = append(top, ranking[i])
+	}
+	return top, nil
+}
+
+// 配信ランキングのスコアも同じく sorted set で持つ
+// メンバーは配信IDをゼロ埋めした文字列にして、同点時の辞書順が配信IDの数値順と一致するようにする
+
+var livestreamScoresKey = livestreamScoresKeyspace.Key()
+
+func livestreamScoresMember(livestreamID int64) string {
+	return fmt.Sprintf("%020d", livestreamID)
+}
+
+// livestreamScoresQuery は配信ごとのリアクション数とチップ合計を集計します
+const livestreamScoresQuery = `
+	SELECT
+		l.id AS livestream_id,
+		IFNULL(r.reaction_count, 0) + IFNULL(t.total_tips, 0) AS score
+	FROM
+		livestreams l
+	LEFT JOIN (
+		SELECT livestream_id, COUNT(*) AS reaction_count
+		FROM reactions
+		GROUP BY livestream_id
+	) r ON r.livestream_id = l.id
+	LEFT JOIN (
+		SELECT livestream_id, SUM(tip) AS total_tips
+		FROM livecomments
+		GROUP BY livestream_id
+	) t ON t.livestream_id = l.id
+`
+
+type livestreamScore struct {
+	LivestreamID int64 `db:"livestream_id"`
+	Score        int64 `db:"score"`
+}
+
+// rebuildLivestreamScores は SQL の集計結果で配信の sorted set を作り直します
+func rebuildLivestreamScores(ctx context.Context) error {
+	var scores []livestreamScore
+	if err := dbConn.SelectContext(ctx, &scores, livestreamScoresQuery); err != nil {
+		return err
+	}
+
+	members := make([]redis.Z, len(scores))
+	for i, score := range scores {
+		members[i] = redis.Z{
+			Score:  float64(score.Score),
+			Member: livestreamScoresMember(score.LivestreamID),
+		}
+	}
+
+	_, err := redisConn.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, livestreamScoresKey)
+		if len(members) > 0 {
+			pipe.ZAdd(ctx, livestreamScoresKey, members...)
+		}
+		return nil
+	})
+	return err
+}
+
+// ensureLivestreamScores は配信の sorted set が無い場合だけ作り直します
+func ensureLivestreamScores(ctx context.Context) error {
+	n, err := redisConn.Exists(ctx, livestreamScoresKey).Result()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+	return rebuildLivestreamScores(ctx)
+}
+
+// addLivestreamScoreMember は予約された配信をスコア0で追加します
+func addLivestreamScoreMember(ctx context.Context, livestreamID int64) error {
+	if !features.RedisRanking {
+		return nil
+	}
+	return redisConn.ZAddNX(ctx, livestreamScoresKey, redis.Z{Score: 0, Member: livestreamScoresMember(livestreamID)}).Err()
+}
+
+// incrLivestreamScore は配信のスコアを加算します
+func incrLivestreamScore(ctx context.Context, livestreamID int64, delta int64) error {
+	if !features.RedisRanking || delta == 0 {
+		return nil
+	}
+	return redisConn.ZIncrBy(ctx, livestreamScoresKey, float64(delta), livestreamScoresMember(livestreamID)).Err()
+}
+
+// getLivestreamRank は配信の順位(1始まり)を返します
+// 同じスコアの場合は配信IDが大きいものを上位とする
+func getLivestreamRank(ctx context.Context, tx *sqlx.Tx, livestreamID int64) (int64, error) {
+	if features.RedisRanking {
+		rank, err := redisConn.ZRevRank(ctx, livestreamScoresKey, livestreamScoresMember(livestreamID)).Result()
+		if err == nil {
+			return rank + 1, nil
+		}
+		log.Printf("failed to get livestream rank from redis; falling back to sql: %+v", err)
+	}
+
+	var scores []livestreamScore
+	if err := tx.SelectContext(ctx, &scores, livestreamScoresQuery); err != nil {
+		return 0, err
+	}
+	ranking := make(LivestreamRanking, len(scores))
+	for i, score := range scores {
+		ranking[i] = LivestreamRankingEntry{
+			LivestreamID: score.LivestreamID,
+			Score:        score.Score,
+		}
+	}
+	sort.Sort(ranking)
+
+	var rank int64 = 1
+	for i := len(ranking) - 1; i >= 0; i-- {
+		if ranking[i].LivestreamID == livestreamID {
+			break
+		}
+		rank++
+	}
+	return rank, nil
+}
+
+// getPopularLivestreamIDs はスコアの上位から offset 件飛ばして limit 件の配信IDを返します
+func getPopularLivestreamIDs(ctx context.Context, tx *sqlx.Tx, offset, limit int64) ([]int64, error) {
+	if features.RedisRanking {
+		members, err := redisConn.ZRevRange(ctx, livestreamScoresKey, offset, offset+limit-1).Result()
+		if err == nil {
+			ids := make([]int64, 0, len(members))
+			for _, member := range members {
+				var id int64
+				if _, err := fmt.Sscan(member, &id); err != nil {
+					return nil, err
+				}
+				ids = append(ids, id)
+			}
+			return ids, nil
+		}
+		log.Printf("failed to get popular livestreams from redis; falling back to sql: %+v", err)
+	}
+
+	var ids []int64
+	query := "SELECT livestream_id FROM (" + livestreamScoresQuery + ") s ORDER BY score DESC, livestream_id DESC LIMIT ? OFFSET ?"
+	if err := tx.SelectContext(ctx, &ids, query, limit, offset); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+type UserRankingResponseEntry struct {
+	Rank     int64  `json:"rank"`
+	Username string `json:"username"`
+	Score    int64  `json:"score"`
+}
+
+const mimeApplicationNDJSON = "application/x-ndjson"
+
+const (
+	// limit 未指定のときに返す件数。この件数のレスポンスはJSONをキャッシュしておく
+	defaultUserRankingLimit = 100
+	userRankingBlobTTL      = 1 * time.Second
+)
+
+// userRankingBlobCache は上位 defaultUserRankingLimit 件のレスポンスをJSONのまま短時間キャッシュします
+var userRankingBlobCache = struct {
+	sync.RWMutex
+	blob      []byte
+	expiresAt time.Time
+}{}
+
+// ユーザーランキング取得API
+// GET /api/ranking/users?limit=
+// limit=0 で全員を返す。件数が多くなるので、全件を組み立ててから書き出さず1件ずつエンコードして書き出す
+// Accept に application/x-ndjson を含む場合は配列にせず1行に1件ずつ返す
+func getUserRankingHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if _, err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	limit := int64(defaultUserRankingLimit)
+	if v := c.QueryParam("limit"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be non-negative integer")
+		}
+		limit = n
+	}
+
+	ndjson := strings.Contains(c.Request().Header.Get(echo.HeaderAccept), mimeApplicationNDJSON)
+
+	if limit == defaultUserRankingLimit && !ndjson {
+		userRankingBlobCache.RLock()
+		blob, expiresAt := userRankingBlobCache.blob, userRankingBlobCache.expiresAt
+		userRankingBlobCache.RUnlock()
+		if blob != nil && time.Now().Before(expiresAt) {
+			return c.JSONBlob(http.StatusOK, blob)
+		}
+	}
+
+	top, err := getTopUsers(ctx, limit)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user ranking: "+err.Error())
+	}
+
+	if ndjson {
+		return writeUserRankingNDJSON(c, top)
+	}
+
+	if limit == defaultUserRankingLimit {
+		entries := make([]UserRankingResponseEntry, len(top))
+		for i := range top {
+			entries[i] = UserRankingResponseEntry{
+				Rank:     int64(i + 1),
+				Username: top[i].Username,
+				Score:    top[i].Score,
+			}
+		}
+		blob, err := jsonMarshal(entries)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to marshal user ranking: "+err.Error())
+		}
+		userRankingBlobCache.Lock()
+		userRankingBlobCache.blob = blob
+		userRankingBlobCache.expiresAt = time.Now().Add(userRankingBlobTTL)
+		userRankingBlobCache.Unlock()
+		return c.JSONBlob(http.StatusOK, blob)
+	}
+
+	// ヘッダを書いた後はエラーレスポンスを返せないので、エンコードの失敗はログに残して打ち切る
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSONCharsetUTF8)
+	res.WriteHeader(http.StatusOK)
+	enc := newJSONEncoder(res)
+	if _, err := res.Write([]byte("[")); err != nil {
+		return nil
+	}
+	for i := range top {
+		if i > 0 {
+			if _, err := res.Write([]byte(",")); err != nil {
+				return nil
+			}
+		}
+		entry := UserRankingResponseEntry{
+			Rank:     int64(i + 1),
+			Username: top[i].Username,
+			Score:    top[i].Score,
+		}
+		if err := enc.Encode(entry); err != nil {
+			c.Logger().Warnf("failed to encode user ranking entry: %+v", err)
+			return nil
+		}
+	}
+	if _, err := res.Write([]byte("]")); err != nil {
+		return nil
+	}
+	return nil
+}
+
+// writeUserRankingNDJSON はランキングを1行に1件の JSON で書き出します
+func writeUserRankingNDJSON(c echo.Context, top UserRanking) error {
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, mimeApplicationNDJSON)
+	res.WriteHeader(http.StatusOK)
+	// Encode は1件ごとに改行を付ける
+	enc := newJSONEncoder(res)
+	for i := range top {
+		entry := UserRankingResponseEntry{
+			Rank:     int64(i + 1),
+			Username: top[i].Username,
+			Score:    top[i].Score,
+		}
+		if err := enc.Encode(entry); err != nil {
+			c.Logger().Warnf("failed to encode user ranking entry: %+v", err)
+			return nil
+		}
+	}
+	return nil
+}
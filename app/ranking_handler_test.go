@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+// useTestUserRanking は DB を使わずに ranking を返すよう、集計に失敗した直後の状態にします
+// ranking は getUserRanking と同じくスコアの低い順で渡す
+func useTestUserRanking(t *testing.T, ranking UserRanking) {
+	t.Helper()
+	resetUserRankingState(t)
+	prevFeatures, prevDB := features, dbConn
+	features.RedisRanking = false
+	dbConn = newBrokenDB(t)
+	userRankingBlobCache.Lock()
+	userRankingBlobCache.blob = nil
+	userRankingBlobCache.Unlock()
+	t.Cleanup(func() {
+		features, dbConn = prevFeatures, prevDB
+		userRankingBlobCache.Lock()
+		userRankingBlobCache.blob = nil
+		userRankingBlobCache.Unlock()
+	})
+	userRankingState.Lock()
+	userRankingState.lastGood, userRankingState.hasGood = ranking, true
+	userRankingState.Unlock()
+}
+
+func getTestUserRanking(t *testing.T, limit string, accept string) []byte {
+	t.Helper()
+	viewer := UserModel{ID: -1, Name: "ranking-viewer"}
+	cacheTestUser(t, viewer)
+	c, rec := newTestContext(http.MethodGet, "/api/ranking/users?limit="+limit, nil)
+	if accept != "" {
+		c.Request().Header.Set("Accept", accept)
+	}
+	if err := serveWithSession(c, viewer, getUserRankingHandler); err != nil {
+		t.Fatalf("getUserRankingHandler: %+v", err)
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	return rec.Body.Bytes()
+}
+
+func wantUserRankingEntries(ranking UserRanking, n int) []UserRankingResponseEntry {
+	entries := make([]UserRankingResponseEntry, 0, n)
+	for i := len(ranking) - 1; i >= 0 && len(entries) < n; i-- {
+		entries = append(entries, UserRankingResponseEntry{
+			Rank:     int64(len(entries) + 1),
+			Username: ranking[i].Username,
+			Score:    ranking[i].Score,
+		})
+	}
+	return entries
+}
+
+// 1件ずつ書き出した全件のレスポンスも、キャッシュ用にまとめて組み立てた上位のレスポンスも、
+// 一度に Marshal したものと同じ JSON になる
+func TestUserRankingStreamedMatchesMarshal(t *testing.T) {
+	ranking := make(UserRanking, 250)
+	for i := range ranking {
+		ranking[i] = UserRankingEntry{Username: fmt.Sprintf("user%03d", i), Score: int64(i)}
+	}
+	useTestUserRanking(t, ranking)
+
+	for _, tt := range []struct {
+		name  string
+		limit string
+		n     int
+	}{
+		{"all streamed", "0", len(ranking)},
+		{"partial streamed", "150", 150},
+		{"cached top", fmt.Sprint(defaultUserRankingLimit), defaultUserRankingLimit},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			body := getTestUserRanking(t, tt.limit, "")
+			if !json.Valid(body) {
+				t.Fatalf("response is not valid json: %s", body)
+			}
+			want, err := json.Marshal(wantUserRankingEntries(ranking, tt.n))
+			if err != nil {
+				t.Fatalf("failed to marshal: %+v", err)
+			}
+			var got bytes.Buffer
+			if err := json.Compact(&got, body); err != nil {
+				t.Fatalf("failed to compact response: %+v", err)
+			}
+			if !bytes.Equal(got.Bytes(), want) {
+				t.Errorf("response = %s, want %s", got.Bytes(), want)
+			}
+		})
+	}
+}
+
+// 空のランキングでも配列として読める
+func TestUserRankingStreamedEmpty(t *testing.T) {
+	useTestUserRanking(t, UserRanking{})
+	body := getTestUserRanking(t, "0", "")
+	var entries []UserRankingResponseEntry
+	if err := json.Unmarshal(body, &entries); err != nil {
+		t.Fatalf("failed to decode response %q: %+v", body, err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("got %d entries, want 0", len(entries))
+	}
+}
+
+func TestUserRankingNDJSON(t *testing.T) {
+	ranking := UserRanking{{Username: "alice", Score: 1}, {Username: "bob", Score: 2}, {Username: "carol", Score: 3}}
+	useTestUserRanking(t, ranking)
+	body := getTestUserRanking(t, "0", mimeApplicationNDJSON)
+
+	lines := strings.Split(strings.TrimSuffix(string(body), "\n"), "\n")
+	want := wantUserRankingEntries(ranking, len(ranking))
+	if len(lines) != len(want) {
+		t.Fatalf("got %d lines, want %d: %q", len(lines), len(want), body)
+	}
+	for i, line := range lines {
+		var got UserRankingResponseEntry
+		if err := json.Unmarshal([]byte(line), &got); err != nil {
+			t.Fatalf("line %d is not valid json: %q", i, line)
+		}
+		if got != want[i] {
+			t.Errorf("line %d = %+v, want %+v", i, got, want[i])
+		}
+	}
+}
+
+// NDJSON でも limit は効き、Content-Type で NDJSON だと分かる
+func TestUserRankingNDJSONLimit(t *testing.T) {
+	ranking := UserRanking{{Username: "alice", Score: 1}, {Username: "bob", Score: 2}, {Username: "carol", Score: 3}}
+	useTestUserRanking(t, ranking)
+	viewer := UserModel{ID: -1, Name: "ranking-viewer"}
+	cacheTestUser(t, viewer)
+	c, rec := newTestContext(http.MethodGet, "/api/ranking/users?limit=2", nil)
+	c.Request().Header.Set("Accept", "application/json, "+mimeApplicationNDJSON)
+	if err := serveWithSession(c, viewer, getUserRankingHandler); err != nil {
+		t.Fatalf("getUserRankingHandler: %+v", err)
+	}
+	if got := rec.Header().Get(echo.HeaderContentType); got != mimeApplicationNDJSON {
+		t.Errorf("content-type = %q, want %q", got, mimeApplicationNDJSON)
+	}
+
+	var got []UserRankingResponseEntry
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		var entry UserRankingResponseEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("line %d is not valid json: %q", len(got), scanner.Text())
+		}
+		got = append(got, entry)
+	}
+	if want := wantUserRankingEntries(ranking, 2); !reflect.DeepEqual(got, want) {
+		t.Errorf("entries = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// enableRedisRanking は features.RedisRanking を有効にし、sorted set を SQL の集計から作り直します
+func enableRedisRanking(t *testing.T) {
+	t.Helper()
+	prevFeatures := features
+	features.RedisRanking = true
+	t.Cleanup(func() { features = prevFeatures })
+	ctx := context.Background()
+	if err := rebuildUserScores(ctx); err != nil {
+		t.Fatalf("failed to rebuild user scores: %+v", err)
+	}
+	if err := rebuildLivestreamScores(ctx); err != nil {
+		t.Fatalf("failed to rebuild livestream scores: %+v", err)
+	}
+}
+
+// sqlUserRanks は SQL の集計から求めたユーザーの順位を返します
+func sqlUserRanks(t *testing.T, usernames []string) map[string]int64 {
+	t.Helper()
+	ranking, err := computeUserRanking()
+	if err != nil {
+		t.Fatalf("computeUserRanking: %+v", err)
+	}
+	ranks := make(map[string]int64, len(usernames))
+	for _, username := range usernames {
+		for i := range ranking {
+			if ranking[i].Username == username {
+				ranks[username] = int64(len(ranking) - i)
+			}
+		}
+	}
+	return ranks
+}
+
+// sorted set から引いた順位と上位のユーザーは、SQL の集計と一致する
+func TestUserRanksZSetMatchesSQL(t *testing.T) {
+	setupIntegration(t)
+	owners := []UserModel{createTestUser(t), createTestUser(t), createTestUser(t)}
+	viewer := createTestUser(t)
+	now := time.Now().Unix()
+	for i, owner := range owners {
+		livestream := createTestLivestream(t, owner.ID)
+		for j := 0; j < i; j++ {
+			createTestReaction(t, viewer.ID, livestream.ID, "heart", now)
+		}
+	}
+	enableRedisRanking(t)
+
+	usernames := []string{owners[0].Name, owners[1].Name, owners[2].Name, viewer.Name}
+	got, err := getUserRanksFromZSet(context.Background(), usernames)
+	if err != nil {
+		t.Fatalf("getUserRanksFromZSet: %+v", err)
+	}
+	if want := sqlUserRanks(t, usernames); !reflect.DeepEqual(got, want) {
+		t.Errorf("zset ranks = %v, sql ranks = %v", got, want)
+	}
+
+	top, err := getTopUsers(context.Background(), 5)
+	if err != nil {
+		t.Fatalf("getTopUsers: %+v", err)
+	}
+	features.RedisRanking = false
+	want, err := getTopUsers(context.Background(), 5)
+	if err != nil {
+		t.Fatalf("getTopUsers from sql: %+v", err)
+	}
+	if !reflect.DeepEqual(top, want) {
+		t.Errorf("zset top = %v, sql top = %v", top, want)
+	}
+}
+
+// 投稿ごとにスコアを加算した後も、sorted set の順位は SQL の集計と一致する
+func TestIncrUserScoreKeepsRanksConsistent(t *testing.T) {
+	setupIntegration(t)
+	owners := []UserModel{createTestUser(t), createTestUser(t)}
+	viewer := createTestUser(t)
+	livestreams := []LivestreamModel{createTestLivestream(t, owners[0].ID), createTestLivestream(t, owners[1].ID)}
+	enableRedisRanking(t)
+	usernames := []string{owners[0].Name, owners[1].Name}
+
+	// 同点ならユーザー名が辞書順で後ろの方が上位
+	ranks, err := getUserRanksFromZSet(context.Background(), usernames)
+	if err != nil {
+		t.Fatalf("getUserRanksFromZSet: %+v", err)
+	}
+	if ranks[owners[1].Name] >= ranks[owners[0].Name] {
+		t.Errorf("tied ranks = %v, want %s above %s", ranks, owners[1].Name, owners[0].Name)
+	}
+
+	for i, emojiName := range []string{"heart", "smile", "+1"} {
+		if code, err := postTestReaction(t, viewer, livestreams[0].ID, emojiName); err != nil {
+			t.Fatalf("postReactionHandler: %d, %+v", code, err)
+		}
+		got, err := getUserRanksFromZSet(context.Background(), usernames)
+		if err != nil {
+			t.Fatalf("getUserRanksFromZSet: %+v", err)
+		}
+		if want := sqlUserRanks(t, usernames); !reflect.DeepEqual(got, want) {
+			t.Errorf("after %d reactions: zset ranks = %v, sql ranks = %v", i+1, got, want)
+		}
+	}
+	if got, _ := getUserRanksFromZSet(context.Background(), usernames); got[owners[0].Name] >= got[owners[1].Name] {
+		t.Errorf("ranks = %v, want %s above %s after the reactions", got, owners[0].Name, owners[1].Name)
+	}
+}
+
+// sorted set から引いた配信の順位は SQL の集計と一致し、同点なら配信IDが大きい方が上位
+func TestLivestreamRankZSetMatchesSQL(t *testing.T) {
+	setupIntegration(t)
+	ctx := context.Background()
+	owner := createTestUser(t)
+	viewer := createTestUser(t)
+	livestreams := []LivestreamModel{createTestLivestream(t, owner.ID), createTestLivestream(t, owner.ID), createTestLivestream(t, owner.ID)}
+	now := time.Now().Unix()
+	// 0 と 2 は同点、1 は1つ多い
+	createTestReaction(t, viewer.ID, livestreams[0].ID, "heart", now)
+	createTestReaction(t, viewer.ID, livestreams[1].ID, "heart", now)
+	createTestReaction(t, viewer.ID, livestreams[1].ID, "smile", now)
+	createTestReaction(t, viewer.ID, livestreams[2].ID, "heart", now)
+	enableRedisRanking(t)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		t.Fatalf("failed to begin transaction: %+v", err)
+	}
+	defer tx.Rollback()
+
+	ranks := make(map[int64]int64)
+	for _, livestream := range livestreams {
+		features.RedisRanking = true
+		got, err := getLivestreamRank(ctx, tx, livestream.ID)
+		if err != nil {
+			t.Fatalf("getLivestreamRank: %+v", err)
+		}
+		features.RedisRanking = false
+		want, err := getLivestreamRank(ctx, tx, livestream.ID)
+		if err != nil {
+			t.Fatalf("getLivestreamRank from sql: %+v", err)
+		}
+		if got != want {
+			t.Errorf("livestream %d: zset rank = %d, sql rank = %d", livestream.ID, got, want)
+		}
+		ranks[livestream.ID] = got
+	}
+	if !(ranks[livestreams[1].ID] < ranks[livestreams[2].ID] && ranks[livestreams[2].ID] < ranks[livestreams[0].ID]) {
+		t.Errorf("ranks = %v, want livestream %d > %d > %d", ranks, livestreams[1].ID, livestreams[2].ID, livestreams[0].ID)
+	}
+}
+
+func TestLivestreamScoresMemberOrder(t *testing.T) {
+	// ゼロ埋めしているので、辞書順が数値順と一致する
+	if !(livestreamScoresMember(9) < livestreamScoresMember(10)) {
+		t.Errorf("member(9) = %s is not before member(10) = %s", livestreamScoresMember(9), livestreamScoresMember(10))
+	}
+}
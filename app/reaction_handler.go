@@ -2,14 +2,18 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"database/sql"
+	"errors"
 	"fmt"
+	"log"
+	"math"
 	"net/http"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/jmoiron/sqlx"
-	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
 )
 
@@ -29,21 +33,42 @@ type Reaction struct {
 	CreatedAt  int64      `json:"created_at"`
 }
 
+type ReactionHistoryEntry struct {
+	ID              int64  `json:"id"`
+	EmojiName       string `json:"emoji_name"`
+	LivestreamID    int64  `json:"livestream_id"`
+	LivestreamTitle string `json:"livestream_title"`
+	CreatedAt       int64  `json:"created_at"`
+}
+
 type PostReactionRequest struct {
 	EmojiName string `json:"emoji_name"`
 }
 
+// emojiNamePattern はリアクションとして受け付ける絵文字名です
+// 任意の文字列を受け付けるとお気に入り絵文字などの集計が汚れるので、小文字英数字と _+- に限る
+var emojiNamePattern = regexp.MustCompile(`^[a-z0-9_+-]+$`)
+
+// normalizeEmojiName は大文字小文字の違いで同じ絵文字が別々に集計されないよう小文字に揃え、妥当性を検証します
+func normalizeEmojiName(name string) (string, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if !emojiNamePattern.MatchString(name) {
+		return "", false
+	}
+	return name, true
+}
+
 func getReactionsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
-	if err := verifyUserSession(c); err != nil {
+	if _, err := verifyUserSession(c); err != nil {
 		// echo.NewHTTPErrorが返っているのでそのまま出力
 		return err
 	}
 
-	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	livestreamID, err := parseInt64Param(c, "livestream_id")
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+		return err
 	}
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
@@ -83,27 +108,91 @@ func getReactionsHandler(c echo.Context) error {
 	return c.JSON(http.StatusOK, reactions)
 }
 
-func postReactionHandler(c echo.Context) error {
+// 絵文字で絞り込んだリアクション一覧取得API
+// GET /api/livestream/:livestream_id/reactions?emoji=
+func getReactionsByEmojiHandler(c echo.Context) error {
 	ctx := c.Request().Context()
-	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+
+	if _, err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := parseInt64Param(c, "livestream_id")
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+		return err
 	}
 
-	if err := verifyUserSession(c); err != nil {
-		// echo.NewHTTPErrorが返っているのでそのまま出力
+	emojiName := c.QueryParam("emoji")
+	if emojiName == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "emoji query parameter must not be empty")
+	}
+	// 登録時と同じ正規化をしてから絞り込む
+	emojiName, ok := normalizeEmojiName(emojiName)
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "emoji must consist of lowercase letters, digits, '_', '+' and '-'")
+	}
+
+	fillUser, err := userFillerFromQuery(c)
+	if err != nil {
 		return err
 	}
 
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	query := "SELECT * FROM reactions WHERE livestream_id = ? AND emoji_name = ? ORDER BY created_at DESC, id DESC"
+	page, err := limitOffsetClause(c)
+	if err != nil {
+		return err
+	}
+	query += page
 
-	var req *PostReactionRequest
-	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
+	defer tx.Rollback()
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
+	reactionModels := []ReactionModel{}
+	if err := tx.SelectContext(ctx, &reactionModels, query, livestreamID, emojiName); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reactions: "+err.Error())
+	}
+
+	reactions, err := fillReactionsResponse(ctx, tx, livestreamModel, reactionModels, fillUser)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reactions: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, reactions)
+}
+
+// 自分のリアクション履歴取得API
+// GET /api/user/me/reactions
+func getMyReactionsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID, err := verifyUserSession(c)
+	if err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	query := "SELECT * FROM reactions WHERE user_id = ? ORDER BY created_at DESC, id DESC"
+	page, err := limitOffsetClause(c)
+	if err != nil {
+		return err
+	}
+	query += page
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
@@ -111,23 +200,160 @@ func postReactionHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
+	reactionModels := []ReactionModel{}
+	if err := tx.SelectContext(ctx, &reactionModels, query, userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reactions: "+err.Error())
+	}
+
+	// 配信タイトルはまとめて1クエリで取得する
+	titles := make(map[int64]string)
+	if len(reactionModels) > 0 {
+		livestreamIDs := make([]int64, len(reactionModels))
+		for i := range reactionModels {
+			livestreamIDs[i] = reactionModels[i].LivestreamID
+		}
+		query, params, err := sqlx.In("SELECT * FROM livestreams WHERE id IN (?)", livestreamIDs)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+		}
+		var livestreamModels []*LivestreamModel
+		if err := tx.SelectContext(ctx, &livestreamModels, query, params...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+		}
+		for _, livestreamModel := range livestreamModels {
+			titles[livestreamModel.ID] = livestreamModel.Title
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	history := make([]ReactionHistoryEntry, len(reactionModels))
+	for i := range reactionModels {
+		history[i] = ReactionHistoryEntry{
+			ID:              reactionModels[i].ID,
+			EmojiName:       reactionModels[i].EmojiName,
+			LivestreamID:    reactionModels[i].LivestreamID,
+			LivestreamTitle: titles[reactionModels[i].LivestreamID],
+			CreatedAt:       reactionModels[i].CreatedAt,
+		}
+	}
+
+	return c.JSON(http.StatusOK, history)
+}
+
+type ReactionCountResponse struct {
+	Count int64 `json:"count"`
+}
+
+// 自分が付けたリアクション数取得API
+// GET /api/user/me/reactions/count
+// 自分の配信に付いたリアクションではなく、自分が他の配信に付けたリアクションを数える
+func getMyReactionCountHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID, err := verifyUserSession(c)
+	if err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	var count int64
+	if err := dbConn.GetContext(ctx, &count, "SELECT COUNT(*) FROM reactions WHERE user_id = ?", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count reactions: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, ReactionCountResponse{Count: count})
+}
+
+func postReactionHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	livestreamID, err := parseInt64Param(c, "livestream_id")
+	if err != nil {
+		return err
+	}
+
+	userID, err := verifyUserSession(c)
+	if err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	var req *PostReactionRequest
+	if err := decodeJSON(c.Request().Body, &req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	emojiName, ok := normalizeEmojiName(req.EmojiName)
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "emoji_name must consist of lowercase letters, digits, '_', '+' and '-'")
+	}
+
+	if retryAfter, limited := checkReactionRateLimit(ctx, userID, livestreamID, emojiName); limited {
+		c.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		return echo.NewHTTPError(http.StatusTooManyRequests, "too many reactions; please wait before reacting again")
+	}
+
 	reactionModel := ReactionModel{
-		UserID:       int64(userID),
-		LivestreamID: int64(livestreamID),
-		EmojiName:    req.EmojiName,
+		UserID:       userID,
+		LivestreamID: livestreamID,
+		EmojiName:    emojiName,
 		CreatedAt:    time.Now().Unix(),
 	}
 
-	result, err := tx.NamedExecContext(ctx, "INSERT INTO reactions (user_id, livestream_id, emoji_name, created_at) VALUES (:user_id, :livestream_id, :emoji_name, :created_at)", reactionModel)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert reaction: "+err.Error())
+	// 重複排除モードでは既存の行を確認してから書き込むので、バッチ書き込みは使わない
+	useBatch := reactionBatchWriter != nil && !features.ReactionDedup
+
+	// バッチ書き込みはトランザクション外で行う
+	// トランザクションを開いたまま待つとコネクションを掴んだままになり、書き込み側がコネクションを取れなくなる
+	if useBatch {
+		if err := reactionBatchWriter.Insert(ctx, &reactionModel); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert reaction: "+err.Error())
+		}
 	}
 
-	reactionID, err := result.LastInsertId()
+	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted reaction id: "+err.Error())
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	// 同じユーザー・配信・絵文字のリアクションが既にあれば、行を増やさずに日時だけ更新する
+	// 既存の行を SELECT ... FOR UPDATE で探すだけでは、まだ行がないときに同時に来た2件が両方INSERTしてしまう
+	// reaction_dedup_keys の一意キーの行を先に押さえ、同じ組み合わせの書き込みを1件ずつにする
+	inserted := true
+	if features.ReactionDedup {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO reaction_dedup_keys (user_id, livestream_id, emoji_name) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE user_id = user_id", reactionModel.UserID, reactionModel.LivestreamID, reactionModel.EmojiName); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to lock reaction dedup key: "+err.Error())
+		}
+
+		// キーの行で直列化されているので、reactions 側はロックせずに読む
+		var existingID int64
+		err := tx.GetContext(ctx, &existingID, "SELECT id FROM reactions WHERE user_id = ? AND livestream_id = ? AND emoji_name = ? ORDER BY id LIMIT 1", reactionModel.UserID, reactionModel.LivestreamID, reactionModel.EmojiName)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reaction: "+err.Error())
+		}
+		if err == nil {
+			if _, err := tx.ExecContext(ctx, "UPDATE reactions SET created_at = ? WHERE id = ?", reactionModel.CreatedAt, existingID); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reaction: "+err.Error())
+			}
+			reactionModel.ID = existingID
+			inserted = false
+		}
+	}
+
+	if !useBatch && inserted {
+		result, err := tx.NamedExecContext(ctx, "INSERT INTO reactions (user_id, livestream_id, emoji_name, created_at) VALUES (:user_id, :livestream_id, :emoji_name, :created_at)", reactionModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert reaction: "+err.Error())
+		}
+
+		reactionID, err := result.LastInsertId()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted reaction id: "+err.Error())
+		}
+		reactionModel.ID = reactionID
 	}
-	reactionModel.ID = reactionID
 
 	reaction, err := fillReactionResponse(ctx, tx, reactionModel)
 	if err != nil {
@@ -138,9 +364,169 @@ func postReactionHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	if !inserted {
+		// 件数は変わらないので、集計のキャッシュやスコアはそのまま
+		return c.JSON(http.StatusOK, reaction)
+	}
+
+	invalidateFavoriteEmoji(reaction.Livestream.Owner.ID)
+	invalidateUserStats(reaction.Livestream.Owner.ID)
+
+	if err := incrUserScore(ctx, reaction.Livestream.Owner.Name, 1); err != nil {
+		c.Logger().Warnf("failed to increment user score: %+v", err)
+	}
+	if err := incrLivestreamScore(ctx, reaction.Livestream.ID, 1); err != nil {
+		c.Logger().Warnf("failed to increment livestream score: %+v", err)
+	}
+
 	return c.JSON(http.StatusCreated, reaction)
 }
 
+// reactionBatchWriter はリアクションのINSERTをまとめて行います
+// nil の場合はリクエストごとにINSERTします
+var reactionBatchWriter *reactionBatcher
+
+type reactionInsertRequest struct {
+	model  *ReactionModel
+	result chan error
+}
+
+// reactionBatcher は短い間隔で届いたリアクションを1回のトランザクションにまとめて書き込みます
+// 件数が maxBatch に達するか、最初の1件から interval が経過したら書き込みます
+type reactionBatcher struct {
+	queue    chan reactionInsertRequest
+	maxBatch int
+	interval time.Duration
+}
+
+func getReactionRateKey(userID, livestreamID int64, emojiName string) string {
+	return reactionRateKeyspace.Key(livestreamID, userID, emojiName)
+}
+
+// checkReactionRateLimit はユーザーが同じ配信に同じ絵文字を reactionRateWindow の間に
+// reactionRateLimit 回より多く投稿しようとしていないかを Redis のカウンタで確かめます
+// 制限を超えた場合はカウンタが消えるまでの時間を返す
+// Redis が使えない場合はリアクションの投稿を止めないよう、制限せずに通す
+func checkReactionRateLimit(ctx context.Context, userID, livestreamID int64, emojiName string) (time.Duration, bool) {
+	if reactionRateLimit <= 0 {
+		return 0, false
+	}
+
+	key := getReactionRateKey(userID, livestreamID, emojiName)
+	count, err := redisConn.Incr(ctx, key).Result()
+	if err != nil {
+		log.Printf("failed to count reactions for rate limit: %+v", err)
+		return 0, false
+	}
+	if count == 1 {
+		if err := redisConn.Expire(ctx, key, reactionRateWindow).Err(); err != nil {
+			log.Printf("failed to set reaction rate limit window: %+v", err)
+		}
+	}
+	if count <= int64(reactionRateLimit) {
+		return 0, false
+	}
+
+	ttl, err := redisConn.PTTL(ctx, key).Result()
+	if err != nil || ttl < 0 {
+		// 有効期限が付いていなければカウンタが残り続けるので、ここで付け直す
+		if ttl == -1 {
+			redisConn.Expire(ctx, key, reactionRateWindow)
+		}
+		ttl = reactionRateWindow
+	}
+	return ttl, true
+}
+
+func newReactionBatcher(maxBatch int, interval time.Duration) *reactionBatcher {
+	b := &reactionBatcher{
+		queue:    make(chan reactionInsertRequest, maxBatch),
+		maxBatch: maxBatch,
+		interval: interval,
+	}
+	go b.run()
+	return b
+}
+
+// Insert はリアクションを書き込み、採番されたIDを model.ID に設定します
+// キューに積んだ後に ctx がキャンセルされても書き込み自体は行われます
+func (b *reactionBatcher) Insert(ctx context.Context, model *ReactionModel) error {
+	req := reactionInsertRequest{
+		model:  model,
+		result: make(chan error, 1),
+	}
+
+	select {
+	case b.queue <- req:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-req.result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *reactionBatcher) run() {
+	for {
+		batch := []reactionInsertRequest{<-b.queue}
+
+		timer := time.NewTimer(b.interval)
+	collect:
+		for len(batch) < b.maxBatch {
+			select {
+			case req := <-b.queue:
+				batch = append(batch, req)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+
+		b.flush(batch)
+	}
+}
+
+// flush はまとめたリアクションを1つのトランザクションで書き込みます
+// 複数行INSERTは innodb_autoinc_lock_mode=2 だとIDが連番になる保証が無いので、1行ずつINSERTして LastInsertId を取る
+// コミットは1回なので、書き込みをまとめる効果はそのまま残る
+func (b *reactionBatcher) flush(batch []reactionInsertRequest) {
+	err := b.insert(context.Background(), batch)
+	for i := range batch {
+		batch[i].result <- err
+	}
+}
+
+func (b *reactionBatcher) insert(ctx context.Context, batch []reactionInsertRequest) error {
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	ids := make([]int64, len(batch))
+	for i := range batch {
+		result, err := tx.NamedExecContext(ctx, "INSERT INTO reactions (user_id, livestream_id, emoji_name, created_at) VALUES (:user_id, :livestream_id, :emoji_name, :created_at)", batch[i].model)
+		if err != nil {
+			return err
+		}
+		if ids[i], err = result.LastInsertId(); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for i := range batch {
+		batch[i].model.ID = ids[i]
+	}
+	return nil
+}
+
 func fillReactionResponse(ctx context.Context, tx *sqlx.Tx, reactionModel ReactionModel) (Reaction, error) {
 	userModel, err := getUser(ctx, tx, reactionModel.UserID)
 	if err != nil {
@@ -170,3 +556,65 @@ func fillReactionResponse(ctx context.Context, tx *sqlx.Tx, reactionModel Reacti
 
 	return reaction, nil
 }
+
+// fillReactionsResponse は同一配信に対するリアクションをまとめて埋めます
+// 配信は一度だけ、ユーザーは同じユーザーにつき一度だけ fillUser で埋めます
+func fillReactionsResponse(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel, reactionModels []ReactionModel, fillUser userFiller) ([]Reaction, error) {
+	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
+	if err != nil {
+		return nil, err
+	}
+
+	users := make(map[int64]User)
+	reactions := make([]Reaction, len(reactionModels))
+	for i := range reactionModels {
+		user, ok := users[reactionModels[i].UserID]
+		if !ok {
+			userModel, err := getUser(ctx, tx, reactionModels[i].UserID)
+			if err != nil {
+				return nil, err
+			}
+			user, err = fillUser(ctx, tx, userModel)
+			if err != nil {
+				return nil, err
+			}
+			users[reactionModels[i].UserID] = user
+		}
+
+		reactions[i] = Reaction{
+			ID:         reactionModels[i].ID,
+			EmojiName:  reactionModels[i].EmojiName,
+			User:       user,
+			Livestream: livestream,
+			CreatedAt:  reactionModels[i].CreatedAt,
+		}
+	}
+
+	return reactions, nil
+}
+
+// getReactionCounts は配信ごとのリアクション数をまとめて集計します
+// リアクションが無い配信はマップに含まれないので、参照側では0として扱う
+// since (unix 秒) より前のリアクションは数えない。全期間の場合は 0 を渡す
+func getReactionCounts(ctx context.Context, tx *sqlx.Tx, livestreamIDs []int64, since int64) (map[int64]int64, error) {
+	reactionCounts := make(map[int64]int64, len(livestreamIDs))
+	if len(livestreamIDs) == 0 {
+		return reactionCounts, nil
+	}
+
+	var counts []struct {
+		LivestreamID int64 `db:"livestream_id"`
+		Count        int64 `db:"cnt"`
+	}
+	query, params, err := sqlx.In("SELECT livestream_id, COUNT(*) AS cnt FROM reactions WHERE livestream_id IN (?) AND created_at >= ? GROUP BY livestream_id", livestreamIDs, since)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.SelectContext(ctx, &counts, query, params...); err != nil {
+		return nil, err
+	}
+	for _, cnt := range counts {
+		reactionCounts[cnt.LivestreamID] = cnt.Count
+	}
+	return reactionCounts, nil
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// 絵文字で絞り込むと、その絵文字のリアクションだけが新しい順に返る
+func TestGetReactionsByEmoji(t *testing.T) {
+	setupIntegration(t)
+	owner := createTestUser(t)
+	viewer := createTestUser(t)
+	livestream := createTestLivestream(t, owner.ID)
+	now := time.Now().Unix()
+	var want []int64
+	for i, emojiName := range []string{"heart", "smile", "heart", "+1", "heart"} {
+		reaction := createTestReaction(t, viewer.ID, livestream.ID, emojiName, now+int64(i))
+		if emojiName == "heart" {
+			want = append([]int64{reaction.ID}, want...)
+		}
+	}
+
+	id := strconv.FormatInt(livestream.ID, 10)
+	c, rec := newTestContext(http.MethodGet, "/api/livestream/"+id+"/reactions?emoji=Heart", nil)
+	c.SetParamNames("livestream_id")
+	c.SetParamValues(id)
+	if err := serveWithSession(c, viewer, getReactionsByEmojiHandler); err != nil {
+		t.Fatalf("getReactionsByEmojiHandler: %+v", err)
+	}
+	var reactions []Reaction
+	if err := json.Unmarshal(rec.Body.Bytes(), &reactions); err != nil {
+		t.Fatalf("failed to decode response: %+v", err)
+	}
+	if len(reactions) != len(want) {
+		t.Fatalf("got %d reactions, want %d", len(reactions), len(want))
+	}
+	for i, reaction := range reactions {
+		if reaction.EmojiName != "heart" {
+			t.Errorf("reactions[%d].emoji_name = %s, want heart", i, reaction.EmojiName)
+		}
+		if reaction.ID != want[i] {
+			t.Errorf("reactions[%d].id = %d, want %d", i, reaction.ID, want[i])
+		}
+		if reaction.User.ID != viewer.ID {
+			t.Errorf("reactions[%d].user.id = %d, want %d", i, reaction.User.ID, viewer.ID)
+		}
+	}
+}
+
+// emoji を指定しないか、使えない文字を含めば 400 を返す
+func TestGetReactionsByEmojiRequiresEmoji(t *testing.T) {
+	user := UserModel{ID: 1 << 40, Name: "test001"}
+	cacheTestUser(t, user)
+	for _, query := range []string{"", "?emoji=", "?emoji=he%20art", "?emoji=%E2%9D%A4", "?emoji=heart%27"} {
+		c, _ := newTestContext(http.MethodGet, "/api/livestream/1/reactions"+query, nil)
+		c.SetParamNames("livestream_id")
+		c.SetParamValues("1")
+		err := serveWithSession(c, user, getReactionsByEmojiHandler)
+		wantBadRequest(t, err)
+	}
+}
+
+// 自分のリアクション履歴は、複数の配信にまたがって新しい順に配信タイトル付きで返る
+func TestGetMyReactions(t *testing.T) {
+	setupIntegration(t)
+	owner := createTestUser(t)
+	viewer := createTestUser(t)
+	livestreams := []LivestreamModel{createTestLivestream(t, owner.ID), createTestLivestream(t, owner.ID)}
+	now := time.Now().Unix()
+	var want []ReactionModel
+	for i := 0; i < 4; i++ {
+		reaction := createTestReaction(t, viewer.ID, livestreams[i%2].ID, "heart", now+int64(i))
+		want = append([]ReactionModel{reaction}, want...)
+	}
+	// 他のユーザーのリアクションは含まない
+	createTestReaction(t, owner.ID, livestreams[0].ID, "smile", now+10)
+
+	c, rec := newTestContext(http.MethodGet, "/api/user/me/reactions", nil)
+	if err := serveWithSession(c, viewer, getMyReactionsHandler); err != nil {
+		t.Fatalf("getMyReactionsHandler: %+v", err)
+	}
+	var history []ReactionHistoryEntry
+	if err := json.Unmarshal(rec.Body.Bytes(), &history); err != nil {
+		t.Fatalf("failed to decode response: %+v", err)
+	}
+	if len(history) != len(want) {
+		t.Fatalf("got %d entries, want %d", len(history), len(want))
+	}
+	for i, entry := range history {
+		if entry.ID != want[i].ID || entry.LivestreamID != want[i].LivestreamID {
+			t.Errorf("history[%d] = %+v, want reaction %d on livestream %d", i, entry, want[i].ID, want[i].LivestreamID)
+		}
+		if entry.LivestreamTitle != "test livestream" {
+			t.Errorf("history[%d].livestream_title = %q, want %q", i, entry.LivestreamTitle, "test livestream")
+		}
+	}
+}
+
+// postTestReaction は postReactionHandler でリアクションを付け、ステータスとエラーを返します
+func postTestReaction(t *testing.T, user UserModel, livestreamID int64, emojiName string) (int, error) {
+	t.Helper()
+	body, err := json.Marshal(PostReactionRequest{EmojiName: emojiName})
+	if err != nil {
+		t.Fatalf("failed to marshal request: %+v", err)
+	}
+	id := strconv.FormatInt(livestreamID, 10)
+	c, rec := newTestContext(http.MethodPost, "/api/livestream/"+id+"/reaction", bytes.NewReader(body))
+	c.SetParamNames("livestream_id")
+	c.SetParamValues(id)
+	err = serveWithSession(c, user, postReactionHandler)
+	return rec.Code, err
+}
+
+// まとめて書き込んでも、並行して投稿したリアクションはすべて別のIDで保存される
+func TestReactionBatcherPersistsAll(t *testing.T) {
+	setupIntegration(t)
+	prevWriter, prevFeatures := reactionBatchWriter, features
+	reactionBatchWriter = newReactionBatcher(8, 20*time.Millisecond)
+	features.ReactionDedup = false
+	t.Cleanup(func() { reactionBatchWriter, features = prevWriter, prevFeatures })
+
+	owner := createTestUser(t)
+	viewer := createTestUser(t)
+	livestream := createTestLivestream(t, owner.ID)
+
+	const posts = 30
+	ids := make([]int64, posts)
+	var wg sync.WaitGroup
+	for i := 0; i < posts; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			model := ReactionModel{UserID: viewer.ID, LivestreamID: livestream.ID, EmojiName: "heart", CreatedAt: time.Now().Unix()}
+			if err := reactionBatchWriter.Insert(context.Background(), &model); err != nil {
+				t.Errorf("Insert: %+v", err)
+				return
+			}
+			ids[i] = model.ID
+		}(i)
+	}
+	wg.Wait()
+
+	seen := make(map[int64]bool, posts)
+	for i, id := range ids {
+		if id == 0 || seen[id] {
+			t.Errorf("ids[%d] = %d, want a distinct inserted id", i, id)
+		}
+		seen[id] = true
+	}
+	var count int64
+	if err := dbConn.GetContext(context.Background(), &count, "SELECT COUNT(*) FROM reactions WHERE livestream_id = ?", livestream.ID); err != nil {
+		t.Fatalf("failed to count reactions: %+v", err)
+	}
+	if count != posts {
+		t.Errorf("count = %d, want %d", count, posts)
+	}
+}
+
+// 書き込みに失敗したら、まとめられたリアクションすべてにエラーを返す
+func TestReactionBatcherReturnsError(t *testing.T) {
+	prevDB := dbConn
+	dbConn = newBrokenDB(t)
+	t.Cleanup(func() { dbConn = prevDB })
+	b := newReactionBatcher(4, 10*time.Millisecond)
+
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		go func() {
+			model := ReactionModel{UserID: 1, LivestreamID: 1, EmojiName: "heart"}
+			errs <- b.Insert(context.Background(), &model)
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		if err := <-errs; err == nil {
+			t.Error("Insert succeeded with a broken db")
+		}
+	}
+}
+
+func TestNormalizeEmojiName(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		want   string
+		wantOK bool
+	}{
+		{"heart", "heart", true},
+		{"Heart_Eyes", "heart_eyes", true},
+		{" +1 ", "+1", true},
+		{"thumbs-up", "thumbs-up", true},
+		{"", "", false},
+		{"heart eyes", "", false},
+		{"<script>", "", false},
+		{"ハート", "", false},
+	} {
+		got, ok := normalizeEmojiName(tt.name)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("normalizeEmojiName(%q) = (%q, %v), want (%q, %v)", tt.name, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+// 使えない文字を含む絵文字名のリアクションは、DBに触れる前に 400 で断る
+func TestPostReactionRejectsInvalidEmoji(t *testing.T) {
+	user := UserModel{ID: 1<<40 + 7, Name: "test007"}
+	cacheTestUser(t, user)
+	for _, emojiName := range []string{"", "heart eyes", "<script>"} {
+		_, err := postTestReaction(t, user, 1, emojiName)
+		wantBadRequest(t, err)
+	}
+}
+
+func countTestReactions(t *testing.T, userID, livestreamID int64, emojiName string) int64 {
+	t.Helper()
+	var count int64
+	if err := dbConn.GetContext(context.Background(), &count, "SELECT COUNT(*) FROM reactions WHERE user_id = ? AND livestream_id = ? AND emoji_name = ?", userID, livestreamID, emojiName); err != nil {
+		t.Fatalf("failed to count reactions: %+v", err)
+	}
+	return count
+}
+
+// 重複排除モードでは、同じリアクションを何度付けても、同時に付けても1件のまま
+func TestPostReactionDedup(t *testing.T) {
+	setupIntegration(t)
+	prevFeatures := features
+	features.ReactionDedup = true
+	t.Cleanup(func() { features = prevFeatures })
+	owner := createTestUser(t)
+	viewer := createTestUser(t)
+	livestream := createTestLivestream(t, owner.ID)
+
+	for i := 0; i < 2; i++ {
+		if code, err := postTestReaction(t, viewer, livestream.ID, "heart"); err != nil || code/100 != 2 {
+			t.Fatalf("post %d: postReactionHandler = %d, %+v", i+1, code, err)
+		}
+	}
+	if got := countTestReactions(t, viewer.ID, livestream.ID, "heart"); got != 1 {
+		t.Errorf("count after posting twice = %d, want 1", got)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if code, err := postTestReaction(t, viewer, livestream.ID, "smile"); err != nil || code/100 != 2 {
+				t.Errorf("postReactionHandler = %d, %+v", code, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := countTestReactions(t, viewer.ID, livestream.ID, "smile"); got != 1 {
+		t.Errorf("count after concurrent posts = %d, want 1", got)
+	}
+}
+
+// 重複排除モードでなければ、同じリアクションも別の行として数える
+func TestPostReactionWithoutDedup(t *testing.T) {
+	setupIntegration(t)
+	prevFeatures := features
+	features.ReactionDedup = false
+	t.Cleanup(func() { features = prevFeatures })
+	owner := createTestUser(t)
+	viewer := createTestUser(t)
+	livestream := createTestLivestream(t, owner.ID)
+
+	for i := 0; i < 2; i++ {
+		if code, err := postTestReaction(t, viewer, livestream.ID, "heart"); err != nil || code != http.StatusCreated {
+			t.Fatalf("post %d: postReactionHandler = %d, %+v", i+1, code, err)
+		}
+	}
+	if got := countTestReactions(t, viewer.ID, livestream.ID, "heart"); got != 2 {
+		t.Errorf("count = %d, want 2", got)
+	}
+}
+
+// 指定した配信の分だけを1クエリで数え、リアクションの無い配信はマップに含めない
+func TestGetReactionCountsSubset(t *testing.T) {
+	setupIntegration(t)
+	ctx := context.Background()
+	owner := createTestUser(t)
+	viewer := createTestUser(t)
+	now := time.Now().Unix()
+	var livestreams []LivestreamModel
+	for i, n := range []int{2, 0, 3} {
+		livestreams = append(livestreams, createTestLivestream(t, owner.ID))
+		for j := 0; j < n; j++ {
+			createTestReaction(t, viewer.ID, livestreams[i].ID, "heart", now-int64(j)*60)
+		}
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		t.Fatalf("failed to begin transaction: %+v", err)
+	}
+	defer tx.Rollback()
+
+	got, err := getReactionCounts(ctx, tx, []int64{livestreams[0].ID, livestreams[1].ID}, 0)
+	if err != nil {
+		t.Fatalf("getReactionCounts: %+v", err)
+	}
+	want := map[int64]int64{livestreams[0].ID: 2}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("getReactionCounts = %v, want %v", got, want)
+	}
+
+	// since より前のリアクションは数えない
+	got, err = getReactionCounts(ctx, tx, []int64{livestreams[0].ID, livestreams[2].ID}, now-30)
+	if err != nil {
+		t.Fatalf("getReactionCounts with since: %+v", err)
+	}
+	want = map[int64]int64{livestreams[0].ID: 1, livestreams[2].ID: 1}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("getReactionCounts with since = %v, want %v", got, want)
+	}
+}
+
+// 配信が無ければDBを引かずに空のマップを返す
+func TestGetReactionCountsEmpty(t *testing.T) {
+	got, err := getReactionCounts(context.Background(), nil, nil, 0)
+	if err != nil {
+		t.Fatalf("getReactionCounts: %+v", err)
+	}
+	if got == nil || len(got) != 0 {
+		t.Errorf("getReactionCounts = %#v, want an empty map", got)
+	}
+}
+
+func setTestReactionRateLimit(t *testing.T, limit int, window time.Duration) {
+	t.Helper()
+	prevLimit, prevWindow := reactionRateLimit, reactionRateWindow
+	reactionRateLimit, reactionRateWindow = limit, window
+	t.Cleanup(func() { reactionRateLimit, reactionRateWindow = prevLimit, prevWindow })
+}
+
+// 同じ絵文字を上限より多く投稿すると 429 になり、他の絵文字や窓が過ぎた後は投稿できる
+func TestPostReactionRateLimit(t *testing.T) {
+	setupIntegration(t)
+	ctx := context.Background()
+	setTestReactionRateLimit(t, 2, time.Second)
+	prevFeatures := features
+	features.ReactionDedup = false
+	t.Cleanup(func() { features = prevFeatures })
+	owner := createTestUser(t)
+	viewer := createTestUser(t)
+	livestream := createTestLivestream(t, owner.ID)
+	t.Cleanup(func() {
+		redisConn.Del(context.Background(), getReactionRateKey(viewer.ID, livestream.ID, "heart"), getReactionRateKey(viewer.ID, livestream.ID, "smile"))
+	})
+
+	for i := 0; i < 2; i++ {
+		if code, err := postTestReaction(t, viewer, livestream.ID, "heart"); err != nil {
+			t.Fatalf("post %d: postReactionHandler = %d, %+v", i+1, code, err)
+		}
+	}
+	if _, err := postTestReaction(t, viewer, livestream.ID, "heart"); !isHTTPErrorCode(err, http.StatusTooManyRequests) {
+		t.Fatalf("post over the limit = %v, want %d", err, http.StatusTooManyRequests)
+	}
+	if code, err := postTestReaction(t, viewer, livestream.ID, "smile"); err != nil {
+		t.Errorf("another emoji: postReactionHandler = %d, %+v", code, err)
+	}
+
+	var count int
+	if err := dbConn.GetContext(ctx, &count, "SELECT COUNT(*) FROM reactions WHERE user_id = ? AND livestream_id = ?", viewer.ID, livestream.ID); err != nil {
+		t.Fatalf("failed to count reactions: %+v", err)
+	}
+	if count != 3 {
+		t.Errorf("stored %d reactions, want 3", count)
+	}
+
+	time.Sleep(reactionRateWindow + 100*time.Millisecond)
+	if code, err := postTestReaction(t, viewer, livestream.ID, "heart"); err != nil {
+		t.Errorf("after the window: postReactionHandler = %d, %+v", code, err)
+	}
+}
+
+// 制限を超えたときは窓の残り時間を返す
+func TestCheckReactionRateLimitRetryAfter(t *testing.T) {
+	setupIntegration(t)
+	ctx := context.Background()
+	setTestReactionRateLimit(t, 1, 5*time.Second)
+	key := getReactionRateKey(-1, -1, "heart")
+	redisConn.Del(ctx, key)
+	t.Cleanup(func() { redisConn.Del(context.Background(), key) })
+
+	if _, limited := checkReactionRateLimit(ctx, -1, -1, "heart"); limited {
+		t.Fatal("the first reaction was limited")
+	}
+	retryAfter, limited := checkReactionRateLimit(ctx, -1, -1, "heart")
+	if !limited {
+		t.Fatal("the second reaction was not limited")
+	}
+	if retryAfter <= 0 || retryAfter > reactionRateWindow {
+		t.Errorf("retry after = %v, want within (0, %v]", retryAfter, reactionRateWindow)
+	}
+}
+
+// Redis が使えなければ投稿を止めない
+func TestCheckReactionRateLimitWithoutRedis(t *testing.T) {
+	setTestReactionRateLimit(t, 1, time.Second)
+	prevRedis := redisConn
+	redisConn = redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	t.Cleanup(func() {
+		redisConn.Close()
+		redisConn = prevRedis
+	})
+
+	for i := 0; i < 3; i++ {
+		if _, limited := checkReactionRateLimit(context.Background(), 1, 1, "heart"); limited {
+			t.Fatalf("reaction %d was limited without redis", i+1)
+		}
+	}
+}
+
+// 自分が付けたリアクションだけを配信をまたいで数え、自分の配信が受けたものは数えない
+func TestGetMyReactionCount(t *testing.T) {
+	setupIntegration(t)
+	user := createTestUser(t)
+	other := createTestUser(t)
+	now := time.Now().Unix()
+	for _, livestream := range []LivestreamModel{createTestLivestream(t, other.ID), createTestLivestream(t, other.ID)} {
+		createTestReaction(t, user.ID, livestream.ID, "smile", now)
+		createTestReaction(t, user.ID, livestream.ID, "innocent", now)
+	}
+	own := createTestLivestream(t, user.ID)
+	createTestReaction(t, other.ID, own.ID, "smile", now)
+
+	c, rec := newTestContext(http.MethodGet, "/api/user/me/reactions/count", nil)
+	if err := serveWithSession(c, user, getMyReactionCountHandler); err != nil {
+		t.Fatalf("getMyReactionCountHandler: %+v", err)
+	}
+	var res ReactionCountResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("failed to decode response: %+v", err)
+	}
+	if res.Count != 4 {
+		t.Errorf("count = %d, want 4", res.Count)
+	}
+}
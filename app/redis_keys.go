@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Redisのキーはすべて redisKeyPrefix 以下に置き、用途ごとの名前空間から組み立てる
+// キー名を一箇所で管理して衝突を避け、初期化時に前方一致でまとめて消せるようにする
+const redisKeyPrefix = "isupipe:"
+
+// redisKeyspace は用途ごとのキーの名前空間です
+type redisKeyspace string
+
+const (
+	iconHashKeyspace         redisKeyspace = "icon_hash"
+	registerNonceKeyspace    redisKeyspace = "register_nonce"
+	userScoresKeyspace       redisKeyspace = "user_scores"
+	livestreamScoresKeyspace redisKeyspace = "livestream_scores"
+	thumbnailHashKeyspace    redisKeyspace = "thumbnail_hash"
+	reactionRateKeyspace     redisKeyspace = "reaction_rate"
+	activeSessionsKeyspace   redisKeyspace = "active_sessions"
+	dnsRetryKeyspace         redisKeyspace = "dns_retry"
+	// Pub/Sub のチャンネル名。キーではないので flushRedisKeys の対象にはならない
+	livecommentChannelKeyspace redisKeyspace = "livecomment_channel"
+)
+
+// Key は名前空間の下のキーを返します。parts は ":" で連結する
+func (ks redisKeyspace) Key(parts ...interface{}) string {
+	var b strings.Builder
+	b.WriteString(redisKeyPrefix)
+	b.WriteString(string(ks))
+	for _, part := range parts {
+		b.WriteByte(':')
+		fmt.Fprint(&b, part)
+	}
+	return b.String()
+}
+
+// 1回の SCAN / UNLINK で扱うキーの数
+const redisFlushBatchSize = 1000
+
+// flushRedisKeys は prefix から始まるキーをすべて消します
+// FLUSHALL と違い、同じRedisを使う他の用途のキーは残る
+func flushRedisKeys(ctx context.Context, prefix string) error {
+	var cursor uint64
+	for {
+		keys, next, err := redisConn.Scan(ctx, cursor, prefix+"*", redisFlushBatchSize).Result()
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			if err := redisConn.Unlink(ctx, keys...).Err(); err != nil {
+				return err
+			}
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
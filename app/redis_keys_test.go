@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestRedisKeyFormats(t *testing.T) {
+	for _, tt := range []struct {
+		got  string
+		want string
+	}{
+		{getIconHashKey(42), "isupipe:icon_hash:42"},
+		{getRegisterNonceKey("abc", "alice"), "isupipe:register_nonce:abc:alice"},
+		{getThumbnailHashKey(7), "isupipe:thumbnail_hash:7"},
+		{getReactionRateKey(1, 2, "heart"), "isupipe:reaction_rate:2:1:heart"},
+		{userScoresKey, "isupipe:user_scores"},
+		{livestreamScoresKey, "isupipe:livestream_scores"},
+		{activeSessionsKey, "isupipe:active_sessions"},
+		{dnsRetryKey, "isupipe:dns_retry"},
+	} {
+		if tt.got != tt.want {
+			t.Errorf("key = %q, want %q", tt.got, tt.want)
+		}
+	}
+}
+
+// 名前空間の下のキーだけを消し、同じRedisにある他の用途のキーは残す
+func TestFlushRedisKeysByPrefix(t *testing.T) {
+	setupIntegration(t)
+	ctx := context.Background()
+
+	ownKeys := []string{getIconHashKey(1), getThumbnailHashKey(1), userScoresKey}
+	for _, key := range ownKeys {
+		if err := redisConn.Set(ctx, key, "x", 0).Err(); err != nil {
+			t.Fatalf("failed to set %s: %+v", key, err)
+		}
+	}
+	foreignKey := "flush-test:other"
+	if err := redisConn.Set(ctx, foreignKey, "x", 0).Err(); err != nil {
+		t.Fatalf("failed to set %s: %+v", foreignKey, err)
+	}
+	t.Cleanup(func() { redisConn.Del(context.Background(), foreignKey) })
+
+	if err := flushRedisKeys(ctx, redisKeyPrefix); err != nil {
+		t.Fatalf("flushRedisKeys: %+v", err)
+	}
+
+	for _, key := range ownKeys {
+		if err := redisConn.Get(ctx, key).Err(); !errors.Is(err, redis.Nil) {
+			t.Errorf("%s survived the flush: %v", key, err)
+		}
+	}
+	if err := redisConn.Get(ctx, foreignKey).Err(); err != nil {
+		t.Errorf("%s was flushed: %+v", foreignKey, err)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/labstack/echo/v4"
+)
+
+// registrationClosed が true の間は新規登録を受け付けない
+// 障害対応中などに再起動せず切り替えられるよう、起動後も管理者用APIで変えられる
+// 既存ユーザーのログインや管理者の一括登録は止めない
+var registrationClosed atomic.Bool
+
+func init() {
+	expvar.Publish("registration_open", expvar.Func(func() interface{} { return !registrationClosed.Load() }))
+}
+
+type RegistrationStatus struct {
+	Open bool `json:"open"`
+}
+
+// 新規登録の受付状態を取得するAPI
+// GET /api/admin/registration
+func getRegistrationHandler(c echo.Context) error {
+	if err := verifyAdminToken(c); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, RegistrationStatus{Open: !registrationClosed.Load()})
+}
+
+// 新規登録の受付状態を切り替えるAPI
+// PUT /api/admin/registration
+func putRegistrationHandler(c echo.Context) error {
+	defer c.Request().Body.Close()
+
+	if err := verifyAdminToken(c); err != nil {
+		return err
+	}
+
+	var req RegistrationStatus
+	if err := decodeJSON(c.Request().Body, &req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	registrationClosed.Store(!req.Open)
+	c.Logger().Infof("registration open = %t", req.Open)
+
+	return c.JSON(http.StatusOK, req)
+}
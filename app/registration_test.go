@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo-contrib/session"
+)
+
+// putTestRegistration は管理者用APIで新規登録の受付を切り替え、テスト後に元に戻します
+func putTestRegistration(t *testing.T, open bool) {
+	t.Helper()
+	prevClosed := registrationClosed.Load()
+	t.Cleanup(func() { registrationClosed.Store(prevClosed) })
+	c, _ := newTestContext(http.MethodPut, "/api/admin/registration", strings.NewReader(fmt.Sprintf(`{"open":%t}`, open)))
+	c.Request().Header.Set(adminTokenHeader, adminToken)
+	if err := putRegistrationHandler(c); err != nil {
+		t.Fatalf("putRegistrationHandler: %+v", err)
+	}
+}
+
+func getTestRegistration(t *testing.T) RegistrationStatus {
+	t.Helper()
+	c, rec := newTestContext(http.MethodGet, "/api/admin/registration", nil)
+	c.Request().Header.Set(adminTokenHeader, adminToken)
+	if err := getRegistrationHandler(c); err != nil {
+		t.Fatalf("getRegistrationHandler: %+v", err)
+	}
+	var res RegistrationStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("failed to decode response: %+v", err)
+	}
+	return res
+}
+
+// 受付を止めている間は DB に触れずに 503 を返し、状態はAPIとメトリクスから見える
+func TestRegistrationClosed(t *testing.T) {
+	prevToken, prevDB := adminToken, dbConn
+	adminToken, dbConn = "test-admin-token", nil
+	t.Cleanup(func() { adminToken, dbConn = prevToken, prevDB })
+
+	putTestRegistration(t, false)
+	if res := getTestRegistration(t); res.Open {
+		t.Error("registration is reported open after closing it")
+	}
+	if got := expvar.Get("registration_open").String(); got != "false" {
+		t.Errorf("registration_open = %s, want false", got)
+	}
+	c, _ := newTestContext(http.MethodPost, "/api/register", strings.NewReader(`{"name":"alice","display_name":"alice","password":"s3cr3t"}`))
+	if err := registerHandler(c); !isHTTPErrorCode(err, http.StatusServiceUnavailable) {
+		t.Errorf("registerHandler while closed = %v, want 503", err)
+	}
+
+	putTestRegistration(t, true)
+	if res := getTestRegistration(t); !res.Open {
+		t.Error("registration is reported closed after opening it")
+	}
+}
+
+// 受付を止めても既存ユーザーはログインでき、再開すれば登録できる
+func TestRegistrationClosedAllowsLogin(t *testing.T) {
+	setupIntegration(t)
+	setTestZoneFile(t, "")
+	fakePDNSControl(t)
+	prevToken := adminToken
+	adminToken = "test-admin-token"
+	t.Cleanup(func() { adminToken = prevToken })
+	name := fmt.Sprintf("test%dopen", time.Now().UnixNano())
+	if code, _ := postTestRegister(t, PostUserRequest{Name: name, DisplayName: name, Password: "s3cr3t"}); code != http.StatusCreated {
+		t.Fatalf("register status = %d, want %d", code, http.StatusCreated)
+	}
+
+	putTestRegistration(t, false)
+	c, _ := newTestContext(http.MethodPost, "/api/register", strings.NewReader(`{"name":"`+name+`closed","display_name":"x","password":"s3cr3t"}`))
+	if err := registerHandler(c); !isHTTPErrorCode(err, http.StatusServiceUnavailable) {
+		t.Errorf("registerHandler while closed = %v, want 503", err)
+	}
+	body, err := json.Marshal(LoginRequest{Username: name, Password: "s3cr3t"})
+	if err != nil {
+		t.Fatalf("failed to marshal request: %+v", err)
+	}
+	c, rec := newTestContext(http.MethodPost, "/api/login", bytes.NewReader(body))
+	if err := session.Middleware(sessions.NewCookieStore(secret))(loginHandler)(c); err != nil {
+		t.Fatalf("loginHandler while registration is closed: %+v", err)
+	}
+	if rec.Code != http.StatusOK {
+		t.Errorf("login status = %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	putTestRegistration(t, true)
+	if code, _ := postTestRegister(t, PostUserRequest{Name: name + "reopened", DisplayName: name, Password: "s3cr3t"}); code != http.StatusCreated {
+		t.Errorf("register status after reopening = %d, want %d", code, http.StatusCreated)
+	}
+}
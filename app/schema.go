@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// schemaMigrations は ../sql のスキーマに対してアプリ側で追加するDDLです
+// init.sh でスキーマが作り直されても起動時・初期化時に流し直せるよう、既に適用済みのエラーは無視します
+var schemaMigrations = []string{
+	// 退出時に行を消さずに退出時刻を記録し、現在の視聴者数と累計視聴者数を分けて数えられるようにする
+	"ALTER TABLE livestream_viewers_history ADD COLUMN left_at BIGINT NULL DEFAULT NULL",
+	// ユーザー統計の視聴者数を配信ごとに GROUP BY で数えるため、livestream_id だけで完結するインデックスを張る
+	"ALTER TABLE livestream_viewers_history ADD INDEX livestream_viewers_history_livestream_id (livestream_id)",
+	// 退会したユーザーは外部キーの参照があるため消さずに論理削除する
+	"ALTER TABLE users ADD COLUMN deleted_at BIGINT NULL DEFAULT NULL",
+	// 登録日時。既存のユーザーは不明なので NULL のままにする
+	"ALTER TABLE users ADD COLUMN created_at BIGINT NULL DEFAULT NULL",
+	// 登録時のテーマ作成を ON DUPLICATE KEY UPDATE にするため、ユーザーごとに1件に制限する
+	"ALTER TABLE themes ADD UNIQUE INDEX themes_user_id (user_id)",
+	// 全配信の最新ライブコメントを、ソートせずにインデックスの先頭から読めるようにする
+	"ALTER TABLE livecomments ADD INDEX livecomments_created_at_id (created_at, id)",
+	// 配信のサムネイル画像 (アイコンと同じくDBに置く)
+	`CREATE TABLE livestream_thumbnails (
+		id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		livestream_id BIGINT NOT NULL,
+		image LONGBLOB NOT NULL,
+		thumbnail_hash VARCHAR(64) NOT NULL,
+		UNIQUE KEY livestream_thumbnails_livestream_id (livestream_id)
+	) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin`,
+	// リアクションの重複排除で、同じユーザー・配信・絵文字の書き込みを直列にするためのキー
+	// reactions 自体に一意制約を張ると重複排除しないモードで書き込めなくなるので、別テーブルにする
+	`CREATE TABLE reaction_dedup_keys (
+		user_id BIGINT NOT NULL,
+		livestream_id BIGINT NOT NULL,
+		emoji_name VARCHAR(255) NOT NULL,
+		PRIMARY KEY (user_id, livestream_id, emoji_name)
+	) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin`,
+}
+
+// 適用済みのDDLを流したときに返るエラー番号
+const (
+	mysqlErrTableExists      = 1050
+	mysqlErrDuplicateColumn  = 1060
+	mysqlErrDuplicateKeyName = 1061
+)
+
+func migrateSchema(ctx context.Context) error {
+	for _, query := range schemaMigrations {
+		if _, err := dbConn.ExecContext(ctx, query); err != nil {
+			var mysqlErr *mysql.MySQLError
+			if errors.As(err, &mysqlErr) {
+				switch mysqlErr.Number {
+				case mysqlErrTableExists, mysqlErrDuplicateColumn, mysqlErrDuplicateKeyName:
+					continue
+				}
+			}
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"expvar"
+	"log"
+	"strings"
+	"time"
+)
+
+// slowQueryThreshold より時間のかかったクエリをSQLと所要時間つきでログに出します
+// ハンドラは *sqlx.DB / *sqlx.Tx を直接使っているので、ドライバの接続をラップしてすべてのクエリを計測する
+// 引数はパスワードなどを含みうるのでログに出さない
+// SELECT の所要時間は結果セットの最初の応答までで、行の読み出しは含まない
+
+var slowQueries = expvar.NewInt("slow_queries")
+
+func observeQuery(query string, start time.Time) {
+	elapsed := time.Since(start)
+	if elapsed < slowQueryThreshold {
+		return
+	}
+	slowQueries.Add(1)
+	log.Printf("slow query (%s): %s", elapsed, strings.Join(strings.Fields(query), " "))
+}
+
+type slowQueryConnector struct {
+	connector driver.Connector
+}
+
+func (c slowQueryConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &slowQueryConn{Conn: conn}, nil
+}
+
+func (c slowQueryConnector) Driver() driver.Driver {
+	return c.connector.Driver()
+}
+
+// slowQueryConn は database/sql が型アサーションで使うインターフェースを元の接続にそのまま委譲します
+type slowQueryConn struct {
+	driver.Conn
+}
+
+func (c *slowQueryConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *slowQueryConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var stmt driver.Stmt
+	var err error
+	if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = preparer.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &slowQueryStmt{Stmt: stmt, query: query}, nil
+}
+
+func (c *slowQueryConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+// 引数がある場合、mysql ドライバは driver.ErrSkip を返して Prepare 経由の実行に切り替えるので、
+// その場合は slowQueryStmt 側で計測する
+func (c *slowQueryConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	res, err := execer.ExecContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		observeQuery(query, start)
+	}
+	return res, err
+}
+
+func (c *slowQueryConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	rows, err := queryer.QueryContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		observeQuery(query, start)
+	}
+	return rows, err
+}
+
+func (c *slowQueryConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *slowQueryConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *slowQueryConn) IsValid() bool {
+	if validator, ok := c.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+func (c *slowQueryConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+type slowQueryStmt struct {
+	driver.Stmt
+	query string
+}
+
+func (s *slowQueryStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	defer observeQuery(s.query, start)
+	if execer, ok := s.Stmt.(driver.StmtExecContext); ok {
+		return execer.ExecContext(ctx, args)
+	}
+	return s.Stmt.Exec(namedValuesToValues(args))
+}
+
+func (s *slowQueryStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	defer observeQuery(s.query, start)
+	if queryer, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		return queryer.QueryContext(ctx, args)
+	}
+	return s.Stmt.Query(namedValuesToValues(args))
+}
+
+func (s *slowQueryStmt) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := s.Stmt.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+func namedValuesToValues(args []driver.NamedValue) []driver.Value {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	return values
+}
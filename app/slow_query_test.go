@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"log"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeSlowDriver は SLEEP を含むクエリにだけ時間をかける、DBの要らないドライバです
+// 引数つきの Exec は mysql ドライバと同じく driver.ErrSkip を返して Prepare 経由にさせる
+type fakeSlowDriver struct{}
+
+func (fakeSlowDriver) Open(string) (driver.Conn, error) { return fakeSlowConn{}, nil }
+
+type fakeSlowConnector struct{}
+
+func (fakeSlowConnector) Connect(context.Context) (driver.Conn, error) { return fakeSlowConn{}, nil }
+func (fakeSlowConnector) Driver() driver.Driver                        { return fakeSlowDriver{} }
+
+const fakeSlowQueryDelay = 20 * time.Millisecond
+
+// fakeQueries は fakeSlowDriver に流れたクエリの数です
+var fakeQueries atomic.Int64
+
+// fakeOnQuery が設定されていれば、流れたクエリごとに呼ばれます
+var fakeOnQuery func(query string)
+
+func fakeRunQuery(query string) {
+	fakeQueries.Add(1)
+	if fakeOnQuery != nil {
+		fakeOnQuery(query)
+	}
+	if strings.Contains(query, "SLEEP") {
+		time.Sleep(fakeSlowQueryDelay)
+	}
+}
+
+type fakeSlowConn struct{}
+
+func (fakeSlowConn) Prepare(query string) (driver.Stmt, error) {
+	return fakeSlowStmt{query: query}, nil
+}
+func (fakeSlowConn) Close() error              { return nil }
+func (fakeSlowConn) Begin() (driver.Tx, error) { return fakeSlowTx{}, nil }
+
+func (fakeSlowConn) QueryContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	fakeRunQuery(query)
+	return fakeSlowRows{}, nil
+}
+
+func (fakeSlowConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if len(args) > 0 {
+		return nil, driver.ErrSkip
+	}
+	fakeRunQuery(query)
+	return driver.RowsAffected(0), nil
+}
+
+type fakeSlowTx struct{}
+
+// fakeCommits と fakeRollbacks は fakeSlowDriver で終えたトランザクションの数です
+var fakeCommits, fakeRollbacks atomic.Int64
+
+func (fakeSlowTx) Commit() error   { fakeCommits.Add(1); return nil }
+func (fakeSlowTx) Rollback() error { fakeRollbacks.Add(1); return nil }
+
+type fakeSlowStmt struct {
+	query string
+}
+
+func (s fakeSlowStmt) Close() error  { return nil }
+func (s fakeSlowStmt) NumInput() int { return -1 }
+func (s fakeSlowStmt) Exec([]driver.Value) (driver.Result, error) {
+	fakeRunQuery(s.query)
+	return driver.RowsAffected(1), nil
+}
+func (s fakeSlowStmt) Query([]driver.Value) (driver.Rows, error) {
+	fakeRunQuery(s.query)
+	return fakeSlowRows{}, nil
+}
+
+type fakeSlowRows struct{}
+
+func (fakeSlowRows) Columns() []string         { return nil }
+func (fakeSlowRows) Close() error              { return nil }
+func (fakeSlowRows) Next([]driver.Value) error { return io.EOF }
+
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	prevWriter, prevFlags := log.Writer(), log.Flags()
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	t.Cleanup(func() {
+		log.SetOutput(prevWriter)
+		log.SetFlags(prevFlags)
+	})
+	return &buf
+}
+
+// しきい値を超えたクエリだけを、引数を含めずにログに出す
+func TestSlowQueryLogged(t *testing.T) {
+	prevThreshold := slowQueryThreshold
+	slowQueryThreshold = fakeSlowQueryDelay / 2
+	t.Cleanup(func() { slowQueryThreshold = prevThreshold })
+	logs := captureLog(t)
+
+	db := sql.OpenDB(slowQueryConnector{connector: fakeSlowConnector{}})
+	t.Cleanup(func() { db.Close() })
+	ctx := context.Background()
+	before := slowQueries.Value()
+
+	for _, query := range []string{"SELECT 1 FAST", "SELECT SLEEP(1)\n  FROM dual"} {
+		rows, err := db.QueryContext(ctx, query)
+		if err != nil {
+			t.Fatalf("query %q: %+v", query, err)
+		}
+		rows.Close()
+	}
+	if _, err := db.ExecContext(ctx, "UPDATE users SET password = ? WHERE SLEEP(1)", "secret-password"); err != nil {
+		t.Fatalf("slow prepared exec: %+v", err)
+	}
+
+	if got := slowQueries.Value() - before; got != 2 {
+		t.Errorf("slow_queries increased by %d, want 2", got)
+	}
+	out := logs.String()
+	if strings.Contains(out, "FAST") {
+		t.Errorf("fast query was logged: %s", out)
+	}
+	if !strings.Contains(out, "SELECT SLEEP(1) FROM dual") {
+		t.Errorf("slow query was not logged on one line: %s", out)
+	}
+	if !strings.Contains(out, "UPDATE users SET password = ? WHERE SLEEP(1)") {
+		t.Errorf("slow prepared exec was not logged: %s", out)
+	}
+	if strings.Contains(out, "secret-password") {
+		t.Errorf("query arguments were logged: %s", out)
+	}
+}
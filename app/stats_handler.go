@@ -4,20 +4,31 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
+	"log"
 	"net/http"
 	"sort"
 	"strconv"
+	"sync"
+	"time"
 
+	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo/v4"
 	"golang.org/x/sync/singleflight"
 )
 
 type LivestreamStatistics struct {
-	Rank           int64 `json:"rank"`
-	ViewersCount   int64 `json:"viewers_count"`
-	TotalReactions int64 `json:"total_reactions"`
-	TotalReports   int64 `json:"total_reports"`
-	MaxTip         int64 `json:"max_tip"`
+	// Rank は rank=false で順位を求めなかった場合は 0
+	Rank int64 `json:"rank"`
+	// ViewersCount は現在視聴中(退出していない)の視聴者数
+	ViewersCount int64 `json:"viewers_count"`
+	// TotalViewers は退出済みも含めた累計視聴者数
+	TotalViewers int64 `json:"total_viewers"`
+	// MaxConcurrentViewers は同時視聴者数のピーク
+	MaxConcurrentViewers int64 `json:"max_concurrent_viewers"`
+	TotalReactions       int64 `json:"total_reactions"`
+	TotalReports         int64 `json:"total_reports"`
+	MaxTip               int64 `json:"max_tip"`
 }
 
 type LivestreamRankingEntry struct {
@@ -37,12 +48,19 @@ func (r LivestreamRanking) Less(i, j int) bool {
 }
 
 type UserStatistics struct {
-	Rank              int64  `json:"rank"`
-	ViewersCount      int64  `json:"viewers_count"`
-	TotalReactions    int64  `json:"total_reactions"`
-	TotalLivecomments int64  `json:"total_livecomments"`
-	TotalTip          int64  `json:"total_tip"`
-	FavoriteEmoji     string `json:"favorite_emoji"`
+	Rank              int64 `json:"rank"`
+	ViewersCount      int64 `json:"viewers_count"`
+	TotalReactions    int64 `json:"total_reactions"`
+	TotalLivecomments int64 `json:"total_livecomments"`
+	// TotalActivity は TotalReactions と TotalLivecomments の和
+	TotalActivity int64  `json:"total_activity"`
+	TotalTip      int64  `json:"total_tip"`
+	FavoriteEmoji string `json:"favorite_emoji"`
+	// FavoriteEmojis は ?favorites=N のときのみ埋める、多い順の上位 N 件の絵文字
+	// 指定されたときはリアクションが無くても [] を返せるよう、スライスへのポインタにする
+	FavoriteEmojis *[]EmojiCount `json:"favorite_emojis,omitempty"`
+	// RankPending はランキングの集計が終わっておらず、Rank が未確定(0)であることを示す
+	RankPending bool `json:"rank_pending,omitempty"`
 }
 
 type UserScore struct {
@@ -70,7 +88,218 @@ func (r UserRanking) Less(i, j int) bool {
 
 var userRankingSingleflight singleflight.Group
 
+// favoriteEmojiCache は配信者のユーザーIDをキーとし、お気に入り絵文字を値とします
+// 配信者の配信にリアクションが付いたら破棄します
+// userTotalsCache と同じく、集計中に破棄されたユーザーの値を書き戻さないよう破棄した世代を覚えておく
+var favoriteEmojiCache = struct {
+	sync.Mutex
+	m             map[int64]string
+	gen           uint64
+	invalidatedAt map[int64]uint64
+}{m: make(map[int64]string), invalidatedAt: make(map[int64]uint64)}
+
+func getCachedFavoriteEmoji(userID int64) (string, bool) {
+	favoriteEmojiCache.Lock()
+	defer favoriteEmojiCache.Unlock()
+	emoji, ok := favoriteEmojiCache.m[userID]
+	return emoji, ok
+}
+
+func invalidateFavoriteEmoji(userID int64) {
+	favoriteEmojiCache.Lock()
+	favoriteEmojiCache.gen++
+	favoriteEmojiCache.invalidatedAt[userID] = favoriteEmojiCache.gen
+	delete(favoriteEmojiCache.m, userID)
+	favoriteEmojiCache.Unlock()
+}
+
+// favoriteEmojiGen は集計を始める前の世代を返します
+func favoriteEmojiGen() uint64 {
+	favoriteEmojiCache.Lock()
+	defer favoriteEmojiCache.Unlock()
+	return favoriteEmojiCache.gen
+}
+
+// storeFavoriteEmoji は世代 gen の時点から求めたお気に入り絵文字を保存します。gen より後に破棄されたユーザーは保存しない
+func storeFavoriteEmoji(gen uint64, userID int64, emoji string) {
+	favoriteEmojiCache.Lock()
+	defer favoriteEmojiCache.Unlock()
+	if favoriteEmojiCache.invalidatedAt[userID] > gen {
+		return
+	}
+	favoriteEmojiCache.m[userID] = emoji
+}
+
+// userStatsCache はユーザーIDをキーとし、集計済みのユーザー統計を値とします
+// 配信者の配信へのリアクション・ライブコメント・入室があったら破棄する
+// 順位は他のユーザーへの投稿でも変わるので、userStatsCacheTTL の間は古い順位を返しうる
+var userStatsCache = struct {
+	sync.RWMutex
+	m map[int64]userStatsCacheEntry
+}{m: make(map[int64]userStatsCacheEntry)}
+
+type userStatsCacheEntry struct {
+	stats     UserStatistics
+	expiresAt time.Time
+}
+
+func getCachedUserStats(userID int64) (UserStatistics, bool) {
+	userStatsCache.RLock()
+	entry, ok := userStatsCache.m[userID]
+	userStatsCache.RUnlock()
+	if !ok || time.Now().After(entry.expiresAt) {
+		return UserStatistics{}, false
+	}
+	return entry.stats, true
+}
+
+func storeUserStats(userID int64, stats UserStatistics) {
+	if userStatsCacheTTL <= 0 {
+		return
+	}
+	userStatsCache.Lock()
+	userStatsCache.m[userID] = userStatsCacheEntry{stats: stats, expiresAt: time.Now().Add(userStatsCacheTTL)}
+	userStatsCache.Unlock()
+}
+
+func invalidateUserStats(userID int64) {
+	invalidateUserTotals(userID)
+	if userStatsCacheTTL <= 0 {
+		return
+	}
+	userStatsCache.Lock()
+	delete(userStatsCache.m, userID)
+	userStatsCache.Unlock()
+}
+
+// invalidateUserStatsByLivestream は配信者が分からない書き込みのあとで、配信者の統計を破棄します
+func invalidateUserStatsByLivestream(ctx context.Context, livestreamID int64) error {
+	if userStatsCacheTTL <= 0 {
+		return nil
+	}
+	var ownerID int64
+	if err := dbConn.GetContext(ctx, &ownerID, "SELECT user_id FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		return err
+	}
+	invalidateUserStats(ownerID)
+	return nil
+}
+
+// userTotalsCache はユーザーごとの全期間のリアクション数とチップ合計です
+// ユーザーランキングを SQL で集計したときと、ユーザー統計を全期間で集計したときに入れる
+// ランキングを sorted set で持つ場合は SQL で集計しないので、ユーザー統計で入れたものだけになる
+// ユーザー統計はここにあれば集計し直さない
+// 集計中に破棄されたユーザーの値を書き戻さないよう、破棄するたびに世代を進めて破棄した世代を覚えておく
+var userTotalsCache = struct {
+	sync.Mutex
+	m             map[int64]userTotals
+	gen           uint64
+	invalidatedAt map[int64]uint64
+}{m: make(map[int64]userTotals), invalidatedAt: make(map[int64]uint64)}
+
+type userTotals struct {
+	Reactions int64
+	Tips      int64
+}
+
+func getCachedUserTotals(userID int64) (userTotals, bool) {
+	userTotalsCache.Lock()
+	defer userTotalsCache.Unlock()
+	totals, ok := userTotalsCache.m[userID]
+	return totals, ok
+}
+
+func invalidateUserTotals(userID int64) {
+	userTotalsCache.Lock()
+	userTotalsCache.gen++
+	userTotalsCache.invalidatedAt[userID] = userTotalsCache.gen
+	delete(userTotalsCache.m, userID)
+	userTotalsCache.Unlock()
+}
+
+// userTotalsGen は集計を始める前の世代を返します
+func userTotalsGen() uint64 {
+	userTotalsCache.Lock()
+	defer userTotalsCache.Unlock()
+	return userTotalsCache.gen
+}
+
+// storeUserTotals は世代 gen の時点から集計した値を保存します。gen より後に破棄されたユーザーは保存しない
+func storeUserTotals(gen uint64, userScores []UserScore) {
+	// リアクションをまとめて書く場合は破棄の時点でまだ書き込まれていないので、キャッシュしない
+	if reactionBatchInterval > 0 {
+		return
+	}
+	userTotalsCache.Lock()
+	defer userTotalsCache.Unlock()
+	for _, s := range userScores {
+		if userTotalsCache.invalidatedAt[s.ID] > gen {
+			continue
+		}
+		userTotalsCache.m[s.ID] = userTotals{Reactions: s.ReactionCount, Tips: s.TotalTips}
+	}
+}
+
+// storeUserTotal は1人分の値を storeUserTotals と同じ条件で保存します
+func storeUserTotal(gen uint64, userID int64, totals userTotals) {
+	if reactionBatchInterval > 0 {
+		return
+	}
+	userTotalsCache.Lock()
+	defer userTotalsCache.Unlock()
+	if userTotalsCache.invalidatedAt[userID] > gen {
+		return
+	}
+	userTotalsCache.m[userID] = totals
+}
+
+// userRankingState は直近に集計できたランキングと、直近の集計失敗を覚えておきます
+// 集計が失敗し続けるときに毎回DBへ集計クエリを投げないよう、失敗後しばらくは再集計しない
+var userRankingState = struct {
+	sync.Mutex
+	lastGood UserRanking
+	hasGood  bool
+	lastErr  error
+	failedAt time.Time
+}{}
+
+// 集計に失敗してから再集計を試すまでの間隔
+const userRankingErrorBackoff = 1 * time.Second
+
+// getUserRanking はユーザーランキングを集計します
+// 集計に失敗した場合、以前に集計できたランキングがあればそれを返す
 func getUserRanking() (UserRanking, error) {
+	userRankingState.Lock()
+	if userRankingState.lastErr != nil && time.Since(userRankingState.failedAt) < userRankingErrorBackoff {
+		ranking, hasGood, lastErr := userRankingState.lastGood, userRankingState.hasGood, userRankingState.lastErr
+		userRankingState.Unlock()
+		if hasGood {
+			return ranking, nil
+		}
+		return UserRanking{}, lastErr
+	}
+	userRankingState.Unlock()
+
+	ranking, err := computeUserRanking()
+
+	userRankingState.Lock()
+	defer userRankingState.Unlock()
+	if err != nil {
+		userRankingState.lastErr = err
+		userRankingState.failedAt = time.Now()
+		if userRankingState.hasGood {
+			log.Printf("failed to compute user ranking; serving the last known ranking: %+v", err)
+			return userRankingState.lastGood, nil
+		}
+		return UserRanking{}, err
+	}
+	userRankingState.lastGood = ranking
+	userRankingState.hasGood = true
+	userRankingState.lastErr = nil
+	return ranking, nil
+}
+
+func computeUserRanking() (UserRanking, error) {
 	resultI, err, _ := userRankingSingleflight.Do("user_ranking", func() (interface{}, error) {
 		tx, err := dbConn.BeginTxx(context.Background(), nil)
 		if err != nil {
@@ -78,33 +307,13 @@ func getUserRanking() (UserRanking, error) {
 		}
 		defer tx.Rollback()
 
-		var users []*UserModel
-		if err := tx.SelectContext(context.Background(), &users, "SELECT id, name FROM users"); err != nil {
-			return nil, err
-		}
-
 		var ranking UserRanking
-		query := `
-			SELECT
-				u.id,
-				u.name AS username,
-				IFNULL(SUM(r.id), 0) AS reaction_count,
-				IFNULL(SUM(lc.tip), 0) AS total_tips
-			FROM
-				users u
-			LEFT JOIN
-				livestreams l ON l.user_id = u.id
-			LEFT JOIN
-				reactions r ON r.livestream_id = l.id
-			LEFT JOIN
-				livecomments lc ON lc.livestream_id = l.id
-			GROUP BY u.id
-		`
-
 		var userScores []UserScore
-		if err = tx.SelectContext(context.Background(), &userScores, query); err != nil {
+		gen := userTotalsGen()
+		if err = tx.SelectContext(context.Background(), &userScores, userScoresQuery); err != nil {
 			return nil, err
 		}
+		storeUserTotals(gen, userScores)
 
 		for _, userScore := range userScores {
 			score := userScore.ReactionCount + userScore.TotalTips
@@ -124,10 +333,56 @@ func getUserRanking() (UserRanking, error) {
 	return resultI.(UserRanking), nil
 }
 
+// countViewersByLivestream はユーザーの全配信について、配信IDごとの視聴履歴数を1クエリで数えます
+// livestream_viewers_history の livestream_id のインデックス (schemaMigrations で追加) だけで数えられるよう、
+// 視聴履歴側は livestream_id 以外を参照しない
+func countViewersByLivestream(ctx context.Context, tx *sqlx.Tx, userID int64) (map[int64]int64, error) {
+	query := `
+		SELECT h.livestream_id, COUNT(*) AS cnt
+		FROM livestreams l
+		INNER JOIN livestream_viewers_history h ON h.livestream_id = l.id
+		WHERE l.user_id = ?
+		GROUP BY h.livestream_id
+	`
+	var counts []struct {
+		LivestreamID int64 `db:"livestream_id"`
+		Count        int64 `db:"cnt"`
+	}
+	if err := tx.SelectContext(ctx, &counts, query, userID); err != nil {
+		return nil, err
+	}
+	m := make(map[int64]int64, len(counts))
+	for _, cnt := range counts {
+		m[cnt.LivestreamID] = cnt.Count
+	}
+	return m, nil
+}
+
+// parseStatsSince は ?since= (RFC3339) を unix 秒にして返します
+// 指定がない場合は全期間を表す 0 を返す
+func parseStatsSince(c echo.Context) (int64, error) {
+	v := c.QueryParam("since")
+	if v == "" {
+		return 0, nil
+	}
+	since, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, "since query parameter must be RFC3339: "+err.Error())
+	}
+	return since.Unix(), nil
+}
+
+// ユーザー統計で返せるお気に入り絵文字の件数の上限
+const maxFavoriteEmojis = 10
+
+// rank_pending=1 で、他の集計が終わった後にランキングを待つ時間
+// ほとんどの場合はこの間に間に合うので、待たずに保留にすると順位が返らないことが増える
+const rankPendingWait = 50 * time.Millisecond
+
 func getUserStatisticsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
-	if err := verifyUserSession(c); err != nil {
+	if _, err := verifyUserSession(c); err != nil {
 		// echo.NewHTTPErrorが返っているのでそのまま出力
 		return err
 	}
@@ -135,115 +390,205 @@ func getUserStatisticsHandler(c echo.Context) error {
 	username := c.Param("username")
 	// ユーザごとに、紐づく配信について、累計リアクション数、累計ライブコメント数、累計売上金額を算出
 	// また、現在の合計視聴者数もだす
-
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	// since が指定された場合、リアクション数・ライブコメント数・売上金額はそれ以降に投稿されたものだけを数える
+	// favorites で求める上位の絵文字も since 以降のリアクションだけで数える
+	// 順位・視聴者数・favorite_emoji は常に全期間で求める
+	since, err := parseStatsSince(c)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+		return err
 	}
-	defer tx.Rollback()
-
-	var user UserModel
-	if err := tx.GetContext(ctx, &user, "SELECT * FROM users WHERE name = ?", username); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusBadRequest, "not found user that has the given username")
-		} else {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	var favorites int
+	if v := c.QueryParam("favorites"); v != "" {
+		favorites, err = strconv.Atoi(v)
+		if err != nil || favorites < 1 {
+			return echo.NewHTTPError(http.StatusBadRequest, "favorites query parameter must be a positive integer")
 		}
+		favorites = min(favorites, maxFavoriteEmojis)
 	}
 
-	// ランク算出
-	ranking, err := getUserRanking()
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user ranking: "+err.Error())
-	}
-
-	var rank int64 = 1
-	for i := len(ranking) - 1; i >= 0; i-- {
-		entry := ranking[i]
-		if entry.Username == username {
-			break
+	// キャッシュは全期間の統計だけを持つ
+	if userStatsCacheTTL > 0 && since == 0 && favorites == 0 {
+		if userID, err := getUserIDByName(ctx, dbConn, username); err == nil {
+			if stats, ok := getCachedUserStats(userID); ok {
+				return c.JSON(http.StatusOK, stats)
+			}
 		}
-		rank++
 	}
 
-	// リアクション数
-	var totalReactions int64
-	query := `SELECT COUNT(*) FROM users u
-    INNER JOIN livestreams l ON l.user_id = u.id
-    INNER JOIN reactions r ON r.livestream_id = l.id
-    WHERE u.name = ?
-	`
-	if err := tx.GetContext(ctx, &totalReactions, query, username); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count total reactions: "+err.Error())
-	}
+	var stats UserStatistics
+	var userID int64
+	// 集計した合計を userTotalsCache に書き戻すため、トランザクションを始める前の世代を取っておく
+	totalsGen := userTotalsGen()
+	favoriteGen := favoriteEmojiGen()
+	if err := withReadTx(ctx, func(tx *sqlx.Tx) error {
+		user, err := getUserByName(ctx, tx, username)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusBadRequest, "not found user that has the given username")
+			} else {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+			}
+		}
 
-	// ライブコメント数、チップ合計
-	var totalLivecomments int64
-	var totalTip int64
-	var livestreams []*LivestreamModel
-	if err := tx.SelectContext(ctx, &livestreams, "SELECT * FROM livestreams WHERE user_id = ?", user.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
-	}
+		// ランク算出
+		// rank_pending=1 の場合は他の集計と並行してランキングを求め、集計が終わってから rankPendingWait 待っても間に合わなければ順位を保留として返す
+		type rankResult struct {
+			ranks map[string]int64
+			err   error
+		}
+		rankCh := make(chan rankResult, 1)
+		go func() {
+			ranks, err := getUserRanks(ctx, []string{username})
+			rankCh <- rankResult{ranks: ranks, err: err}
+		}()
+
+		// 全期間の場合、以前に集計したリアクション数とチップ合計があればそれを使う
+		var totals userTotals
+		var totalsCached bool
+		if since == 0 {
+			totals, totalsCached = getCachedUserTotals(user.ID)
+		}
 
-	// TODO
-	// var livecomments struct {
-	// 	Tips     int64 `db:"tips"`
-	// 	Comments int64 `db:"comments"`
-	// }
+		// 配信ごとの集計は共通の関数でまとめて行う
+		var livestreams []*LivestreamModel
+		if err := tx.SelectContext(ctx, &livestreams, "SELECT * FROM livestreams WHERE user_id = ?", user.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+		}
+		livestreamIDs := make([]int64, len(livestreams))
+		for i := range livestreams {
+			livestreamIDs[i] = livestreams[i].ID
+		}
 
-	// query = `
-	// 	SELECT IFNULL(SUM(tip), 0) AS tips, COUNT(*) AS comments
-	// 	FROM livecomments WHERE livestream_id IN (SELECT id FROM livestreams WHERE user_id = ?)
-	// `
-	// if err := tx.GetContext(ctx, &livecomments, query, user.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
-	// 	return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
-	// }
+		// リアクション数
+		var totalReactions int64
+		if totalsCached {
+			totalReactions = totals.Reactions
+		} else {
+			reactionCounts, err := getReactionCounts(ctx, tx, livestreamIDs, since)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to count total reactions: "+err.Error())
+			}
+			for _, cnt := range reactionCounts {
+				totalReactions += cnt
+			}
+		}
 
-	for _, livestream := range livestreams {
-		var livecomments []*LivecommentModel
-		if err := tx.SelectContext(ctx, &livecomments, "SELECT * FROM livecomments WHERE livestream_id = ?", livestream.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
+		// ライブコメント数
+		var totalLivecomments int64
+		if len(livestreamIDs) > 0 {
+			query, params, err := sqlx.In("SELECT COUNT(*) FROM livecomments WHERE livestream_id IN (?) AND created_at >= ?", livestreamIDs, since)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+			}
+			if err := tx.GetContext(ctx, &totalLivecomments, query, params...); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to count livecomments: "+err.Error())
+			}
 		}
 
-		for _, livecomment := range livecomments {
-			totalTip += livecomment.Tip
-			totalLivecomments++
+		// チップ合計
+		var totalTip int64
+		if totalsCached {
+			totalTip = totals.Tips
+		} else {
+			tipSums, err := getTipSums(ctx, tx, livestreamIDs, since)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to sum tips: "+err.Error())
+			}
+			for _, sum := range tipSums {
+				totalTip += sum
+			}
+		}
+		if since == 0 && !totalsCached {
+			storeUserTotal(totalsGen, user.ID, userTotals{Reactions: totalReactions, Tips: totalTip})
 		}
-	}
 
-	// 合計視聴者数
-	var viewersCount int64
-	for _, livestream := range livestreams {
-		var cnt int64
-		if err := tx.GetContext(ctx, &cnt, "SELECT COUNT(*) FROM livestream_viewers_history WHERE livestream_id = ?", livestream.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		// 合計視聴者数
+		viewersCounts, err := countViewersByLivestream(ctx, tx, user.ID)
+		if err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream_view_history: "+err.Error())
 		}
-		viewersCount += cnt
-	}
+		var viewersCount int64
+		for _, cnt := range viewersCounts {
+			viewersCount += cnt
+		}
 
-	// お気に入り絵文字
-	var favoriteEmoji string
-	query = `
-	SELECT r.emoji_name
-	FROM users u
-	INNER JOIN livestreams l ON l.user_id = u.id
-	INNER JOIN reactions r ON r.livestream_id = l.id
-	WHERE u.name = ?
-	GROUP BY emoji_name
-	ORDER BY COUNT(*) DESC, emoji_name DESC
-	LIMIT 1
-	`
-	if err := tx.GetContext(ctx, &favoriteEmoji, query, username); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to find favorite emoji: "+err.Error())
+		// お気に入り絵文字
+		var favoriteEmoji string
+		if cached, ok := getCachedFavoriteEmoji(user.ID); ok {
+			favoriteEmoji = cached
+		} else {
+			query := `
+			SELECT r.emoji_name
+			FROM users u
+			INNER JOIN livestreams l ON l.user_id = u.id
+			INNER JOIN reactions r ON r.livestream_id = l.id
+			WHERE u.name = ?
+			GROUP BY emoji_name
+			ORDER BY COUNT(*) DESC, emoji_name DESC
+			LIMIT 1
+			`
+			if err := tx.GetContext(ctx, &favoriteEmoji, query, username); err != nil && !errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to find favorite emoji: "+err.Error())
+			}
+			storeFavoriteEmoji(favoriteGen, user.ID, favoriteEmoji)
+		}
+		var favoriteEmojis *[]EmojiCount
+		if favorites > 0 {
+			query := `
+			SELECT r.emoji_name, COUNT(*) AS count
+			FROM livestreams l
+			INNER JOIN reactions r ON r.livestream_id = l.id
+			WHERE l.user_id = ? AND r.created_at >= ?
+			GROUP BY r.emoji_name
+			ORDER BY count DESC, r.emoji_name DESC
+			LIMIT ?
+			`
+			emojiCounts := []EmojiCount{}
+			if err := tx.SelectContext(ctx, &emojiCounts, query, user.ID, since, favorites); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to find favorite emojis: "+err.Error())
+			}
+			favoriteEmojis = &emojiCounts
+		}
+
+		var rank int64
+		var rankPending bool
+		var result rankResult
+		if c.QueryParam("rank_pending") == "1" {
+			select {
+			case result = <-rankCh:
+			case <-time.After(rankPendingWait):
+				rankPending = true
+			}
+		} else {
+			result = <-rankCh
+		}
+		if !rankPending {
+			if result.err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user ranking: "+result.err.Error())
+			}
+			rank = result.ranks[username]
+		}
+
+		stats = UserStatistics{
+			Rank:              rank,
+			RankPending:       rankPending,
+			ViewersCount:      viewersCount,
+			TotalReactions:    totalReactions,
+			TotalLivecomments: totalLivecomments,
+			TotalActivity:     totalReactions + totalLivecomments,
+			TotalTip:          totalTip,
+			FavoriteEmoji:     favoriteEmoji,
+			FavoriteEmojis:    favoriteEmojis,
+		}
+		userID = user.ID
+		return nil
+	}); err != nil {
+		return err
 	}
 
-	stats := UserStatistics{
-		Rank:              rank,
-		ViewersCount:      viewersCount,
-		TotalReactions:    totalReactions,
-		TotalLivecomments: totalLivecomments,
-		TotalTip:          totalTip,
-		FavoriteEmoji:     favoriteEmoji,
+	// 順位が保留のもの・期間を絞ったもの・上位の絵文字を含むものはキャッシュしない
+	if !stats.RankPending && since == 0 && favorites == 0 {
+		storeUserStats(userID, stats)
 	}
 	return c.JSON(http.StatusOK, stats)
 }
@@ -251,117 +596,386 @@ func getUserStatisticsHandler(c echo.Context) error {
 func getLivestreamStatisticsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
-	if err := verifyUserSession(c); err != nil {
+	if _, err := verifyUserSession(c); err != nil {
 		return err
 	}
 
-	id, err := strconv.Atoi(c.Param("livestream_id"))
+	livestreamID, err := parseInt64Param(c, "livestream_id")
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+		return err
 	}
-	livestreamID := int64(id)
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	since, err := parseStatsSince(c)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+		return err
 	}
-	defer tx.Rollback()
 
-	var livestream LivestreamModel
-	if err := tx.GetContext(ctx, &livestream, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusBadRequest, "cannot get stats of not found livestream")
-		} else {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	// rank=false の場合は全配信のスコアが要る順位の算出を飛ばし、この配信だけを集計する
+	withRank := true
+	if v := c.QueryParam("rank"); v != "" {
+		withRank, err = strconv.ParseBool(v)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "rank query parameter must be a bool")
 		}
 	}
 
-	var livestreams []*LivestreamModel
-	if err := tx.SelectContext(ctx, &livestreams, "SELECT * FROM livestreams"); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	var stats LivestreamStatistics
+	if err := withReadTx(ctx, func(tx *sqlx.Tx) error {
+		var livestream LivestreamModel
+		if err := tx.GetContext(ctx, &livestream, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusBadRequest, "cannot get stats of not found livestream")
+			} else {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+			}
+		}
+
+		var err error
+		stats, err = getLivestreamStatistics(ctx, tx, livestreamID, since, withRank)
+		return err
+	}); err != nil {
+		return err
 	}
 
+	return c.JSON(http.StatusOK, stats)
+}
+
+// getLivestreamStatistics は配信の統計情報を集計します
+// 順位は sorted set (無効時は SQL) から引く
+// since (unix 秒) が 0 より大きい場合、リアクション数と最大チップ額はそれ以降の投稿だけで求める
+// withRank が false の場合は順位を求めず 0 とする
+func getLivestreamStatistics(ctx context.Context, tx *sqlx.Tx, livestreamID int64, since int64, withRank bool) (LivestreamStatistics, error) {
 	// ランク算出
-	var ranking LivestreamRanking
-	reactionCounts := make(map[int64]int64)
-	rows, err := tx.QueryContext(ctx, "SELECT livestream_id, COUNT(reactions.id) AS reaction_count FROM reactions GROUP BY livestream_id")
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fetch reaction counts: "+err.Error())
-	}
-	defer rows.Close()
-	for rows.Next() {
-		var livestreamID, reactionCount int64
-		if err := rows.Scan(&livestreamID, &reactionCount); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to scan reaction count: "+err.Error())
+	var rank int64
+	if withRank {
+		var err error
+		rank, err = getLivestreamRank(ctx, tx, livestreamID)
+		if err != nil {
+			return LivestreamStatistics{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream ranking: "+err.Error())
 		}
-		reactionCounts[livestreamID] = reactionCount
 	}
-	tipSums := make(map[int64]int64)
-	rows, err = tx.QueryContext(ctx, "SELECT livestream_id, IFNULL(SUM(livecomments.tip), 0) FROM livecomments group by livestream_id")
+
+	// 視聴者数算出
+	var viewers struct {
+		Current int64 `db:"current"`
+		Total   int64 `db:"total"`
+	}
+	if err := tx.GetContext(ctx, &viewers, `SELECT IFNULL(SUM(h.left_at IS NULL), 0) AS current, COUNT(*) AS total FROM livestreams l INNER JOIN livestream_viewers_history h ON h.livestream_id = l.id WHERE l.id = ?`, livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return LivestreamStatistics{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to count livestream viewers: "+err.Error())
+	}
+
+	// 同時視聴者数のピーク
+	var viewerHistories []LivestreamViewerModel
+	if err := tx.SelectContext(ctx, &viewerHistories, "SELECT created_at, left_at FROM livestream_viewers_history WHERE livestream_id = ?", livestreamID); err != nil {
+		return LivestreamStatistics{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream_view_history: "+err.Error())
+	}
+	peakViewers := maxConcurrentViewers(viewerHistories)
+
+	// 最大チップ額
+	var maxTip int64
+	if err := tx.GetContext(ctx, &maxTip, `SELECT IFNULL(MAX(tip), 0) FROM livestreams l INNER JOIN livecomments l2 ON l2.livestream_id = l.id WHERE l.id = ? AND l2.created_at >= ?`, livestreamID, since); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return LivestreamStatistics{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to find maximum tip livecomment: "+err.Error())
+	}
+
+	// リアクション数
+	reactionCounts, err := getReactionCounts(ctx, tx, []int64{livestreamID}, since)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fetch reaction counts: "+err.Error())
+		return LivestreamStatistics{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to count total reactions: "+err.Error())
 	}
-	defer rows.Close()
-	for rows.Next() {
-		var livestreamID, tipSum int64
-		if err := rows.Scan(&livestreamID, &tipSum); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to scan reaction count: "+err.Error())
+	totalReactions := reactionCounts[livestreamID]
+
+	// スパム報告数
+	var totalReports int64
+	if err := tx.GetContext(ctx, &totalReports, `SELECT COUNT(*) FROM livestreams l INNER JOIN livecomment_reports r ON r.livestream_id = l.id WHERE l.id = ?`, livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return LivestreamStatistics{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to count total spam reports: "+err.Error())
+	}
+
+	return LivestreamStatistics{
+		Rank:                 rank,
+		ViewersCount:         viewers.Current,
+		TotalViewers:         viewers.Total,
+		MaxConcurrentViewers: peakViewers,
+		MaxTip:               maxTip,
+		TotalReactions:       totalReactions,
+		TotalReports:         totalReports,
+	}, nil
+}
+
+// maxConcurrentViewers は入室・退出の時刻を走査して同時視聴者数の最大値を求めます
+// 視聴区間は [created_at, left_at) とみなし、同時刻では退出を先に数えます
+func maxConcurrentViewers(histories []LivestreamViewerModel) int64 {
+	type event struct {
+		at    int64
+		delta int64
+	}
+	events := make([]event, 0, len(histories)*2)
+	for _, h := range histories {
+		events = append(events, event{at: h.CreatedAt, delta: 1})
+		if h.LeftAt != nil {
+			events = append(events, event{at: *h.LeftAt, delta: -1})
 		}
-		tipSums[livestreamID] = tipSum
 	}
-	for _, livestream := range livestreams {
-		reactions := reactionCounts[livestream.ID]
-		totalTips := tipSums[livestream.ID]
-		score := int64(reactions) + totalTips
-		ranking = append(ranking, LivestreamRankingEntry{
-			LivestreamID: livestream.ID,
-			Score:        score,
-		})
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].at == events[j].at {
+			return events[i].delta < events[j].delta
+		}
+		return events[i].at < events[j].at
+	})
+
+	var current, peak int64
+	for _, e := range events {
+		current += e.delta
+		if current > peak {
+			peak = current
+		}
 	}
-	sort.Sort(ranking)
+	return peak
+}
 
-	var rank int64 = 1
-	for i := len(ranking) - 1; i >= 0; i-- {
-		entry := ranking[i]
-		if entry.LivestreamID == livestreamID {
-			break
+type EmojiCount struct {
+	EmojiName string `json:"emoji_name" db:"emoji_name"`
+	Count     int64  `json:"count" db:"count"`
+}
+
+const (
+	defaultTopEmojiLimit = 10
+	maxTopEmojiLimit     = 100
+	topEmojiCacheTTL     = 5 * time.Second
+)
+
+// topEmojiCache は全体の絵文字ランキング上位 maxTopEmojiLimit 件を短時間キャッシュします
+var topEmojiCache = struct {
+	sync.RWMutex
+	emojis    []EmojiCount
+	expiresAt time.Time
+}{}
+
+// 全体で人気の絵文字取得API
+// GET /api/stats/emoji/top?limit=
+func getTopEmojiHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	limit := defaultTopEmojiLimit
+	if c.QueryParam("limit") != "" {
+		l, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || l < 1 || l > maxTopEmojiLimit {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("limit query parameter must be integer between 1 and %d", maxTopEmojiLimit))
 		}
-		rank++
+		limit = l
 	}
 
-	// 視聴者数算出
-	var viewersCount int64
-	if err := tx.GetContext(ctx, &viewersCount, `SELECT COUNT(*) FROM livestreams l INNER JOIN livestream_viewers_history h ON h.livestream_id = l.id WHERE l.id = ?`, livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count livestream viewers: "+err.Error())
+	topEmojiCache.RLock()
+	emojis, expiresAt := topEmojiCache.emojis, topEmojiCache.expiresAt
+	topEmojiCache.RUnlock()
+
+	if time.Now().After(expiresAt) {
+		emojis = []EmojiCount{}
+		query := "SELECT emoji_name, COUNT(*) AS count FROM reactions GROUP BY emoji_name ORDER BY count DESC, emoji_name ASC LIMIT ?"
+		if err := dbConn.SelectContext(ctx, &emojis, query, maxTopEmojiLimit); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get top emoji: "+err.Error())
+		}
+
+		topEmojiCache.Lock()
+		topEmojiCache.emojis = emojis
+		topEmojiCache.expiresAt = time.Now().Add(topEmojiCacheTTL)
+		topEmojiCache.Unlock()
 	}
 
-	// 最大チップ額
-	var maxTip int64
-	if err := tx.GetContext(ctx, &maxTip, `SELECT IFNULL(MAX(tip), 0) FROM livestreams l INNER JOIN livecomments l2 ON l2.livestream_id = l.id WHERE l.id = ?`, livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to find maximum tip livecomment: "+err.Error())
+	if len(emojis) > limit {
+		emojis = emojis[:limit]
+	}
+	return c.JSON(http.StatusOK, emojis)
+}
+
+type PostUsersStatisticsRequest struct {
+	Usernames []string `json:"usernames"`
+}
+
+// 一度に統計情報を取得できるユーザー数の上限
+const maxUsersStatisticsBatchSize = 100
+
+// userIDCount はユーザーIDごとの集計結果です
+type userIDCount struct {
+	UserID int64 `db:"user_id"`
+	Count  int64 `db:"cnt"`
+}
+
+// 複数ユーザーの統計情報取得API
+// POST /api/users/stats
+// 存在しないユーザー名はレスポンスに含めない
+func postUsersStatisticsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if _, err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	var req *PostUsersStatisticsRequest
+	if err := decodeJSON(c.Request().Body, &req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req == nil || len(req.Usernames) == 0 {
+		return c.JSON(http.StatusOK, map[string]UserStatistics{})
+	}
+	if len(req.Usernames) > maxUsersStatisticsBatchSize {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("too many usernames (max %d)", maxUsersStatisticsBatchSize))
+	}
+
+	// 求めたお気に入り絵文字を書き戻すため、トランザクションを始める前の世代を取っておく
+	favoriteGen := favoriteEmojiGen()
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	query, params, err := sqlx.In("SELECT * FROM users WHERE name IN (?) AND deleted_at IS NULL", req.Usernames)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+	}
+	var users []*UserModel
+	if err := tx.SelectContext(ctx, &users, query, params...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get users: "+err.Error())
+	}
+	if len(users) == 0 {
+		return c.JSON(http.StatusOK, map[string]UserStatistics{})
+	}
+	userIDs := make([]int64, len(users))
+	for i := range users {
+		userIDs[i] = users[i].ID
+	}
+
+	// ランク算出
+	usernames := make([]string, len(users))
+	for i := range users {
+		usernames[i] = users[i].Name
+	}
+	ranks, err := getUserRanks(ctx, usernames)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user ranking: "+err.Error())
+	}
+
+	// ユーザーIDごとに件数を集計するクエリをまとめて流す
+	countByUser := func(query string) (map[int64]int64, error) {
+		query, params, err := sqlx.In(query, userIDs)
+		if err != nil {
+			return nil, err
+		}
+		var counts []userIDCount
+		if err := tx.SelectContext(ctx, &counts, query, params...); err != nil {
+			return nil, err
+		}
+		m := make(map[int64]int64, len(counts))
+		for _, cnt := range counts {
+			m[cnt.UserID] = cnt.Count
+		}
+		return m, nil
 	}
 
 	// リアクション数
-	var totalReactions int64
-	if err := tx.GetContext(ctx, &totalReactions, "SELECT COUNT(*) FROM livestreams l INNER JOIN reactions r ON r.livestream_id = l.id WHERE l.id = ?", livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+	totalReactions, err := countByUser(`
+		SELECT l.user_id, COUNT(*) AS cnt
+		FROM livestreams l
+		INNER JOIN reactions r ON r.livestream_id = l.id
+		WHERE l.user_id IN (?)
+		GROUP BY l.user_id
+	`)
+	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count total reactions: "+err.Error())
 	}
 
-	// スパム報告数
-	var totalReports int64
-	if err := tx.GetContext(ctx, &totalReports, `SELECT COUNT(*) FROM livestreams l INNER JOIN livecomment_reports r ON r.livestream_id = l.id WHERE l.id = ?`, livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count total spam reports: "+err.Error())
+	// ライブコメント数
+	totalLivecomments, err := countByUser(`
+		SELECT l.user_id, COUNT(*) AS cnt
+		FROM livestreams l
+		INNER JOIN livecomments lc ON lc.livestream_id = l.id
+		WHERE l.user_id IN (?)
+		GROUP BY l.user_id
+	`)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count total livecomments: "+err.Error())
 	}
 
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	// チップ合計
+	totalTips, err := countByUser(`
+		SELECT l.user_id, IFNULL(SUM(lc.tip), 0) AS cnt
+		FROM livestreams l
+		INNER JOIN livecomments lc ON lc.livestream_id = l.id
+		WHERE l.user_id IN (?)
+		GROUP BY l.user_id
+	`)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to sum tips: "+err.Error())
 	}
 
-	return c.JSON(http.StatusOK, LivestreamStatistics{
-		Rank:           rank,
-		ViewersCount:   viewersCount,
-		MaxTip:         maxTip,
-		TotalReactions: totalReactions,
-		TotalReports:   totalReports,
-	})
+	// 合計視聴者数
+	viewersCounts, err := countByUser(`
+		SELECT l.user_id, COUNT(*) AS cnt
+		FROM livestreams l
+		INNER JOIN livestream_viewers_history h ON h.livestream_id = l.id
+		WHERE l.user_id IN (?)
+		GROUP BY l.user_id
+	`)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream_view_history: "+err.Error())
+	}
+
+	// お気に入り絵文字
+	// キャッシュにないユーザーの分だけまとめて集計する
+	favoriteEmojis := make(map[int64]string, len(users))
+	var missIDs []int64
+	for _, user := range users {
+		if cached, ok := getCachedFavoriteEmoji(user.ID); ok {
+			favoriteEmojis[user.ID] = cached
+		} else {
+			missIDs = append(missIDs, user.ID)
+		}
+	}
+	if len(missIDs) > 0 {
+		query, params, err := sqlx.In(`
+			SELECT l.user_id, r.emoji_name, COUNT(*) AS cnt
+			FROM livestreams l
+			INNER JOIN reactions r ON r.livestream_id = l.id
+			WHERE l.user_id IN (?)
+			GROUP BY l.user_id, r.emoji_name
+		`, missIDs)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+		}
+		var emojiCounts []struct {
+			UserID    int64  `db:"user_id"`
+			EmojiName string `db:"emoji_name"`
+			Count     int64  `db:"cnt"`
+		}
+		if err := tx.SelectContext(ctx, &emojiCounts, query, params...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to find favorite emoji: "+err.Error())
+		}
+		// 単体のAPIと同じく、件数が同じなら絵文字名の降順で先のものを選ぶ
+		best := make(map[int64]int64, len(missIDs))
+		for _, ec := range emojiCounts {
+			cur, ok := favoriteEmojis[ec.UserID]
+			if !ok || ec.Count > best[ec.UserID] || (ec.Count == best[ec.UserID] && ec.EmojiName > cur) {
+				favoriteEmojis[ec.UserID] = ec.EmojiName
+				best[ec.UserID] = ec.Count
+			}
+		}
+		for _, id := range missIDs {
+			storeFavoriteEmoji(favoriteGen, id, favoriteEmojis[id])
+		}
+	}
+
+	stats := make(map[string]UserStatistics, len(users))
+	for _, user := range users {
+		stats[user.Name] = UserStatistics{
+			Rank:              ranks[user.Name],
+			ViewersCount:      viewersCounts[user.ID],
+			TotalReactions:    totalReactions[user.ID],
+			TotalLivecomments: totalLivecomments[user.ID],
+			TotalActivity:     totalReactions[user.ID] + totalLivecomments[user.ID],
+			TotalTip:          totalTips[user.ID],
+			FavoriteEmoji:     favoriteEmojis[user.ID],
+		}
+	}
+	return c.JSON(http.StatusOK, stats)
 }
@@ -0,0 +1,813 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// favorites を指定したときは、リアクションが無くても favorite_emojis を [] で返す
+func TestUserStatisticsFavoriteEmojisJSON(t *testing.T) {
+	for _, tt := range []struct {
+		name           string
+		favoriteEmojis *[]EmojiCount
+		want           string
+		wantField      bool
+	}{
+		{name: "not requested", favoriteEmojis: nil, wantField: false},
+		{name: "no reactions", favoriteEmojis: &[]EmojiCount{}, want: `"favorite_emojis":[]`, wantField: true},
+		{name: "with reactions", favoriteEmojis: &[]EmojiCount{{EmojiName: "smile", Count: 2}}, want: `"favorite_emojis":[{"emoji_name":"smile","count":2}]`, wantField: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := jsonMarshal(UserStatistics{FavoriteEmojis: tt.favoriteEmojis})
+			if err != nil {
+				t.Fatalf("failed to marshal: %+v", err)
+			}
+			got := string(b)
+			if has := strings.Contains(got, `"favorite_emojis"`); has != tt.wantField {
+				t.Fatalf("favorite_emojis present = %v, want %v: %s", has, tt.wantField, got)
+			}
+			if tt.wantField && !strings.Contains(got, tt.want) {
+				t.Errorf("got %s, want it to contain %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func getTestUserStatistics(t *testing.T, viewer UserModel, username string, query url.Values) UserStatistics {
+	t.Helper()
+	c, rec := newTestContext(http.MethodGet, "/api/user/"+username+"/statistics?"+query.Encode(), nil)
+	c.SetParamNames("username")
+	c.SetParamValues(username)
+	if err := serveWithSession(c, viewer, getUserStatisticsHandler); err != nil {
+		t.Fatalf("getUserStatisticsHandler: %+v", err)
+	}
+	var stats UserStatistics
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("failed to decode response: %+v", err)
+	}
+	return stats
+}
+
+// 上位の絵文字は多い順、同数なら絵文字名の降順で、since より前のリアクションは数えない
+func TestUserStatisticsFavoriteEmojisOrder(t *testing.T) {
+	setupIntegration(t)
+	ctx := context.Background()
+	owner := createTestUser(t)
+	viewer := createTestUser(t)
+	livestream := createTestLivestream(t, owner.ID)
+
+	since := time.Now().Add(-time.Minute).Truncate(time.Second)
+	for _, r := range []struct {
+		emojiName string
+		count     int
+		createdAt int64
+	}{
+		{"a", 3, since.Unix()},
+		{"b", 5, since.Unix() + 1},
+		{"c", 1, since.Unix()},
+		{"d", 3, since.Unix() + 1},
+		// since より前なので数えない
+		{"c", 10, since.Unix() - 1},
+	} {
+		for i := 0; i < r.count; i++ {
+			if _, err := dbConn.ExecContext(ctx, "INSERT INTO reactions (user_id, livestream_id, emoji_name, created_at) VALUES (?, ?, ?, ?)", viewer.ID, livestream.ID, r.emojiName, r.createdAt); err != nil {
+				t.Fatalf("failed to insert reaction: %+v", err)
+			}
+		}
+	}
+
+	stats := getTestUserStatistics(t, viewer, owner.Name, url.Values{"favorites": {"3"}, "since": {since.Format(time.RFC3339)}})
+	if stats.FavoriteEmojis == nil {
+		t.Fatal("favorite_emojis is missing")
+	}
+	want := []EmojiCount{{EmojiName: "b", Count: 5}, {EmojiName: "d", Count: 3}, {EmojiName: "a", Count: 3}}
+	got := *stats.FavoriteEmojis
+	if len(got) != len(want) {
+		t.Fatalf("favorite_emojis = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("favorite_emojis = %+v, want %+v", got, want)
+		}
+	}
+
+	// リアクションの無いユーザーでも、指定すれば [] が返る
+	stats = getTestUserStatistics(t, viewer, viewer.Name, url.Values{"favorites": {"3"}})
+	if stats.FavoriteEmojis == nil || len(*stats.FavoriteEmojis) != 0 {
+		t.Errorf("favorite_emojis = %+v, want []", stats.FavoriteEmojis)
+	}
+}
+
+// 重なった視聴区間から同時視聴者数の最大値を求める
+func TestMaxConcurrentViewers(t *testing.T) {
+	left := func(at int64) *int64 { return &at }
+	for _, tt := range []struct {
+		name      string
+		histories []LivestreamViewerModel
+		want      int64
+	}{
+		{"empty", nil, 0},
+		{"one viewer", []LivestreamViewerModel{{CreatedAt: 10, LeftAt: left(20)}}, 1},
+		{
+			"overlapping",
+			[]LivestreamViewerModel{
+				{CreatedAt: 10, LeftAt: left(50)},
+				{CreatedAt: 20, LeftAt: left(40)},
+				{CreatedAt: 30, LeftAt: left(60)},
+				{CreatedAt: 55, LeftAt: left(70)},
+			},
+			3,
+		},
+		{
+			// 退出と同時刻の入室は重なりとして数えない
+			"leave and enter at the same time",
+			[]LivestreamViewerModel{
+				{CreatedAt: 10, LeftAt: left(20)},
+				{CreatedAt: 20, LeftAt: left(30)},
+				{CreatedAt: 30, LeftAt: left(40)},
+			},
+			1,
+		},
+		{
+			// 退出していない視聴者は最後まで残っている
+			"still watching",
+			[]LivestreamViewerModel{
+				{CreatedAt: 10},
+				{CreatedAt: 15, LeftAt: left(20)},
+				{CreatedAt: 30},
+			},
+			2,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := maxConcurrentViewers(tt.histories); got != tt.want {
+				t.Errorf("maxConcurrentViewers = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// お気に入り絵文字は一度求めたらキャッシュを使い、配信にリアクションが付くまで求め直さない
+func TestFavoriteEmojiCache(t *testing.T) {
+	setupIntegration(t)
+	owner := createTestUser(t)
+	viewer := createTestUser(t)
+	livestream := createTestLivestream(t, owner.ID)
+	now := time.Now().Unix()
+	invalidateFavoriteEmoji(owner.ID)
+	t.Cleanup(func() { invalidateFavoriteEmoji(owner.ID) })
+
+	createTestReaction(t, viewer.ID, livestream.ID, "heart", now)
+	if got := getTestUserStatistics(t, viewer, owner.Name, nil).FavoriteEmoji; got != "heart" {
+		t.Fatalf("favorite_emoji = %q, want heart", got)
+	}
+
+	// ハンドラを通さずに入れたリアクションでは破棄されないので、クエリが走らなければ結果は変わらない
+	for i := 0; i < 3; i++ {
+		createTestReaction(t, viewer.ID, livestream.ID, "smile", now)
+	}
+	invalidateUserStats(owner.ID)
+	if got := getTestUserStatistics(t, viewer, owner.Name, nil).FavoriteEmoji; got != "heart" {
+		t.Errorf("favorite_emoji = %q, want the cached heart", got)
+	}
+
+	if code, err := postTestReaction(t, viewer, livestream.ID, "smile"); err != nil || code != http.StatusCreated {
+		t.Fatalf("postReactionHandler = %d, %+v", code, err)
+	}
+	if got := getTestUserStatistics(t, viewer, owner.Name, nil).FavoriteEmoji; got != "smile" {
+		t.Errorf("after a new reaction: favorite_emoji = %q, want smile", got)
+	}
+}
+
+func getTestTopEmoji(t *testing.T, limit string) []EmojiCount {
+	t.Helper()
+	c, rec := newTestContext(http.MethodGet, "/api/stats/emoji/top?limit="+limit, nil)
+	if err := getTopEmojiHandler(c); err != nil {
+		t.Fatalf("getTopEmojiHandler: %+v", err)
+	}
+	var emojis []EmojiCount
+	if err := json.Unmarshal(rec.Body.Bytes(), &emojis); err != nil {
+		t.Fatalf("failed to decode response: %+v", err)
+	}
+	return emojis
+}
+
+func expireTopEmojiCache(t *testing.T) {
+	t.Helper()
+	topEmojiCache.Lock()
+	topEmojiCache.expiresAt = time.Time{}
+	topEmojiCache.Unlock()
+	t.Cleanup(func() {
+		topEmojiCache.Lock()
+		topEmojiCache.emojis, topEmojiCache.expiresAt = nil, time.Time{}
+		topEmojiCache.Unlock()
+	})
+}
+
+// 全体で多い順、同数なら絵文字名の昇順に並ぶ
+func TestGetTopEmojiOrder(t *testing.T) {
+	setupIntegration(t)
+	ctx := context.Background()
+	expireTopEmojiCache(t)
+	top := getTestTopEmoji(t, "1")
+	var base int64
+	if len(top) > 0 {
+		base = top[0].Count
+	}
+
+	owner := createTestUser(t)
+	viewer := createTestUser(t)
+	livestream := createTestLivestream(t, owner.ID)
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 10)
+	// 既存のどの絵文字よりも多く付けて、上位に来るようにする
+	want := []EmojiCount{
+		{EmojiName: "test_a" + suffix, Count: base + 2},
+		{EmojiName: "test_b" + suffix, Count: base + 1},
+		{EmojiName: "test_c" + suffix, Count: base + 1},
+	}
+	var reactions []ReactionModel
+	for _, emoji := range want {
+		for i := int64(0); i < emoji.Count; i++ {
+			reactions = append(reactions, ReactionModel{UserID: viewer.ID, LivestreamID: livestream.ID, EmojiName: emoji.EmojiName, CreatedAt: time.Now().Unix()})
+		}
+	}
+	if _, err := dbConn.NamedExecContext(ctx, "INSERT INTO reactions (user_id, livestream_id, emoji_name, created_at) VALUES (:user_id, :livestream_id, :emoji_name, :created_at)", reactions); err != nil {
+		t.Fatalf("failed to insert reactions: %+v", err)
+	}
+
+	expireTopEmojiCache(t)
+	if got := getTestTopEmoji(t, "3"); !reflect.DeepEqual(got, want) {
+		t.Errorf("top emoji = %+v, want %+v", got, want)
+	}
+}
+
+// キャッシュが有効な間はDBを読まず、limit 件に切り詰めて返す
+func TestGetTopEmojiCached(t *testing.T) {
+	expireTopEmojiCache(t)
+	topEmojiCache.Lock()
+	topEmojiCache.emojis = []EmojiCount{{EmojiName: "a", Count: 3}, {EmojiName: "b", Count: 2}, {EmojiName: "c", Count: 1}}
+	topEmojiCache.expiresAt = time.Now().Add(time.Minute)
+	topEmojiCache.Unlock()
+
+	want := []EmojiCount{{EmojiName: "a", Count: 3}, {EmojiName: "b", Count: 2}}
+	if got := getTestTopEmoji(t, "2"); !reflect.DeepEqual(got, want) {
+		t.Errorf("top emoji = %+v, want %+v", got, want)
+	}
+}
+
+func TestGetTopEmojiInvalidLimit(t *testing.T) {
+	for _, limit := range []string{"0", "101", "x"} {
+		c, _ := newTestContext(http.MethodGet, "/api/stats/emoji/top?limit="+limit, nil)
+		wantBadRequest(t, getTopEmojiHandler(c))
+	}
+}
+
+func postTestUsersStatistics(t *testing.T, viewer UserModel, usernames []string) (map[string]UserStatistics, error) {
+	t.Helper()
+	body, err := json.Marshal(PostUsersStatisticsRequest{Usernames: usernames})
+	if err != nil {
+		t.Fatalf("failed to marshal request: %+v", err)
+	}
+	c, rec := newTestContext(http.MethodPost, "/api/users/stats", bytes.NewReader(body))
+	if err := serveWithSession(c, viewer, postUsersStatisticsHandler); err != nil {
+		return nil, err
+	}
+	var stats map[string]UserStatistics
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("failed to decode response: %+v", err)
+	}
+	return stats, nil
+}
+
+// まとめて取得した統計は、1人ずつ取得したものと同じになる
+func TestPostUsersStatisticsMatchesSingle(t *testing.T) {
+	setupIntegration(t)
+	ctx := context.Background()
+	viewer := createTestUser(t)
+	owners := []UserModel{createTestUser(t), createTestUser(t)}
+	now := time.Now().Unix()
+	for i, owner := range owners {
+		livestream := createTestLivestream(t, owner.ID)
+		for j := 0; j <= i; j++ {
+			createTestReaction(t, viewer.ID, livestream.ID, "heart", now)
+			livecomment := createTestLivecomment(t, viewer.ID, livestream.ID, now)
+			if _, err := dbConn.ExecContext(ctx, "UPDATE livecomments SET tip = ? WHERE id = ?", 100*(j+1), livecomment.ID); err != nil {
+				t.Fatalf("failed to set tip: %+v", err)
+			}
+		}
+		invalidateUserStats(owner.ID)
+		invalidateFavoriteEmoji(owner.ID)
+	}
+
+	usernames := []string{owners[0].Name, owners[1].Name, "test-no-such-user"}
+	batch, err := postTestUsersStatistics(t, viewer, usernames)
+	if err != nil {
+		t.Fatalf("postUsersStatisticsHandler: %+v", err)
+	}
+	if len(batch) != len(owners) {
+		t.Errorf("got %d users, want %d", len(batch), len(owners))
+	}
+	for _, owner := range owners {
+		want := getTestUserStatistics(t, viewer, owner.Name, nil)
+		if got := batch[owner.Name]; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: batch = %+v, single = %+v", owner.Name, got, want)
+		}
+	}
+}
+
+func TestPostUsersStatisticsTooMany(t *testing.T) {
+	viewer := UserModel{ID: 1<<40 + 5, Name: "test005"}
+	cacheTestUser(t, viewer)
+	usernames := make([]string, maxUsersStatisticsBatchSize+1)
+	for i := range usernames {
+		usernames[i] = "user" + strconv.Itoa(i)
+	}
+	_, err := postTestUsersStatistics(t, viewer, usernames)
+	wantBadRequest(t, err)
+}
+
+// 配信ごとに数えた視聴者数と、GROUP BY でまとめて数えた結果は一致する
+func TestCountViewersByLivestreamMatchesLoop(t *testing.T) {
+	setupIntegration(t)
+	ctx := context.Background()
+	owner := createTestUser(t)
+	livestreams := []LivestreamModel{createTestLivestream(t, owner.ID), createTestLivestream(t, owner.ID), createTestLivestream(t, owner.ID)}
+	now := time.Now().Unix()
+	for i, livestream := range livestreams[:2] {
+		for j := 0; j <= i+1; j++ {
+			viewer := createTestUser(t)
+			if _, err := dbConn.ExecContext(ctx, "INSERT INTO livestream_viewers_history (user_id, livestream_id, created_at) VALUES (?, ?, ?)", viewer.ID, livestream.ID, now); err != nil {
+				t.Fatalf("failed to insert viewer history: %+v", err)
+			}
+		}
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		t.Fatalf("failed to begin transaction: %+v", err)
+	}
+	defer tx.Rollback()
+	got, err := countViewersByLivestream(ctx, tx, owner.ID)
+	if err != nil {
+		t.Fatalf("countViewersByLivestream: %+v", err)
+	}
+
+	want := make(map[int64]int64)
+	for _, livestream := range livestreams {
+		var cnt int64
+		if err := tx.GetContext(ctx, &cnt, "SELECT COUNT(*) FROM livestream_viewers_history WHERE livestream_id = ?", livestream.ID); err != nil {
+			t.Fatalf("failed to count viewers: %+v", err)
+		}
+		// 視聴者のいない配信は結果に含まれない
+		if cnt > 0 {
+			want[livestream.ID] = cnt
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("countViewersByLivestream = %v, want %v", got, want)
+	}
+}
+
+// resetUserRankingState はランキングの最後の成功と失敗の記録を消し、テスト後に元へ戻します
+func resetUserRankingState(t *testing.T) {
+	t.Helper()
+	userRankingState.Lock()
+	prevGood, prevHasGood, prevErr, prevFailedAt := userRankingState.lastGood, userRankingState.hasGood, userRankingState.lastErr, userRankingState.failedAt
+	userRankingState.lastGood, userRankingState.hasGood, userRankingState.lastErr, userRankingState.failedAt = nil, false, nil, time.Time{}
+	userRankingState.Unlock()
+	t.Cleanup(func() {
+		userRankingState.Lock()
+		userRankingState.lastGood, userRankingState.hasGood, userRankingState.lastErr, userRankingState.failedAt = prevGood, prevHasGood, prevErr, prevFailedAt
+		userRankingState.Unlock()
+	})
+}
+
+// 集計に失敗したら最後に成功したランキングを返し、しばらくは集計し直さない
+func TestGetUserRankingServesLastGood(t *testing.T) {
+	resetUserRankingState(t)
+	prevDB := dbConn
+	t.Cleanup(func() { dbConn = prevDB })
+	lastGood := UserRanking{{Username: "alice", Score: 1}, {Username: "bob", Score: 2}}
+	userRankingState.Lock()
+	userRankingState.lastGood, userRankingState.hasGood = lastGood, true
+	userRankingState.Unlock()
+
+	dbConn = newBrokenDB(t)
+	got, err := getUserRanking()
+	if err != nil {
+		t.Fatalf("getUserRanking: %+v", err)
+	}
+	if !reflect.DeepEqual(got, lastGood) {
+		t.Errorf("getUserRanking = %v, want the last good %v", got, lastGood)
+	}
+
+	// 失敗の直後はDBに触れない。触れれば nil の dbConn で panic する
+	dbConn = nil
+	got, err = getUserRanking()
+	if err != nil {
+		t.Fatalf("getUserRanking during backoff: %+v", err)
+	}
+	if !reflect.DeepEqual(got, lastGood) {
+		t.Errorf("getUserRanking during backoff = %v, want the last good %v", got, lastGood)
+	}
+}
+
+// 一度も成功していなければ、失敗をそのまま返す
+func TestGetUserRankingWithoutLastGood(t *testing.T) {
+	resetUserRankingState(t)
+	prevDB := dbConn
+	dbConn = newBrokenDB(t)
+	t.Cleanup(func() { dbConn = prevDB })
+
+	if _, err := getUserRanking(); err == nil {
+		t.Error("getUserRanking succeeded with a broken db")
+	}
+	if _, err := getUserRanking(); err == nil {
+		t.Error("getUserRanking during backoff succeeded without a last good ranking")
+	}
+}
+
+// ランキングの集計が終わらないあいだ、rank_pending=1 なら他の統計だけを待たずに返す
+func TestUserStatisticsRankPending(t *testing.T) {
+	setupIntegration(t)
+	resetUserRankingState(t)
+	prevFeatures, prevTTL := features, userStatsCacheTTL
+	features.RedisRanking = false
+	userStatsCacheTTL = time.Minute
+	t.Cleanup(func() { features, userStatsCacheTTL = prevFeatures, prevTTL })
+
+	owner := createTestUser(t)
+	viewer := createTestUser(t)
+	livestream := createTestLivestream(t, owner.ID)
+	createTestReaction(t, viewer.ID, livestream.ID, "heart", time.Now().Unix())
+
+	// 集計中の singleflight に相乗りさせて、ランキングの集計を止めておく
+	release := make(chan struct{})
+	started := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		userRankingSingleflight.Do("user_ranking", func() (interface{}, error) {
+			close(started)
+			<-release
+			return UserRanking{}, nil
+		})
+	}()
+	<-started
+	released := false
+	t.Cleanup(func() {
+		if !released {
+			close(release)
+		}
+		<-done
+	})
+
+	start := time.Now()
+	stats := getTestUserStatistics(t, viewer, owner.Name, url.Values{"rank_pending": {"1"}})
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("statistics took %v while the ranking was being computed", elapsed)
+	}
+	if !stats.RankPending || stats.Rank != 0 {
+		t.Errorf("rank = %d, rank_pending = %v, want a pending rank", stats.Rank, stats.RankPending)
+	}
+	if stats.TotalReactions != 1 {
+		t.Errorf("total_reactions = %d, want 1", stats.TotalReactions)
+	}
+	if _, ok := getCachedUserStats(owner.ID); ok {
+		t.Error("statistics with a pending rank were cached")
+	}
+
+	close(release)
+	released = true
+	<-done
+	stats = getTestUserStatistics(t, viewer, owner.Name, url.Values{"rank_pending": {"1"}})
+	if stats.RankPending || stats.Rank < 1 {
+		t.Errorf("rank = %d, rank_pending = %v, want a settled rank", stats.Rank, stats.RankPending)
+	}
+}
+
+// TTL のあいだは集計クエリを流さずにキャッシュを返し、破棄すれば集計し直す
+func TestUserStatisticsCached(t *testing.T) {
+	setupIntegration(t)
+	prevTTL := userStatsCacheTTL
+	userStatsCacheTTL = time.Minute
+	t.Cleanup(func() { userStatsCacheTTL = prevTTL })
+	owner := createTestUser(t)
+	viewer := createTestUser(t)
+	livestream := createTestLivestream(t, owner.ID)
+	createTestReaction(t, viewer.ID, livestream.ID, "heart", time.Now().Unix())
+	t.Cleanup(func() { invalidateUserStats(owner.ID) })
+
+	first := getTestUserStatistics(t, viewer, owner.Name, nil)
+	if first.TotalReactions != 1 {
+		t.Fatalf("total_reactions = %d, want 1", first.TotalReactions)
+	}
+
+	// キャッシュから返すならDBは使わない。使えば壊れた接続でエラーになる
+	prevDB := dbConn
+	dbConn = newBrokenDB(t)
+	second := getTestUserStatistics(t, viewer, owner.Name, nil)
+	dbConn = prevDB
+	if !reflect.DeepEqual(second, first) {
+		t.Errorf("cached statistics = %+v, want %+v", second, first)
+	}
+
+	createTestReaction(t, viewer.ID, livestream.ID, "heart", time.Now().Unix())
+	invalidateUserStats(owner.ID)
+	third := getTestUserStatistics(t, viewer, owner.Name, nil)
+	if third.TotalReactions != 2 {
+		t.Errorf("total_reactions after invalidation = %d, want 2", third.TotalReactions)
+	}
+}
+
+func TestUserStatsCacheExpires(t *testing.T) {
+	prevTTL := userStatsCacheTTL
+	t.Cleanup(func() {
+		userStatsCacheTTL = prevTTL
+		userStatsCache.Lock()
+		delete(userStatsCache.m, -1)
+		userStatsCache.Unlock()
+	})
+	stats := UserStatistics{Rank: 3, TotalReactions: 5}
+
+	userStatsCacheTTL = 0
+	storeUserStats(-1, stats)
+	if _, ok := getCachedUserStats(-1); ok {
+		t.Error("statistics were cached with the cache disabled")
+	}
+
+	userStatsCacheTTL = 10 * time.Millisecond
+	storeUserStats(-1, stats)
+	if got, ok := getCachedUserStats(-1); !ok || got != stats {
+		t.Errorf("getCachedUserStats = %+v, %v, want %+v", got, ok, stats)
+	}
+	time.Sleep(2 * userStatsCacheTTL)
+	if _, ok := getCachedUserStats(-1); ok {
+		t.Error("statistics were served after the ttl")
+	}
+}
+
+func getTestLivestreamStatistics(t *testing.T, viewer UserModel, livestreamID int64, query url.Values) LivestreamStatistics {
+	t.Helper()
+	id := strconv.FormatInt(livestreamID, 10)
+	c, rec := newTestContext(http.MethodGet, "/api/livestream/"+id+"/statistics?"+query.Encode(), nil)
+	c.SetParamNames("livestream_id")
+	c.SetParamValues(id)
+	if err := serveWithSession(c, viewer, getLivestreamStatisticsHandler); err != nil {
+		t.Fatalf("getLivestreamStatisticsHandler: %+v", err)
+	}
+	var stats LivestreamStatistics
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("failed to decode response: %+v", err)
+	}
+	return stats
+}
+
+// since を指定するとリアクション・コメント・チップはそれ以降の分だけを数え、順位は全期間のまま
+func TestStatisticsSince(t *testing.T) {
+	setupIntegration(t)
+	ctx := context.Background()
+	owner := createTestUser(t)
+	viewer := createTestUser(t)
+	livestream := createTestLivestream(t, owner.ID)
+
+	since := time.Now().Add(-time.Minute).Truncate(time.Second)
+	old, recent := since.Unix()-3600, since.Unix()+1
+	createTestReaction(t, viewer.ID, livestream.ID, "heart", old)
+	createTestReaction(t, viewer.ID, livestream.ID, "heart", old)
+	createTestReaction(t, viewer.ID, livestream.ID, "smile", recent)
+	for _, lc := range []struct {
+		tip       int64
+		createdAt int64
+	}{{500, old}, {100, recent}} {
+		if _, err := dbConn.ExecContext(ctx, "INSERT INTO livecomments (user_id, livestream_id, comment, tip, created_at) VALUES (?, ?, ?, ?, ?)", viewer.ID, livestream.ID, "tip", lc.tip, lc.createdAt); err != nil {
+			t.Fatalf("failed to insert livecomment: %+v", err)
+		}
+	}
+	invalidateUserStats(owner.ID)
+	window := url.Values{"since": {since.Format(time.RFC3339)}}
+
+	all := getTestUserStatistics(t, viewer, owner.Name, nil)
+	windowed := getTestUserStatistics(t, viewer, owner.Name, window)
+	for _, tt := range []struct {
+		name                   string
+		all, wantAll           int64
+		windowed, wantWindowed int64
+	}{
+		{"total_reactions", all.TotalReactions, 3, windowed.TotalReactions, 1},
+		{"total_livecomments", all.TotalLivecomments, 2, windowed.TotalLivecomments, 1},
+		{"total_tip", all.TotalTip, 600, windowed.TotalTip, 100},
+	} {
+		if tt.all != tt.wantAll {
+			t.Errorf("all-time %s = %d, want %d", tt.name, tt.all, tt.wantAll)
+		}
+		if tt.windowed != tt.wantWindowed {
+			t.Errorf("windowed %s = %d, want %d", tt.name, tt.windowed, tt.wantWindowed)
+		}
+	}
+	if windowed.Rank != all.Rank {
+		t.Errorf("windowed rank = %d, want the all-time rank %d", windowed.Rank, all.Rank)
+	}
+
+	allLivestream := getTestLivestreamStatistics(t, viewer, livestream.ID, nil)
+	windowedLivestream := getTestLivestreamStatistics(t, viewer, livestream.ID, window)
+	if allLivestream.TotalReactions != 3 || windowedLivestream.TotalReactions != 1 {
+		t.Errorf("livestream total_reactions = %d / %d, want 3 / 1", allLivestream.TotalReactions, windowedLivestream.TotalReactions)
+	}
+	if allLivestream.MaxTip != 500 || windowedLivestream.MaxTip != 100 {
+		t.Errorf("livestream max_tip = %d / %d, want 500 / 100", allLivestream.MaxTip, windowedLivestream.MaxTip)
+	}
+	if windowedLivestream.Rank != allLivestream.Rank {
+		t.Errorf("windowed livestream rank = %d, want the all-time rank %d", windowedLivestream.Rank, allLivestream.Rank)
+	}
+}
+
+func TestParseStatsSinceInvalid(t *testing.T) {
+	for _, v := range []string{"yesterday", "2023-11-25", "1700000000"} {
+		c, _ := newTestContext(http.MethodGet, "/api/user/test/statistics?since="+url.QueryEscape(v), nil)
+		_, err := parseStatsSince(c)
+		wantBadRequest(t, err)
+	}
+}
+
+// rank=false では全配信のスコアを集める順位のクエリを発行せず、順位は 0 のまま
+func TestLivestreamStatisticsWithoutRank(t *testing.T) {
+	saveFeatures(t)
+	// Redis の sorted set を使わず、順位を SQL で求める場合でも飛ばすことを確かめる
+	features.RedisRanking = false
+	db := sqlx.NewDb(sql.OpenDB(fakeSlowConnector{}), "mysql")
+	t.Cleanup(func() { db.Close() })
+	var queries []string
+	fakeOnQuery = func(query string) { queries = append(queries, query) }
+	t.Cleanup(func() { fakeOnQuery = nil })
+
+	ctx := context.Background()
+	for _, tt := range []struct {
+		withRank bool
+		wantScan bool
+	}{
+		{withRank: false, wantScan: false},
+		{withRank: true, wantScan: true},
+	} {
+		queries = nil
+		tx, err := db.BeginTxx(ctx, nil)
+		if err != nil {
+			t.Fatalf("failed to begin transaction: %+v", err)
+		}
+		stats, err := getLivestreamStatistics(ctx, tx, 1, 0, tt.withRank)
+		tx.Rollback()
+		if err != nil {
+			t.Fatalf("getLivestreamStatistics(withRank=%v): %+v", tt.withRank, err)
+		}
+		scanned := false
+		for _, query := range queries {
+			if query == livestreamScoresQuery {
+				scanned = true
+			}
+		}
+		if scanned != tt.wantScan {
+			t.Errorf("withRank=%v: scanned all livestreams = %v, want %v", tt.withRank, scanned, tt.wantScan)
+		}
+		if !tt.withRank && stats.Rank != 0 {
+			t.Errorf("withRank=false: rank = %d, want 0", stats.Rank)
+		}
+	}
+}
+
+func TestLivestreamStatisticsInvalidRank(t *testing.T) {
+	user := UserModel{ID: 1<<40 + 9, Name: "test009"}
+	cacheTestUser(t, user)
+	c, _ := newTestContext(http.MethodGet, "/api/livestream/1/statistics?rank=x", nil)
+	c.SetParamNames("livestream_id")
+	c.SetParamValues("1")
+	wantBadRequest(t, serveWithSession(c, user, getLivestreamStatisticsHandler))
+}
+
+// ランキングの集計で入れた全期間の合計は、ユーザーごとに数え直したものと一致する
+func TestUserTotalsFromRankingMatchQuery(t *testing.T) {
+	setupIntegration(t)
+	resetUserRankingState(t)
+	ctx := context.Background()
+	owner := createTestUser(t)
+	viewer := createTestUser(t)
+	livestream := createTestLivestream(t, owner.ID)
+	now := time.Now().Unix()
+	for _, emoji := range []string{"innocent", "smile", "smile"} {
+		createTestReaction(t, viewer.ID, livestream.ID, emoji, now)
+	}
+	for _, tip := range []int64{100, 2000} {
+		if _, err := dbConn.ExecContext(ctx, "INSERT INTO livecomments (user_id, livestream_id, comment, tip, created_at) VALUES (?, ?, ?, ?, ?)", viewer.ID, livestream.ID, "tip", tip, now); err != nil {
+			t.Fatalf("failed to insert livecomment: %+v", err)
+		}
+	}
+	t.Cleanup(func() { invalidateUserTotals(owner.ID) })
+
+	invalidateUserTotals(owner.ID)
+	if _, err := computeUserRanking(); err != nil {
+		t.Fatalf("computeUserRanking: %+v", err)
+	}
+	got, ok := getCachedUserTotals(owner.ID)
+	if !ok {
+		t.Fatal("computeUserRanking did not cache the totals")
+	}
+	var want userTotals
+	if err := dbConn.GetContext(ctx, &want.Reactions, "SELECT COUNT(*) FROM livestreams l INNER JOIN reactions r ON r.livestream_id = l.id WHERE l.user_id = ?", owner.ID); err != nil {
+		t.Fatalf("failed to count reactions: %+v", err)
+	}
+	if err := dbConn.GetContext(ctx, &want.Tips, "SELECT IFNULL(SUM(lc.tip), 0) FROM livestreams l INNER JOIN livecomments lc ON lc.livestream_id = l.id WHERE l.user_id = ?", owner.ID); err != nil {
+		t.Fatalf("failed to sum tips: %+v", err)
+	}
+	if got != want {
+		t.Errorf("cached totals = %+v, want %+v", got, want)
+	}
+
+	invalidateUserStats(owner.ID)
+	if _, ok := getCachedUserTotals(owner.ID); ok {
+		t.Error("invalidateUserStats left the totals cached")
+	}
+}
+
+// 集計を始めた後に破棄されたユーザーの値は、古いかもしれないので書き戻さない
+func TestStoreUserTotalsSkipsInvalidated(t *testing.T) {
+	const stale, fresh = 1<<40 + 10, 1<<40 + 11
+	t.Cleanup(func() {
+		invalidateUserTotals(stale)
+		invalidateUserTotals(fresh)
+	})
+
+	gen := userTotalsGen()
+	invalidateUserTotals(stale)
+	storeUserTotals(gen, []UserScore{
+		{ID: stale, ReactionCount: 1, TotalTips: 10},
+		{ID: fresh, ReactionCount: 2, TotalTips: 20},
+	})
+	if totals, ok := getCachedUserTotals(stale); ok {
+		t.Errorf("stored totals %+v for a user invalidated during the aggregation", totals)
+	}
+	if totals, ok := getCachedUserTotals(fresh); !ok || totals != (userTotals{Reactions: 2, Tips: 20}) {
+		t.Errorf("totals = %+v (cached %v), want {2 20}", totals, ok)
+	}
+}
+
+// お気に入り絵文字も、求め始めた後にリアクションが付いたユーザーの値は書き戻さない
+func TestStoreFavoriteEmojiSkipsInvalidated(t *testing.T) {
+	const stale, fresh = 1<<40 + 15, 1<<40 + 16
+	t.Cleanup(func() {
+		invalidateFavoriteEmoji(stale)
+		invalidateFavoriteEmoji(fresh)
+	})
+
+	gen := favoriteEmojiGen()
+	invalidateFavoriteEmoji(stale)
+	storeFavoriteEmoji(gen, stale, "heart")
+	storeFavoriteEmoji(gen, fresh, "smile")
+	if emoji, ok := getCachedFavoriteEmoji(stale); ok {
+		t.Errorf("stored favorite emoji %q for a user invalidated during the aggregation", emoji)
+	}
+	if emoji, ok := getCachedFavoriteEmoji(fresh); !ok || emoji != "smile" {
+		t.Errorf("favorite emoji = %q (cached %v), want smile", emoji, ok)
+	}
+}
+
+// total_activity はリアクション数とコメント数の和で、どちらが増えても和のまま
+func TestUserStatisticsTotalActivity(t *testing.T) {
+	setupIntegration(t)
+	owner := createTestUser(t)
+	viewer := createTestUser(t)
+	livestream := createTestLivestream(t, owner.ID)
+	now := time.Now().Unix()
+	for i := 0; i < 3; i++ {
+		createTestReaction(t, viewer.ID, livestream.ID, "heart", now)
+	}
+	createTestLivecomment(t, viewer.ID, livestream.ID, now)
+	t.Cleanup(func() { invalidateUserStats(owner.ID) })
+
+	assertActivity := func(wantReactions, wantLivecomments int64) {
+		t.Helper()
+		invalidateUserStats(owner.ID)
+		stats := getTestUserStatistics(t, viewer, owner.Name, nil)
+		if stats.TotalReactions != wantReactions || stats.TotalLivecomments != wantLivecomments {
+			t.Fatalf("reactions, livecomments = %d, %d, want %d, %d", stats.TotalReactions, stats.TotalLivecomments, wantReactions, wantLivecomments)
+		}
+		if stats.TotalActivity != stats.TotalReactions+stats.TotalLivecomments {
+			t.Errorf("total_activity = %d, want %d + %d", stats.TotalActivity, stats.TotalReactions, stats.TotalLivecomments)
+		}
+	}
+	assertActivity(3, 1)
+
+	createTestLivecomment(t, viewer.ID, livestream.ID, now)
+	assertActivity(3, 2)
+	createTestReaction(t, viewer.ID, livestream.ID, "heart", now)
+	assertActivity(4, 2)
+}
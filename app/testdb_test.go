@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// DBとRedisを使うテストは、消してよい環境を指していることを ISUCON13_INTEGRATION_TEST=1 で明示したときだけ動かす
+// 接続先は本体と同じ環境変数 (ISUCON13_MYSQL_DIALCONFIG_*, ISUCON13_REDIS_ADDR) で決める
+const integrationTestEnvKey = "ISUCON13_INTEGRATION_TEST"
+
+// setupIntegration は dbConn と redisConn を繋ぎ、アプリ側のスキーマを当てます
+// 条件を満たさない場合や繋がらない場合はテストを飛ばす
+func setupIntegration(t testing.TB) {
+	t.Helper()
+	if enabled, _ := strconv.ParseBool(os.Getenv(integrationTestEnvKey)); !enabled {
+		t.Skipf("%s is not set", integrationTestEnvKey)
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatalf("failed to load config: %+v", err)
+	}
+	prevConfig := config
+	config = cfg
+	t.Cleanup(func() { config = prevConfig })
+
+	db, err := connectDB(nil)
+	if err != nil {
+		t.Skipf("mysql is not available: %+v", err)
+	}
+	rdb, err := connectRedis(nil)
+	if err != nil {
+		t.Skipf("redis is not available: %+v", err)
+	}
+	if err := rdb.Ping(context.Background()).Err(); err != nil {
+		t.Skipf("redis is not available: %+v", err)
+	}
+
+	prevDB, prevRedis := dbConn, redisConn
+	dbConn, redisConn = db, rdb
+	t.Cleanup(func() {
+		dbConn, redisConn = prevDB, prevRedis
+		db.Close()
+		rdb.Close()
+	})
+
+	if err := migrateSchema(context.Background()); err != nil {
+		t.Fatalf("failed to migrate schema: %+v", err)
+	}
+}
+
+var testUserSeq atomic.Int64
+
+// createTestUser は他のテストや初期データと名前が重ならないユーザーを作ります
+func createTestUser(t *testing.T) UserModel {
+	t.Helper()
+	name := fmt.Sprintf("test%d%d", time.Now().UnixNano(), testUserSeq.Add(1))
+	createdAt := time.Now().Unix()
+	user := UserModel{
+		Name:           name,
+		DisplayName:    name,
+		Description:    "test user",
+		HashedPassword: "x",
+		CreatedAt:      &createdAt,
+	}
+	result, err := dbConn.NamedExecContext(context.Background(), "INSERT INTO users (name, display_name, description, password, created_at) VALUES(:name, :display_name, :description, :password, :created_at)", user)
+	if err != nil {
+		t.Fatalf("failed to insert user: %+v", err)
+	}
+	user.ID, err = result.LastInsertId()
+	if err != nil {
+		t.Fatalf("failed to get last inserted user id: %+v", err)
+	}
+	return user
+}
+
+func createTestLivestream(t *testing.T, ownerID int64) LivestreamModel {
+	t.Helper()
+	now := time.Now().Unix()
+	livestream := LivestreamModel{
+		UserID:       ownerID,
+		Title:        "test livestream",
+		Description:  "test livestream",
+		PlaylistUrl:  "https://media.xiii.isucon.dev/api/4/playlist.m3u8",
+		ThumbnailUrl: "https://media.xiii.isucon.dev/isucon12_final.webp",
+		StartAt:      now,
+		EndAt:        now + 3600,
+	}
+	result, err := dbConn.NamedExecContext(context.Background(), "INSERT INTO livestreams (user_id, title, description, playlist_url, thumbnail_url, start_at, end_at) VALUES(:user_id, :title, :description, :playlist_url, :thumbnail_url, :start_at, :end_at)", livestream)
+	if err != nil {
+		t.Fatalf("failed to insert livestream: %+v", err)
+	}
+	livestream.ID, err = result.LastInsertId()
+	if err != nil {
+		t.Fatalf("failed to get last inserted livestream id: %+v", err)
+	}
+	return livestream
+}
+
+func createTestLivecomment(t *testing.T, userID, livestreamID, createdAt int64) LivecommentModel {
+	t.Helper()
+	livecomment := LivecommentModel{
+		UserID:       userID,
+		LivestreamID: livestreamID,
+		Comment:      "test comment",
+		CreatedAt:    createdAt,
+	}
+	result, err := dbConn.NamedExecContext(context.Background(), "INSERT INTO livecomments (user_id, livestream_id, comment, tip, created_at) VALUES (:user_id, :livestream_id, :comment, :tip, :created_at)", livecomment)
+	if err != nil {
+		t.Fatalf("failed to insert livecomment: %+v", err)
+	}
+	livecomment.ID, err = result.LastInsertId()
+	if err != nil {
+		t.Fatalf("failed to get last inserted livecomment id: %+v", err)
+	}
+	return livecomment
+}
+
+func createTestReport(t *testing.T, reporterID int64, livecomment LivecommentModel, createdAt int64) LivecommentReportModel {
+	t.Helper()
+	report := LivecommentReportModel{
+		UserID:        reporterID,
+		LivestreamID:  livecomment.LivestreamID,
+		LivecommentID: livecomment.ID,
+		CreatedAt:     createdAt,
+	}
+	result, err := dbConn.NamedExecContext(context.Background(), "INSERT INTO livecomment_reports(user_id, livestream_id, livecomment_id, created_at) VALUES (:user_id, :livestream_id, :livecomment_id, :created_at)", report)
+	if err != nil {
+		t.Fatalf("failed to insert livecomment report: %+v", err)
+	}
+	report.ID, err = result.LastInsertId()
+	if err != nil {
+		t.Fatalf("failed to get last inserted livecomment report id: %+v", err)
+	}
+	return report
+}
+
+func createTestReaction(t *testing.T, userID, livestreamID int64, emojiName string, createdAt int64) ReactionModel {
+	t.Helper()
+	reaction := ReactionModel{
+		UserID:       userID,
+		LivestreamID: livestreamID,
+		EmojiName:    emojiName,
+		CreatedAt:    createdAt,
+	}
+	result, err := dbConn.NamedExecContext(context.Background(), "INSERT INTO reactions (user_id, livestream_id, emoji_name, created_at) VALUES (:user_id, :livestream_id, :emoji_name, :created_at)", reaction)
+	if err != nil {
+		t.Fatalf("failed to insert reaction: %+v", err)
+	}
+	reaction.ID, err = result.LastInsertId()
+	if err != nil {
+		t.Fatalf("failed to get last inserted reaction id: %+v", err)
+	}
+	return reaction
+}
+
+// newTestContext はハンドラを直接呼ぶための echo.Context を作ります
+func newTestContext(method, target string, body io.Reader) (echo.Context, *httptest.ResponseRecorder) {
+	req := httptest.NewRequest(method, target, body)
+	if body != nil {
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	}
+	rec := httptest.NewRecorder()
+	return echo.New().NewContext(req, rec), rec
+}
+
+// serveWithSession は user でログインしたセッションを持たせて h を呼びます
+func serveWithSession(c echo.Context, user UserModel, h echo.HandlerFunc) error {
+	return session.Middleware(sessions.NewCookieStore(secret))(func(c echo.Context) error {
+		sess, err := session.Get(defaultSessionIDKey, c)
+		if err != nil {
+			return err
+		}
+		sess.Values[defaultUserIDKey] = user.ID
+		sess.Values[defaultUsernameKey] = user.Name
+		sess.Values[defaultSessionExpiresKey] = time.Now().Add(time.Hour).Unix()
+		return h(c)
+	})(c)
+}
+
+// cacheTestUser は DB を使わずにセッション検証を通せるよう、user を userCache に載せます
+func cacheTestUser(t *testing.T, user UserModel) {
+	t.Helper()
+	userCache.Store(user.ID, user)
+	t.Cleanup(func() { userCache.Delete(user.ID) })
+}
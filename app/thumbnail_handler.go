@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+type PostThumbnailRequest struct {
+	Image []byte `json:"image"`
+}
+
+type PostThumbnailResponse struct {
+	ID int64 `json:"id"`
+}
+
+type ThumbnailModel struct {
+	ID            int64  `db:"id"`
+	LivestreamID  int64  `db:"livestream_id"`
+	Image         []byte `db:"image"`
+	ThumbnailHash string `db:"thumbnail_hash"`
+}
+
+func getThumbnailHashKey(livestreamID int64) string {
+	return thumbnailHashKeyspace.Key(livestreamID)
+}
+
+// 配信サムネイル取得API
+// GET /api/livestream/:livestream_id/thumbnail
+// ETag はサムネイルのハッシュで、If-None-Match が一致すればDBを引かずに 304 を返す
+func getThumbnailHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	livestreamID, err := parseInt64Param(c, "livestream_id")
+	if err != nil {
+		return err
+	}
+
+	ifNoneMatch := c.Request().Header.Get("If-None-Match")
+	if ifNoneMatch != "" {
+		hash, err := redisConn.Get(ctx, getThumbnailHashKey(livestreamID)).Result()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get thumbnail hash: "+err.Error())
+		}
+		if etag := `"` + hash + `"`; err == nil && ifNoneMatch == etag {
+			c.Response().Header().Set("ETag", etag)
+			return c.NoContent(http.StatusNotModified)
+		}
+	}
+
+	var thumbnail ThumbnailModel
+	if err := dbConn.GetContext(ctx, &thumbnail, "SELECT * FROM livestream_thumbnails WHERE livestream_id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found thumbnail of the livestream")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get thumbnail: "+err.Error())
+	}
+
+	// 読んだ後に登録されたサムネイルのハッシュを古い値で上書きしないよう、無い場合だけ短い期限で書き戻す
+	if err := redisConn.SetNX(ctx, getThumbnailHashKey(thumbnail.LivestreamID), thumbnail.ThumbnailHash, iconHashReadBackExpiration()).Err(); err != nil {
+		c.Logger().Warnf("failed to cache thumbnail hash: %+v", err)
+	}
+
+	return serveImage(c, `"`+thumbnail.ThumbnailHash+`"`, thumbnail.Image)
+}
+
+// 配信サムネイル登録API
+// POST /api/livestream/:livestream_id/thumbnail
+// 配信者のみ登録でき、既存のサムネイルは置き換える
+func postThumbnailHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID, err := verifyUserSession(c)
+	if err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := parseInt64Param(c, "livestream_id")
+	if err != nil {
+		return err
+	}
+
+	var req *PostThumbnailRequest
+	if err := decodeJSON(c.Request().Body, &req); err != nil || req == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if livestreamModel.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "only the streamer can set the thumbnail of the livestream")
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_thumbnails WHERE livestream_id = ?", livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete old thumbnail: "+err.Error())
+	}
+
+	thumbnailHash := sha256.Sum256(req.Image)
+	hashString := hex.EncodeToString(thumbnailHash[:])
+	rs, err := tx.ExecContext(ctx, "INSERT INTO livestream_thumbnails (livestream_id, image, thumbnail_hash) VALUES (?, ?, ?)", livestreamID, req.Image, hashString)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert new thumbnail: "+err.Error())
+	}
+
+	thumbnailID, err := rs.LastInsertId()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted thumbnail id: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	// アイコンと同じく、コミット済みなのでキャッシュの更新に失敗してもエラーにはせず消しておく
+	if err := redisConn.Set(ctx, getThumbnailHashKey(livestreamID), hashString, iconHashTTL).Err(); err != nil {
+		c.Logger().Errorf("failed to update thumbnail hash cache for livestream_id=%d: %+v", livestreamID, err)
+		if err := redisConn.Del(ctx, getThumbnailHashKey(livestreamID)).Err(); err != nil {
+			c.Logger().Errorf("failed to invalidate thumbnail hash cache for livestream_id=%d; needs repair: %+v", livestreamID, err)
+		}
+	}
+
+	return c.JSON(http.StatusCreated, &PostThumbnailResponse{
+		ID: thumbnailID,
+	})
+}
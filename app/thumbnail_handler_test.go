@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func postTestThumbnail(t *testing.T, user UserModel, livestreamID int64, image []byte) error {
+	t.Helper()
+	body, err := json.Marshal(PostThumbnailRequest{Image: image})
+	if err != nil {
+		t.Fatalf("failed to marshal request: %+v", err)
+	}
+	c, rec := newTestContext(http.MethodPost, fmt.Sprintf("/api/livestream/%d/thumbnail", livestreamID), bytes.NewReader(body))
+	c.SetParamNames("livestream_id")
+	c.SetParamValues(strconv.FormatInt(livestreamID, 10))
+	if err := serveWithSession(c, user, postThumbnailHandler); err != nil {
+		return err
+	}
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusCreated)
+	}
+	return nil
+}
+
+func getTestThumbnail(t *testing.T, livestreamID int64, ifNoneMatch string) (*httptest.ResponseRecorder, error) {
+	t.Helper()
+	c, rec := newTestContext(http.MethodGet, fmt.Sprintf("/api/livestream/%d/thumbnail", livestreamID), nil)
+	c.SetParamNames("livestream_id")
+	c.SetParamValues(strconv.FormatInt(livestreamID, 10))
+	if ifNoneMatch != "" {
+		c.Request().Header.Set("If-None-Match", ifNoneMatch)
+	}
+	return rec, getThumbnailHandler(c)
+}
+
+func thumbnailETag(image []byte) string {
+	hash := sha256.Sum256(image)
+	return `"` + hex.EncodeToString(hash[:]) + `"`
+}
+
+// 登録したサムネイルがそのまま返り、ETag が一致すれば 304、置き換えれば新しい画像が返る
+func TestThumbnailRoundTrip(t *testing.T) {
+	setupIntegration(t)
+	owner := createTestUser(t)
+	livestream := createTestLivestream(t, owner.ID)
+
+	if _, err := getTestThumbnail(t, livestream.ID, ""); !isHTTPErrorCode(err, http.StatusNotFound) {
+		t.Fatalf("getThumbnailHandler before upload = %v, want %d", err, http.StatusNotFound)
+	}
+
+	first := []byte("first thumbnail")
+	if err := postTestThumbnail(t, owner, livestream.ID, first); err != nil {
+		t.Fatalf("postThumbnailHandler: %+v", err)
+	}
+	rec, err := getTestThumbnail(t, livestream.ID, "")
+	if err != nil {
+		t.Fatalf("getThumbnailHandler: %+v", err)
+	}
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), first) {
+		t.Errorf("got %d %q, want %d %q", rec.Code, rec.Body.Bytes(), http.StatusOK, first)
+	}
+	etag := rec.Header().Get("ETag")
+	if etag != thumbnailETag(first) {
+		t.Errorf("ETag = %s, want %s", etag, thumbnailETag(first))
+	}
+
+	// キャッシュしたハッシュと一致すればDBを引かずに 304 を返す。引けば nil の dbConn で panic する
+	prevDB := dbConn
+	dbConn = nil
+	rec, err = getTestThumbnail(t, livestream.ID, etag)
+	dbConn = prevDB
+	if err != nil {
+		t.Fatalf("conditional getThumbnailHandler: %+v", err)
+	}
+	if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Errorf("conditional status = %d with %d bytes, want %d with no body", rec.Code, rec.Body.Len(), http.StatusNotModified)
+	}
+	if got := rec.Header().Get("ETag"); got != etag {
+		t.Errorf("ETag on 304 = %s, want %s", got, etag)
+	}
+
+	second := []byte("second thumbnail")
+	if err := postTestThumbnail(t, owner, livestream.ID, second); err != nil {
+		t.Fatalf("postThumbnailHandler replacement: %+v", err)
+	}
+	rec, err = getTestThumbnail(t, livestream.ID, etag)
+	if err != nil {
+		t.Fatalf("getThumbnailHandler after replacement: %+v", err)
+	}
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), second) {
+		t.Errorf("got %d %q after replacement, want %d %q", rec.Code, rec.Body.Bytes(), http.StatusOK, second)
+	}
+	if got := rec.Header().Get("ETag"); got != thumbnailETag(second) {
+		t.Errorf("ETag after replacement = %s, want %s", got, thumbnailETag(second))
+	}
+}
+
+// 読み込みで書き戻すのはキャッシュが無いときだけで、期限も短くする
+// 古い行を読んだ GET が、その後の登録で書かれた新しいハッシュを上書きしてはいけない
+func TestGetThumbnailDoesNotOverwriteNewerHash(t *testing.T) {
+	setupIntegration(t)
+	ctx := context.Background()
+	owner := createTestUser(t)
+	livestream := createTestLivestream(t, owner.ID)
+	key := getThumbnailHashKey(livestream.ID)
+	t.Cleanup(func() { redisConn.Del(context.Background(), key) })
+
+	image := []byte("thumbnail")
+	if err := postTestThumbnail(t, owner, livestream.ID, image); err != nil {
+		t.Fatalf("postThumbnailHandler: %+v", err)
+	}
+
+	if err := redisConn.Del(ctx, key).Err(); err != nil {
+		t.Fatalf("failed to delete thumbnail hash: %+v", err)
+	}
+	if _, err := getTestThumbnail(t, livestream.ID, ""); err != nil {
+		t.Fatalf("getThumbnailHandler: %+v", err)
+	}
+	if ttl, err := redisConn.TTL(ctx, key).Result(); err != nil || ttl <= 0 || ttl > iconHashReadBackExpiration() {
+		t.Errorf("read-back TTL = %v (err=%v), want at most %v", ttl, err, iconHashReadBackExpiration())
+	}
+
+	// 並行した登録が先に新しいハッシュを書いた状態
+	if err := redisConn.Set(ctx, key, "newer", iconHashTTL).Err(); err != nil {
+		t.Fatalf("failed to set thumbnail hash: %+v", err)
+	}
+	if _, err := getTestThumbnail(t, livestream.ID, ""); err != nil {
+		t.Fatalf("getThumbnailHandler: %+v", err)
+	}
+	if got, err := redisConn.Get(ctx, key).Result(); err != nil || got != "newer" {
+		t.Errorf("thumbnail hash = %q (err=%v), want the newer hash kept", got, err)
+	}
+}
+
+// 配信者以外はサムネイルを登録できない
+func TestPostThumbnailByOtherUser(t *testing.T) {
+	setupIntegration(t)
+	owner := createTestUser(t)
+	other := createTestUser(t)
+	livestream := createTestLivestream(t, owner.ID)
+
+	if err := postTestThumbnail(t, other, livestream.ID, []byte("not mine")); !isHTTPErrorCode(err, http.StatusForbidden) {
+		t.Fatalf("postThumbnailHandler by other user = %v, want %d", err, http.StatusForbidden)
+	}
+	if _, err := getTestThumbnail(t, livestream.ID, ""); !isHTTPErrorCode(err, http.StatusNotFound) {
+		t.Errorf("getThumbnailHandler = %v, want %d", err, http.StatusNotFound)
+	}
+}
+
+func isHTTPErrorCode(err error, code int) bool {
+	var httpErr *echo.HTTPError
+	return errors.As(err, &httpErr) && httpErr.Code == code
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// withTx はトランザクションを開始して fn を実行し、fn がエラーを返さなければコミットします
+// fn がエラーを返した場合はロールバックしてそのエラーをそのまま返すので、fn の中では echo.NewHTTPError を返してよい
+// 開始・コミットの失敗は500にして返す
+func withTx(ctx context.Context, fn func(tx *sqlx.Tx) error) error {
+	return runTx(ctx, nil, fn)
+}
+
+// withReadTx は読み取り専用のトランザクションで fn を実行します
+// 参照だけのAPIで使い、誤って書き込むとDBがエラーを返す
+func withReadTx(ctx context.Context, fn func(tx *sqlx.Tx) error) error {
+	return runTx(ctx, &sql.TxOptions{ReadOnly: true}, fn)
+}
+
+func runTx(ctx context.Context, opts *sql.TxOptions, fn func(tx *sqlx.Tx) error) error {
+	tx, err := dbConn.BeginTxx(ctx, opts)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// fn が成功すればコミットし、エラーを返せばそのエラーのままロールバックする
+func TestWithTx(t *testing.T) {
+	prevDB := dbConn
+	dbConn = sqlx.NewDb(sql.OpenDB(fakeSlowConnector{}), "mysql")
+	t.Cleanup(func() {
+		dbConn.Close()
+		dbConn = prevDB
+	})
+	ctx := context.Background()
+
+	commits, rollbacks := fakeCommits.Load(), fakeRollbacks.Load()
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		_, err := tx.ExecContext(ctx, "UPDATE users SET display_name = ? WHERE id = ?", "x", 1)
+		return err
+	}); err != nil {
+		t.Fatalf("withTx: %+v", err)
+	}
+	if got := fakeCommits.Load() - commits; got != 1 {
+		t.Errorf("commits = %d, want 1", got)
+	}
+	if got := fakeRollbacks.Load() - rollbacks; got != 0 {
+		t.Errorf("rollbacks = %d, want 0", got)
+	}
+
+	commits, rollbacks = fakeCommits.Load(), fakeRollbacks.Load()
+	errFn := errors.New("fn failed")
+	if err := withTx(ctx, func(*sqlx.Tx) error { return errFn }); !errors.Is(err, errFn) {
+		t.Errorf("withTx = %v, want %v", err, errFn)
+	}
+	if got := fakeCommits.Load() - commits; got != 0 {
+		t.Errorf("commits = %d, want 0", got)
+	}
+	if got := fakeRollbacks.Load() - rollbacks; got != 1 {
+		t.Errorf("rollbacks = %d, want 1", got)
+	}
+}
+
+// トランザクションを始められなければ fn を呼ばずに 500 を返す
+func TestWithTxBeginFailure(t *testing.T) {
+	prevDB := dbConn
+	dbConn = newBrokenDB(t)
+	t.Cleanup(func() { dbConn = prevDB })
+
+	called := false
+	err := withTx(context.Background(), func(*sqlx.Tx) error {
+		called = true
+		return nil
+	})
+	if !isHTTPErrorCode(err, http.StatusInternalServerError) {
+		t.Errorf("withTx = %v, want a 500 error", err)
+	}
+	if called {
+		t.Error("withTx called fn without a transaction")
+	}
+}
+
+// 読み取り専用のトランザクションでは書き込みがDBに拒否され、行は変わらない
+func TestWithReadTxRejectsWrites(t *testing.T) {
+	setupIntegration(t)
+	ctx := context.Background()
+	user := createTestUser(t)
+
+	err := withReadTx(ctx, func(tx *sqlx.Tx) error {
+		var name string
+		if err := tx.GetContext(ctx, &name, "SELECT name FROM users WHERE id = ?", user.ID); err != nil {
+			t.Errorf("failed to read in a read-only transaction: %+v", err)
+		}
+		_, err := tx.ExecContext(ctx, "UPDATE users SET display_name = ? WHERE id = ?", "written", user.ID)
+		return err
+	})
+	if err == nil {
+		t.Fatal("withReadTx allowed a write")
+	}
+
+	var displayName string
+	if err := dbConn.GetContext(ctx, &displayName, "SELECT display_name FROM users WHERE id = ?", user.ID); err != nil {
+		t.Fatalf("failed to get user: %+v", err)
+	}
+	if displayName != user.DisplayName {
+		t.Errorf("display_name = %q, want %q", displayName, user.DisplayName)
+	}
+}
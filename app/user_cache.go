@@ -0,0 +1,167 @@
+package main
+
+import (
+	"container/list"
+	"expvar"
+	"sync"
+)
+
+// userCacheEvictions は userCache が上限を超えて追い出した件数です
+var userCacheEvictions = expvar.NewInt("user_cache_evictions")
+
+// userStaleCacheEvictions は userStaleCache が上限を超えて追い出した件数です
+var userStaleCacheEvictions = expvar.NewInt("user_stale_cache_evictions")
+
+// userLRU はユーザーIDをキーとし、UserModelを値とするLRUキャッシュです
+// limit が 0 の場合は追い出さない
+// 読むたびに並びを変えるので、RWMutex ではなく Mutex で守る
+// 消す前にDBから読んだ値を消した後に書き戻さないよう、消すたびに世代を進め、
+// DBから読んだ値は読む前の世代を添えて StoreIfGen で書く
+type userLRU struct {
+	mu        sync.Mutex
+	limit     int
+	ll        *list.List
+	m         map[int64]*list.Element
+	gen       uint64
+	evictions *expvar.Int
+}
+
+type userLRUEntry struct {
+	userID int64
+	user   UserModel
+}
+
+// evictions には上限を超えて追い出した件数を数える
+func newUserLRU(limit int, evictions *expvar.Int) *userLRU {
+	return &userLRU{
+		limit:     limit,
+		ll:        list.New(),
+		m:         make(map[int64]*list.Element),
+		evictions: evictions,
+	}
+}
+
+// SetLimit は上限を変えます。既に超えている分はその場で追い出す
+func (c *userLRU) SetLimit(limit int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.limit = limit
+	c.evict()
+}
+
+func (c *userLRU) Load(userID int64) (UserModel, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.m[userID]
+	if !ok {
+		return UserModel{}, false
+	}
+	c.ll.MoveToFront(e)
+	return e.Value.(*userLRUEntry).user, true
+}
+
+// Gen はDBから読む前に取っておく世代を返します
+func (c *userLRU) Gen() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// StoreIfGen は gen 以降に何も消されていない場合だけ保存し、保存したかどうかを返します
+func (c *userLRU) StoreIfGen(gen uint64, userID int64, user UserModel) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gen != gen {
+		return false
+	}
+	c.store(userID, user)
+	return true
+}
+
+func (c *userLRU) Store(userID int64, user UserModel) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.store(userID, user)
+}
+
+func (c *userLRU) Delete(userID int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	if e, ok := c.m[userID]; ok {
+		c.ll.Remove(e)
+		delete(c.m, userID)
+	}
+}
+
+func (c *userLRU) Limit() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.limit
+}
+
+func (c *userLRU) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+// DeleteIf は userID のエントリが match を満たす場合だけ消します
+// 比較している間に別の値で上書きされたエントリを消さないために使う
+func (c *userLRU) DeleteIf(userID int64, match func(UserModel) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.m[userID]; ok && match(e.Value.(*userLRUEntry).user) {
+		c.gen++
+		c.ll.Remove(e)
+		delete(c.m, userID)
+	}
+}
+
+// Sample は最大 n 件を並びを変えずに返します
+// map の走査順はランダムなので無作為抽出になる
+func (c *userLRU) Sample(n int) []UserModel {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sampled := make([]UserModel, 0, min(n, len(c.m)))
+	for _, e := range c.m {
+		if len(sampled) >= n {
+			break
+		}
+		sampled = append(sampled, e.Value.(*userLRUEntry).user)
+	}
+	return sampled
+}
+
+// Reset は全件を消します。上限はそのまま
+func (c *userLRU) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	c.ll.Init()
+	c.m = make(map[int64]*list.Element)
+}
+
+// store は c.mu を持った状態で呼ぶ
+func (c *userLRU) store(userID int64, user UserModel) {
+	if e, ok := c.m[userID]; ok {
+		e.Value.(*userLRUEntry).user = user
+		c.ll.MoveToFront(e)
+		return
+	}
+	c.m[userID] = c.ll.PushFront(&userLRUEntry{userID: userID, user: user})
+	c.evict()
+}
+
+// evict は上限を超えた分を、最も長く使われていないものから消します。c.mu を持った状態で呼ぶ
+func (c *userLRU) evict() {
+	if c.limit <= 0 {
+		return
+	}
+	for c.ll.Len() > c.limit {
+		e := c.ll.Back()
+		c.ll.Remove(e)
+		delete(c.m, e.Value.(*userLRUEntry).userID)
+		c.evictions.Add(1)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"expvar"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func newTestUserLRU(limit int) *userLRU {
+	return newUserLRU(limit, new(expvar.Int))
+}
+
+func userLRUKeys(c *userLRU) []int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make([]int64, 0, len(c.m))
+	for userID := range c.m {
+		keys = append(keys, userID)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+// 上限を超えると、最も長く使われていないものから追い出す
+func TestUserLRUEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newTestUserLRU(3)
+	for userID := int64(1); userID <= 3; userID++ {
+		c.Store(userID, UserModel{ID: userID})
+	}
+	// 1 を読んだので、次に追い出されるのは 2
+	if _, ok := c.Load(1); !ok {
+		t.Fatal("user 1 is missing")
+	}
+	c.Store(4, UserModel{ID: 4})
+
+	if got, want := userLRUKeys(c), []int64{1, 3, 4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("keys = %v, want %v", got, want)
+	}
+	if got := c.evictions.Value(); got != 1 {
+		t.Errorf("evictions = %d, want 1", got)
+	}
+
+	// 上書きも使ったことになる
+	c.Store(3, UserModel{ID: 3, Name: "updated"})
+	c.Store(5, UserModel{ID: 5})
+	if got, want := userLRUKeys(c), []int64{3, 4, 5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("keys = %v, want %v", got, want)
+	}
+	if user, _ := c.Load(3); user.Name != "updated" {
+		t.Errorf("user 3 = %+v, want the updated one", user)
+	}
+}
+
+func TestUserLRUSetLimit(t *testing.T) {
+	c := newTestUserLRU(0)
+	for userID := int64(1); userID <= 5; userID++ {
+		c.Store(userID, UserModel{ID: userID})
+	}
+	if got := c.Len(); got != 5 {
+		t.Fatalf("len = %d, want 5 without a limit", got)
+	}
+
+	c.SetLimit(2)
+	if got, want := userLRUKeys(c), []int64{4, 5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("keys = %v, want %v", got, want)
+	}
+	if got := c.Limit(); got != 2 {
+		t.Errorf("limit = %d, want 2", got)
+	}
+}
+
+// 読んでいる間に消されたら、読む前の世代では書き戻せない
+func TestUserLRUStoreIfGen(t *testing.T) {
+	c := newTestUserLRU(10)
+	gen := c.Gen()
+	c.Delete(1)
+	if c.StoreIfGen(gen, 1, UserModel{ID: 1}) {
+		t.Error("StoreIfGen stored with a generation from before Delete")
+	}
+	if _, ok := c.Load(1); ok {
+		t.Error("user 1 was stored")
+	}
+
+	if !c.StoreIfGen(c.Gen(), 1, UserModel{ID: 1}) {
+		t.Error("StoreIfGen did not store with the current generation")
+	}
+}
+
+func TestUserLRUDeleteIf(t *testing.T) {
+	c := newTestUserLRU(10)
+	c.Store(1, UserModel{ID: 1, Name: "new"})
+	c.DeleteIf(1, func(user UserModel) bool { return user.Name == "old" })
+	if _, ok := c.Load(1); !ok {
+		t.Error("DeleteIf removed an entry that did not match")
+	}
+	c.DeleteIf(1, func(user UserModel) bool { return user.Name == "new" })
+	if _, ok := c.Load(1); ok {
+		t.Error("DeleteIf kept an entry that matched")
+	}
+}
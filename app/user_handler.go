@@ -1,16 +1,25 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
-	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -19,7 +28,10 @@ import (
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
 	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
 )
 
 const (
@@ -27,18 +39,47 @@ const (
 	defaultSessionExpiresKey = "EXPIRES"
 	defaultUserIDKey         = "USERID"
 	defaultUsernameKey       = "USERNAME"
-	bcryptDefaultCost        = bcrypt.MinCost
 )
 
+// zoneFileMu はゾーンファイルへの追記と書き換えを直列化します
+var zoneFileMu sync.Mutex
+
 var fallbackImage = "../img/NoImage.jpg"
 var fallbackHash = "d9f8294e9d895f81ce62e73dc7d5dff862a4fa40bd4e0fecf53f7526a8edcac0"
 
+// fallbackImageBytes は起動時に読み込んだ fallbackImage の中身です
+// 読み込めなかった場合は nil のままで、毎回ファイルから返す
+var fallbackImageBytes []byte
+
+func loadFallbackImage() error {
+	b, err := os.ReadFile(fallbackImage)
+	if err != nil {
+		return err
+	}
+	fallbackImageBytes = b
+	return nil
+}
+
+// serveFallbackImage はアイコンが無いユーザーのための画像を返します
+func serveFallbackImage(c echo.Context) error {
+	etag := `"` + fallbackHash + `"`
+	if fallbackImageBytes != nil {
+		return serveImage(c, etag, fallbackImageBytes)
+	}
+	c.Response().Header().Set("ETag", etag)
+	return c.File(fallbackImage)
+}
+
 type UserModel struct {
 	ID             int64  `db:"id"`
 	Name           string `db:"name"`
 	DisplayName    string `db:"display_name"`
 	Description    string `db:"description"`
 	HashedPassword string `db:"password"`
+	// DeletedAt は退会(論理削除)した時刻。退会していなければ nil
+	DeletedAt *int64 `db:"deleted_at"`
+	// CreatedAt は登録日時。カラム追加前に登録したユーザーは nil
+	CreatedAt *int64 `db:"created_at"`
 }
 
 type User struct {
@@ -46,8 +87,25 @@ type User struct {
 	Name        string `json:"name"`
 	DisplayName string `json:"display_name,omitempty"`
 	Description string `json:"description,omitempty"`
-	Theme       Theme  `json:"theme,omitempty"`
+	Theme       *Theme `json:"theme,omitempty"`
 	IconHash    string `json:"icon_hash,omitempty"`
+	// CreatedAt は登録日時。不明なユーザーでは省略する
+	CreatedAt *int64 `json:"created_at,omitempty"`
+
+	// include_counts=1 のときのみ埋める
+	LivestreamCount *int64 `json:"livestream_count,omitempty"`
+	TotalReactions  *int64 `json:"total_reactions,omitempty"`
+
+	// IsSelf は閲覧しているユーザー自身かどうか。ユーザー取得APIでのみ埋める
+	IsSelf *bool `json:"is_self,omitempty"`
+
+	// TotalEarnings は自分の配信で受け取ったチップの合計。/api/user/me で include_earnings=1 のときのみ埋める
+	TotalEarnings *int64 `json:"total_earnings,omitempty"`
+}
+
+type UserCounts struct {
+	LivestreamCount int64 `db:"livestream_count"`
+	TotalReactions  int64 `db:"total_reactions"`
 }
 
 type Theme struct {
@@ -66,14 +124,30 @@ type PostUserRequest struct {
 	DisplayName string `json:"display_name"`
 	Description string `json:"description"`
 	// Password is non-hashed password.
-	Password string               `json:"password"`
-	Theme    PostUserRequestTheme `json:"theme"`
+	Password string `json:"password"`
+	// Theme is optional. When omitted, defaultDarkMode is used.
+	Theme *PostUserRequestTheme `json:"theme"`
+	// Nonce is optional. Retrying with the same nonce and name returns the originally registered user.
+	Nonce string `json:"nonce,omitempty"`
 }
 
 type PostUserRequestTheme struct {
 	DarkMode bool `json:"dark_mode"`
 }
 
+// darkMode は登録するユーザーのテーマを返します
+func (r PostUserRequest) darkMode() bool {
+	if r.Theme == nil {
+		return defaultDarkMode
+	}
+	return r.Theme.DarkMode
+}
+
+type PatchUserRequest struct {
+	DisplayName *string `json:"display_name"`
+	Description *string `json:"description"`
+}
+
 type LoginRequest struct {
 	Username string `json:"username"`
 	// Password is non-hashed password.
@@ -86,17 +160,159 @@ type PostIconRequest struct {
 
 type PostIconResponse struct {
 	ID int64 `json:"id"`
+	// 画像の幅と高さ。デコードできない形式の場合は省略する
+	Width  *int `json:"width,omitempty"`
+	Height *int `json:"height,omitempty"`
 }
 
 func getIconHashKey(userID int64) string {
-	return fmt.Sprintf("icon_hash_%d", userID)
+	return iconHashKeyspace.Key(userID)
 }
 
+// iconHashReadBackTTL は参照時にDBから読んで書き戻したハッシュの有効期限です
+// 書き戻す前に退会や更新失敗でキーが消されると、SET NX では読んだ古いハッシュを書き戻してしまう
+// そうなっても古いハッシュが残るのはこの間だけになるよう、更新時に書く iconHashTTL より短くする
+const iconHashReadBackTTL = 10 * time.Second
+
+func iconHashReadBackExpiration() time.Duration {
+	return min(iconHashTTL, iconHashReadBackTTL)
+}
+
+// registerNonceTTL はクライアントが登録をリトライしうる期間です
+const registerNonceTTL = 10 * time.Minute
+
+// registerNoncePending は登録中のnonceに置いておく値です。登録できたら作成したユーザーのJSONで上書きする
+const registerNoncePending = "pending"
+
+func getRegisterNonceKey(nonce, name string) string {
+	return registerNonceKeyspace.Key(nonce, name)
+}
+
+// userDerivedCacheKeyFuncs はアイコン変更時に破棄すべきユーザー単位のRedisキーを返す関数の一覧です
+// ユーザー情報から派生するキャッシュをRedisに追加したらここに登録します
+var userDerivedCacheKeyFuncs = []func(userID int64) string{}
+
+// updateIconHashCache はアイコンのハッシュの更新と派生キャッシュの削除を1回のパイプラインで行います
+// ここだけは上書きし、参照時にDBから読んだハッシュは SET NX で短い期限を付けて書き戻す
+// 書き戻す前にアイコンが更新されても、ここで書いた新しいハッシュを古い値で上書きしないため
+func updateIconHashCache(ctx context.Context, userID int64, iconHash string) error {
+	_, err := redisConn.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, getIconHashKey(userID), iconHash, iconHashTTL)
+
+		keys := make([]string, 0, len(userDerivedCacheKeyFuncs))
+		for _, keyFunc := range userDerivedCacheKeyFuncs {
+			keys = append(keys, keyFunc(userID))
+		}
+		if len(keys) > 0 {
+			pipe.Del(ctx, keys...)
+		}
+		return nil
+	})
+	return err
+}
+
+// invalidateIconHashCache はアイコンのハッシュと派生キャッシュを削除し、次回参照時にDBから読み直させます
+func invalidateIconHashCache(ctx context.Context, userID int64) error {
+	keys := []string{getIconHashKey(userID)}
+	for _, keyFunc := range userDerivedCacheKeyFuncs {
+		keys = append(keys, keyFunc(userID))
+	}
+	return redisConn.Del(ctx, keys...).Err()
+}
+
+// iconImageCache はアイコンのハッシュをキーとし、画像を値とするキャッシュです
+// ハッシュは画像の内容から決まるので、一度入れたものが古くなることは無い
+// 画像は大きいので、合計バイト数で上限を設けて古いものから追い出す
+var iconImageCache = newImageLRU(64 << 20)
+
+// evictIconImages は消したアイコンの画像をキャッシュから外します
+// 同じ画像を使っている他のユーザーがいても、次の参照時にDBから読み直すだけ
+func evictIconImages(iconHashes []string) {
+	if len(iconHashes) == 0 {
+		return
+	}
+	for _, iconHash := range iconHashes {
+		iconImageCache.Delete(iconHash)
+	}
+}
+
+// アイコン取得API
+// GET /api/user/:username/icon
+// Redis のハッシュで If-None-Match を判定し、画像もハッシュで引けるならDBを使わずに返す
 func getIconHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
 	username := c.Param("username")
 
+	userID, err := getUserIDByName(ctx, dbConn, username)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+
+	iconHash, err := redisConn.Get(ctx, getIconHashKey(userID)).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get icon hash: "+err.Error())
+	}
+	if err == nil {
+		etag := `"` + iconHash + `"`
+		if c.Request().Header.Get("If-None-Match") == etag {
+			c.Response().Header().Set("ETag", etag)
+			return c.NoContent(http.StatusNotModified)
+		}
+		if iconHash == fallbackHash {
+			return serveFallbackImage(c)
+		}
+		image, ok := iconImageCache.Load(iconHash)
+		if ok {
+			return serveImage(c, etag, image)
+		}
+	}
+
+	// ハッシュか画像がキャッシュに無い場合だけDBから読む
+	var icon IconModel
+	if err := dbConn.GetContext(ctx, &icon, "SELECT * FROM icons WHERE user_id = ? ORDER BY id DESC LIMIT 1", userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return serveFallbackImage(c)
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user icon: "+err.Error())
+	}
+
+	iconImageCache.Store(icon.IconHash, icon.Image)
+	if err := redisConn.SetNX(ctx, getIconHashKey(userID), icon.IconHash, iconHashReadBackExpiration()).Err(); err != nil {
+		c.Logger().Warnf("failed to cache icon hash: %+v", err)
+	}
+
+	return serveImage(c, `"`+icon.IconHash+`"`, icon.Image)
+}
+
+// serveImage はメモリ上の画像を http.ServeContent で返します
+// c.File で返すフォールバック画像と同じく、Range / If-Range / If-None-Match を扱えるようにする
+func serveImage(c echo.Context, etag string, image []byte) error {
+	c.Response().Header().Set(echo.HeaderContentType, "image/jpeg")
+	c.Response().Header().Set("ETag", etag)
+	http.ServeContent(c.Response(), c.Request(), "", time.Time{}, bytes.NewReader(image))
+	return nil
+}
+
+type IconHistoryEntry struct {
+	ID       int64  `json:"id" db:"id"`
+	IconHash string `json:"icon_hash" db:"icon_hash"`
+}
+
+// アイコン履歴取得API (先頭が現在のアイコン)
+// GET /api/user/:username/icons
+func getIconHistoryHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if _, err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	username := c.Param("username")
+
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
@@ -104,40 +320,36 @@ func getIconHandler(c echo.Context) error {
 	defer tx.Rollback()
 
 	var user UserModel
-	if err := tx.GetContext(ctx, &user, "SELECT * FROM users WHERE name = ?", username); err != nil {
+	if err := tx.GetContext(ctx, &user, "SELECT * FROM users WHERE name = ? AND deleted_at IS NULL", username); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
 		}
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
 	}
 
-	var image []byte
-	if err := tx.GetContext(ctx, &image, "SELECT image FROM icons WHERE user_id = ?", user.ID); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return c.File(fallbackImage)
-		} else {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user icon: "+err.Error())
-		}
+	history := []IconHistoryEntry{}
+	if err := tx.SelectContext(ctx, &history, "SELECT id, icon_hash FROM icons WHERE user_id = ? ORDER BY id DESC", user.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user icons: "+err.Error())
 	}
 
-	return c.Blob(http.StatusOK, "image/jpeg", image)
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, history)
 }
 
 func postIconHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
-	if err := verifyUserSession(c); err != nil {
+	userID, err := verifyUserSession(c)
+	if err != nil {
 		// echo.NewHTTPErrorが返っているのでそのまま出力
 		return err
 	}
 
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
-
 	var req *PostIconRequest
-	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+	if err := decodeJSON(c.Request().Body, &req); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
 
@@ -147,8 +359,21 @@ func postIconHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	if _, err := tx.ExecContext(ctx, "DELETE FROM icons WHERE user_id = ?", userID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete old user icon: "+err.Error())
+	// 履歴として残すのは直近 iconHistorySize 件まで (新しいアイコンは別に数える)
+	if iconHistorySize > 0 {
+		query := `
+		DELETE FROM icons
+		WHERE user_id = ? AND id NOT IN (
+			SELECT id FROM (SELECT id FROM icons WHERE user_id = ? ORDER BY id DESC LIMIT ?) AS recent
+		)
+		`
+		if _, err := tx.ExecContext(ctx, query, userID, userID, iconHistorySize); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to prune old user icons: "+err.Error())
+		}
+	} else {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM icons WHERE user_id = ?", userID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete old user icon: "+err.Error())
+		}
 	}
 
 	iconHash := sha256.Sum256(req.Image)
@@ -167,37 +392,44 @@ func postIconHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	err = redisConn.Set(ctx, getIconHashKey(userID), hashString, 0).Err()
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to redis set: "+err.Error())
+	iconImageCache.Store(hashString, req.Image)
+
+	// アイコンはDBにしか保存していないので、コミット後に更新するのはRedisのキャッシュだけ
+	// コミット済みなので失敗してもエラーにはせず、キャッシュを消してDBから読み直させる
+	if err := updateIconHashCache(ctx, userID, hashString); err != nil {
+		c.Logger().Errorf("failed to update icon hash cache for user_id=%d: %+v", userID, err)
+		if err := invalidateIconHashCache(ctx, userID); err != nil {
+			c.Logger().Errorf("failed to invalidate icon hash cache for user_id=%d; needs repair: %+v", userID, err)
+		}
 	}
 
-	return c.JSON(http.StatusCreated, &PostIconResponse{
+	res := &PostIconResponse{
 		ID: iconID,
-	})
+	}
+	// ヘッダだけ読めば大きさは分かるので、画像全体はデコードしない
+	if cfg, _, err := image.DecodeConfig(bytes.NewReader(req.Image)); err == nil {
+		res.Width = &cfg.Width
+		res.Height = &cfg.Height
+	}
+	return c.JSON(http.StatusCreated, res)
 }
 
 func getMeHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
-	if err := verifyUserSession(c); err != nil {
+	userID, err := verifyUserSession(c)
+	if err != nil {
 		// echo.NewHTTPErrorが返っているのでそのまま出力
 		return err
 	}
 
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
-
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
 	defer tx.Rollback()
 
-	userModel := UserModel{}
-	err = tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ?", userID)
+	userModel, err := getUser(ctx, tx, userID)
 	if errors.Is(err, sql.ErrNoRows) {
 		return echo.NewHTTPError(http.StatusNotFound, "not found user that has the userid in session")
 	}
@@ -210,21 +442,308 @@ func getMeHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
 	}
 
+	if c.QueryParam("include_earnings") == "1" {
+		var earnings int64
+		query := `
+		SELECT IFNULL(SUM(lc.tip), 0)
+		FROM livestreams l
+		INNER JOIN livecomments lc ON lc.livestream_id = l.id
+		WHERE l.user_id = ?
+		`
+		if err := tx.GetContext(ctx, &earnings, query, userModel.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to sum user earnings: "+err.Error())
+		}
+		user.TotalEarnings = &earnings
+	}
+
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	c.Response().Header().Set("ETag", userETag(userModel))
 	return c.JSON(http.StatusOK, user)
 }
 
+// userETag はプロフィール更新の競合検出に使うETagです
+// 更新できる項目とユーザーを特定する項目から計算する
+func userETag(userModel UserModel) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\x00%s\x00%s\x00%s", userModel.ID, userModel.Name, userModel.DisplayName, userModel.Description)
+	return `"` + hex.EncodeToString(h.Sum(nil))[:32] + `"`
+}
+
+// プロフィール更新API
+// PATCH /api/user
+// If-Match が指定されていて、現在のETagと一致しない場合は他の更新と競合したとみなし 412 を返す
+func patchUserHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	userID, err := verifyUserSession(c)
+	if err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	var req *PatchUserRequest
+	if err := decodeJSON(c.Request().Body, &req); err != nil || req == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	userModel := UserModel{}
+	if err := tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ? FOR UPDATE", userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found user that has the userid in session")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+
+	if ifMatch := c.Request().Header.Get("If-Match"); ifMatch != "" && ifMatch != "*" && ifMatch != userETag(userModel) {
+		return echo.NewHTTPError(http.StatusPreconditionFailed, "the user has been modified since it was read")
+	}
+
+	if req.DisplayName != nil {
+		userModel.DisplayName = *req.DisplayName
+	}
+	if req.Description != nil {
+		userModel.Description = *req.Description
+	}
+	if _, err := tx.NamedExecContext(ctx, "UPDATE users SET display_name = :display_name, description = :description WHERE id = :id", userModel); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update user: "+err.Error())
+	}
+
+	user, err := fillUserResponse(ctx, tx, userModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	// コミット前に読まれた古い値が残らないよう、コミット後に破棄する
+	userCache.Delete(userID)
+
+	c.Response().Header().Set("ETag", userETag(userModel))
+	return c.JSON(http.StatusOK, user)
+}
+
+// 退会API
+// DELETE /api/user/me
+func deleteMeHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID, err := verifyUserSession(c)
+	if err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	// 配信やライブコメントから外部キーで参照されているので、行は消さずに退会時刻を記録する
+	userModel := UserModel{}
+	if err := tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ? FOR UPDATE", userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found user that has the userid in session")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET deleted_at = ? WHERE id = ?", time.Now().Unix(), userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete user: "+err.Error())
+	}
+
+	// アイコンは誰からも参照されなくなるので、行ごと消す
+	var iconHashes []string
+	if err := tx.SelectContext(ctx, &iconHashes, "SELECT icon_hash FROM icons WHERE user_id = ?", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user icons: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM icons WHERE user_id = ?", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete user icons: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	// セッションの検証は userCache 経由で deleted_at を見るので、キャッシュを消せば以降のリクエストは弾かれる
+	userCache.Delete(userID)
+	userIDByNameCache.Delete(userModel.Name)
+	userStaleCache.Delete(userID)
+	themeCache.Lock()
+	delete(themeCache.m, userID)
+	themeCache.Unlock()
+	invalidateFavoriteEmoji(userID)
+	invalidateUserStats(userID)
+	if err := removeUserScoreMember(ctx, userModel.Name); err != nil {
+		c.Logger().Warnf("failed to remove user score for deleted user_id=%d: %+v", userID, err)
+	}
+	evictIconImages(iconHashes)
+	if err := invalidateIconHashCache(ctx, userID); err != nil {
+		c.Logger().Warnf("failed to invalidate icon hash cache for deleted user_id=%d: %+v", userID, err)
+	}
+
+	// 退会はコミット済みなので、レコードが消せなくても失敗にはしない
+	if err := removeDNSRecord(userModel.Name); err != nil {
+		c.Logger().Warnf("failed to remove dns record for deleted user %q: %+v", userModel.Name, err)
+	}
+
+	// 手元のセッションCookieも破棄する
+	if sess, err := session.Get(defaultSessionIDKey, c); err == nil {
+		if sessionID, ok := sess.Values[defaultSessionIDKey].(string); ok {
+			if err := untrackSession(ctx, sessionID); err != nil {
+				c.Logger().Warnf("failed to untrack session: %+v", err)
+			}
+		}
+		sess.Options = &sessions.Options{
+			Domain: sessionCookieDomain,
+			MaxAge: -1,
+			Path:   "/",
+		}
+		if err := sess.Save(c.Request(), c.Response()); err != nil {
+			c.Logger().Warnf("failed to clear session: %+v", err)
+		}
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// dnsRecordFailures はDNSレコードの追加に失敗した回数です
+var dnsRecordFailures = expvar.NewInt("dns_record_failures")
+
+// addDNSRecords はゾーンファイルにユーザーのレコードを追記し、リロードします
+// 複数のユーザーをまとめて追加する場合もリロードは1回だけ行う
+func addDNSRecords(names ...string) error {
+	if len(names) == 0 {
+		return nil
+	}
+
+	zoneFileMu.Lock()
+	defer zoneFileMu.Unlock()
+
+	f, err := os.OpenFile(config.ZoneFilePath, os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	var records strings.Builder
+	for _, name := range names {
+		records.WriteString(dnsRecordLine(name))
+		records.WriteByte('\n')
+	}
+	if _, err := f.WriteString(records.String()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if out, err := exec.Command("pdns_control", "bind-reload-now", "u.isucon.local").CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %w", string(out), err)
+	}
+	return nil
+}
+
+// dnsRecordLine はユーザーのために追記するゾーンファイルの行を返します (改行は含まない)
+func dnsRecordLine(name string) string {
+	return name + "\tIN\tA\t" + config.PowerDNSSubdomainAddress
+}
+
+// renameDNSRecord はゾーンファイルの oldName のレコードを newName のものに置き換え、1回だけリロードします
+func renameDNSRecord(oldName, newName string) error {
+	zoneFileMu.Lock()
+	defer zoneFileMu.Unlock()
+
+	b, err := os.ReadFile(config.ZoneFilePath)
+	if err != nil {
+		return err
+	}
+	prefix := oldName + "\t"
+	lines := strings.SplitAfter(string(b), "\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		if strings.HasPrefix(line, prefix) {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	zone := strings.Join(kept, "")
+	if zone != "" && !strings.HasSuffix(zone, "\n") {
+		zone += "\n"
+	}
+	zone += dnsRecordLine(newName) + "\n"
+	if err := os.WriteFile(config.ZoneFilePath, []byte(zone), 0666); err != nil {
+		return err
+	}
+
+	if out, err := exec.Command("pdns_control", "bind-reload-now", "u.isucon.local").CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %w", string(out), err)
+	}
+	return nil
+}
+
+// removeDNSRecord はゾーンファイルからユーザーのレコードを取り除き、リロードします
+// ゾーンファイルが無い場合は取り除くレコードも無いので何もしない
+func removeDNSRecord(name string) error {
+	zoneFileMu.Lock()
+	defer zoneFileMu.Unlock()
+
+	b, err := os.ReadFile(config.ZoneFilePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	prefix := name + "\t"
+	lines := strings.SplitAfter(string(b), "\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		if strings.HasPrefix(line, prefix) {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	if err := os.WriteFile(config.ZoneFilePath, []byte(strings.Join(kept, "")), 0666); err != nil {
+		return err
+	}
+
+	if out, err := exec.Command("pdns_control", "bind-reload-now", "u.isucon.local").CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %w", string(out), err)
+	}
+	return nil
+}
+
+// upsertThemeQuery は登録時のテーマの作成です
+// 登録のリトライなどで既にテーマがある場合は失敗させずに dark_mode を上書きする
+const upsertThemeQuery = "INSERT INTO themes (user_id, dark_mode) VALUES(:user_id, :dark_mode) ON DUPLICATE KEY UPDATE dark_mode = VALUES(dark_mode)"
+
 // ユーザ登録API
 // POST /api/register
 func registerHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	defer c.Request().Body.Close()
 
+	if registrationClosed.Load() {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "registration closed")
+	}
+
 	req := PostUserRequest{}
-	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+	if err := decodeRequestJSON(c.Request().Body, &req); err != nil {
+		var unknownErr *unknownFieldsError
+		if errors.As(err, &unknownErr) {
+			return echo.NewHTTPError(http.StatusBadRequest, unknownErr.Error())
+		}
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
 
@@ -232,7 +751,39 @@ func registerHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "the username 'pipe' is reserved")
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcryptDefaultCost)
+	// 同じnonceでの再送であれば、DNSの更新も含めて再処理せずに前回の結果を返す
+	// 同時に届いた再送が両方とも登録しないよう、登録を始める前に SETNX でnonceを押さえる
+	var nonceKey string
+	committed := false
+	if req.Nonce != "" {
+		nonceKey = getRegisterNonceKey(req.Nonce, req.Name)
+		reserved, err := redisConn.SetNX(ctx, nonceKey, registerNoncePending, registerNonceTTL).Result()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to reserve registration nonce: "+err.Error())
+		}
+		if !reserved {
+			registered, err := redisConn.Get(ctx, nonceKey).Bytes()
+			if err != nil && !errors.Is(err, redis.Nil) {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get registration nonce: "+err.Error())
+			}
+			if err != nil || string(registered) == registerNoncePending {
+				// 先に届いた方がまだ登録中 (またはちょうど失敗して外した) なので、後で再送させる
+				return echo.NewHTTPError(http.StatusConflict, "registration with the same nonce is in progress")
+			}
+			return c.JSONBlob(http.StatusCreated, registered)
+		}
+		// コミットまで進めなかった場合は外して、再送で登録し直せるようにする
+		defer func() {
+			if committed {
+				return
+			}
+			if err := redisConn.Del(context.WithoutCancel(ctx), nonceKey).Err(); err != nil {
+				c.Logger().Warnf("failed to release registration nonce: %+v", err)
+			}
+		}()
+	}
+
+	hashedPassword, err := generatePasswordHash(ctx, req.Password)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate hashed password: "+err.Error())
 	}
@@ -243,14 +794,16 @@ func registerHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
+	createdAt := time.Now().Unix()
 	userModel := UserModel{
 		Name:           req.Name,
 		DisplayName:    req.DisplayName,
 		Description:    req.Description,
 		HashedPassword: string(hashedPassword),
+		CreatedAt:      &createdAt,
 	}
 
-	result, err := tx.NamedExecContext(ctx, "INSERT INTO users (name, display_name, description, password) VALUES(:name, :display_name, :description, :password)", userModel)
+	result, err := tx.NamedExecContext(ctx, "INSERT INTO users (name, display_name, description, password, created_at) VALUES(:name, :display_name, :description, :password, :created_at)", userModel)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert user: "+err.Error())
 	}
@@ -264,9 +817,9 @@ func registerHandler(c echo.Context) error {
 
 	themeModel := ThemeModel{
 		UserID:   userID,
-		DarkMode: req.Theme.DarkMode,
+		DarkMode: req.darkMode(),
 	}
-	if _, err := tx.NamedExecContext(ctx, "INSERT INTO themes (user_id, dark_mode) VALUES(:user_id, :dark_mode)", themeModel); err != nil {
+	if _, err := tx.NamedExecContext(ctx, upsertThemeQuery, themeModel); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert user theme: "+err.Error())
 	}
 
@@ -274,29 +827,229 @@ func registerHandler(c echo.Context) error {
 	// 	return echo.NewHTTPError(http.StatusInternalServerError, string(out)+": "+err.Error())
 	// }
 
-	// ゾーンファイルへレコードを追加
-	f, err := os.OpenFile("/etc/powerdns/u.isucon.local.zone", os.O_WRONLY|os.O_APPEND, 0666)
+	user, err := fillUserResponse(ctx, tx, userModel)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to open zone file: "+err.Error())
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
 	}
-	defer f.Close()
-	fmt.Fprintf(f, "%s\tIN\tA\t%s\n", req.Name, powerDNSSubdomainAddress)
 
-	// ゾーンファイルをリロード
-	if out, err := exec.Command("pdns_control", "bind-reload-now", "u.isucon.local").CombinedOutput(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, string(out)+": "+err.Error())
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
+	committed = true
 
-	user, err := fillUserResponse(ctx, tx, userModel)
+	userIDByNameCache.Delete(userModel.Name)
+	if err := addUserScoreMember(ctx, userModel.Name); err != nil {
+		c.Logger().Warnf("failed to add user score: %+v", err)
+	}
+
+	// DNSレコードの追加に失敗しても登録自体は成功させ、警告とメトリクスを残して再試行に回す
+	// ゾーンファイルが無い場合に空のファイルを作ると SOA の無いゾーンになって壊れるので作らない
+	if err := addDNSRecords(userModel.Name); err != nil {
+		dnsRecordFailures.Add(1)
+		c.Logger().Warnf("failed to add dns record for user %q: %+v", userModel.Name, err)
+		enqueueDNSRetry(ctx, userModel.Name)
+	}
+
+	if nonceKey != "" {
+		registered, err := jsonMarshal(user)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to marshal user: "+err.Error())
+		}
+		// 登録はコミット済みなので、保存に失敗したらnonceは登録中のまま残し、再送で二重に登録させない
+		if err := redisConn.Set(ctx, nonceKey, registered, registerNonceTTL).Err(); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to save registration nonce: "+err.Error())
+		}
+		return c.JSONBlob(http.StatusCreated, registered)
+	}
+
+	return c.JSON(http.StatusCreated, user)
+}
+
+// DNS のラベルの最大長
+const maxDNSLabelLength = 63
+
+// validateUsername はユーザー名がサブドメインとして使えるかを確かめます
+// 英数字とハイフンのみで、ハイフンで始まったり終わったりしないこと
+func validateUsername(name string) error {
+	if name == "" {
+		return errors.New("name must not be empty")
+	}
+	if name == "pipe" {
+		return errors.New("the username 'pipe' is reserved")
+	}
+	if len(name) > maxDNSLabelLength {
+		return errors.New("name must be at most 63 characters")
+	}
+	if strings.HasPrefix(name, "-") || strings.HasSuffix(name, "-") {
+		return errors.New("name must not start or end with a hyphen")
+	}
+	for _, r := range name {
+		if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '-') {
+			return errors.New("name must consist of letters, digits and hyphens")
+		}
+	}
+	return nil
+}
+
+// registerBatchMaxSize は一括登録で一度に受け付けるユーザー数の上限です
+const registerBatchMaxSize = 1000
+
+type RegisterBatchResult struct {
+	Name  string `json:"name"`
+	User  *User  `json:"user,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// ユーザ一括登録API (負荷試験・セットアップ用)
+// POST /api/register/batch
+// 不正なエントリはエラーとして結果に含め、残りは1トランザクションで登録する
+// ゾーンファイルへの追記とリロードも最後に1回だけ行う
+func registerBatchHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyAdminToken(c); err != nil {
+		return err
+	}
+
+	var reqs []PostUserRequest
+	if err := decodeJSON(c.Request().Body, &reqs); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if len(reqs) > registerBatchMaxSize {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("too many users: at most %d users can be registered at once", registerBatchMaxSize))
+	}
+
+	results := make([]RegisterBatchResult, len(reqs))
+	seen := make(map[string]struct{}, len(reqs))
+	var valid []int
+	for i, req := range reqs {
+		results[i].Name = req.Name
+		// 名前はそのままゾーンファイルに書くので、DNS のラベルとして使えるものだけを通す
+		if err := validateUsername(req.Name); err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		if req.Password == "" {
+			results[i].Error = "password must not be empty"
+			continue
+		}
+		if _, ok := seen[req.Name]; ok {
+			results[i].Error = "duplicated name in the request"
+			continue
+		}
+		seen[req.Name] = struct{}{}
+		valid = append(valid, i)
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	// 既に登録済みの名前はまとめて調べて除外する
+	if len(valid) > 0 {
+		names := make([]string, len(valid))
+		for j, i := range valid {
+			names[j] = reqs[i].Name
+		}
+		query, params, err := sqlx.In("SELECT name FROM users WHERE name IN (?)", names)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+		}
+		var existingNames []string
+		if err := tx.SelectContext(ctx, &existingNames, query, params...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get users: "+err.Error())
+		}
+		existing := make(map[string]struct{}, len(existingNames))
+		for _, name := range existingNames {
+			existing[name] = struct{}{}
+		}
+		kept := valid[:0]
+		for _, i := range valid {
+			if _, ok := existing[reqs[i].Name]; ok {
+				results[i].Error = "the username is already registered"
+				continue
+			}
+			kept = append(kept, i)
+		}
+		valid = kept
+	}
+
+	// bcrypt が一番重いので並列に計算する (同時実行数は bcryptSem で制限される)
+	hashedPasswords := make([]string, len(reqs))
+	eg, egCtx := errgroup.WithContext(ctx)
+	for _, i := range valid {
+		i := i
+		eg.Go(func() error {
+			hashedPassword, err := generatePasswordHash(egCtx, reqs[i].Password)
+			if err != nil {
+				return err
+			}
+			hashedPasswords[i] = string(hashedPassword)
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate hashed password: "+err.Error())
+	}
+
+	registered := make([]string, 0, len(valid))
+	for _, i := range valid {
+		req := reqs[i]
+		createdAt := time.Now().Unix()
+		userModel := UserModel{
+			Name:           req.Name,
+			DisplayName:    req.DisplayName,
+			Description:    req.Description,
+			HashedPassword: hashedPasswords[i],
+			CreatedAt:      &createdAt,
+		}
+		result, err := tx.NamedExecContext(ctx, "INSERT INTO users (name, display_name, description, password, created_at) VALUES(:name, :display_name, :description, :password, :created_at)", userModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert user: "+err.Error())
+		}
+		userID, err := result.LastInsertId()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted user id: "+err.Error())
+		}
+		userModel.ID = userID
+
+		themeModel := ThemeModel{
+			UserID:   userID,
+			DarkMode: req.darkMode(),
+		}
+		if _, err := tx.NamedExecContext(ctx, upsertThemeQuery, themeModel); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert user theme: "+err.Error())
+		}
+
+		user, err := fillUserResponse(ctx, tx, userModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
+		}
+		results[i].User = &user
+		registered = append(registered, req.Name)
 	}
 
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	return c.JSON(http.StatusCreated, user)
+	for _, name := range registered {
+		userIDByNameCache.Delete(name)
+		if err := addUserScoreMember(ctx, name); err != nil {
+			c.Logger().Warnf("failed to add user score: %+v", err)
+		}
+	}
+
+	if err := addDNSRecords(registered...); err != nil {
+		dnsRecordFailures.Add(1)
+		c.Logger().Warnf("failed to add dns records for %d users: %+v", len(registered), err)
+		enqueueDNSRetry(ctx, registered...)
+	}
+
+	return c.JSON(http.StatusOK, results)
 }
 
 // ユーザログインAPI
@@ -306,10 +1059,15 @@ func loginHandler(c echo.Context) error {
 	defer c.Request().Body.Close()
 
 	req := LoginRequest{}
-	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+	if err := decodeRequestJSON(c.Request().Body, &req); err != nil {
+		var unknownErr *unknownFieldsError
+		if errors.As(err, &unknownErr) {
+			return echo.NewHTTPError(http.StatusBadRequest, unknownErr.Error())
+		}
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
 
+	cacheGen := userCache.Gen()
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
@@ -325,12 +1083,22 @@ func loginHandler(c echo.Context) error {
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
 	}
+	// 退会済みのユーザーは存在しないものとして扱う
+	if userModel.DeletedAt != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, "invalid username or password")
+	}
+
+	// ログイン直後の /api/user/me がキャッシュだけで返せるよう、テーマも読んでおく
+	// 読めなくてもログイン自体は失敗させない
+	if _, err := getUserTheme(ctx, tx, userModel.ID); err != nil {
+		c.Logger().Warnf("failed to prime user theme: %+v", err)
+	}
 
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(userModel.HashedPassword), []byte(req.Password))
+	err = comparePasswordHash(ctx, userModel.HashedPassword, req.Password)
 	if err == bcrypt.ErrMismatchedHashAndPassword {
 		return echo.NewHTTPError(http.StatusUnauthorized, "invalid username or password")
 	}
@@ -338,7 +1106,11 @@ func loginHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to compare hash and password: "+err.Error())
 	}
 
-	sessionEndAt := time.Now().Add(1 * time.Hour)
+	// 今読んだばかりの行なので、読んだ後に消されていなければそのままキャッシュに載せる
+	userCache.StoreIfGen(cacheGen, userModel.ID, userModel)
+
+	// 有効期限は Unix 時刻で保存して比較するので、サーバーのタイムゾーンには左右されない
+	sessionEndAt := time.Now().Add(config.SessionTTL)
 
 	sessionID := uuid.NewString()
 
@@ -347,11 +1119,11 @@ func loginHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusUnauthorized, "failed to get session")
 	}
 
-	sess.Options = &sessions.Options{
-		Domain: "u.isucon.local",
-		MaxAge: int(60000),
-		Path:   "/",
+	if !cookieDomainMatchesHost(sessionCookieDomain, c.Request().Host) {
+		c.Logger().Warnf("session cookie domain %q does not match request host %q; the cookie will not be stored by the client", sessionCookieDomain, c.Request().Host)
 	}
+
+	sess.Options = sessionCookieOptions()
 	sess.Values[defaultSessionIDKey] = sessionID
 	sess.Values[defaultUserIDKey] = userModel.ID
 	sess.Values[defaultUsernameKey] = userModel.Name
@@ -361,68 +1133,161 @@ func loginHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to save session: "+err.Error())
 	}
 
+	// ログイン数の集計にしか使わないので、失敗してもログインは成功させる
+	if err := trackSession(ctx, sessionID, sessionEndAt); err != nil {
+		c.Logger().Warnf("failed to track session: %+v", err)
+	}
+
 	return c.NoContent(http.StatusOK)
 }
 
+// sessionCookieOptions はログイン時に発行するセッションCookieの属性です
+func sessionCookieOptions() *sessions.Options {
+	return &sessions.Options{
+		Domain:   sessionCookieDomain,
+		MaxAge:   int(60000),
+		Path:     "/",
+		Secure:   sessionCookieSecure,
+		HttpOnly: true,
+		SameSite: sessionCookieSameSite,
+	}
+}
+
 // ユーザ詳細API
 // GET /api/user/:username
 func getUserHandler(c echo.Context) error {
 	ctx := c.Request().Context()
-	if err := verifyUserSession(c); err != nil {
+	viewerID, err := verifyUserSession(c)
+	if err != nil {
 		// echo.NewHTTPErrorが返っているのでそのまま出力
 		return err
 	}
 
 	username := c.Param("username")
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
-	}
-	defer tx.Rollback()
+	var user User
+	if err := withReadTx(ctx, func(tx *sqlx.Tx) error {
+		userModel, err := getUserByName(ctx, tx, username)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+		}
 
-	userModel := UserModel{}
-	if err := tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE name = ?", username); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
+		user, err = fillUserResponse(ctx, tx, userModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
 		}
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+		isSelf := userModel.ID == viewerID
+		user.IsSelf = &isSelf
+
+		if c.QueryParam("include_counts") == "1" {
+			var counts UserCounts
+			query := `
+			SELECT COUNT(DISTINCT l.id) AS livestream_count, COUNT(r.id) AS total_reactions
+			FROM livestreams l
+			LEFT JOIN reactions r ON r.livestream_id = l.id
+			WHERE l.user_id = ?
+			`
+			if err := tx.GetContext(ctx, &counts, query, userModel.ID); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to count user livestreams: "+err.Error())
+			}
+			user.LivestreamCount = &counts.LivestreamCount
+			user.TotalReactions = &counts.TotalReactions
+		}
+		return nil
+	}); err != nil {
+		return err
 	}
 
-	user, err := fillUserResponse(ctx, tx, userModel)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
-	}
+	return c.JSON(http.StatusOK, user)
+}
 
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+// cookieDomainMatchesHost はCookieのDomain属性がリクエストのホストに対して有効かを判定します
+func cookieDomainMatchesHost(domain, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
 	}
-
-	return c.JSON(http.StatusOK, user)
+	domain = strings.TrimPrefix(domain, ".")
+	return host == domain || strings.HasSuffix(host, "."+domain)
 }
 
-func verifyUserSession(c echo.Context) error {
+// セッション検証の失敗理由
+// errorResponseHandler でレスポンスの code に変換され、クライアントは再ログインが必要な理由を区別できる
+var (
+	errSessionMissing = errors.New("SESSION_MISSING")
+	errSessionExpired = errors.New("SESSION_EXPIRED")
+)
+
+// verifyUserSession はセッションを検証し、セッションに紐づくユーザーIDを返します
+// ハンドラはセッションを読み直さず、ここで返したユーザーIDを使います
+func verifyUserSession(c echo.Context) (int64, error) {
 	sess, err := session.Get(defaultSessionIDKey, c)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusUnauthorized, "failed to get session")
+		return 0, echo.NewHTTPError(http.StatusUnauthorized, "failed to get session").SetInternal(errSessionMissing)
 	}
 
 	sessionExpires, ok := sess.Values[defaultSessionExpiresKey]
 	if !ok {
-		return echo.NewHTTPError(http.StatusForbidden, "failed to get EXPIRES value from session")
+		return 0, echo.NewHTTPError(http.StatusForbidden, "failed to get EXPIRES value from session").SetInternal(errSessionMissing)
 	}
 
-	_, ok = sess.Values[defaultUserIDKey].(int64)
+	userID, ok := sess.Values[defaultUserIDKey].(int64)
 	if !ok {
-		return echo.NewHTTPError(http.StatusUnauthorized, "failed to get USERID value from session")
+		return 0, echo.NewHTTPError(http.StatusUnauthorized, "failed to get USERID value from session").SetInternal(errSessionMissing)
 	}
 
 	now := time.Now()
 	if now.Unix() > sessionExpires.(int64) {
-		return echo.NewHTTPError(http.StatusUnauthorized, "session has expired")
+		return 0, echo.NewHTTPError(http.StatusUnauthorized, "session has expired").SetInternal(errSessionExpired)
 	}
 
-	return nil
+	// 退会済みユーザーのセッションは、Cookieが残っていても無効とする
+	// 普段は userCache に載っているので、DBを読むのはキャッシュに無いときだけ
+	user, err := getUser(c.Request().Context(), dbConn, userID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+	if err != nil || user.DeletedAt != nil {
+		return 0, echo.NewHTTPError(http.StatusUnauthorized, "user has been deleted").SetInternal(errSessionMissing)
+	}
+
+	return userID, nil
+}
+
+type SessionResponse struct {
+	UserID    int64  `json:"user_id"`
+	Username  string `json:"username"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+// セッション確認API
+// GET /api/session
+// ログイン中かどうかの確認用で、何も書き換えない
+// 退会の確認に userCache を読むので、キャッシュに無いユーザーの場合だけDBを参照する
+func getSessionHandler(c echo.Context) error {
+	userID, err := verifyUserSession(c)
+	if err != nil {
+		// 他のAPIは EXPIRES の無いセッションに403を返すが、ここでは未ログインとして401にそろえる
+		var httpErr *echo.HTTPError
+		if errors.As(err, &httpErr) && httpErr.Code == http.StatusForbidden && errors.Is(httpErr.Internal, errSessionMissing) {
+			return echo.NewHTTPError(http.StatusUnauthorized, httpErr.Message).SetInternal(errSessionMissing)
+		}
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// verifyUserSession が成功していればセッションは取得でき、EXPIRES も入っている
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	username, _ := sess.Values[defaultUsernameKey].(string)
+	expiresAt, _ := sess.Values[defaultSessionExpiresKey].(int64)
+
+	return c.JSON(http.StatusOK, SessionResponse{
+		UserID:    userID,
+		Username:  username,
+		ExpiresAt: expiresAt,
+	})
 }
 
 // themeCache はユーザーIDをキーとし、ThemeModelを値とするマップです
@@ -431,10 +1296,17 @@ var themeCache = struct {
 	m map[int64]ThemeModel
 }{m: make(map[int64]ThemeModel)}
 
-var userCache = struct {
-	sync.RWMutex
-	m map[int64]UserModel
-}{m: make(map[int64]UserModel)}
+// userCache は最近使われたユーザーを持ちます。上限は ISUCON13_USER_CACHE_SIZE で変えられる (0 なら無制限)
+var userCache = newUserLRU(10000, userCacheEvictions)
+
+// userStaleCache は最後にDBから読めたユーザーを持ちます
+// userCache と違いプロフィール更新では消さず、DBが読めないときの代わりにだけ使う
+// 退会したユーザーを生きているものとして返さないよう、退会時には消す
+// features.UserStaleFallback が有効な場合だけ入れる。上限は ISUCON13_USER_STALE_CACHE_SIZE で決める
+var userStaleCache = newUserLRU(10000, userStaleCacheEvictions)
+
+// staleUsersServed はDBの代わりに userStaleCache から返した回数です
+var staleUsersServed = expvar.NewInt("stale_users_served")
 
 // GetUserTheme はユーザーのテーマを取得します。キャッシュがあればそれを返し、なければDBから取得してキャッシュします
 func getUserTheme(ctx context.Context, tx *sqlx.Tx, userID int64) (ThemeModel, error) {
@@ -449,7 +1321,15 @@ func getUserTheme(ctx context.Context, tx *sqlx.Tx, userID int64) (ThemeModel, e
 	// キャッシュになければDBから取得
 	var theme ThemeModel
 	if err := tx.GetContext(ctx, &theme, "SELECT * FROM themes WHERE user_id = ?", userID); err != nil {
-		return ThemeModel{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get user theme: "+err.Error())
+		if !errors.Is(err, sql.ErrNoRows) {
+			return ThemeModel{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get user theme: "+err.Error())
+		}
+		// テーマが無いのはデータ不整合だが、500にはせずライトモードを返す (キャッシュもして再クエリしない)
+		log.Printf("theme not found for user_id=%d; falling back to the default theme", userID)
+		theme = ThemeModel{
+			UserID:   userID,
+			DarkMode: false,
+		}
 	}
 
 	// 取得したテーマをキャッシュに保存
@@ -460,46 +1340,121 @@ func getUserTheme(ctx context.Context, tx *sqlx.Tx, userID int64) (ThemeModel, e
 	return theme, nil
 }
 
-func getUser(ctx context.Context, tx *sqlx.Tx, userID int64) (UserModel, error) {
+func getUser(ctx context.Context, q sqlx.QueryerContext, userID int64) (UserModel, error) {
 	// まずキャッシュをチェック
-	userCache.RLock()
-	if user, ok := userCache.m[userID]; ok {
-		userCache.RUnlock()
+	if user, ok := userCache.Load(userID); ok {
 		return user, nil
 	}
-	userCache.RUnlock()
 
 	// キャッシュになければDBから取得
+	cacheGen := userCache.Gen()
+	staleGen := userStaleCache.Gen()
 	var user UserModel
-	if err := tx.GetContext(ctx, &user, "SELECT * FROM users WHERE id = ?", userID); err != nil {
+	if err := sqlx.GetContext(ctx, q, &user, "SELECT * FROM users WHERE id = ?", userID); err != nil {
+		if features.UserStaleFallback && !errors.Is(err, sql.ErrNoRows) {
+			if stale, ok := userStaleCache.Load(userID); ok {
+				log.Printf("serving stale user_id=%d: %+v", userID, err)
+				staleUsersServed.Add(1)
+				return stale, nil
+			}
+		}
 		return UserModel{}, err
 	}
 
-	// 取得したテーマをキャッシュに保存
-	userCache.Lock()
-	userCache.m[userID] = user
-	userCache.Unlock()
+	// 取得したユーザーをキャッシュに保存
+	userCache.StoreIfGen(cacheGen, userID, user)
+	if features.UserStaleFallback {
+		userStaleCache.StoreIfGen(staleGen, userID, user)
+	}
 
 	return user, nil
 }
 
-func fillUserResponse(ctx context.Context, tx *sqlx.Tx, userModel UserModel) (User, error) {
-	themeModel, err := getUserTheme(ctx, tx, userModel.ID)
-	if err != nil {
-		return User{}, err
+// userIDByNameCache はユーザー名をキーとし、ユーザーIDを値とします
+// ユーザー名は変更できるので、変更のときに消すだけでは、変更前にDBから読んだ古い名前が消した後に書き戻されることがある
+// そのため引けた値はそのまま信用せず、getUserIDByName でユーザーの現在の名前と照らし合わせる
+var userIDByNameCache sync.Map
+
+// getUserIDByName はユーザー名からユーザーIDを引きます。見つからない場合や退会済みの場合は sql.ErrNoRows を返します
+func getUserIDByName(ctx context.Context, q sqlx.QueryerContext, name string) (int64, error) {
+	if cached, ok := userIDByNameCache.Load(name); ok {
+		userID := cached.(int64)
+		// 名前を変えたユーザーや退会したユーザーの古いエントリは消してDBから引き直す
+		if user, err := getUser(ctx, q, userID); err == nil && user.Name == name && user.DeletedAt == nil {
+			return userID, nil
+		}
+		userIDByNameCache.CompareAndDelete(name, cached)
 	}
 
-	iconHash, err := redisConn.Get(ctx, getIconHashKey(userModel.ID)).Result()
+	var userID int64
+	if err := sqlx.GetContext(ctx, q, &userID, "SELECT id FROM users WHERE name = ? AND deleted_at IS NULL", name); err != nil {
+		return 0, err
+	}
+	userIDByNameCache.Store(name, userID)
+	return userID, nil
+}
+
+// getUserByName はユーザー名からユーザーを引きます。ID を引いた後は userCache を使う
+func getUserByName(ctx context.Context, tx *sqlx.Tx, name string) (UserModel, error) {
+	userID, err := getUserIDByName(ctx, tx, name)
 	if err != nil {
-		fmt.Printf("Failed to get iconHash: %v\n", err)
+		return UserModel{}, err
+	}
+	return getUser(ctx, tx, userID)
+}
+
+var iconHashSingleflight singleflight.Group
 
-		// var iconHash string
-		if err := tx.GetContext(ctx, &iconHash, "SELECT icon_hash FROM icons WHERE user_id = ?", userModel.ID); err != nil {
+// getIconHash はRedisからアイコンのハッシュを取得します。
+// キャッシュミス時のDBフォールバックはユーザーごとにsingleflightでまとめ、Redisへの書き戻しも一度だけ行います
+// まとめた読み込みは待っている全員の結果になるので、最初の呼び出し元のトランザクションやキャンセルには乗らず dbConn で読む
+func getIconHash(ctx context.Context, userID int64) (string, error) {
+	iconHash, err := redisConn.Get(ctx, getIconHashKey(userID)).Result()
+	if err == nil {
+		return iconHash, nil
+	}
+	if !errors.Is(err, redis.Nil) {
+		log.Printf("failed to get icon hash from redis; falling back to db: %+v", err)
+	}
+
+	resultI, err, _ := iconHashSingleflight.Do(strconv.FormatInt(userID, 10), func() (interface{}, error) {
+		ctx := context.WithoutCancel(ctx)
+
+		var iconHash string
+		if err := dbConn.GetContext(ctx, &iconHash, "SELECT icon_hash FROM icons WHERE user_id = ? ORDER BY id DESC LIMIT 1", userID); err != nil {
 			if !errors.Is(err, sql.ErrNoRows) {
-				return User{}, err
+				return "", err
 			}
 			iconHash = fallbackHash
 		}
+
+		stored, err := redisConn.SetNX(ctx, getIconHashKey(userID), iconHash, iconHashReadBackExpiration()).Result()
+		if err != nil {
+			log.Printf("failed to set icon hash: %+v", err)
+		} else if !stored {
+			// DBを読んでいる間にアイコンが更新された。書かれている新しい方を返す
+			if latest, err := redisConn.Get(ctx, getIconHashKey(userID)).Result(); err == nil {
+				iconHash = latest
+			}
+		}
+
+		return iconHash, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return resultI.(string), nil
+}
+
+func fillUserResponse(ctx context.Context, tx *sqlx.Tx, userModel UserModel) (User, error) {
+	themeModel, err := getUserTheme(ctx, tx, userModel.ID)
+	if err != nil {
+		return User{}, err
+	}
+
+	iconHash, err := getIconHash(ctx, userModel.ID)
+	if err != nil {
+		return User{}, err
 	}
 
 	user := User{
@@ -507,12 +1462,137 @@ func fillUserResponse(ctx context.Context, tx *sqlx.Tx, userModel UserModel) (Us
 		Name:        userModel.Name,
 		DisplayName: userModel.DisplayName,
 		Description: userModel.Description,
-		Theme: Theme{
+		Theme: &Theme{
 			ID:       themeModel.ID,
 			DarkMode: themeModel.DarkMode,
 		},
-		IconHash: iconHash,
+		IconHash:  iconHash,
+		CreatedAt: userModel.CreatedAt,
 	}
 
 	return user, nil
 }
+
+// getIconHashes は複数ユーザーのアイコンのハッシュを MGET でまとめて取得します
+// Redis に無かったユーザーだけを1クエリでDBから引いて書き戻し、アイコンの無いユーザーは fallbackHash とする
+// Redis 自体が使えない場合は全員をDBから引く
+func getIconHashes(ctx context.Context, tx *sqlx.Tx, userIDs []int64) (map[int64]string, error) {
+	iconHashes := make(map[int64]string, len(userIDs))
+	if len(userIDs) == 0 {
+		return iconHashes, nil
+	}
+
+	keys := make([]string, len(userIDs))
+	for i, userID := range userIDs {
+		keys[i] = getIconHashKey(userID)
+	}
+	var misses []int64
+	values, err := redisConn.MGet(ctx, keys...).Result()
+	if err != nil {
+		log.Printf("failed to get icon hashes from redis; falling back to db: %+v", err)
+		misses = userIDs
+	} else {
+		for i, value := range values {
+			// キャッシュミスは nil で返る
+			iconHash, ok := value.(string)
+			if !ok {
+				misses = append(misses, userIDs[i])
+				continue
+			}
+			iconHashes[userIDs[i]] = iconHash
+		}
+	}
+	if len(misses) == 0 {
+		return iconHashes, nil
+	}
+
+	query, params, err := sqlx.In("SELECT user_id, icon_hash FROM icons WHERE id IN (SELECT MAX(id) FROM icons WHERE user_id IN (?) GROUP BY user_id)", misses)
+	if err != nil {
+		return nil, err
+	}
+	var icons []struct {
+		UserID   int64  `db:"user_id"`
+		IconHash string `db:"icon_hash"`
+	}
+	if err := tx.SelectContext(ctx, &icons, query, params...); err != nil {
+		return nil, err
+	}
+	for _, icon := range icons {
+		iconHashes[icon.UserID] = icon.IconHash
+	}
+
+	_, err = redisConn.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, userID := range misses {
+			if _, ok := iconHashes[userID]; !ok {
+				iconHashes[userID] = fallbackHash
+			}
+			pipe.SetNX(ctx, getIconHashKey(userID), iconHashes[userID], iconHashReadBackExpiration())
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("failed to set icon hashes: %+v", err)
+	}
+
+	return iconHashes, nil
+}
+
+// fillUsersResponse は複数のユーザーをまとめて埋めます。アイコンのハッシュは getIconHashes で一度に引く
+func fillUsersResponse(ctx context.Context, tx *sqlx.Tx, userModels []UserModel) (map[int64]User, error) {
+	userIDs := make([]int64, len(userModels))
+	for i := range userModels {
+		userIDs[i] = userModels[i].ID
+	}
+	iconHashes, err := getIconHashes(ctx, tx, userIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	users := make(map[int64]User, len(userModels))
+	for _, userModel := range userModels {
+		themeModel, err := getUserTheme(ctx, tx, userModel.ID)
+		if err != nil {
+			return nil, err
+		}
+		users[userModel.ID] = User{
+			ID:          userModel.ID,
+			Name:        userModel.Name,
+			DisplayName: userModel.DisplayName,
+			Description: userModel.Description,
+			Theme: &Theme{
+				ID:       themeModel.ID,
+				DarkMode: themeModel.DarkMode,
+			},
+			IconHash:  iconHashes[userModel.ID],
+			CreatedAt: userModel.CreatedAt,
+		}
+	}
+	return users, nil
+}
+
+// userFiller は UserModel からレスポンスの User を作る関数です
+type userFiller func(ctx context.Context, tx *sqlx.Tx, userModel UserModel) (User, error)
+
+// fillUserResponseBasic は id/name/display_name/description だけを埋めます
+// テーマとアイコンのハッシュを引かないので、一覧でそれらが不要な場合に使う
+func fillUserResponseBasic(_ context.Context, _ *sqlx.Tx, userModel UserModel) (User, error) {
+	return User{
+		ID:          userModel.ID,
+		Name:        userModel.Name,
+		DisplayName: userModel.DisplayName,
+		Description: userModel.Description,
+	}, nil
+}
+
+// userFillerFromQuery は user_fields クエリパラメータから一覧のユーザーの埋め方を決めます
+// user_fields=basic ならテーマとアイコンを省き、未指定なら従来どおり全て埋める
+func userFillerFromQuery(c echo.Context) (userFiller, error) {
+	switch c.QueryParam("user_fields") {
+	case "", "full":
+		return fillUserResponse, nil
+	case "basic":
+		return fillUserResponseBasic, nil
+	default:
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "user_fields query parameter must be 'basic' or 'full'")
+	}
+}
@@ -0,0 +1,1816 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+func uploadTestIcon(t *testing.T, userID int64, image []byte) string {
+	t.Helper()
+	ctx := context.Background()
+	sum := sha256.Sum256(image)
+	iconHash := hex.EncodeToString(sum[:])
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		t.Errorf("failed to begin transaction: %+v", err)
+		return ""
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "DELETE FROM icons WHERE user_id = ?", userID); err != nil {
+		t.Errorf("failed to delete icon: %+v", err)
+		return ""
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO icons (user_id, image, icon_hash) VALUES (?, ?, ?)", userID, image, iconHash); err != nil {
+		t.Errorf("failed to insert icon: %+v", err)
+		return ""
+	}
+	if err := tx.Commit(); err != nil {
+		t.Errorf("failed to commit: %+v", err)
+		return ""
+	}
+	if err := updateIconHashCache(ctx, userID, iconHash); err != nil {
+		t.Errorf("failed to update icon hash cache: %+v", err)
+	}
+	return iconHash
+}
+
+// アイコンの更新と並行してキャッシュミスからの読み込みが走っても、最後に残るのは最新のハッシュ
+func TestIconHashLatestAfterConcurrentUploads(t *testing.T) {
+	setupIntegration(t)
+	ctx := context.Background()
+	user := createTestUser(t)
+
+	const uploads = 20
+	const readers = 8
+	var latest string
+	for i := 0; i < uploads; i++ {
+		// 毎回キャッシュミスから読ませる
+		if err := redisConn.Del(ctx, getIconHashKey(user.ID)).Err(); err != nil {
+			t.Fatalf("failed to delete icon hash: %+v", err)
+		}
+
+		var wg sync.WaitGroup
+		for r := 0; r < readers; r++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := getIconHash(ctx, user.ID); err != nil {
+					t.Errorf("failed to get icon hash: %+v", err)
+				}
+			}()
+		}
+		latest = uploadTestIcon(t, user.ID, []byte("icon-"+strconv.Itoa(i)))
+		wg.Wait()
+
+		cached, err := redisConn.Get(ctx, getIconHashKey(user.ID)).Result()
+		if err != nil {
+			t.Fatalf("failed to get cached icon hash: %+v", err)
+		}
+		if cached != latest {
+			t.Fatalf("upload %d: cached icon hash = %s, want %s", i, cached, latest)
+		}
+	}
+
+	got, err := getIconHash(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("failed to get icon hash: %+v", err)
+	}
+	if got != latest {
+		t.Errorf("getIconHash = %s, want %s", got, latest)
+	}
+}
+
+// 参照時の書き戻しは、消された後に古い値を書いても長く残らないよう短い期限で入る
+func TestIconHashReadBackExpiresSoon(t *testing.T) {
+	setupIntegration(t)
+	ctx := context.Background()
+	user := createTestUser(t)
+
+	uploadTestIcon(t, user.ID, []byte("icon"))
+	if err := invalidateIconHashCache(ctx, user.ID); err != nil {
+		t.Fatalf("failed to invalidate icon hash cache: %+v", err)
+	}
+	if _, err := getIconHash(ctx, user.ID); err != nil {
+		t.Fatalf("failed to get icon hash: %+v", err)
+	}
+
+	ttl, err := redisConn.PTTL(ctx, getIconHashKey(user.ID)).Result()
+	if err != nil {
+		t.Fatalf("failed to get ttl: %+v", err)
+	}
+	if ttl <= 0 || ttl > iconHashReadBackExpiration() {
+		t.Errorf("ttl = %s, want (0, %s]", ttl, iconHashReadBackExpiration())
+	}
+}
+
+// verifyTestSession は user のセッションで verifyUserSession を通し、失敗した場合のステータスを返します
+func verifyTestSession(t *testing.T, user UserModel) int {
+	t.Helper()
+	c, _ := newTestContext(http.MethodGet, "/api/session", nil)
+	err := serveWithSession(c, user, func(c echo.Context) error {
+		_, err := verifyUserSession(c)
+		return err
+	})
+	if err == nil {
+		return http.StatusOK
+	}
+	var httpErr *echo.HTTPError
+	if !errors.As(err, &httpErr) {
+		t.Fatalf("verifyUserSession returned %+v", err)
+	}
+	return httpErr.Code
+}
+
+func rankingHasUser(t *testing.T, username string) bool {
+	t.Helper()
+	ranking, err := computeUserRanking()
+	if err != nil {
+		t.Fatalf("computeUserRanking: %+v", err)
+	}
+	for _, entry := range ranking {
+		if entry.Username == username {
+			return true
+		}
+	}
+	return false
+}
+
+// 退会したユーザーはランキングから消え、残ったセッションでは認証できない
+func TestDeleteMe(t *testing.T) {
+	setupIntegration(t)
+	ctx := context.Background()
+	prevFeatures := features
+	features.RedisRanking = true
+	t.Cleanup(func() { features = prevFeatures })
+	user := createTestUser(t)
+	setTestZoneFile(t, dnsRecordLine(user.Name)+"\n")
+	if err := redisConn.ZAdd(ctx, userScoresKey, redis.Z{Score: 1, Member: user.Name}).Err(); err != nil {
+		t.Fatalf("failed to add user score: %+v", err)
+	}
+
+	if code := verifyTestSession(t, user); code != http.StatusOK {
+		t.Fatalf("before deletion: verifyUserSession = %d, want %d", code, http.StatusOK)
+	}
+	if !rankingHasUser(t, user.Name) {
+		t.Fatalf("before deletion: %s is not in the ranking", user.Name)
+	}
+
+	c, rec := newTestContext(http.MethodDelete, "/api/user/me", nil)
+	if err := serveWithSession(c, user, deleteMeHandler); err != nil {
+		t.Fatalf("deleteMeHandler: %+v", err)
+	}
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("deleteMeHandler status = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+
+	if code := verifyTestSession(t, user); code != http.StatusUnauthorized {
+		t.Errorf("after deletion: verifyUserSession = %d, want %d", code, http.StatusUnauthorized)
+	}
+	if rankingHasUser(t, user.Name) {
+		t.Errorf("after deletion: %s is still in the sql ranking", user.Name)
+	}
+	if err := redisConn.ZScore(ctx, userScoresKey, user.Name).Err(); !errors.Is(err, redis.Nil) {
+		t.Errorf("after deletion: zscore err = %v, want redis.Nil", err)
+	}
+	zone, err := os.ReadFile(config.ZoneFilePath)
+	if err != nil {
+		t.Fatalf("failed to read zone file: %+v", err)
+	}
+	if strings.Contains(string(zone), user.Name) {
+		t.Errorf("after deletion: zone file still has a record for %s", user.Name)
+	}
+}
+
+// newBrokenDB はどのクエリもエラーになるDBを返します
+// 接続せずに閉じるので、MySQL が無くても使える
+func newBrokenDB(t *testing.T) *sqlx.DB {
+	t.Helper()
+	db, err := sqlx.Open("mysql", "isucon:isucon@tcp(127.0.0.1:1)/isupipe")
+	if err != nil {
+		t.Fatalf("failed to open db: %+v", err)
+	}
+	db.Close()
+	return db
+}
+
+// DBが読めないとき、フォールバックが有効なら最後に読めたユーザーを返し、無効ならエラーを返す
+func TestGetUserStaleFallback(t *testing.T) {
+	const userID = 1 << 40
+	stale := UserModel{ID: userID, Name: "stale", DisplayName: "stale user"}
+	db := newBrokenDB(t)
+	prevFeatures := features
+	t.Cleanup(func() {
+		features = prevFeatures
+		userCache.Delete(userID)
+		userStaleCache.Delete(userID)
+	})
+
+	for _, tt := range []struct {
+		name      string
+		enabled   bool
+		wantStale bool
+	}{
+		{"enabled", true, true},
+		{"disabled", false, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			features.UserStaleFallback = tt.enabled
+			userCache.Delete(userID)
+			userStaleCache.Store(userID, stale)
+			served := staleUsersServed.Value()
+
+			got, err := getUser(context.Background(), db, userID)
+			if !tt.wantStale {
+				if err == nil {
+					t.Fatalf("getUser = %+v, want an error", got)
+				}
+				if staleUsersServed.Value() != served {
+					t.Errorf("stale_users_served changed without the fallback")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getUser: %+v", err)
+			}
+			if got != stale {
+				t.Errorf("getUser = %+v, want %+v", got, stale)
+			}
+			if staleUsersServed.Value() != served+1 {
+				t.Errorf("stale_users_served = %d, want %d", staleUsersServed.Value(), served+1)
+			}
+		})
+	}
+}
+
+// 古い値が無ければ、フォールバックが有効でもDBのエラーを返す
+func TestGetUserStaleFallbackWithoutCache(t *testing.T) {
+	const userID = 1<<40 + 1
+	prevFeatures := features
+	features.UserStaleFallback = true
+	t.Cleanup(func() { features = prevFeatures })
+	userCache.Delete(userID)
+	userStaleCache.Delete(userID)
+
+	if got, err := getUser(context.Background(), newBrokenDB(t), userID); err == nil {
+		t.Errorf("getUser = %+v, want an error", got)
+	}
+}
+
+func TestCookieDomainMatchesHost(t *testing.T) {
+	for _, tt := range []struct {
+		domain, host string
+		want         bool
+	}{
+		{"u.isucon.local", "u.isucon.local", true},
+		{"u.isucon.local", "u.isucon.local:8080", true},
+		{"u.isucon.local", "test001.u.isucon.local", true},
+		{".u.isucon.local", "test001.u.isucon.local", true},
+		{"u.isucon.local", "localhost:8080", false},
+		{"u.isucon.local", "xu.isucon.local", false},
+		{"staging.example.com", "u.isucon.local", false},
+	} {
+		if got := cookieDomainMatchesHost(tt.domain, tt.host); got != tt.want {
+			t.Errorf("cookieDomainMatchesHost(%q, %q) = %v, want %v", tt.domain, tt.host, got, tt.want)
+		}
+	}
+}
+
+// saveTestSessionCookie はログイン時の属性でセッションを保存し、発行された Set-Cookie を返します
+func saveTestSessionCookie(t *testing.T) *http.Cookie {
+	t.Helper()
+	c, rec := newTestContext(http.MethodPost, "/api/login", nil)
+	err := session.Middleware(sessions.NewCookieStore(secret))(func(c echo.Context) error {
+		sess, err := session.Get(defaultSessionIDKey, c)
+		if err != nil {
+			return err
+		}
+		sess.Options = sessionCookieOptions()
+		sess.Values[defaultUserIDKey] = int64(1)
+		return sess.Save(c.Request(), c.Response())
+	})(c)
+	if err != nil {
+		t.Fatalf("failed to save session: %+v", err)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("got %d cookies, want 1", len(cookies))
+	}
+	return cookies[0]
+}
+
+// 環境変数で変えたドメインが Set-Cookie の Domain 属性に出る
+func TestSessionCookieDomain(t *testing.T) {
+	prev := sessionCookieDomain
+	sessionCookieDomain = "staging.example.com"
+	t.Cleanup(func() { sessionCookieDomain = prev })
+
+	if got := saveTestSessionCookie(t).Domain; got != "staging.example.com" {
+		t.Errorf("cookie domain = %q, want %q", got, "staging.example.com")
+	}
+}
+
+// セッションCookieには HttpOnly が常に付き、Secure と SameSite は設定に従う
+func TestSessionCookieAttributes(t *testing.T) {
+	prevSecure, prevSameSite := sessionCookieSecure, sessionCookieSameSite
+	t.Cleanup(func() { sessionCookieSecure, sessionCookieSameSite = prevSecure, prevSameSite })
+
+	for _, tt := range []struct {
+		name     string
+		secure   bool
+		sameSite http.SameSite
+	}{
+		{"default", true, http.SameSiteLaxMode},
+		{"local http", false, http.SameSiteStrictMode},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			sessionCookieSecure, sessionCookieSameSite = tt.secure, tt.sameSite
+			cookie := saveTestSessionCookie(t)
+			if !cookie.HttpOnly {
+				t.Error("cookie is not HttpOnly")
+			}
+			if cookie.Secure != tt.secure {
+				t.Errorf("cookie secure = %v, want %v", cookie.Secure, tt.secure)
+			}
+			if cookie.SameSite != tt.sameSite {
+				t.Errorf("cookie samesite = %v, want %v", cookie.SameSite, tt.sameSite)
+			}
+		})
+	}
+}
+
+func postTestIcon(t *testing.T, user UserModel, image []byte) PostIconResponse {
+	t.Helper()
+	body, err := json.Marshal(PostIconRequest{Image: image})
+	if err != nil {
+		t.Fatalf("failed to marshal request: %+v", err)
+	}
+	c, rec := newTestContext(http.MethodPost, "/api/icon", bytes.NewReader(body))
+	if err := serveWithSession(c, user, postIconHandler); err != nil {
+		t.Fatalf("postIconHandler: %+v", err)
+	}
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("postIconHandler status = %d, want %d", rec.Code, http.StatusCreated)
+	}
+	var res PostIconResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("failed to decode response: %+v", err)
+	}
+	return res
+}
+
+// 画像として読めるアイコンは幅と高さを返し、読めないものは省略する
+func TestPostIconDimensions(t *testing.T) {
+	setupIntegration(t)
+	user := createTestUser(t)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 3, 2))); err != nil {
+		t.Fatalf("failed to encode png: %+v", err)
+	}
+	res := postTestIcon(t, user, buf.Bytes())
+	if res.Width == nil || res.Height == nil || *res.Width != 3 || *res.Height != 2 {
+		t.Errorf("dimensions = (%v, %v), want (3, 2)", res.Width, res.Height)
+	}
+
+	res = postTestIcon(t, user, []byte("not an image"))
+	if res.Width != nil || res.Height != nil {
+		t.Errorf("dimensions = (%v, %v), want them omitted", res.Width, res.Height)
+	}
+}
+
+// アイコンを変えると、ハッシュは新しい値に置き換わり、派生キャッシュは消える
+func TestPostIconUpdatesIconKeys(t *testing.T) {
+	setupIntegration(t)
+	ctx := context.Background()
+	user := createTestUser(t)
+
+	derivedKey := func(userID int64) string { return "test:user:" + strconv.FormatInt(userID, 10) + ":derived" }
+	prevKeyFuncs := userDerivedCacheKeyFuncs
+	userDerivedCacheKeyFuncs = append(append([]func(int64) string(nil), prevKeyFuncs...), derivedKey)
+	t.Cleanup(func() { userDerivedCacheKeyFuncs = prevKeyFuncs })
+
+	if err := redisConn.Set(ctx, getIconHashKey(user.ID), "stale", 0).Err(); err != nil {
+		t.Fatalf("failed to set icon hash: %+v", err)
+	}
+	if err := redisConn.Set(ctx, derivedKey(user.ID), "cached", 0).Err(); err != nil {
+		t.Fatalf("failed to set derived key: %+v", err)
+	}
+
+	image := []byte("new icon")
+	postTestIcon(t, user, image)
+
+	sum := sha256.Sum256(image)
+	want := hex.EncodeToString(sum[:])
+	got, err := redisConn.Get(ctx, getIconHashKey(user.ID)).Result()
+	if err != nil {
+		t.Fatalf("failed to get icon hash: %+v", err)
+	}
+	if got != want {
+		t.Errorf("icon hash = %s, want %s", got, want)
+	}
+	if n, err := redisConn.Exists(ctx, derivedKey(user.ID)).Result(); err != nil || n != 0 {
+		t.Errorf("derived key exists = %d (err %v), want it deleted", n, err)
+	}
+}
+
+func getTestUser(t *testing.T, viewer UserModel, username, query string) User {
+	t.Helper()
+	c, rec := newTestContext(http.MethodGet, "/api/user/"+username+"?"+query, nil)
+	c.SetParamNames("username")
+	c.SetParamValues(username)
+	if err := serveWithSession(c, viewer, getUserHandler); err != nil {
+		t.Fatalf("getUserHandler: %+v", err)
+	}
+	var user User
+	if err := json.Unmarshal(rec.Body.Bytes(), &user); err != nil {
+		t.Fatalf("failed to decode response: %+v", err)
+	}
+	return user
+}
+
+// include_counts=1 を付けたときだけ、配信数とリアクション数を返す
+func TestGetUserIncludeCounts(t *testing.T) {
+	setupIntegration(t)
+	owner := createTestUser(t)
+	viewer := createTestUser(t)
+	now := time.Now().Unix()
+	for i := 0; i < 3; i++ {
+		livestream := createTestLivestream(t, owner.ID)
+		for j := 0; j < i; j++ {
+			createTestReaction(t, viewer.ID, livestream.ID, "heart", now)
+		}
+	}
+
+	if user := getTestUser(t, viewer, owner.Name, ""); user.LivestreamCount != nil || user.TotalReactions != nil {
+		t.Errorf("counts are returned without include_counts: %+v", user)
+	}
+
+	user := getTestUser(t, viewer, owner.Name, "include_counts=1")
+	if user.LivestreamCount == nil || *user.LivestreamCount != 3 {
+		t.Errorf("livestream_count = %v, want 3", user.LivestreamCount)
+	}
+	if user.TotalReactions == nil || *user.TotalReactions != 3 {
+		t.Errorf("total_reactions = %v, want 3", user.TotalReactions)
+	}
+}
+
+// verifyUserSession はセッションのユーザーIDを返し、ハンドラはそれをそのまま使う
+func TestVerifyUserSessionReturnsUserID(t *testing.T) {
+	user := UserModel{ID: 1<<40 + 2, Name: "test002"}
+	cacheTestUser(t, user)
+
+	c, _ := newTestContext(http.MethodGet, "/api/user/me", nil)
+	var got int64
+	err := serveWithSession(c, user, func(c echo.Context) error {
+		var err error
+		got, err = verifyUserSession(c)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("verifyUserSession: %+v", err)
+	}
+	if got != user.ID {
+		t.Errorf("verifyUserSession = %d, want %d", got, user.ID)
+	}
+
+	// 退会済みのユーザーのセッションは通さない
+	deletedAt := time.Now().Unix()
+	user.DeletedAt = &deletedAt
+	cacheTestUser(t, user)
+	if code := verifyTestSession(t, user); code != http.StatusUnauthorized {
+		t.Errorf("deleted user: verifyUserSession = %d, want %d", code, http.StatusUnauthorized)
+	}
+}
+
+// セッションが無ければ、アイコンの登録はDBに触れる前に断る
+func TestPostIconWithoutSession(t *testing.T) {
+	c, _ := newTestContext(http.MethodPost, "/api/icon", strings.NewReader(`{"image":""}`))
+	err := session.Middleware(sessions.NewCookieStore(secret))(postIconHandler)(c)
+	var httpErr *echo.HTTPError
+	if !errors.As(err, &httpErr) || !errors.Is(httpErr.Internal, errSessionMissing) {
+		t.Errorf("postIconHandler = %v, want an echo.HTTPError for a missing session", err)
+	}
+}
+
+func postTestRegister(t *testing.T, req PostUserRequest) (int, User) {
+	t.Helper()
+	body, err := json.Marshal(req)
+	if err != nil {
+		t.Fatalf("failed to marshal request: %+v", err)
+	}
+	c, rec := newTestContext(http.MethodPost, "/api/register", bytes.NewReader(body))
+	if err := registerHandler(c); err != nil {
+		t.Fatalf("registerHandler: %+v", err)
+	}
+	var user User
+	if err := json.Unmarshal(rec.Body.Bytes(), &user); err != nil {
+		t.Fatalf("failed to decode response: %+v", err)
+	}
+	return rec.Code, user
+}
+
+// 同じnonceで登録を再送すると最初に作ったユーザーを返し、ゾーンファイルへの追記は1回だけ
+func TestRegisterIdempotentNonce(t *testing.T) {
+	setupIntegration(t)
+	ctx := context.Background()
+	setTestZoneFile(t, "")
+	name := fmt.Sprintf("test%dnonce", time.Now().UnixNano())
+	req := PostUserRequest{Name: name, DisplayName: name, Password: "s3cr3t", Nonce: "nonce-" + name}
+	t.Cleanup(func() {
+		redisConn.Del(ctx, getRegisterNonceKey(req.Nonce, req.Name))
+		redisConn.SRem(ctx, dnsRetryKey, name)
+	})
+
+	code, first := postTestRegister(t, req)
+	if code != http.StatusCreated {
+		t.Fatalf("first register status = %d, want %d", code, http.StatusCreated)
+	}
+	code, second := postTestRegister(t, req)
+	if code != http.StatusCreated {
+		t.Fatalf("second register status = %d, want %d", code, http.StatusCreated)
+	}
+	if second.ID != first.ID {
+		t.Errorf("second register returned user %d, want %d", second.ID, first.ID)
+	}
+
+	zone, err := os.ReadFile(config.ZoneFilePath)
+	if err != nil {
+		t.Fatalf("failed to read zone file: %+v", err)
+	}
+	if got := strings.Count(string(zone), dnsRecordLine(name)); got != 1 {
+		t.Errorf("zone file has %d records for %s, want 1", got, name)
+	}
+}
+
+// 登録の再送などでテーマが既にあっても、エラーにも重複にもならず dark_mode を上書きする
+func TestUpsertThemeExistingRow(t *testing.T) {
+	setupIntegration(t)
+	ctx := context.Background()
+	user := createTestUser(t)
+
+	if _, err := dbConn.NamedExecContext(ctx, upsertThemeQuery, ThemeModel{UserID: user.ID, DarkMode: false}); err != nil {
+		t.Fatalf("failed to insert theme: %+v", err)
+	}
+	if _, err := dbConn.NamedExecContext(ctx, upsertThemeQuery, ThemeModel{UserID: user.ID, DarkMode: true}); err != nil {
+		t.Fatalf("upsert with an existing theme: %+v", err)
+	}
+
+	var themes []ThemeModel
+	if err := dbConn.SelectContext(ctx, &themes, "SELECT * FROM themes WHERE user_id = ?", user.ID); err != nil {
+		t.Fatalf("failed to get themes: %+v", err)
+	}
+	if len(themes) != 1 {
+		t.Fatalf("got %d themes, want 1", len(themes))
+	}
+	if !themes[0].DarkMode {
+		t.Error("dark_mode was not updated")
+	}
+}
+
+// テーマの行が無いユーザーには、エラーにせずライトモードを返してキャッシュする
+func TestGetUserThemeWithoutRow(t *testing.T) {
+	setupIntegration(t)
+	ctx := context.Background()
+	user := createTestUser(t)
+	t.Cleanup(func() {
+		themeCache.Lock()
+		delete(themeCache.m, user.ID)
+		themeCache.Unlock()
+	})
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		t.Fatalf("failed to begin transaction: %+v", err)
+	}
+	defer tx.Rollback()
+	theme, err := getUserTheme(ctx, tx, user.ID)
+	if err != nil {
+		t.Fatalf("getUserTheme: %+v", err)
+	}
+	if theme.UserID != user.ID || theme.DarkMode {
+		t.Errorf("getUserTheme = %+v, want the light default for user %d", theme, user.ID)
+	}
+
+	themeCache.RLock()
+	cached, ok := themeCache.m[user.ID]
+	themeCache.RUnlock()
+	if !ok || cached != theme {
+		t.Errorf("cached theme = %+v (ok %v), want %+v", cached, ok, theme)
+	}
+}
+
+// 履歴を残す設定では、現在のアイコンに加えて直近 iconHistorySize 件を新しい順に返す
+func TestIconHistoryKeepsRecentIcons(t *testing.T) {
+	setupIntegration(t)
+	prevSize := iconHistorySize
+	iconHistorySize = 2
+	t.Cleanup(func() { iconHistorySize = prevSize })
+	user := createTestUser(t)
+
+	var hashes []string
+	for i := 0; i < 4; i++ {
+		image := []byte("history icon " + strconv.Itoa(i))
+		postTestIcon(t, user, image)
+		sum := sha256.Sum256(image)
+		hashes = append([]string{hex.EncodeToString(sum[:])}, hashes...)
+	}
+
+	c, rec := newTestContext(http.MethodGet, "/api/user/"+user.Name+"/icons", nil)
+	c.SetParamNames("username")
+	c.SetParamValues(user.Name)
+	if err := serveWithSession(c, user, getIconHistoryHandler); err != nil {
+		t.Fatalf("getIconHistoryHandler: %+v", err)
+	}
+	var history []IconHistoryEntry
+	if err := json.Unmarshal(rec.Body.Bytes(), &history); err != nil {
+		t.Fatalf("failed to decode response: %+v", err)
+	}
+	got := make([]string, len(history))
+	for i, entry := range history {
+		got[i] = entry.IconHash
+	}
+	if want := hashes[:3]; !reflect.DeepEqual(got, want) {
+		t.Errorf("history = %v, want %v", got, want)
+	}
+}
+
+// アイコン更新時のハッシュは、設定した期限付きで書かれる
+func TestUpdateIconHashCacheUsesConfiguredTTL(t *testing.T) {
+	setupIntegration(t)
+	ctx := context.Background()
+	prevTTL := iconHashTTL
+	iconHashTTL = 90 * time.Second
+	t.Cleanup(func() { iconHashTTL = prevTTL })
+	user := createTestUser(t)
+
+	if err := updateIconHashCache(ctx, user.ID, "hash"); err != nil {
+		t.Fatalf("updateIconHashCache: %+v", err)
+	}
+	ttl, err := redisConn.PTTL(ctx, getIconHashKey(user.ID)).Result()
+	if err != nil {
+		t.Fatalf("failed to get ttl: %+v", err)
+	}
+	if ttl <= 0 || ttl > iconHashTTL {
+		t.Errorf("ttl = %s, want (0, %s]", ttl, iconHashTTL)
+	}
+}
+
+// 参照時の書き戻しの期限は、更新時の期限を超えない
+func TestIconHashReadBackExpiration(t *testing.T) {
+	prevTTL := iconHashTTL
+	t.Cleanup(func() { iconHashTTL = prevTTL })
+
+	iconHashTTL = time.Hour
+	if got := iconHashReadBackExpiration(); got != iconHashReadBackTTL {
+		t.Errorf("iconHashReadBackExpiration = %s, want %s", got, iconHashReadBackTTL)
+	}
+	iconHashTTL = time.Millisecond
+	if got := iconHashReadBackExpiration(); got != time.Millisecond {
+		t.Errorf("iconHashReadBackExpiration = %s, want %s", got, time.Millisecond)
+	}
+}
+
+// DBへの書き込みに失敗したら、画像もハッシュもキャッシュに載せずにエラーを返す
+func TestPostIconFailureLeavesCachesUntouched(t *testing.T) {
+	prevDB := dbConn
+	dbConn = newBrokenDB(t)
+	t.Cleanup(func() { dbConn = prevDB })
+	user := UserModel{ID: 1<<40 + 3, Name: "test003"}
+	cacheTestUser(t, user)
+
+	image := []byte("icon that is never committed")
+	sum := sha256.Sum256(image)
+	hash := hex.EncodeToString(sum[:])
+	iconImageCache.Delete(hash)
+
+	body, err := json.Marshal(PostIconRequest{Image: image})
+	if err != nil {
+		t.Fatalf("failed to marshal request: %+v", err)
+	}
+	c, _ := newTestContext(http.MethodPost, "/api/icon", bytes.NewReader(body))
+	if err := serveWithSession(c, user, postIconHandler); err == nil {
+		t.Fatal("postIconHandler succeeded with a broken db")
+	}
+	if _, ok := iconImageCache.Load(hash); ok {
+		t.Error("the icon image was cached although the db write failed")
+	}
+}
+
+// セッションが無い場合と期限切れの場合は、レスポンスの code で区別できる
+func TestSessionErrorCodes(t *testing.T) {
+	user := UserModel{ID: 1<<40 + 4, Name: "test004"}
+	cacheTestUser(t, user)
+
+	for _, tt := range []struct {
+		name     string
+		values   map[interface{}]interface{}
+		wantCode string
+	}{
+		{"no session", map[interface{}]interface{}{}, "SESSION_MISSING"},
+		{
+			"no user id",
+			map[interface{}]interface{}{defaultSessionExpiresKey: time.Now().Add(time.Hour).Unix()},
+			"SESSION_MISSING",
+		},
+		{
+			"expired",
+			map[interface{}]interface{}{defaultUserIDKey: user.ID, defaultSessionExpiresKey: time.Now().Add(-time.Minute).Unix()},
+			"SESSION_EXPIRED",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c, rec := newTestContext(http.MethodGet, "/api/user/me", nil)
+			err := session.Middleware(sessions.NewCookieStore(secret))(func(c echo.Context) error {
+				sess, err := session.Get(defaultSessionIDKey, c)
+				if err != nil {
+					return err
+				}
+				for k, v := range tt.values {
+					sess.Values[k] = v
+				}
+				_, err = verifyUserSession(c)
+				return err
+			})(c)
+			if err == nil {
+				t.Fatal("verifyUserSession succeeded")
+			}
+
+			errorResponseHandler(err, c)
+			var res ErrorResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+				t.Fatalf("failed to decode response: %+v", err)
+			}
+			if res.Code != tt.wantCode {
+				t.Errorf("code = %q, want %q", res.Code, tt.wantCode)
+			}
+			if tt.wantCode == "SESSION_EXPIRED" && rec.Code != http.StatusUnauthorized {
+				t.Errorf("status = %d, want %d", rec.Code, http.StatusUnauthorized)
+			}
+		})
+	}
+}
+
+// basic の埋め方はテーマもアイコンも引かないので、トランザクションが無くても埋められる
+func TestFillUserResponseBasicSkipsLookups(t *testing.T) {
+	const userID = 1<<40 + 8
+	themeCache.Lock()
+	delete(themeCache.m, userID)
+	themeCache.Unlock()
+
+	userModel := UserModel{ID: userID, Name: "test008", DisplayName: "test user", Description: "desc"}
+	user, err := fillUserResponseBasic(context.Background(), nil, userModel)
+	if err != nil {
+		t.Fatalf("fillUserResponseBasic: %+v", err)
+	}
+	want := User{ID: userID, Name: "test008", DisplayName: "test user", Description: "desc"}
+	if !reflect.DeepEqual(user, want) {
+		t.Errorf("fillUserResponseBasic = %+v, want %+v", user, want)
+	}
+
+	themeCache.RLock()
+	_, cached := themeCache.m[userID]
+	themeCache.RUnlock()
+	if cached {
+		t.Error("fillUserResponseBasic looked up the theme")
+	}
+}
+
+func TestUserFillerFromQuery(t *testing.T) {
+	for _, tt := range []struct {
+		query string
+		want  userFiller
+	}{
+		{"", fillUserResponse},
+		{"user_fields=full", fillUserResponse},
+		{"user_fields=basic", fillUserResponseBasic},
+	} {
+		c, _ := newTestContext(http.MethodGet, "/?"+tt.query, nil)
+		got, err := userFillerFromQuery(c)
+		if err != nil {
+			t.Errorf("userFillerFromQuery(%q): %+v", tt.query, err)
+			continue
+		}
+		if reflect.ValueOf(got).Pointer() != reflect.ValueOf(tt.want).Pointer() {
+			t.Errorf("userFillerFromQuery(%q) returned the wrong filler", tt.query)
+		}
+	}
+	c, _ := newTestContext(http.MethodGet, "/?user_fields=all", nil)
+	_, err := userFillerFromQuery(c)
+	wantBadRequest(t, err)
+}
+
+func BenchmarkFillUserResponseBasic(b *testing.B) {
+	userModel := UserModel{ID: 1, Name: "test001", DisplayName: "test user", Description: "desc"}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := fillUserResponseBasic(context.Background(), nil, userModel); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// 比較用に、テーマとアイコンのハッシュも引く埋め方を測る (DBとRedisが必要)
+func BenchmarkFillUserResponse(b *testing.B) {
+	setupIntegration(b)
+	ctx := context.Background()
+	var userModel UserModel
+	if err := dbConn.GetContext(ctx, &userModel, "SELECT * FROM users ORDER BY id LIMIT 1"); err != nil {
+		b.Skipf("no user to fill: %+v", err)
+	}
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer tx.Rollback()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := fillUserResponse(ctx, tx, userModel); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func patchTestUser(t *testing.T, user UserModel, ifMatch string, displayName string) (*httptest.ResponseRecorder, error) {
+	t.Helper()
+	body := strings.NewReader(fmt.Sprintf(`{"display_name":%q}`, displayName))
+	c, rec := newTestContext(http.MethodPatch, "/api/user", body)
+	if ifMatch != "" {
+		c.Request().Header.Set("If-Match", ifMatch)
+	}
+	return rec, serveWithSession(c, user, patchUserHandler)
+}
+
+// 同じETagを読んだ2つのクライアントのうち、後から更新した方は 412 で弾かれ、先の更新が残る
+func TestPatchUserIfMatch(t *testing.T) {
+	setupIntegration(t)
+	user := createTestUser(t)
+
+	c, rec := newTestContext(http.MethodGet, "/api/user/me", nil)
+	if err := serveWithSession(c, user, getMeHandler); err != nil {
+		t.Fatalf("getMeHandler: %+v", err)
+	}
+	etag := rec.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("getMeHandler returned no ETag")
+	}
+
+	rec, err := patchTestUser(t, user, etag, "first")
+	if err != nil {
+		t.Fatalf("first patchUserHandler: %+v", err)
+	}
+	if next := rec.Header().Get("ETag"); next == "" || next == etag {
+		t.Errorf("ETag after update = %q, want a new one (was %q)", next, etag)
+	}
+
+	_, err = patchTestUser(t, user, etag, "second")
+	var httpErr *echo.HTTPError
+	if !errors.As(err, &httpErr) || httpErr.Code != http.StatusPreconditionFailed {
+		t.Fatalf("second patchUserHandler = %v, want %d", err, http.StatusPreconditionFailed)
+	}
+
+	var displayName string
+	if err := dbConn.GetContext(context.Background(), &displayName, "SELECT display_name FROM users WHERE id = ?", user.ID); err != nil {
+		t.Fatalf("failed to get user: %+v", err)
+	}
+	if displayName != "first" {
+		t.Errorf("display_name = %q, want %q", displayName, "first")
+	}
+
+	// If-Match が無い場合と * の場合は無条件に更新する
+	for _, ifMatch := range []string{"", "*"} {
+		if _, err := patchTestUser(t, user, ifMatch, "unconditional"); err != nil {
+			t.Errorf("patchUserHandler with If-Match %q: %+v", ifMatch, err)
+		}
+	}
+}
+
+func TestUserETagChangesWithProfile(t *testing.T) {
+	user := UserModel{ID: 1, Name: "alice", DisplayName: "Alice", Description: "hello"}
+	etag := userETag(user)
+	if etag != userETag(user) {
+		t.Error("userETag is not stable")
+	}
+	changed := user
+	changed.DisplayName = "Alice2"
+	if userETag(changed) == etag {
+		t.Error("userETag did not change with display_name")
+	}
+	changed = user
+	changed.Description = "bye"
+	if userETag(changed) == etag {
+		t.Error("userETag did not change with description")
+	}
+}
+
+// 2回目以降の名前からの検索はDBを引かない
+func TestGetUserIDByNameCached(t *testing.T) {
+	setupIntegration(t)
+	ctx := context.Background()
+	user := createTestUser(t)
+	t.Cleanup(func() { userIDByNameCache.Delete(user.Name) })
+
+	got, err := getUserIDByName(ctx, dbConn, user.Name)
+	if err != nil {
+		t.Fatalf("getUserIDByName: %+v", err)
+	}
+	if got != user.ID {
+		t.Fatalf("getUserIDByName = %d, want %d", got, user.ID)
+	}
+
+	got, err = getUserIDByName(ctx, newBrokenDB(t), user.Name)
+	if err != nil {
+		t.Fatalf("cached getUserIDByName: %+v", err)
+	}
+	if got != user.ID {
+		t.Errorf("cached getUserIDByName = %d, want %d", got, user.ID)
+	}
+}
+
+// 名前を変えたユーザーのエントリは使わずに消し、DBから引き直す
+func TestGetUserIDByNameDropsRenamedEntry(t *testing.T) {
+	user := UserModel{ID: -1, Name: "renamed-after"}
+	cacheTestUser(t, user)
+	userIDByNameCache.Store("renamed-before", user.ID)
+	t.Cleanup(func() { userIDByNameCache.Delete("renamed-before") })
+
+	if _, err := getUserIDByName(context.Background(), newBrokenDB(t), "renamed-before"); err == nil {
+		t.Error("getUserIDByName returned the id of the renamed user")
+	}
+	if _, ok := userIDByNameCache.Load("renamed-before"); ok {
+		t.Error("the entry for the old name is still cached")
+	}
+}
+
+// ゾーンファイルが無ければ作らずにエラーを返す。空のファイルを作ると SOA の無い壊れたゾーンになる
+func TestAddDNSRecordsMissingZoneFile(t *testing.T) {
+	prev := config
+	config.ZoneFilePath = filepath.Join(t.TempDir(), "missing.zone")
+	t.Cleanup(func() { config = prev })
+
+	if err := addDNSRecords("alice"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("addDNSRecords = %v, want os.ErrNotExist", err)
+	}
+	if _, err := os.Stat(config.ZoneFilePath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("zone file was created: %v", err)
+	}
+}
+
+// ゾーンファイルが無くても登録は成功させ、失敗を数えて再試行に積む
+func TestRegisterWithMissingZoneFile(t *testing.T) {
+	setupIntegration(t)
+	ctx := context.Background()
+	prev := config
+	config.ZoneFilePath = filepath.Join(t.TempDir(), "missing.zone")
+	t.Cleanup(func() { config = prev })
+	name := fmt.Sprintf("test%dnozone", time.Now().UnixNano())
+	t.Cleanup(func() { redisConn.SRem(context.Background(), dnsRetryKey, name) })
+	before := dnsRecordFailures.Value()
+
+	code, user := postTestRegister(t, PostUserRequest{Name: name, DisplayName: name, Password: "s3cr3t"})
+	if code != http.StatusCreated {
+		t.Fatalf("status = %d, want %d", code, http.StatusCreated)
+	}
+	if user.Name != name {
+		t.Errorf("registered user = %q, want %q", user.Name, name)
+	}
+	if got := dnsRecordFailures.Value() - before; got != 1 {
+		t.Errorf("dns_record_failures increased by %d, want 1", got)
+	}
+	queued, err := redisConn.SIsMember(ctx, dnsRetryKey, name).Result()
+	if err != nil {
+		t.Fatalf("failed to check dns retry queue: %+v", err)
+	}
+	if !queued {
+		t.Errorf("%s was not queued for dns retry", name)
+	}
+}
+
+// fakePDNSControl は PATH の先頭に呼ばれた回数を数える pdns_control を置き、その回数を返す関数を返します
+func fakePDNSControl(t *testing.T) func() int {
+	t.Helper()
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+	script := "#!/bin/sh\necho \"$@\" >> " + calls + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "pdns_control"), []byte(script), 0o755); err != nil {
+		t.Fatalf("failed to write fake pdns_control: %+v", err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return func() int {
+		b, err := os.ReadFile(calls)
+		if errors.Is(err, os.ErrNotExist) {
+			return 0
+		}
+		if err != nil {
+			t.Fatalf("failed to read fake pdns_control calls: %+v", err)
+		}
+		return strings.Count(string(b), "\n")
+	}
+}
+
+// 一括登録は有効なエントリだけを登録し、ゾーンのリロードは1回だけ行う
+func TestValidateUsername(t *testing.T) {
+	for _, name := range []string{"alice", "alice-2", "A1", strings.Repeat("a", maxDNSLabelLength)} {
+		if err := validateUsername(name); err != nil {
+			t.Errorf("validateUsername(%q) = %v, want nil", name, err)
+		}
+	}
+	for _, name := range []string{"", "pipe", "-alice", "alice-", "al_ice", "al.ice", "アリス", strings.Repeat("a", maxDNSLabelLength+1)} {
+		if err := validateUsername(name); err == nil {
+			t.Errorf("validateUsername(%q) accepted an invalid name", name)
+		}
+	}
+}
+
+func TestRegisterBatchSingleReload(t *testing.T) {
+	setupIntegration(t)
+	prevToken := adminToken
+	adminToken = "test-admin-token"
+	t.Cleanup(func() { adminToken = prevToken })
+	setTestZoneFile(t, "")
+	reloads := fakePDNSControl(t)
+	existing := createTestUser(t)
+
+	prefix := fmt.Sprintf("test%dbatch", time.Now().UnixNano())
+	names := []string{prefix + "a", prefix + "b", prefix + "c"}
+	reqs := []PostUserRequest{
+		{Name: names[0], DisplayName: names[0], Password: "s3cr3t"},
+		{Name: names[1], DisplayName: names[1], Password: "s3cr3t"},
+		{Name: "", Password: "s3cr3t"},
+		{Name: names[2], DisplayName: names[2], Password: "s3cr3t"},
+		{Name: names[0], Password: "s3cr3t"},
+		{Name: existing.Name, Password: "s3cr3t"},
+		{Name: "bad.name", Password: "s3cr3t"},
+		{Name: "bad\nname", Password: "s3cr3t"},
+		{Name: "-" + prefix, Password: "s3cr3t"},
+	}
+	body, err := json.Marshal(reqs)
+	if err != nil {
+		t.Fatalf("failed to marshal request: %+v", err)
+	}
+	c, rec := newTestContext(http.MethodPost, "/api/register/batch", bytes.NewReader(body))
+	c.Request().Header.Set(adminTokenHeader, adminToken)
+	if err := registerBatchHandler(c); err != nil {
+		t.Fatalf("registerBatchHandler: %+v", err)
+	}
+	var results []RegisterBatchResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+		t.Fatalf("failed to decode response: %+v", err)
+	}
+	if len(results) != len(reqs) {
+		t.Fatalf("got %d results, want %d", len(results), len(reqs))
+	}
+	for i, wantOK := range []bool{true, true, false, true, false, false, false, false, false} {
+		if ok := results[i].User != nil && results[i].Error == ""; ok != wantOK {
+			t.Errorf("results[%d] = %+v, want registered = %v", i, results[i], wantOK)
+		}
+	}
+
+	if got := reloads(); got != 1 {
+		t.Errorf("pdns_control was called %d times, want 1", got)
+	}
+	zone, err := os.ReadFile(config.ZoneFilePath)
+	if err != nil {
+		t.Fatalf("failed to read zone file: %+v", err)
+	}
+	for _, name := range names {
+		if !strings.Contains(string(zone), dnsRecordLine(name)+"\n") {
+			t.Errorf("zone file has no record for %s", name)
+		}
+	}
+	if strings.Contains(string(zone), "bad") {
+		t.Errorf("zone file has a record for an invalid name:\n%s", zone)
+	}
+}
+
+func getTestIconRange(t *testing.T, username string, header http.Header) *httptest.ResponseRecorder {
+	t.Helper()
+	c, rec := newTestContext(http.MethodGet, "/api/user/"+username+"/icon", nil)
+	c.SetParamNames("username")
+	c.SetParamValues(username)
+	for key, values := range header {
+		c.Request().Header[key] = values
+	}
+	if err := getIconHandler(c); err != nil {
+		t.Fatalf("getIconHandler: %+v", err)
+	}
+	return rec
+}
+
+// ハッシュも画像もキャッシュに無くDBから読んだ場合も、Range / If-Range に従って返す
+func TestGetIconRangeFromDB(t *testing.T) {
+	setupIntegration(t)
+	ctx := context.Background()
+	user := createTestUser(t)
+	image := []byte("0123456789abcdef")
+	iconHash := uploadTestIcon(t, user.ID, image)
+	etag := `"` + iconHash + `"`
+
+	uncache := func() {
+		iconImageCache.Delete(iconHash)
+		if err := redisConn.Del(ctx, getIconHashKey(user.ID)).Err(); err != nil {
+			t.Fatalf("failed to delete icon hash: %+v", err)
+		}
+	}
+
+	for _, tt := range []struct {
+		name     string
+		header   http.Header
+		wantCode int
+		wantBody []byte
+	}{
+		{"range", http.Header{"Range": {"bytes=2-5"}}, http.StatusPartialContent, image[2:6]},
+		{"suffix range", http.Header{"Range": {"bytes=-4"}}, http.StatusPartialContent, image[len(image)-4:]},
+		{"matching if-range", http.Header{"Range": {"bytes=0-3"}, "If-Range": {etag}}, http.StatusPartialContent, image[:4]},
+		{"stale if-range", http.Header{"Range": {"bytes=0-3"}, "If-Range": {`"stale"`}}, http.StatusOK, image},
+		{"unsatisfiable range", http.Header{"Range": {"bytes=100-"}}, http.StatusRequestedRangeNotSatisfiable, nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			uncache()
+			rec := getTestIconRange(t, user.Name, tt.header)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantCode)
+			}
+			if tt.wantBody != nil && !bytes.Equal(rec.Body.Bytes(), tt.wantBody) {
+				t.Errorf("body = %q, want %q", rec.Body.Bytes(), tt.wantBody)
+			}
+			if got := rec.Header().Get("ETag"); got != etag {
+				t.Errorf("ETag = %s, want %s", got, etag)
+			}
+		})
+	}
+}
+
+func TestServeImageRange(t *testing.T) {
+	image := []byte("0123456789")
+	c, rec := newTestContext(http.MethodGet, "/api/user/test/icon", nil)
+	c.Request().Header.Set("Range", "bytes=3-6")
+	if err := serveImage(c, `"hash"`, image); err != nil {
+		t.Fatalf("serveImage: %+v", err)
+	}
+	if rec.Code != http.StatusPartialContent {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusPartialContent)
+	}
+	if got := rec.Body.String(); got != "3456" {
+		t.Errorf("body = %q, want %q", got, "3456")
+	}
+	if got := rec.Header().Get("Content-Range"); got != "bytes 3-6/10" {
+		t.Errorf("Content-Range = %q, want %q", got, "bytes 3-6/10")
+	}
+}
+
+// serveWithSessionValues は values を持たせたセッションで h を呼びます
+func serveWithSessionValues(c echo.Context, values map[interface{}]interface{}, h echo.HandlerFunc) error {
+	return session.Middleware(sessions.NewCookieStore(secret))(func(c echo.Context) error {
+		sess, err := session.Get(defaultSessionIDKey, c)
+		if err != nil {
+			return err
+		}
+		for k, v := range values {
+			sess.Values[k] = v
+		}
+		return h(c)
+	})(c)
+}
+
+// 有効なセッションならDBに触れずに中身を返し、期限切れや未ログインは 401 を返す
+func TestGetSession(t *testing.T) {
+	user := UserModel{ID: -1, Name: "session-user"}
+	cacheTestUser(t, user)
+	prevDB := dbConn
+	dbConn = nil
+	t.Cleanup(func() { dbConn = prevDB })
+
+	expiresAt := time.Now().Add(time.Hour).Unix()
+	c, rec := newTestContext(http.MethodGet, "/api/session", nil)
+	err := serveWithSessionValues(c, map[interface{}]interface{}{
+		defaultUserIDKey:         user.ID,
+		defaultUsernameKey:       user.Name,
+		defaultSessionExpiresKey: expiresAt,
+	}, getSessionHandler)
+	if err != nil {
+		t.Fatalf("getSessionHandler: %+v", err)
+	}
+	var res SessionResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("failed to decode response: %+v", err)
+	}
+	want := SessionResponse{UserID: user.ID, Username: user.Name, ExpiresAt: expiresAt}
+	if res != want {
+		t.Errorf("response = %+v, want %+v", res, want)
+	}
+	if cookie := rec.Header().Get("Set-Cookie"); cookie != "" {
+		t.Errorf("getSessionHandler wrote a cookie: %s", cookie)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		values map[interface{}]interface{}
+	}{
+		{"expired", map[interface{}]interface{}{
+			defaultUserIDKey:         user.ID,
+			defaultUsernameKey:       user.Name,
+			defaultSessionExpiresKey: time.Now().Add(-time.Minute).Unix(),
+		}},
+		{"missing", map[interface{}]interface{}{}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newTestContext(http.MethodGet, "/api/session", nil)
+			err := serveWithSessionValues(c, tt.values, getSessionHandler)
+			if !isHTTPErrorCode(err, http.StatusUnauthorized) {
+				t.Errorf("getSessionHandler = %v, want %d", err, http.StatusUnauthorized)
+			}
+		})
+	}
+}
+
+// assertIconsRemoved はユーザーのアイコンの行、ハッシュのキャッシュ、画像のキャッシュが残っていないことを確かめます
+func assertIconsRemoved(t *testing.T, userID int64, iconHash string) {
+	t.Helper()
+	ctx := context.Background()
+	var count int
+	if err := dbConn.GetContext(ctx, &count, "SELECT COUNT(*) FROM icons WHERE user_id = ?", userID); err != nil {
+		t.Fatalf("failed to count icons: %+v", err)
+	}
+	if count != 0 {
+		t.Errorf("%d icons remain", count)
+	}
+	if err := redisConn.Get(ctx, getIconHashKey(userID)).Err(); !errors.Is(err, redis.Nil) {
+		t.Errorf("icon hash cache remains: %v", err)
+	}
+	if _, ok := iconImageCache.Load(iconHash); ok {
+		t.Error("icon image remains in the cache")
+	}
+}
+
+// 退会するとアイコンの行とキャッシュがすべて消える
+func TestDeleteMeRemovesIcons(t *testing.T) {
+	setupIntegration(t)
+	ctx := context.Background()
+	setTestZoneFile(t, "")
+	user := createTestUser(t)
+	iconHash := uploadTestIcon(t, user.ID, []byte("icon of a leaving user "+user.Name))
+	iconImageCache.Store(iconHash, []byte("cached"))
+	if err := redisConn.Set(ctx, getIconHashKey(user.ID), iconHash, 0).Err(); err != nil {
+		t.Fatalf("failed to cache icon hash: %+v", err)
+	}
+
+	c, _ := newTestContext(http.MethodDelete, "/api/user/me", nil)
+	if err := serveWithSession(c, user, deleteMeHandler); err != nil {
+		t.Fatalf("deleteMeHandler: %+v", err)
+	}
+	assertIconsRemoved(t, user.ID, iconHash)
+}
+
+// 退会APIを通らずに退会したユーザーのアイコンも、掃除で消える
+func TestSweepOrphanIcons(t *testing.T) {
+	setupIntegration(t)
+	ctx := context.Background()
+	deleted := createTestUser(t)
+	alive := createTestUser(t)
+	deletedHash := uploadTestIcon(t, deleted.ID, []byte("icon of a deleted user "+deleted.Name))
+	aliveHash := uploadTestIcon(t, alive.ID, []byte("icon of an alive user "+alive.Name))
+	if _, err := dbConn.ExecContext(ctx, "UPDATE users SET deleted_at = ? WHERE id = ?", time.Now().Unix(), deleted.ID); err != nil {
+		t.Fatalf("failed to delete user: %+v", err)
+	}
+	if err := redisConn.Set(ctx, getIconHashKey(deleted.ID), deletedHash, 0).Err(); err != nil {
+		t.Fatalf("failed to cache icon hash: %+v", err)
+	}
+	before := iconsSwept.Value()
+
+	if err := sweepOrphanIcons(ctx); err != nil {
+		t.Fatalf("sweepOrphanIcons: %+v", err)
+	}
+	assertIconsRemoved(t, deleted.ID, deletedHash)
+	if got := iconsSwept.Value() - before; got < 1 {
+		t.Errorf("icons_swept increased by %d, want at least 1", got)
+	}
+
+	var stored string
+	if err := dbConn.GetContext(ctx, &stored, "SELECT icon_hash FROM icons WHERE user_id = ?", alive.ID); err != nil {
+		t.Fatalf("icon of the alive user was removed: %+v", err)
+	}
+	if stored != aliveHash {
+		t.Errorf("icon hash of the alive user = %s, want %s", stored, aliveHash)
+	}
+}
+
+// 登録日時は分かるユーザーでは返し、カラム追加前のユーザーでは省く
+func TestUserCreatedAt(t *testing.T) {
+	setupIntegration(t)
+	ctx := context.Background()
+	viewer := createTestUser(t)
+	user := createTestUser(t)
+
+	got := getTestUser(t, viewer, user.Name, "")
+	if got.CreatedAt == nil || *got.CreatedAt != *user.CreatedAt {
+		t.Errorf("created_at = %v, want %d", got.CreatedAt, *user.CreatedAt)
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		t.Fatalf("failed to begin transaction: %+v", err)
+	}
+	defer tx.Rollback()
+	users, err := fillUsersResponse(ctx, tx, []UserModel{user})
+	if err != nil {
+		t.Fatalf("fillUsersResponse: %+v", err)
+	}
+	if filled := users[user.ID]; filled.CreatedAt == nil || *filled.CreatedAt != *user.CreatedAt {
+		t.Errorf("fillUsersResponse created_at = %v, want %d", filled.CreatedAt, *user.CreatedAt)
+	}
+
+	if _, err := dbConn.ExecContext(ctx, "UPDATE users SET created_at = NULL WHERE id = ?", user.ID); err != nil {
+		t.Fatalf("failed to clear created_at: %+v", err)
+	}
+	userCache.Delete(user.ID)
+	if got := getTestUser(t, viewer, user.Name, ""); got.CreatedAt != nil {
+		t.Errorf("created_at = %d, want it omitted", *got.CreatedAt)
+	}
+}
+
+func TestUserCreatedAtJSON(t *testing.T) {
+	createdAt := int64(1700000000)
+	for _, tt := range []struct {
+		name      string
+		createdAt *int64
+		want      string
+	}{
+		{"known", &createdAt, `"created_at":1700000000`},
+		{"unknown", nil, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := jsonMarshal(User{ID: 1, Name: "alice", CreatedAt: tt.createdAt})
+			if err != nil {
+				t.Fatalf("failed to marshal: %+v", err)
+			}
+			has := strings.Contains(string(b), `"created_at"`)
+			if has != (tt.want != "") || (tt.want != "" && !strings.Contains(string(b), tt.want)) {
+				t.Errorf("got %s, want created_at %q", b, tt.want)
+			}
+		})
+	}
+}
+
+// Redis にあるユーザーはそのハッシュを使い、無いユーザーだけをDBから引いて書き戻す
+// アイコンの無いユーザーも fallbackHash で埋め、取りこぼさない
+func TestGetIconHashesPartialMiss(t *testing.T) {
+	setupIntegration(t)
+	ctx := context.Background()
+	var users []UserModel
+	for i := 0; i < 4; i++ {
+		users = append(users, createTestUser(t))
+	}
+	want := map[int64]string{
+		users[0].ID: "cached-hash-0",
+		users[1].ID: "cached-hash-1",
+		users[2].ID: uploadTestIcon(t, users[2].ID, []byte("icon only in db "+users[2].Name)),
+		users[3].ID: fallbackHash,
+	}
+	for _, user := range users {
+		redisConn.Del(ctx, getIconHashKey(user.ID))
+	}
+	for _, user := range users[:2] {
+		if err := redisConn.Set(ctx, getIconHashKey(user.ID), want[user.ID], time.Minute).Err(); err != nil {
+			t.Fatalf("failed to cache icon hash: %+v", err)
+		}
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		t.Fatalf("failed to begin transaction: %+v", err)
+	}
+	defer tx.Rollback()
+	userIDs := []int64{users[0].ID, users[2].ID, users[1].ID, users[3].ID}
+	got, err := getIconHashes(ctx, tx, userIDs)
+	if err != nil {
+		t.Fatalf("getIconHashes: %+v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("getIconHashes = %v, want %v", got, want)
+	}
+
+	for _, user := range users[2:] {
+		cached, err := redisConn.Get(ctx, getIconHashKey(user.ID)).Result()
+		if err != nil {
+			t.Fatalf("icon hash of user %d was not written back: %+v", user.ID, err)
+		}
+		if cached != want[user.ID] {
+			t.Errorf("written back icon hash of user %d = %s, want %s", user.ID, cached, want[user.ID])
+		}
+	}
+}
+
+// Redis が使えなければ全員をDBから引く
+func TestGetIconHashesWithoutRedis(t *testing.T) {
+	setupIntegration(t)
+	ctx := context.Background()
+	withIcon := createTestUser(t)
+	withoutIcon := createTestUser(t)
+	iconHash := uploadTestIcon(t, withIcon.ID, []byte("icon without redis "+withIcon.Name))
+
+	prevRedis := redisConn
+	redisConn = redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	t.Cleanup(func() {
+		redisConn.Close()
+		redisConn = prevRedis
+	})
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		t.Fatalf("failed to begin transaction: %+v", err)
+	}
+	defer tx.Rollback()
+	got, err := getIconHashes(ctx, tx, []int64{withIcon.ID, withoutIcon.ID})
+	if err != nil {
+		t.Fatalf("getIconHashes: %+v", err)
+	}
+	want := map[int64]string{withIcon.ID: iconHash, withoutIcon.ID: fallbackHash}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("getIconHashes = %v, want %v", got, want)
+	}
+}
+
+// themes.user_id には UNIQUE 制約があり、登録の再試行でテーマを入れ直しても行は増えずに上書きされる
+func TestRegisterThemeUpsertOnRetry(t *testing.T) {
+	setupIntegration(t)
+	ctx := context.Background()
+	setTestZoneFile(t, "")
+	name := fmt.Sprintf("test%dtheme", time.Now().UnixNano())
+	t.Cleanup(func() { redisConn.SRem(context.Background(), dnsRetryKey, name) })
+
+	code, user := postTestRegister(t, PostUserRequest{Name: name, DisplayName: name, Password: "s3cr3t", Theme: &PostUserRequestTheme{DarkMode: true}})
+	if code != http.StatusCreated {
+		t.Fatalf("status = %d, want %d", code, http.StatusCreated)
+	}
+	if user.Theme == nil || !user.Theme.DarkMode {
+		t.Fatalf("theme = %+v, want dark mode", user.Theme)
+	}
+
+	// 素の INSERT は UNIQUE 制約で弾かれる
+	if _, err := dbConn.ExecContext(ctx, "INSERT INTO themes (user_id, dark_mode) VALUES (?, ?)", user.ID, false); err == nil {
+		t.Fatal("a second theme row was inserted; themes.user_id is not unique")
+	}
+
+	// 登録と同じクエリでの入れ直しは上書きになる
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		t.Fatalf("failed to begin transaction: %+v", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.NamedExecContext(ctx, upsertThemeQuery, ThemeModel{UserID: user.ID, DarkMode: false}); err != nil {
+		t.Fatalf("upsert on retry: %+v", err)
+	}
+	var themes []ThemeModel
+	if err := tx.SelectContext(ctx, &themes, "SELECT * FROM themes WHERE user_id = ?", user.ID); err != nil {
+		t.Fatalf("failed to get themes: %+v", err)
+	}
+	if len(themes) != 1 || themes[0].DarkMode {
+		t.Errorf("themes = %+v, want one row with dark_mode false", themes)
+	}
+}
+
+// 自分のプロフィールでは is_self が true、他人のプロフィールでは false になる
+func TestGetUserIsSelf(t *testing.T) {
+	setupIntegration(t)
+	viewer := createTestUser(t)
+	other := createTestUser(t)
+
+	for _, tt := range []struct {
+		name   string
+		target UserModel
+		want   bool
+	}{
+		{"self", viewer, true},
+		{"other", other, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := getTestUser(t, viewer, tt.target.Name, "")
+			if got.IsSelf == nil || *got.IsSelf != tt.want {
+				t.Errorf("is_self = %v, want %v", got.IsSelf, tt.want)
+			}
+		})
+	}
+}
+
+// is_self はユーザー取得API以外のレスポンスには出さない
+func TestUserIsSelfOmitted(t *testing.T) {
+	b, err := jsonMarshal(User{ID: 1, Name: "alice"})
+	if err != nil {
+		t.Fatalf("failed to marshal: %+v", err)
+	}
+	if strings.Contains(string(b), `"is_self"`) {
+		t.Errorf("got %s, want is_self omitted", b)
+	}
+}
+
+// ログイン時にユーザーとテーマをキャッシュに載せるので、直後の /api/user/me はクエリを発行しない
+func TestGetMeAfterLoginAvoidsDB(t *testing.T) {
+	setupIntegration(t)
+	ctx := context.Background()
+	setTestZoneFile(t, "")
+	name := fmt.Sprintf("test%dlogin", time.Now().UnixNano())
+	code, registered := postTestRegister(t, PostUserRequest{Name: name, DisplayName: name, Password: "s3cr3t", Theme: &PostUserRequestTheme{DarkMode: true}})
+	if code != http.StatusCreated {
+		t.Fatalf("register status = %d, want %d", code, http.StatusCreated)
+	}
+	// 登録で載ったキャッシュを消し、ログインで載ることを確かめる
+	userCache.Delete(registered.ID)
+	themeCache.Lock()
+	delete(themeCache.m, registered.ID)
+	themeCache.Unlock()
+	if err := redisConn.Set(ctx, getIconHashKey(registered.ID), fallbackHash, 0).Err(); err != nil {
+		t.Fatalf("failed to set icon hash: %+v", err)
+	}
+	t.Cleanup(func() {
+		userCache.Delete(registered.ID)
+		themeCache.Lock()
+		delete(themeCache.m, registered.ID)
+		themeCache.Unlock()
+		redisConn.Del(ctx, getIconHashKey(registered.ID))
+	})
+
+	body, err := json.Marshal(LoginRequest{Username: name, Password: "s3cr3t"})
+	if err != nil {
+		t.Fatalf("failed to marshal request: %+v", err)
+	}
+	c, _ := newTestContext(http.MethodPost, "/api/login", bytes.NewReader(body))
+	if err := session.Middleware(sessions.NewCookieStore(secret))(loginHandler)(c); err != nil {
+		t.Fatalf("loginHandler: %+v", err)
+	}
+
+	prevDB := dbConn
+	dbConn = sqlx.NewDb(sql.OpenDB(fakeSlowConnector{}), "mysql")
+	t.Cleanup(func() {
+		dbConn.Close()
+		dbConn = prevDB
+	})
+	before := fakeQueries.Load()
+
+	c, rec := newTestContext(http.MethodGet, "/api/user/me", nil)
+	if err := serveWithSession(c, UserModel{ID: registered.ID, Name: name}, getMeHandler); err != nil {
+		t.Fatalf("getMeHandler: %+v", err)
+	}
+	if n := fakeQueries.Load() - before; n != 0 {
+		t.Errorf("getMeHandler issued %d queries after login, want 0", n)
+	}
+	var me User
+	if err := json.Unmarshal(rec.Body.Bytes(), &me); err != nil {
+		t.Fatalf("failed to decode response: %+v", err)
+	}
+	if me.ID != registered.ID || me.Name != name || me.Theme == nil || !me.Theme.DarkMode {
+		t.Errorf("me = %+v, want user %d (%s) with dark mode", me, registered.ID, name)
+	}
+}
+
+// テーマを省略したときだけ既定値を使い、明示した false は既定値で上書きしない
+func TestPostUserRequestDarkMode(t *testing.T) {
+	prevDefault := defaultDarkMode
+	defaultDarkMode = true
+	t.Cleanup(func() { defaultDarkMode = prevDefault })
+
+	for _, tt := range []struct {
+		body string
+		want bool
+	}{
+		{body: `{"name":"alice"}`, want: true},
+		{body: `{"name":"alice","theme":null}`, want: true},
+		{body: `{"name":"alice","theme":{"dark_mode":false}}`, want: false},
+		{body: `{"name":"alice","theme":{"dark_mode":true}}`, want: true},
+	} {
+		var req PostUserRequest
+		if err := json.Unmarshal([]byte(tt.body), &req); err != nil {
+			t.Fatalf("failed to decode %s: %+v", tt.body, err)
+		}
+		if got := req.darkMode(); got != tt.want {
+			t.Errorf("%s: darkMode = %v, want %v", tt.body, got, tt.want)
+		}
+	}
+}
+
+// テーマを省略して登録すると、設定した既定値が保存される
+func TestRegisterWithoutThemeUsesDefault(t *testing.T) {
+	setupIntegration(t)
+	ctx := context.Background()
+	setTestZoneFile(t, "")
+	prevDefault := defaultDarkMode
+	defaultDarkMode = true
+	t.Cleanup(func() { defaultDarkMode = prevDefault })
+	name := fmt.Sprintf("test%ddefaulttheme", time.Now().UnixNano())
+	t.Cleanup(func() { redisConn.SRem(context.Background(), dnsRetryKey, name) })
+
+	code, user := postTestRegister(t, PostUserRequest{Name: name, DisplayName: name, Password: "s3cr3t"})
+	if code != http.StatusCreated {
+		t.Fatalf("status = %d, want %d", code, http.StatusCreated)
+	}
+	if user.Theme == nil || !user.Theme.DarkMode {
+		t.Errorf("theme = %+v, want dark mode", user.Theme)
+	}
+	var darkMode bool
+	if err := dbConn.GetContext(ctx, &darkMode, "SELECT dark_mode FROM themes WHERE user_id = ?", user.ID); err != nil {
+		t.Fatalf("failed to get theme: %+v", err)
+	}
+	if !darkMode {
+		t.Error("stored dark_mode = false, want the configured default true")
+	}
+}
+
+// useTestFallbackImage は fallbackImage を content を書いた一時ファイルに向けます
+func useTestFallbackImage(t *testing.T, content []byte) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "NoImage.jpg")
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		t.Fatalf("failed to write fallback image: %+v", err)
+	}
+	prevImage, prevBytes := fallbackImage, fallbackImageBytes
+	fallbackImage, fallbackImageBytes = path, nil
+	t.Cleanup(func() { fallbackImage, fallbackImageBytes = prevImage, prevBytes })
+}
+
+// 起動時に読み込んだ後はファイルを読まずにメモリから返し、ETag で 304 を返せる
+func TestServeFallbackImageFromMemory(t *testing.T) {
+	content := []byte("fallback image")
+	useTestFallbackImage(t, content)
+	if err := loadFallbackImage(); err != nil {
+		t.Fatalf("loadFallbackImage: %+v", err)
+	}
+	// ファイルを消しても返せればメモリから返している
+	if err := os.Remove(fallbackImage); err != nil {
+		t.Fatalf("failed to remove fallback image: %+v", err)
+	}
+	etag := `"` + fallbackHash + `"`
+
+	c, rec := newTestContext(http.MethodGet, "/api/user/test/icon", nil)
+	if err := serveFallbackImage(c); err != nil {
+		t.Fatalf("serveFallbackImage: %+v", err)
+	}
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), content) {
+		t.Errorf("response = %d %q, want %d %q", rec.Code, rec.Body.Bytes(), http.StatusOK, content)
+	}
+	if got := rec.Header().Get("ETag"); got != etag {
+		t.Errorf("ETag = %q, want %q", got, etag)
+	}
+
+	c, rec = newTestContext(http.MethodGet, "/api/user/test/icon", nil)
+	c.Request().Header.Set("If-None-Match", etag)
+	if err := serveFallbackImage(c); err != nil {
+		t.Fatalf("serveFallbackImage: %+v", err)
+	}
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("status with If-None-Match = %d, want %d", rec.Code, http.StatusNotModified)
+	}
+}
+
+// 読み込めていなければ、同じ ETag でファイルから返す
+func TestServeFallbackImageFromFile(t *testing.T) {
+	content := []byte("fallback image")
+	useTestFallbackImage(t, content)
+
+	c, rec := newTestContext(http.MethodGet, "/api/user/test/icon", nil)
+	if err := serveFallbackImage(c); err != nil {
+		t.Fatalf("serveFallbackImage: %+v", err)
+	}
+	if !bytes.Equal(rec.Body.Bytes(), content) {
+		t.Errorf("body = %q, want %q", rec.Body.Bytes(), content)
+	}
+	if got, want := rec.Header().Get("ETag"), `"`+fallbackHash+`"`; got != want {
+		t.Errorf("ETag = %q, want %q", got, want)
+	}
+}
+
+// 厳格モードでは、登録とログインのリクエストに知らないフィールドがあれば DB に触れずに 400 で列挙する
+func TestStrictRequestJSONHandlers(t *testing.T) {
+	saveFeatures(t)
+	features.StrictRequestJSON = true
+	prevDB := dbConn
+	dbConn = nil
+	t.Cleanup(func() { dbConn = prevDB })
+
+	for _, tt := range []struct {
+		name    string
+		body    string
+		handler echo.HandlerFunc
+	}{
+		{"register", `{"name":"alice","display_name":"alice","passwrod":"s3cr3t","extra":1}`, registerHandler},
+		{"login", `{"username":"alice","passwrod":"s3cr3t","extra":1}`, loginHandler},
+	} {
+		c, _ := newTestContext(http.MethodPost, "/api/"+tt.name, strings.NewReader(tt.body))
+		err := tt.handler(c)
+		var he *echo.HTTPError
+		if !errors.As(err, &he) || he.Code != http.StatusBadRequest {
+			t.Errorf("%s: handler = %v, want 400", tt.name, err)
+			continue
+		}
+		if msg := fmt.Sprint(he.Message); !strings.Contains(msg, "passwrod") || !strings.Contains(msg, "extra") {
+			t.Errorf("%s: message = %q, want it to list passwrod and extra", tt.name, msg)
+		}
+	}
+}
+
+func getTestMe(t *testing.T, user UserModel, query string) User {
+	t.Helper()
+	c, rec := newTestContext(http.MethodGet, "/api/user/me?"+query, nil)
+	if err := serveWithSession(c, user, getMeHandler); err != nil {
+		t.Fatalf("getMeHandler: %+v", err)
+	}
+	var me User
+	if err := json.Unmarshal(rec.Body.Bytes(), &me); err != nil {
+		t.Fatalf("failed to decode response: %+v", err)
+	}
+	return me
+}
+
+// include_earnings=1 のときだけ、自分の全配信で受け取ったチップの合計を返す
+func TestGetMeIncludeEarnings(t *testing.T) {
+	setupIntegration(t)
+	ctx := context.Background()
+	owner := createTestUser(t)
+	viewer := createTestUser(t)
+	now := time.Now().Unix()
+	for _, livestream := range []LivestreamModel{createTestLivestream(t, owner.ID), createTestLivestream(t, owner.ID)} {
+		for _, tip := range []int64{100, 0, 2500} {
+			if _, err := dbConn.ExecContext(ctx, "INSERT INTO livecomments (user_id, livestream_id, comment, tip, created_at) VALUES (?, ?, ?, ?, ?)", viewer.ID, livestream.ID, "tip", tip, now); err != nil {
+				t.Fatalf("failed to insert livecomment: %+v", err)
+			}
+		}
+	}
+	// 自分が他人の配信に送ったチップは数えない
+	other := createTestLivestream(t, viewer.ID)
+	if _, err := dbConn.ExecContext(ctx, "INSERT INTO livecomments (user_id, livestream_id, comment, tip, created_at) VALUES (?, ?, ?, ?, ?)", owner.ID, other.ID, "tip", 999, now); err != nil {
+		t.Fatalf("failed to insert livecomment: %+v", err)
+	}
+
+	if me := getTestMe(t, owner, ""); me.TotalEarnings != nil {
+		t.Errorf("total_earnings = %d without include_earnings, want it omitted", *me.TotalEarnings)
+	}
+	me := getTestMe(t, owner, "include_earnings=1")
+	if me.TotalEarnings == nil || *me.TotalEarnings != 5200 {
+		t.Errorf("total_earnings = %v, want 5200", me.TotalEarnings)
+	}
+	if me := getTestMe(t, viewer, "include_earnings=1"); me.TotalEarnings == nil || *me.TotalEarnings != 999 {
+		t.Errorf("viewer total_earnings = %v, want 999", me.TotalEarnings)
+	}
+}
+
+// 退会したユーザーは名前で引けず、プロフィール・統計・配信一覧はどれも 404 を返す
+// 退会前に引いて名前のキャッシュに載っていても同じ
+func TestDeletedUserNotFoundByName(t *testing.T) {
+	setupIntegration(t)
+	user := createTestUser(t)
+	viewer := createTestUser(t)
+	setTestZoneFile(t, dnsRecordLine(user.Name)+"\n")
+	fakePDNSControl(t)
+	t.Cleanup(func() { userIDByNameCache.Delete(user.Name) })
+
+	if got := getTestUser(t, viewer, user.Name, ""); got.ID != user.ID {
+		t.Fatalf("before deletion: user = %d, want %d", got.ID, user.ID)
+	}
+
+	c, _ := newTestContext(http.MethodDelete, "/api/user/me", nil)
+	if err := serveWithSession(c, user, deleteMeHandler); err != nil {
+		t.Fatalf("deleteMeHandler: %+v", err)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		target  string
+		handler echo.HandlerFunc
+		want    int
+	}{
+		{"profile", "/api/user/" + user.Name, getUserHandler, http.StatusNotFound},
+		// 統計は存在しないユーザー名と同じく 400 を返す
+		{"statistics", "/api/user/" + user.Name + "/statistics", getUserStatisticsHandler, http.StatusBadRequest},
+		{"livestreams", "/api/user/" + user.Name + "/livestream", getUserLivestreamsHandler, http.StatusNotFound},
+	} {
+		c, _ := newTestContext(http.MethodGet, tt.target, nil)
+		c.SetParamNames("username")
+		c.SetParamValues(user.Name)
+		if err := serveWithSession(c, viewer, tt.handler); !isHTTPErrorCode(err, tt.want) {
+			t.Errorf("%s after deletion = %v, want %d", tt.name, err, tt.want)
+		}
+	}
+}
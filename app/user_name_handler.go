@@ -0,0 +1,110 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// ユニークキーの重複で INSERT / UPDATE が失敗したときのエラー番号
+const mysqlErrDuplicateEntry = 1062
+
+type PatchUserNameRequest struct {
+	Name string `json:"name"`
+}
+
+// ユーザー名変更API
+// PATCH /api/user/name
+// ユーザー名はサブドメインになっているので、DNSレコードも付け替える
+func patchUserNameHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID, err := verifyUserSession(c)
+	if err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	var req PatchUserNameRequest
+	if err := decodeJSON(c.Request().Body, &req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if err := validateUsername(req.Name); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	var userModel UserModel
+	if err := withTx(ctx, func(tx *sqlx.Tx) error {
+		if err := tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ? FOR UPDATE", userID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "not found user that has the userid in session")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+		}
+		if userModel.Name == req.Name {
+			return nil
+		}
+
+		if _, err := tx.ExecContext(ctx, "UPDATE users SET name = ? WHERE id = ?", req.Name, userID); err != nil {
+			var mysqlErr *mysql.MySQLError
+			if errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlErrDuplicateEntry {
+				return echo.NewHTTPError(http.StatusConflict, "the username is already taken")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update user name: "+err.Error())
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	oldName := userModel.Name
+	userModel.Name = req.Name
+	if oldName != req.Name {
+		// ユーザー名を含むキャッシュはコミット後に破棄する
+		userCache.Delete(userID)
+		userStaleCache.Delete(userID)
+		userIDByNameCache.Delete(oldName)
+		userIDByNameCache.Delete(req.Name)
+		invalidateUserStats(userID)
+		userRankingBlobCache.Lock()
+		userRankingBlobCache.blob = nil
+		userRankingBlobCache.Unlock()
+		if err := renameUserScoreMember(ctx, oldName, req.Name); err != nil {
+			c.Logger().Warnf("failed to rename user score member: %+v", err)
+		}
+
+		// 登録時と同じく、DBの更新は取り消さずにDNSの失敗は記録だけする
+		if err := renameDNSRecord(oldName, req.Name); err != nil {
+			dnsRecordFailures.Add(1)
+			c.Logger().Warnf("failed to rename dns record from %q to %q: %+v", oldName, req.Name, err)
+			enqueueDNSRetry(ctx, req.Name)
+		}
+
+		// セッションに入っているユーザー名も新しいものにする
+		if sess, err := session.Get(defaultSessionIDKey, c); err == nil {
+			sess.Options = sessionCookieOptions()
+			sess.Values[defaultUsernameKey] = req.Name
+			if err := sess.Save(c.Request(), c.Response()); err != nil {
+				c.Logger().Warnf("failed to update session: %+v", err)
+			}
+		}
+	}
+
+	var user User
+	if err := withReadTx(ctx, func(tx *sqlx.Tx) error {
+		user, err = fillUserResponse(ctx, tx, userModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, user)
+}
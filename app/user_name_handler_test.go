@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 古い名前のレコードを取り除いて新しい名前のレコードを足し、リロードは1回だけ行う
+func TestRenameDNSRecord(t *testing.T) {
+	setTestZoneFile(t, "$ORIGIN u.isucon.local.\nalice\tIN\tA\t192.0.2.1\nbob\tIN\tA\t192.0.2.1\n")
+	reloads := fakePDNSControl(t)
+
+	if err := renameDNSRecord("alice", "alicia"); err != nil {
+		t.Fatalf("renameDNSRecord: %+v", err)
+	}
+	b, err := os.ReadFile(config.ZoneFilePath)
+	if err != nil {
+		t.Fatalf("failed to read zone file: %+v", err)
+	}
+	want := "$ORIGIN u.isucon.local.\nbob\tIN\tA\t192.0.2.1\nalicia\tIN\tA\t192.0.2.1\n"
+	if string(b) != want {
+		t.Errorf("zone file = %q, want %q", b, want)
+	}
+	if got := reloads(); got != 1 {
+		t.Errorf("pdns reloads = %d, want 1", got)
+	}
+}
+
+func patchTestUserName(t *testing.T, user UserModel, name string) (User, error) {
+	t.Helper()
+	body, err := json.Marshal(PatchUserNameRequest{Name: name})
+	if err != nil {
+		t.Fatalf("failed to marshal request: %+v", err)
+	}
+	c, rec := newTestContext(http.MethodPatch, "/api/user/name", bytes.NewReader(body))
+	if err := serveWithSession(c, user, patchUserNameHandler); err != nil {
+		return User{}, err
+	}
+	var res User
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("failed to decode response: %+v", err)
+	}
+	return res, nil
+}
+
+// 名前を変えると古い名前は 404 になり、新しい名前で引けて、ゾーンファイルも付け替わる
+func TestPatchUserName(t *testing.T) {
+	setupIntegration(t)
+	user := createTestUser(t)
+	viewer := createTestUser(t)
+	setTestZoneFile(t, dnsRecordLine(user.Name)+"\n")
+	fakePDNSControl(t)
+	newName := fmt.Sprintf("test%drenamed", time.Now().UnixNano())
+	t.Cleanup(func() {
+		userIDByNameCache.Delete(user.Name)
+		userIDByNameCache.Delete(newName)
+	})
+
+	// 古い名前を name->id のキャッシュに載せておき、変更後に使われないことも確かめる
+	if got := getTestUser(t, viewer, user.Name, ""); got.ID != user.ID {
+		t.Fatalf("user before rename = %d, want %d", got.ID, user.ID)
+	}
+
+	res, err := patchTestUserName(t, user, newName)
+	if err != nil {
+		t.Fatalf("patchUserNameHandler: %+v", err)
+	}
+	if res.ID != user.ID || res.Name != newName {
+		t.Errorf("response = %+v, want user %d named %s", res, user.ID, newName)
+	}
+
+	c, _ := newTestContext(http.MethodGet, "/api/user/"+user.Name, nil)
+	c.SetParamNames("username")
+	c.SetParamValues(user.Name)
+	if err := serveWithSession(c, viewer, getUserHandler); !isHTTPErrorCode(err, http.StatusNotFound) {
+		t.Errorf("old name: getUserHandler = %v, want 404", err)
+	}
+	if got := getTestUser(t, viewer, newName, ""); got.ID != user.ID {
+		t.Errorf("new name resolves to %d, want %d", got.ID, user.ID)
+	}
+
+	b, err := os.ReadFile(config.ZoneFilePath)
+	if err != nil {
+		t.Fatalf("failed to read zone file: %+v", err)
+	}
+	if zone := string(b); strings.Contains(zone, user.Name+"\t") || !strings.Contains(zone, dnsRecordLine(newName)+"\n") {
+		t.Errorf("zone file = %q, want only the record for %s", zone, newName)
+	}
+}
+
+// 使われている名前や予約された名前には変えられない
+func TestPatchUserNameRejected(t *testing.T) {
+	setupIntegration(t)
+	user := createTestUser(t)
+	other := createTestUser(t)
+	setTestZoneFile(t, "")
+	fakePDNSControl(t)
+
+	if _, err := patchTestUserName(t, user, other.Name); !isHTTPErrorCode(err, http.StatusConflict) {
+		t.Errorf("taken name: patchUserNameHandler = %v, want 409", err)
+	}
+	if _, err := patchTestUserName(t, user, "pipe"); !isHTTPErrorCode(err, http.StatusBadRequest) {
+		t.Errorf("reserved name: patchUserNameHandler = %v, want 400", err)
+	}
+	var name string
+	if err := dbConn.GetContext(context.Background(), &name, "SELECT name FROM users WHERE id = ?", user.ID); err != nil {
+		t.Fatalf("failed to get user: %+v", err)
+	}
+	if name != user.Name {
+		t.Errorf("name = %q, want it unchanged as %q", name, user.Name)
+	}
+}